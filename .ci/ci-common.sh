@@ -47,6 +47,8 @@ export PKG_CONFIG_PATH="${prefix_dir}/lib/pkgconfig:$PKG_CONFIG_PATH"
 export ACLOCAL_FLAGS="-I \"${prefix_dir}/share/aclocal\" $ACLOCAL_FLAG"
 export GOROOT=$HOME/go
 export GOPATH=$HOME/gopath
+# The tree is built from GOPATH (see ci-setup.sh), not as a module
+export GO111MODULE=off
 export PATH=$GOROOT/bin:$GOPATH/bin:$PATH
 export PATH="${prefix_dir}/bin:${prefix_dir}/sbin:$PATH"
 
@@ -22,11 +22,40 @@ import (
 
 // The Hello payload is issued first after connecting to the proxy socket.
 // It is used to let the proxy know about a new container on the system along
-// with the paths go hyperstart's command and I/O channels (AF_UNIX sockets).
+// with the endpoints of hyperstart's command and I/O channels.
+//
+// Endpoints are given as "unix:<path>", "tcp:<host>:<port>" or
+// "vsock:<cid>:<port>". A bare path designates an AF_UNIX socket.
 //
 // Console can be used to indicate the path of a socket linked to the VM
 // console. The proxy can output this data when asked for verbose output.
 //
+// When Record is true, the proxy records the traffic between itself and
+// hyperstart. The proxy needs to be started with -record-dir for this to
+// work.
+//
+// For VMs running several containers, PodID registers the VM under the pod
+// identifier, ContainerID being registered as the first container of the pod.
+// More containers can then be added with RegisterContainer. Any of those
+// identifiers can be used to designate the VM in the other payloads.
+//
+// The proxy waits for the ctl, io and console sockets to appear and for
+// hyperstart to send READY. Timeout, in milliseconds, bounds that wait; 0
+// means the proxy default (see the -hello-timeout option). On timeout, hello
+// fails with the ErrorCodeVMNotReady code and the VM is unregistered.
+//
+// Agent selects the agent running inside the VM the proxy talks to,
+// "hyperstart" when empty, the only agent at the moment.
+//
+// When Async is true, hello returns as soon as the VM is registered, the
+// client being attached to it. A VMReady or VMFailed notification is sent to
+// the clients attached to the VM once the outcome is known. Until then,
+// payloads needing the VM to be ready fail with ErrorCodeVMNotReady.
+//
+// Notifications about the VM (VMLost, VMReady and VMFailed) are only sent to
+// the clients asking for them, with Notifications set to true in hello or
+// attach. An asynchronous hello always asks for them.
+//
 //  {
 //    "id": "hello",
 //    "data": {
@@ -36,16 +65,25 @@ import (
 //    }
 //  }
 type Hello struct {
-	ContainerID string `json:"containerId"`
-	CtlSerial   string `json:"ctlSerial"`
-	IoSerial    string `json:"ioSerial"`
-	Console     string `json:"console,omitempty"`
+	ContainerID   string `json:"containerId"`
+	PodID         string `json:"podId,omitempty"`
+	CtlSerial     string `json:"ctlSerial"`
+	IoSerial      string `json:"ioSerial"`
+	Console       string `json:"console,omitempty"`
+	Record        bool   `json:"record,omitempty"`
+	Timeout       uint32 `json:"timeout,omitempty"`
+	Async         bool   `json:"async,omitempty"`
+	Agent         string `json:"agent,omitempty"`
+	Notifications bool   `json:"notifications,omitempty"`
 }
 
 // The Attach payload can be used to associate clients to an already known VM.
 // attach cannot be issued if a hello for this container hasn't been issued
 // beforehand.
 //
+// When Notifications is true, the client receives the notifications about the
+// VM, as described in the Hello payload.
+//
 //  {
 //    "id": "attach",
 //    "data": {
@@ -53,12 +91,14 @@ type Hello struct {
 //    }
 //  }
 type Attach struct {
-	ContainerID string `json:"containerId"`
+	ContainerID   string `json:"containerId"`
+	Notifications bool   `json:"notifications,omitempty"`
 }
 
 // The Bye payload does the opposite of what hello does, indicating to the
 // proxy it should release resources created by hello for the container
-// identified by containerId.
+// identified by containerId. For pods, any container of the pod identifies
+// the VM and all the containers of the pod are unregistered.
 //
 //  {
 //    "id": "bye",
@@ -86,6 +126,9 @@ type Bye struct {
 //
 // The result of an allocateIO operation is encoded as an AllocateIoResult.
 //
+// In pods, ContainerID is the container the I/O streams belong to. It
+// defaults to the container the client gave in hello or attach.
+//
 //  {
 //    "id": "allocateIO",
 //    "data": {
@@ -93,7 +136,8 @@ type Bye struct {
 //    }
 //  }
 type AllocateIo struct {
-	NStreams int `json:"nStreams"`
+	NStreams    int    `json:"nStreams"`
+	ContainerID string `json:"containerId,omitempty"`
 }
 
 // AllocateIoResult is the result from a successful allocateIO.
@@ -138,3 +182,413 @@ type Hyper struct {
 	HyperName string          `json:"hyperName"`
 	Data      json.RawMessage `json:"data,omitempty"`
 }
+
+// Reasons why a VM can be declared lost. See the VMLost notification.
+const (
+	// VMLostIoEOF means hyperstart closed its I/O channel.
+	VMLostIoEOF = "io-eof"
+	// VMLostIoError means an error occurred reading from the I/O channel.
+	VMLostIoError = "io-error"
+	// VMLostCtlError means the control channel broke while sending a
+	// command to hyperstart.
+	VMLostCtlError = "ctl-error"
+	// VMLostQemuExit means the VM console was closed, which happens when
+	// the qemu process exits.
+	VMLostQemuExit = "qemu-exit"
+	// VMLostProxyShutdown means the proxy is shutting down.
+	VMLostProxyShutdown = "proxy-shutdown"
+	// VMLostHealthCheck means the agent didn't answer a health check
+	// ping in time, see the -health-check-interval option.
+	VMLostHealthCheck = "health-check"
+)
+
+// VMLostExitStatus is the exit status sent on the I/O streams of processes
+// that were running inside a VM when that VM is lost.
+//
+// When a VM is lost, the proxy terminates every I/O session associated with it
+// by sending an empty data packet on each allocated stream, signaling the end
+// of the stream, followed by VMLostExitStatus as the exit status on ioBase.
+// The I/O file descriptor is then closed.
+const VMLostExitStatus = 255
+
+// The VMLost notification is sent to the clients attached to a VM, and having
+// asked for notifications, when the proxy detects that VM is gone. Reason is
+// one of the VMLost* constants.
+//
+// After a VMLost notification, payloads targeting that VM fail. The VM stays
+// registered for a grace period, after which the proxy forgets about it.
+//
+//  {
+//    "id": "vmLost",
+//    "data": {
+//      "containerId": "756535dc6e9ab9b560f84c8...",
+//      "reason": "io-eof"
+//    }
+//  }
+type VMLost struct {
+	ContainerID string `json:"containerId"`
+	Reason      string `json:"reason"`
+}
+
+// The VMReady notification is sent to the clients attached to a VM registered
+// by an asynchronous hello, and having asked for notifications, when
+// hyperstart is ready.
+//
+//  {
+//    "id": "vmReady",
+//    "data": {
+//      "containerId": "756535dc6e9ab9b560f84c8..."
+//    }
+//  }
+type VMReady struct {
+	ContainerID string `json:"containerId"`
+}
+
+// The VMFailed notification is sent to the clients attached to a VM registered
+// by an asynchronous hello, and having asked for notifications, when the VM
+// couldn't be started. The VM has been unregistered and the clients detached
+// from it.
+//
+//  {
+//    "id": "vmFailed",
+//    "data": {
+//      "containerId": "756535dc6e9ab9b560f84c8...",
+//      "error": "timed out waiting for hyperstart to be ready",
+//      "code": "vmNotReady"
+//    }
+//  }
+type VMFailed struct {
+	ContainerID string    `json:"containerId"`
+	Error       string    `json:"error"`
+	Code        ErrorCode `json:"code,omitempty"`
+}
+
+// The Console payload gives access to the console output of a VM, captured
+// by the proxy when a console socket has been given to hello.
+//
+// The proxy keeps the last lines of the console in memory. Lines is the number
+// of lines to return, 0 meaning all the lines kept by the proxy.
+// ContainerID can be omitted if the client is attached to the VM.
+//
+// When Follow is true, the console output will then be sent to the client as
+// ConsoleOutput notifications until the client disconnects or issues a console
+// payload with Unfollow set to true.
+//
+// The result of a console operation is encoded as a ConsoleResult.
+//
+//  {
+//    "id": "console",
+//    "data": {
+//      "containerId": "756535dc6e9ab9b560f84c8...",
+//      "lines": 20,
+//      "follow": true
+//    }
+//  }
+type Console struct {
+	ContainerID string `json:"containerId,omitempty"`
+	Lines       int    `json:"lines,omitempty"`
+	Follow      bool   `json:"follow,omitempty"`
+	Unfollow    bool   `json:"unfollow,omitempty"`
+}
+
+// ConsoleResult is the result from a successful console payload. Lines are
+// given oldest first.
+//
+//  {
+//    "success": true,
+//    "data": {
+//      "lines": [ "hyperstart starting", "..." ]
+//    }
+//  }
+type ConsoleResult struct {
+	Lines []string `json:"lines"`
+}
+
+// The ConsoleOutput notification carries new console lines to clients
+// following the console of a VM (see the Console payload).
+//
+// A chatty guest can be rate limited by the proxy. When that happens, a line
+// indicating the number of lines dropped is inserted in the output.
+//
+//  {
+//    "id": "consoleOutput",
+//    "data": {
+//      "containerId": "756535dc6e9ab9b560f84c8...",
+//      "lines": [ "..." ]
+//    }
+//  }
+type ConsoleOutput struct {
+	ContainerID string   `json:"containerId"`
+	Lines       []string `json:"lines"`
+}
+
+// The ConsoleAttach payload gives interactive access to the console of a VM.
+// This is useful to debug a VM when hyperstart doesn't answer anymore.
+//
+// A successful consoleAttach response is preceded by a file descriptor, passed
+// the same way as for allocateIO. Data read from that file descriptor is the
+// console output, data written to it is sent to the console input. The
+// console output keeps being captured by the proxy (see the Console payload).
+//
+// Only one client can be attached to the console of a VM at a time. The
+// session ends when the client closes the file descriptor.
+//
+//  {
+//    "id": "consoleAttach",
+//    "data": {
+//      "containerId": "756535dc6e9ab9b560f84c8..."
+//    }
+//  }
+type ConsoleAttach struct {
+	ContainerID string `json:"containerId"`
+}
+
+// The Tap payload subscribes the client to a live copy of the traffic between
+// the proxy and hyperstart for a VM, a bit like tcpdump. The traffic is sent
+// to the client as TapFrame notifications until the client disconnects or
+// issues a tap payload with Stop set to true.
+//
+// ContainerID can be omitted if the client is attached to the VM. When Data
+// is true, the notifications include the data of each frame, not only its
+// header.
+//
+//  {
+//    "id": "tap",
+//    "data": {
+//      "containerId": "756535dc6e9ab9b560f84c8...",
+//      "data": true
+//    }
+//  }
+type Tap struct {
+	ContainerID string `json:"containerId,omitempty"`
+	Data        bool   `json:"data,omitempty"`
+	Stop        bool   `json:"stop,omitempty"`
+}
+
+// Channels a TapFrame can be seen on.
+const (
+	// hyperstart control channel
+	TapChannelCtl = "ctl"
+	// hyperstart I/O channel
+	TapChannelIo = "io"
+	// A client has allocated an I/O session, Seq is the session ioBase
+	// and Length its number of streams.
+	TapChannelSession = "session"
+)
+
+// Directions of a TapFrame.
+const (
+	TapToVM   = "toVM"
+	TapFromVM = "fromVM"
+)
+
+// The TapFrame notification describes a frame exchanged between the proxy and
+// hyperstart (see the Tap payload).
+//
+// Cmd is the name of the hyperstart command for ctl frames, Seq the sequence
+// number of io frames. Data, base64 encoded, is only given when asked for.
+// Frames can be dropped when the client doesn't keep up, Dropped is the number
+// of frames lost before this one.
+//
+//  {
+//    "id": "tapFrame",
+//    "data": {
+//      "containerId": "756535dc6e9ab9b560f84c8...",
+//      "time": "2017-01-02T15:04:05.123456789Z",
+//      "channel": "ctl",
+//      "direction": "toVM",
+//      "cmd": "execcmd",
+//      "length": 234,
+//      "data": "eyJjb250YWluZXIiOiAiZm9vIn0="
+//    }
+//  }
+type TapFrame struct {
+	ContainerID string `json:"containerId"`
+	Time        string `json:"time"`
+	Channel     string `json:"channel"`
+	Direction   string `json:"direction"`
+	Cmd         string `json:"cmd,omitempty"`
+	Seq         uint64 `json:"seq,omitempty"`
+	Length      int    `json:"length"`
+	Data        []byte `json:"data,omitempty"`
+	Dropped     uint64 `json:"dropped,omitempty"`
+}
+
+// VMState describes a VM known to the proxy. ContainerID is the identifier
+// the VM has been registered with, the pod identifier for pods, Containers the
+// other containers registered with the VM. Lost is set to the reason the VM
+// has been declared lost, if it has (see VMLost). LogLevel is only set when
+// the VM has its own log level (see SetLogLevel).
+type VMState struct {
+	ContainerID string   `json:"containerId"`
+	Containers  []string `json:"containers,omitempty"`
+	CtlSerial   string   `json:"ctlSerial"`
+	IoSerial    string   `json:"ioSerial"`
+	Console     string   `json:"console,omitempty"`
+	Lost        string   `json:"lost,omitempty"`
+	IoSessions  int      `json:"ioSessions"`
+	Clients     int      `json:"clients"`
+	LogLevel    *int     `json:"logLevel,omitempty"`
+}
+
+// SessionState describes an I/O session allocated by a client for the
+// container ContainerID.
+type SessionState struct {
+	IoBase      uint64 `json:"ioBase"`
+	NStreams    int    `json:"nStreams"`
+	ClientID    uint64 `json:"clientId"`
+	ContainerID string `json:"containerId,omitempty"`
+}
+
+// ClientState describes a client connected to the proxy. Pid and Uid are the
+// credentials of the peer process, when known.
+type ClientState struct {
+	ID          uint64 `json:"id"`
+	Pid         int32  `json:"pid,omitempty"`
+	Uid         uint32 `json:"uid,omitempty"`
+	ContainerID string `json:"containerId,omitempty"`
+}
+
+// The ListVMs payload returns the list of VMs known to the proxy. It doesn't
+// take any argument and the result is encoded as a ListVMsResult.
+//
+//  {
+//    "id": "listVMs"
+//  }
+type ListVMs struct {
+}
+
+// ListVMsResult is the result from a successful listVMs payload.
+//
+//  {
+//    "success": true,
+//    "data": {
+//      "vms": [
+//        {
+//          "containerId": "756535dc6e9ab9b560f84c8...",
+//          "ctlSerial": "/tmp/sh.hyper.channel.0.sock",
+//          "ioSerial": "/tmp/sh.hyper.channel.1.sock",
+//          "ioSessions": 1,
+//          "clients": 2
+//        }
+//      ]
+//    }
+//  }
+type ListVMsResult struct {
+	VMs []VMState `json:"vms"`
+}
+
+// The VMInfo payload returns the details of a single VM, encoded as a
+// VMInfoResult. When Sessions is true, the list of I/O sessions is included.
+//
+//  {
+//    "id": "vmInfo",
+//    "data": {
+//      "containerId": "756535dc6e9ab9b560f84c8...",
+//      "sessions": true
+//    }
+//  }
+type VMInfo struct {
+	ContainerID string `json:"containerId"`
+	Sessions    bool   `json:"sessions,omitempty"`
+}
+
+// VMInfoResult is the result from a successful vmInfo payload.
+//
+//  {
+//    "success": true,
+//    "data": {
+//      "vm": {
+//        "containerId": "756535dc6e9ab9b560f84c8...",
+//        "ctlSerial": "/tmp/sh.hyper.channel.0.sock",
+//        "ioSerial": "/tmp/sh.hyper.channel.1.sock",
+//        "ioSessions": 1,
+//        "clients": 2
+//      },
+//      "sessions": [
+//        { "ioBase": 1, "nStreams": 2, "clientId": 3 }
+//      ]
+//    }
+//  }
+type VMInfoResult struct {
+	VM       VMState        `json:"vm"`
+	Sessions []SessionState `json:"sessions,omitempty"`
+}
+
+// The ListClients payload returns the list of clients connected to the proxy,
+// encoded as a ListClientsResult. It doesn't take any argument.
+//
+//  {
+//    "id": "listClients"
+//  }
+type ListClients struct {
+}
+
+// ListClientsResult is the result from a successful listClients payload.
+//
+//  {
+//    "success": true,
+//    "data": {
+//      "clients": [
+//        { "id": 1, "pid": 4242, "containerId": "756535dc6e9ab9b560f84c8..." }
+//      ]
+//    }
+//  }
+type ListClientsResult struct {
+	Clients []ClientState `json:"clients"`
+}
+
+// The SetLogLevel payload changes the verbosity of the proxy logs, as the -v
+// option does, without having to restart the proxy.
+//
+// When ContainerID is given, only the verbosity of the messages about that VM,
+// and the clients attached to it, is changed. It can be higher or lower than
+// the global log level, eg. to look at the I/O data dumps (level 2) of a single
+// VM. Reset removes the VM log level, the VM going back to the global log
+// level.
+//
+//  {
+//    "id": "setLogLevel",
+//    "data": {
+//      "level": 2,
+//      "containerId": "756535dc6e9ab9b560f84c8..."
+//    }
+//  }
+type SetLogLevel struct {
+	Level       int    `json:"level"`
+	ContainerID string `json:"containerId,omitempty"`
+	Reset       bool   `json:"reset,omitempty"`
+}
+
+// The RegisterContainer payload adds a container to a pod, ie. a VM
+// registered with a pod identifier in hello. The VM can then be designated by
+// the new container identifier in the other payloads.
+//
+// PodID can be any identifier already designating the VM. It can be omitted
+// when the client is attached to the VM.
+//
+//  {
+//    "id": "registerContainer",
+//    "data": {
+//      "containerId": "c63a5ee3e5e12ba1e39b5d8...",
+//      "podId": "8cd2b1e29d2d3c2c6c2bf48..."
+//    }
+//  }
+type RegisterContainer struct {
+	ContainerID string `json:"containerId"`
+	PodID       string `json:"podId,omitempty"`
+}
+
+// The UnregisterContainer payload removes a container added with
+// RegisterContainer, or with hello, from its pod. The I/O sessions of that
+// container are closed. The VM itself stays registered until bye is issued.
+//
+//  {
+//    "id": "unregisterContainer",
+//    "data": {
+//      "containerId": "c63a5ee3e5e12ba1e39b5d8..."
+//    }
+//  }
+type UnregisterContainer struct {
+	ContainerID string `json:"containerId"`
+}
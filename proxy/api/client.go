@@ -18,14 +18,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"time"
 )
 
 // The Client struct can be used to issue proxy API calls with a convenient
 // high level API.
 type Client struct {
-	conn *net.UnixConn
+	conn   *net.UnixConn
+	reader *Reader
+
+	// Notifications received while waiting for a response, oldest first.
+	// They are handed out by WaitNotification.
+	notifications []*Notification
 }
 
 // NewClient creates a new client object to communicate with the proxy using
@@ -33,7 +40,8 @@ type Client struct {
 // client object to close conn.
 func NewClient(conn *net.UnixConn) *Client {
 	return &Client{
-		conn: conn,
+		conn:   conn,
+		reader: NewReader(conn),
 	}
 }
 
@@ -57,12 +65,109 @@ func (client *Client) sendPayload(id string, payload interface{}) (*Response, er
 		return nil, err
 	}
 
-	resp := Response{}
-	if err := ReadMessage(client.conn, &resp); err != nil {
+	return client.readResponse()
+}
+
+// queueNotification decodes a notification message and keeps it around for
+// WaitNotification.
+func (client *Client) queueNotification(data []byte) error {
+	notification := &Notification{}
+	if err := json.Unmarshal(data, notification); err != nil {
+		return err
+	}
+	client.notifications = append(client.notifications, notification)
+	return nil
+}
+
+// readResponse reads messages until a Response is found, queuing the
+// notifications received in the meantime.
+func (client *Client) readResponse() (*Response, error) {
+	for {
+		header, data, err := client.reader.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		if header.flags&flagNotification != 0 {
+			if err := client.queueNotification(data); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		resp := Response{}
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return nil, err
+		}
+
+		return &resp, nil
+	}
+}
+
+// readFd reads the file descriptor sent before a response. Notifications can
+// be received before the fd and are queued. The proxy doesn't send any fd when
+// the request fails, in which case the response is returned instead.
+func (client *Client) readFd() (int, *Response, error) {
+	for {
+		fd, b, err := readFdOrByte(client.conn)
+		if err != nil {
+			return -1, nil, err
+		}
+		if fd != -1 {
+			return fd, nil, nil
+		}
+
+		// We've read the first byte of a message header, complete it
+		// before reading the message data.
+		client.reader.release()
+		client.reader.header[0] = b
+		if _, err := io.ReadFull(client.conn, client.reader.header[1:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return -1, nil, err
+		}
+		header, data, err := client.reader.readData()
+		if err != nil {
+			return -1, nil, err
+		}
+
+		if header.flags&flagNotification == 0 {
+			resp := Response{}
+			if err := json.Unmarshal(data, &resp); err != nil {
+				return -1, nil, err
+			}
+			return -1, &resp, nil
+		}
+
+		if err := client.queueNotification(data); err != nil {
+			return -1, nil, err
+		}
+	}
+}
+
+// WaitNotification returns the next notification sent by the proxy, blocking
+// until one is received if none has been queued while waiting for responses.
+func (client *Client) WaitNotification() (*Notification, error) {
+	if len(client.notifications) > 0 {
+		notification := client.notifications[0]
+		client.notifications = client.notifications[1:]
+		return notification, nil
+	}
+
+	header, data, err := client.reader.readFrame()
+	if err != nil {
 		return nil, err
 	}
+	if header.flags&flagNotification == 0 {
+		return nil, errors.New("unexpected response received")
+	}
 
-	return &resp, nil
+	notification := &Notification{}
+	if err := json.Unmarshal(data, notification); err != nil {
+		return nil, err
+	}
+	return notification, nil
 }
 
 // sendPayloadGetFd will send a command payload and get a response back
@@ -83,30 +188,65 @@ func (client *Client) sendPayloadGetFd(id string, payload interface{}) (*Respons
 	}
 
 	// I/O fd
-	newFd, err := ReadFd(client.conn)
+	newFd, resp, err := client.readFd()
 	if err != nil {
-		return nil, nil, fmt.Errorf("sendPayloadGetFd: couldn't read fd for request %s", id)
+		return nil, nil, fmt.Errorf("sendPayloadGetFd: couldn't read fd for request %s: %v", id, err)
+	}
+	if resp != nil {
+		// No fd, most likely an error
+		return resp, nil, nil
 	}
 
 	ioFile := os.NewFile(uintptr(newFd), "")
 
-	resp := Response{}
-	if err := ReadMessage(client.conn, &resp); err != nil {
+	resp, err = client.readResponse()
+	if err != nil {
+		ioFile.Close()
 		return nil, nil, err
 	}
 
-	return &resp, ioFile, nil
+	return resp, ioFile, nil
+}
+
+// Error is the error returned by the Client functions when the proxy answers
+// with a failed Response.
+//
+// Errors can be compared to an ErrorCode with errors.Is, or retrieved with
+// errors.As to look at their details:
+//
+//  var proxyErr *api.Error
+//  if errors.As(err, &proxyErr) && proxyErr.Code == api.ErrorCodeVMLost {
+//    fmt.Println("lost:", proxyErr.Details["reason"])
+//  }
+type Error struct {
+	// Code is one of the ErrorCode constants, or empty when talking to an
+	// older proxy
+	Code    ErrorCode
+	Message string
+	// Details are the values the proxy gave along with Code, if any
+	Details map[string]interface{}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether e has the code target, target being an ErrorCode.
+func (e *Error) Is(target error) bool {
+	code, ok := target.(ErrorCode)
+	return ok && code != "" && code == e.Code
 }
 
 func errorFromResponse(resp *Response) error {
 	// We should always have an error with the response, but better safe
 	// than sorry.
 	if resp.Success == false {
-		if resp.Error != "" {
-			return errors.New(resp.Error)
+		msg := resp.Error
+		if msg == "" {
+			msg = "unknown error"
 		}
 
-		return errors.New("unknown error")
+		return &Error{Code: resp.Code, Message: msg, Details: resp.Details}
 	}
 
 	return nil
@@ -115,7 +255,19 @@ func errorFromResponse(resp *Response) error {
 // HelloOptions holds extra arguments one can pass to the Hello function. See
 // the Hello payload for more details.
 type HelloOptions struct {
+	PodID   string
 	Console string
+	Record  bool
+	// How long the proxy waits for the VM to be ready, 0 for the proxy
+	// default. The proxy has a millisecond resolution.
+	Timeout time.Duration
+	// Don't wait for the VM to be ready, see WaitVMReady
+	Async bool
+	// Agent running inside the VM, hyperstart when empty
+	Agent string
+	// Receive the VMLost notification, always true for asynchronous
+	// hellos
+	Notifications bool
 }
 
 // HelloReturn contains the return values from Hello. See the Hello and
@@ -133,7 +285,13 @@ func (client *Client) Hello(containerID, ctlSerial, ioSerial string,
 	}
 
 	if options != nil {
+		hello.PodID = options.PodID
 		hello.Console = options.Console
+		hello.Record = options.Record
+		hello.Timeout = uint32(options.Timeout / time.Millisecond)
+		hello.Async = options.Async
+		hello.Agent = options.Agent
+		hello.Notifications = options.Notifications
 	}
 
 	resp, err := client.sendPayload("hello", &hello)
@@ -146,9 +304,50 @@ func (client *Client) Hello(containerID, ctlSerial, ioSerial string,
 	return ret, errorFromResponse(resp)
 }
 
+// WaitVMReady waits for the outcome of an asynchronous Hello registering
+// containerID, the pod ID for pods, returning nil on VMReady and the error
+// carried by VMFailed otherwise. Other notifications received in the meantime
+// are kept for WaitNotification.
+func (client *Client) WaitVMReady(containerID string) error {
+	var others []*Notification
+	defer func() {
+		client.notifications = append(others, client.notifications...)
+	}()
+
+	for {
+		notification, err := client.WaitNotification()
+		if err != nil {
+			return err
+		}
+
+		switch notification.ID {
+		case "vmReady":
+			ready := VMReady{}
+			if err := json.Unmarshal(notification.Data, &ready); err != nil {
+				return err
+			}
+			if ready.ContainerID == containerID {
+				return nil
+			}
+		case "vmFailed":
+			failed := VMFailed{}
+			if err := json.Unmarshal(notification.Data, &failed); err != nil {
+				return err
+			}
+			if failed.ContainerID == containerID {
+				return &Error{Code: failed.Code, Message: failed.Error}
+			}
+		}
+
+		others = append(others, notification)
+	}
+}
+
 // AttachOptions holds extra arguments one can pass to the Attach function. See
 // the Attach payload for more details.
 type AttachOptions struct {
+	// Receive the notifications about the VM
+	Notifications bool
 }
 
 // AttachReturn contains the return values from Hello. See the Hello and
@@ -162,6 +361,10 @@ func (client *Client) Attach(containerID string, options *AttachOptions) (*Attac
 		ContainerID: containerID,
 	}
 
+	if options != nil {
+		hello.Notifications = options.Notifications
+	}
+
 	resp, err := client.sendPayload("attach", &hello)
 	if err != nil {
 		return nil, err
@@ -174,8 +377,14 @@ func (client *Client) Attach(containerID string, options *AttachOptions) (*Attac
 
 // AllocateIo wraps the AllocateIo payload (see payload description for more details)
 func (client *Client) AllocateIo(nStreams int) (ioBase uint64, ioFile *os.File, err error) {
+	return client.AllocateContainerIo("", nStreams)
+}
+
+// AllocateContainerIo is AllocateIo for the container containerID of a pod.
+func (client *Client) AllocateContainerIo(containerID string, nStreams int) (ioBase uint64, ioFile *os.File, err error) {
 	allocate := AllocateIo{
-		NStreams: nStreams,
+		NStreams:    nStreams,
+		ContainerID: containerID,
 	}
 
 	resp, ioFile, err := client.sendPayloadGetFd("allocateIO", &allocate)
@@ -185,17 +394,19 @@ func (client *Client) AllocateIo(nStreams int) (ioBase uint64, ioFile *os.File,
 
 	err = errorFromResponse(resp)
 	if err != nil {
-		return
+		if ioFile != nil {
+			ioFile.Close()
+		}
+		return 0, nil, err
 	}
 
-	val, ok := resp.Data["ioBase"]
-	if !ok {
-		return 0, nil, errors.New("allocateio: no ioBase in response")
+	result := AllocateIoResult{}
+	if err := decodeData(resp, &result); err != nil {
+		ioFile.Close()
+		return 0, nil, fmt.Errorf("allocateIO: %v", err)
 	}
 
-	ioBase = (uint64)(val.(float64))
-
-	return
+	return result.IoBase, ioFile, nil
 }
 
 // Hyper wraps the Hyper payload (see payload description for more details)
@@ -237,3 +448,255 @@ func (client *Client) Bye(containerID string) error {
 
 	return errorFromResponse(resp)
 }
+
+// ConsoleOptions holds extra arguments one can pass to the Console function.
+// See the Console payload for more details.
+type ConsoleOptions struct {
+	// ContainerID of the VM, defaults to the VM the client is attached to
+	ContainerID string
+	// Follow the console output through ConsoleOutput notifications
+	Follow bool
+}
+
+// Console wraps the Console payload (see payload description for more
+// details). It returns the last n lines of the VM console.
+func (client *Client) Console(n int, options *ConsoleOptions) ([]string, error) {
+	console := Console{
+		Lines: n,
+	}
+
+	if options != nil {
+		console.ContainerID = options.ContainerID
+		console.Follow = options.Follow
+	}
+
+	resp, err := client.sendPayload("console", &console)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := errorFromResponse(resp); err != nil {
+		return nil, err
+	}
+
+	result := ConsoleResult{}
+	if err := decodeData(resp, &result); err != nil {
+		return nil, fmt.Errorf("console: %v", err)
+	}
+	if result.Lines == nil {
+		result.Lines = []string{}
+	}
+
+	return result.Lines, nil
+}
+
+// ConsoleUnfollow stops the ConsoleOutput notifications started with Console.
+func (client *Client) ConsoleUnfollow(containerID string) error {
+	console := Console{
+		ContainerID: containerID,
+		Unfollow:    true,
+	}
+
+	resp, err := client.sendPayload("console", &console)
+	if err != nil {
+		return err
+	}
+
+	return errorFromResponse(resp)
+}
+
+// ConsoleAttach wraps the ConsoleAttach payload (see payload description for
+// more details). It returns a file connected to the VM console.
+func (client *Client) ConsoleAttach(containerID string) (*os.File, error) {
+	attach := ConsoleAttach{
+		ContainerID: containerID,
+	}
+
+	resp, console, err := client.sendPayloadGetFd("consoleAttach", &attach)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := errorFromResponse(resp); err != nil {
+		if console != nil {
+			console.Close()
+		}
+		return nil, err
+	}
+
+	return console, nil
+}
+
+// TapOptions holds extra arguments one can pass to the Tap function. See the
+// Tap payload for more details.
+type TapOptions struct {
+	ContainerID string
+	Data        bool
+}
+
+// Tap wraps the Tap payload (see payload description for more details). The
+// frames are then received with WaitNotification.
+func (client *Client) Tap(options *TapOptions) error {
+	tap := Tap{}
+
+	if options != nil {
+		tap.ContainerID = options.ContainerID
+		tap.Data = options.Data
+	}
+
+	resp, err := client.sendPayload("tap", &tap)
+	if err != nil {
+		return err
+	}
+
+	return errorFromResponse(resp)
+}
+
+// TapStop stops the flow of TapFrame notifications started with Tap.
+func (client *Client) TapStop(containerID string) error {
+	tap := Tap{
+		ContainerID: containerID,
+		Stop:        true,
+	}
+
+	resp, err := client.sendPayload("tap", &tap)
+	if err != nil {
+		return err
+	}
+
+	return errorFromResponse(resp)
+}
+
+// decodeData decodes the data of resp into result, the result type of the
+// payload.
+func decodeData(resp *Response, result interface{}) error {
+	if len(resp.Data) == 0 {
+		return errors.New("no data in response")
+	}
+
+	return json.Unmarshal(resp.Data, result)
+}
+
+// ListVMs wraps the ListVMs payload (see payload description for more
+// details).
+func (client *Client) ListVMs() ([]VMState, error) {
+	resp, err := client.sendPayload("listVMs", &ListVMs{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := errorFromResponse(resp); err != nil {
+		return nil, err
+	}
+
+	result := ListVMsResult{}
+	if err := decodeData(resp, &result); err != nil {
+		return nil, fmt.Errorf("listVMs: %v", err)
+	}
+
+	return result.VMs, nil
+}
+
+// VMInfo wraps the VMInfo payload (see payload description for more
+// details). The I/O sessions are only returned when sessions is true.
+func (client *Client) VMInfo(containerID string, sessions bool) (*VMInfoResult, error) {
+	info := VMInfo{
+		ContainerID: containerID,
+		Sessions:    sessions,
+	}
+
+	resp, err := client.sendPayload("vmInfo", &info)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := errorFromResponse(resp); err != nil {
+		return nil, err
+	}
+
+	result := &VMInfoResult{}
+	if err := decodeData(resp, result); err != nil {
+		return nil, fmt.Errorf("vmInfo: %v", err)
+	}
+
+	return result, nil
+}
+
+// ListClients wraps the ListClients payload (see payload description for more
+// details).
+func (client *Client) ListClients() ([]ClientState, error) {
+	resp, err := client.sendPayload("listClients", &ListClients{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := errorFromResponse(resp); err != nil {
+		return nil, err
+	}
+
+	result := ListClientsResult{}
+	if err := decodeData(resp, &result); err != nil {
+		return nil, fmt.Errorf("listClients: %v", err)
+	}
+
+	return result.Clients, nil
+}
+
+// SetLogLevelOptions holds extra arguments one can pass to the SetLogLevel
+// function. See the SetLogLevel payload for more details.
+type SetLogLevelOptions struct {
+	ContainerID string
+	Reset       bool
+}
+
+// SetLogLevel wraps the SetLogLevel payload (see payload description for more
+// details).
+func (client *Client) SetLogLevel(level int, options *SetLogLevelOptions) error {
+	setLevel := SetLogLevel{
+		Level: level,
+	}
+
+	if options != nil {
+		setLevel.ContainerID = options.ContainerID
+		setLevel.Reset = options.Reset
+	}
+
+	resp, err := client.sendPayload("setLogLevel", &setLevel)
+	if err != nil {
+		return err
+	}
+
+	return errorFromResponse(resp)
+}
+
+// RegisterContainer wraps the RegisterContainer payload (see payload
+// description for more details). podID can be empty if the client is attached
+// to the pod VM.
+func (client *Client) RegisterContainer(containerID, podID string) error {
+	register := RegisterContainer{
+		ContainerID: containerID,
+		PodID:       podID,
+	}
+
+	resp, err := client.sendPayload("registerContainer", &register)
+	if err != nil {
+		return err
+	}
+
+	return errorFromResponse(resp)
+}
+
+// UnregisterContainer wraps the UnregisterContainer payload (see payload
+// description for more details).
+func (client *Client) UnregisterContainer(containerID string) error {
+	unregister := UnregisterContainer{
+		ContainerID: containerID,
+	}
+
+	resp, err := client.sendPayload("unregisterContainer", &unregister)
+	if err != nil {
+		return err
+	}
+
+	return errorFromResponse(resp)
+}
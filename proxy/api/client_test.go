@@ -0,0 +1,71 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeData(t *testing.T) {
+	resp := Response{}
+	err := json.Unmarshal([]byte(`{"success":true,"data":{"ioBase":9007199254740993}}`), &resp)
+	assert.Nil(t, err)
+
+	// Sequence numbers don't go through float64
+	result := AllocateIoResult{}
+	assert.Nil(t, decodeData(&resp, &result))
+	assert.Equal(t, uint64(1<<53+1), result.IoBase)
+
+	// Code still using the map form of the data gets it
+	data, err := resp.DataMap()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"ioBase": float64(1 << 53)}, data)
+
+	resp = Response{Success: true}
+	assert.NotNil(t, decodeData(&resp, &result))
+	data, err = resp.DataMap()
+	assert.Nil(t, err)
+	assert.Nil(t, data)
+}
+
+func TestErrorFromResponse(t *testing.T) {
+	assert.Nil(t, errorFromResponse(&Response{Success: true}))
+
+	resp := Response{}
+	err := json.Unmarshal([]byte(`{"success":false,"error":"foo: vm lost (io-eof)",`+
+		`"code":"vmLost","details":{"containerId":"foo","reason":"io-eof"}}`), &resp)
+	assert.Nil(t, err)
+
+	err = fmt.Errorf("attach: %w", errorFromResponse(&resp))
+	assert.True(t, errors.Is(err, ErrorCodeVMLost))
+	assert.False(t, errors.Is(err, ErrorCodeUnknownContainer))
+
+	var proxyErr *Error
+	if assert.True(t, errors.As(err, &proxyErr)) {
+		assert.Equal(t, "foo: vm lost (io-eof)", proxyErr.Message)
+		assert.Equal(t, "io-eof", proxyErr.Details["reason"])
+	}
+
+	// Older proxies don't give a code
+	err = errorFromResponse(&Response{Error: "unknown containerID: foo"})
+	assert.False(t, errors.Is(err, ErrorCode("")))
+	assert.Equal(t, "unknown containerID: foo", err.Error())
+	assert.Equal(t, "unknown error", errorFromResponse(&Response{}).Error())
+}
@@ -43,36 +43,53 @@ func WriteFd(c *net.UnixConn, fd int) error {
 
 // ReadFd reads a fd file descriptor written with WriteFd.
 func ReadFd(c *net.UnixConn) (int, error) {
+	fd, _, err := readFdOrByte(c)
+	if err != nil {
+		return -1, err
+	}
+	if fd == -1 {
+		return -1, errors.New("no out of band data read")
+	}
+	return fd, nil
+}
+
+// readFdOrByte reads a single byte from c. If that byte carries a file
+// descriptor, readFdOrByte returns it, otherwise the fd returned is -1 and the
+// byte read is returned instead so the caller can make sense of it.
+func readFdOrByte(c *net.UnixConn) (int, byte, error) {
 	oob := make([]byte, 32)
 	buf := make([]byte, 1)
 
 	// Retrieve out of band data
 	n, oobn, _, _, err := c.ReadMsgUnix(buf, oob)
 	if err != nil {
-		return -1, err
+		return -1, 0, err
+	}
+	if n != 1 {
+		return -1, 0, errors.New("couldn't read fd passing tag")
 	}
 	if oobn == 0 {
-		return -1, errors.New("no out of band data read")
+		return -1, buf[0], nil
 	}
-	if n != 1 && buf[0] != fileTag {
-		return -1, errors.New("couldn't read fd passing tag")
+	if buf[0] != fileTag {
+		return -1, 0, errors.New("couldn't read fd passing tag")
 	}
 
 	// Parse the fd out of the out of band data
-	scms, err := syscall.ParseSocketControlMessage(oob)
+	scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
 	if len(scms) != 1 {
-		return -1, fmt.Errorf("unexpected number of control messages (%d)", len(scms))
+		return -1, 0, fmt.Errorf("unexpected number of control messages (%d)", len(scms))
 	}
 	scm := scms[0]
 	fds, err := syscall.ParseUnixRights(&scm)
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
 	if len(fds) != 1 {
-		return -1, fmt.Errorf("unexpected number of fds (%d)", len(fds))
+		return -1, 0, fmt.Errorf("unexpected number of fds (%d)", len(fds))
 	}
-	return fds[0], nil
+	return fds[0], fileTag, nil
 }
@@ -28,6 +28,36 @@ type header struct {
 	flags  uint32
 }
 
+// Flags that can be set in the message header.
+const (
+	// flagNotification marks messages sent by the proxy on its own
+	// initiative, ie. not as a response to a Request.
+	flagNotification = 1 << 0
+
+	// knownFlags are the flags defined so far, messages with other bits
+	// set are rejected.
+	knownFlags = flagNotification
+)
+
+// DefaultMaxMessageSize is the maximum length of the message data a Reader
+// accepts by default. The header announces the length of the data, which is
+// only allocated once checked against that limit.
+const DefaultMaxMessageSize = 4 * 1024 * 1024
+
+// Buffers larger than this aren't kept by a Reader once the message is
+// decoded, not to pin the memory of an occasional large message.
+const maxRetainedBufferSize = 64 * 1024
+
+var (
+	// ErrMessageTooLarge is returned when reading a message longer than
+	// the maximum message size. The stream is left in the middle of the
+	// message and can't be read further.
+	ErrMessageTooLarge = errors.New("message too large")
+	// ErrUnknownFlags is returned when reading a message whose header has
+	// flags this package doesn't know about.
+	ErrUnknownFlags = errors.New("unknown message flags")
+)
+
 // A Request is a JSON message sent from a client to the proxy. This message
 // embed a payload identified by "id". A payload can have data associated with
 // it. It's useful to think of Request as an RPC call with "id" as function
@@ -46,52 +76,216 @@ type Request struct {
 // including its success state and optional data. It's useful to think of
 // Response as the result of an RPC call with ("success", "error") describing
 // if the call has been successul and "data" holding the optional results.
+// The results of each payload are documented by a result type, eg.
+// AllocateIoResult, Data can be decoded into.
+//
+// Failed requests also carry a "code", one of the ErrorCode constants, so
+// clients can react to them without parsing the error message, and sometimes
+// "details", values specific to the error such as the container concerned.
 type Response struct {
 	Success bool                   `json:"success"`
 	Error   string                 `json:"error,omitempty"`
-	Data    map[string]interface{} `json:"data,omitempty"`
+	Code    ErrorCode              `json:"code,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	Data    json.RawMessage        `json:"data,omitempty"`
 }
 
-// ReadMessage reads a message from reader. A message is either a Request or a
-// Response
-func ReadMessage(reader io.Reader, msg interface{}) error {
-	buf := make([]byte, headerLength)
-	n, err := reader.Read(buf)
-	if err != nil {
-		return err
+// DataMap returns the data of resp decoded as a map, the type Data had before
+// the results were typed, for code not converted to the result types yet. A
+// response without data gives a nil map.
+//
+// Numbers are decoded as float64, which can't hold large integers such as I/O
+// sequence numbers. Prefer decoding Data into the payload result type.
+func (resp *Response) DataMap() (map[string]interface{}, error) {
+	var data map[string]interface{}
+	if len(resp.Data) == 0 {
+		return nil, nil
 	}
-	if n != headerLength {
-		return errors.New("couldn't read the full header")
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, err
 	}
+	return data, nil
+}
+
+// An ErrorCode identifies the reason a request failed. Codes are part of the
+// protocol: new ones can be added but existing ones won't change meaning.
+//
+// ErrorCode implements error, so the errors returned by Client can be
+// compared to a code with errors.Is:
+//
+//  if errors.Is(err, api.ErrorCodeVMLost) {
+//    ...
+//  }
+type ErrorCode string
+
+func (code ErrorCode) Error() string {
+	return string(code)
+}
+
+// Error codes, found in the "code" field of a failed Response. The details
+// given, if any, are listed with each code.
+const (
+	// The request isn't valid: its data can't be decoded or has missing
+	// or invalid fields
+	ErrorCodeInvalidRequest ErrorCode = "invalidRequest"
+	// The proxy doesn't know the payload of the request
+	ErrorCodeUnknownPayload ErrorCode = "unknownPayload"
+	// No VM or container is registered with that ID. Details:
+	// "containerId"
+	ErrorCodeUnknownContainer ErrorCode = "unknownContainer"
+	// A VM or container is already registered with that ID. Details:
+	// "containerId"
+	ErrorCodeContainerAlreadyRegistered ErrorCode = "containerAlreadyRegistered"
+	// The payload needs the client to be attached to a VM, with hello or
+	// attach, and it isn't
+	ErrorCodeNotAttached ErrorCode = "notAttached"
+	// The VM has been lost. Details: "containerId", "reason"
+	ErrorCodeVMLost ErrorCode = "vmLost"
+	// The container isn't one of the containers of the VM the client is
+	// attached to. Details: "containerId", "vmId"
+	ErrorCodeContainerNotInVM ErrorCode = "containerNotInVM"
+	// The container is the first container of a pod, it can't be
+	// unregistered on its own. Details: "containerId"
+	ErrorCodeNotPodContainer ErrorCode = "notPodContainer"
+	// The VM has no console. Details: "containerId"
+	ErrorCodeNoConsole ErrorCode = "noConsole"
+	// Another client is already attached to the VM console. Details:
+	// "containerId"
+	ErrorCodeConsoleAlreadyAttached ErrorCode = "consoleAlreadyAttached"
+	// The agent in the VM couldn't be reached or failed to run a command
+	ErrorCodeAgentFailed ErrorCode = "agentFailed"
+	// The client is sending requests faster than the proxy allows
+	ErrorCodeRateLimited ErrorCode = "rateLimited"
+	// The client has reached its maximum number of I/O sessions
+	ErrorCodeTooManyClientIoSessions ErrorCode = "tooManyClientIoSessions"
+	// The VM has reached its maximum number of I/O sessions
+	ErrorCodeTooManyVMIoSessions ErrorCode = "tooManyVMIoSessions"
+	// The user has reached its maximum number of VMs
+	ErrorCodeTooManyUserVMs ErrorCode = "tooManyUserVMs"
+	// The VM isn't ready: it didn't become ready before the hello deadline
+	// or, after an asynchronous hello, it's still starting
+	ErrorCodeVMNotReady ErrorCode = "vmNotReady"
+	// The proxy failed unexpectedly while handling the request, eg. the
+	// payload handler panicked
+	ErrorCodeInternal ErrorCode = "internalError"
+)
+
+// A Notification is a JSON message sent by the proxy to a client without the
+// client having issued a Request. Notifications can be received at any time,
+// including while waiting for the Response to a Request.
+//
+// Notifications are distinguished from Responses by a flag in the message
+// header. "id" identifies the notification and "data" holds its optional
+// payload. The list of possible notifications are documented in this package.
+type Notification struct {
+	ID   string          `json:"id"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// A Reader reads messages from a stream. Unlike ReadMessage, it reuses its
+// buffer from one message to the next and lets the caller choose the maximum
+// message size.
+type Reader struct {
+	r io.Reader
 
+	// MaxMessageSize is the maximum length of the message data, 0 meaning
+	// DefaultMaxMessageSize. Longer messages are rejected with
+	// ErrMessageTooLarge.
+	MaxMessageSize int
+
+	header [headerLength]byte
+	buf    []byte
+}
+
+// NewReader returns a Reader reading messages from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// readFrame reads a message header and its data. The data is only valid
+// until the next call.
+func (r *Reader) readFrame() (*header, []byte, error) {
+	r.release()
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		return nil, nil, err
+	}
+	return r.readData()
+}
+
+// readData reads the data of the message whose header is in r.header.
+func (r *Reader) readData() (*header, []byte, error) {
 	header := header{
-		length: binary.BigEndian.Uint32(buf[0:4]),
-		flags:  binary.BigEndian.Uint32(buf[4:8]),
+		length: binary.BigEndian.Uint32(r.header[0:4]),
+		flags:  binary.BigEndian.Uint32(r.header[4:8]),
+	}
+
+	if header.flags&^knownFlags != 0 {
+		return nil, nil, ErrUnknownFlags
+	}
+
+	limit := r.MaxMessageSize
+	if limit <= 0 {
+		limit = DefaultMaxMessageSize
+	}
+	if uint64(header.length) > uint64(limit) {
+		return nil, nil, ErrMessageTooLarge
+	}
+
+	length := int(header.length)
+	if cap(r.buf) < length {
+		r.buf = make([]byte, length)
 	}
+	data := r.buf[:length]
 
-	received := 0
-	need := int(header.length)
-	data := make([]byte, need)
-	for received < need {
-		n, err := reader.Read(data[received:need])
-		if err != nil {
-			return err
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
+		return nil, nil, err
+	}
+
+	return &header, data, nil
+}
 
-		received += n
+// release drops the buffer if it grew too large to be kept around.
+func (r *Reader) release() {
+	if cap(r.buf) > maxRetainedBufferSize {
+		r.buf = nil
 	}
+}
 
-	err = json.Unmarshal(data, msg)
+// ReadMessage reads the next message and decodes it into msg. A message is
+// either a Request or a Response.
+func (r *Reader) ReadMessage(msg interface{}) error {
+	_, data, err := r.readFrame()
 	if err != nil {
 		return err
 	}
+	defer r.release()
 
-	return nil
+	return json.Unmarshal(data, msg)
+}
+
+// ReadMessage reads a message from reader. A message is either a Request or a
+// Response. Messages longer than DefaultMaxMessageSize are rejected, a Reader
+// can be used for another limit.
+func ReadMessage(reader io.Reader, msg interface{}) error {
+	return NewReader(reader).ReadMessage(msg)
 }
 
 // WriteMessage writes a message into writer. A message is either a Request for
 // a Response
 func WriteMessage(writer io.Writer, msg interface{}) error {
+	return writeFrame(writer, 0, msg)
+}
+
+// WriteNotification writes a Notification into writer, flagging the message
+// as such in its header.
+func WriteNotification(writer io.Writer, notification *Notification) error {
+	return writeFrame(writer, flagNotification, notification)
+}
+
+func writeFrame(writer io.Writer, flags uint32, msg interface{}) error {
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return err
@@ -99,6 +293,7 @@ func WriteMessage(writer io.Writer, msg interface{}) error {
 
 	buf := make([]byte, headerLength)
 	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], flags)
 	n, err := writer.Write(buf)
 	if err != nil {
 		return err
@@ -0,0 +1,179 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rawFrame returns a message made of the given header fields and data.
+func rawFrame(length, flags uint32, data []byte) []byte {
+	buf := make([]byte, headerLength, headerLength+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], length)
+	binary.BigEndian.PutUint32(buf[4:8], flags)
+	return append(buf, data...)
+}
+
+func TestReadMessage(t *testing.T) {
+	var buf bytes.Buffer
+	requests := []Request{
+		{ID: "hello", Data: json.RawMessage(`{"containerId":"foo"}`)},
+		{ID: "bye"},
+	}
+	for i := range requests {
+		assert.Nil(t, WriteMessage(&buf, &requests[i]))
+	}
+
+	// Short reads don't split messages
+	r := NewReader(iotest.OneByteReader(&buf))
+	for i := range requests {
+		var req Request
+		assert.Nil(t, r.ReadMessage(&req))
+		assert.Equal(t, requests[i], req)
+	}
+
+	// The end of the stream, between messages, is a clean EOF
+	var req Request
+	assert.Equal(t, io.EOF, r.ReadMessage(&req))
+}
+
+func TestReadMessageTruncated(t *testing.T) {
+	frame := rawFrame(16, 0, []byte(`{"id":"hello"}  `))
+
+	for _, n := range []int{1, headerLength - 1, headerLength, len(frame) - 1} {
+		var req Request
+		err := ReadMessage(bytes.NewReader(frame[:n]), &req)
+		assert.Equal(t, io.ErrUnexpectedEOF, err, "truncated at %d", n)
+	}
+}
+
+func TestReadMessageTooLarge(t *testing.T) {
+	// The announced length is checked before the data is read, or
+	// allocated
+	r := NewReader(bytes.NewReader(rawFrame(0xffffffff, 0, nil)))
+	var req Request
+	assert.Equal(t, ErrMessageTooLarge, r.ReadMessage(&req))
+	assert.Nil(t, r.buf)
+
+	data := []byte(`{"id":"hello"}`)
+	frame := rawFrame(uint32(len(data)), 0, data)
+
+	r = NewReader(bytes.NewReader(frame))
+	r.MaxMessageSize = len(data) - 1
+	assert.Equal(t, ErrMessageTooLarge, r.ReadMessage(&req))
+
+	r = NewReader(bytes.NewReader(frame))
+	r.MaxMessageSize = len(data)
+	assert.Nil(t, r.ReadMessage(&req))
+	assert.Equal(t, "hello", req.ID)
+}
+
+func TestReadMessageUnknownFlags(t *testing.T) {
+	data := []byte(`{"id":"hello"}`)
+	for _, flags := range []uint32{1 << 1, 1 << 31, flagNotification | 1<<4} {
+		frame := rawFrame(uint32(len(data)), flags, data)
+		var req Request
+		err := ReadMessage(bytes.NewReader(frame), &req)
+		assert.Equal(t, ErrUnknownFlags, err, "flags %#x", flags)
+	}
+}
+
+func TestReaderBufferReuse(t *testing.T) {
+	var buf bytes.Buffer
+	small := Request{ID: "small"}
+	large := Request{ID: "large", Data: json.RawMessage(
+		`"` + string(bytes.Repeat([]byte("x"), 2*maxRetainedBufferSize)) + `"`)}
+
+	for _, req := range []*Request{&small, &small, &large, &small} {
+		assert.Nil(t, WriteMessage(&buf, req))
+	}
+
+	r := NewReader(&buf)
+	var req Request
+
+	// Messages that fit in the buffer are read into it
+	assert.Nil(t, r.ReadMessage(&req))
+	first := &r.buf[:1][0]
+	assert.Nil(t, r.ReadMessage(&req))
+	assert.True(t, first == &r.buf[:1][0])
+
+	// A large message isn't kept around once decoded
+	assert.Nil(t, r.ReadMessage(&req))
+	assert.Equal(t, large, req)
+	assert.Nil(t, r.buf)
+
+	assert.Nil(t, r.ReadMessage(&req))
+	assert.Equal(t, small.ID, req.ID)
+}
+
+// FuzzReadMessage checks a Reader copes with any input: it must not panic,
+// must read the same messages whatever the size of the reads and must give
+// back the messages it decoded once written again.
+func FuzzReadMessage(f *testing.F) {
+	var buf bytes.Buffer
+	WriteMessage(&buf, &Request{ID: "hello", Data: json.RawMessage(`{"containerId":"foo"}`)})
+	WriteMessage(&buf, &Response{Success: true})
+	WriteNotification(&buf, &Notification{ID: "vmLost"})
+	f.Add(buf.Bytes())
+	f.Add(rawFrame(0, 0, nil))
+	f.Add(rawFrame(2, 0, []byte("{}")))
+	f.Add(rawFrame(2, 1<<3, []byte("{}")))
+	f.Add(rawFrame(1<<20, 0, []byte("{}")))
+	f.Add([]byte{0, 0, 0})
+
+	const fuzzMaxSize = 1024
+
+	readAll := func(t *testing.T, r io.Reader, maxSize int) ([]Request, error) {
+		reader := NewReader(r)
+		reader.MaxMessageSize = maxSize
+		var msgs []Request
+		for {
+			var msg Request
+			err := reader.ReadMessage(&msg)
+			if err != nil {
+				return msgs, err
+			}
+			assert.True(t, cap(reader.buf) <= maxSize)
+			msgs = append(msgs, msg)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msgs, err := readAll(t, bytes.NewReader(data), fuzzMaxSize)
+		assert.NotNil(t, err)
+
+		oneByteMsgs, oneByteErr := readAll(t, iotest.OneByteReader(bytes.NewReader(data)), fuzzMaxSize)
+		assert.Equal(t, msgs, oneByteMsgs)
+		assert.Equal(t, err, oneByteErr)
+
+		var out bytes.Buffer
+		for i := range msgs {
+			assert.Nil(t, WriteMessage(&out, &msgs[i]))
+		}
+		again, err := readAll(t, &out, DefaultMaxMessageSize)
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, len(msgs), len(again))
+		for i := range again {
+			assert.Equal(t, msgs[i].ID, again[i].ID)
+		}
+	})
+}
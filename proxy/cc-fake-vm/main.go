@@ -0,0 +1,86 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// cc-fake-vm pretends to be a VM running hyperstart: it listens on the ctl and
+// io channels, and optionally on a console socket, for the proxy to connect
+// and simulates the container processes from a script. It makes it possible
+// to run the runtime, the proxy and the shim without KVM.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/01org/cc-oci-runtime/proxy/fakevm"
+)
+
+// Command line options
+var (
+	ArgCtl     = flag.String("ctl", "", "hyperstart ctl channel endpoint (socket path, unix:<path> or tcp:<host>:<port>)")
+	ArgIo      = flag.String("io", "", "hyperstart io channel endpoint")
+	ArgConsole = flag.String("console", "", "console endpoint, no console if empty")
+	ArgScript  = flag.String("script", "", "JSON file scripting the processes")
+	ArgReady   = flag.Duration("ready-delay", 0,
+		"how long the VM takes to be ready once the proxy is connected")
+	ArgVerbose = flag.Bool("v", false, "print the VM events")
+)
+
+func logf(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "[cc-fake-vm] "+format+"\n", a...)
+}
+
+func main() {
+	flag.Parse()
+
+	if *ArgCtl == "" || *ArgIo == "" {
+		fmt.Fprintln(os.Stderr, "-ctl and -io are mandatory")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	config := fakevm.Config{
+		Ctl:        *ArgCtl,
+		Io:         *ArgIo,
+		Console:    *ArgConsole,
+		ReadyDelay: *ArgReady,
+	}
+	if *ArgVerbose {
+		config.Log = logf
+	}
+	if *ArgScript != "" {
+		script, err := fakevm.LoadScript(*ArgScript)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "script:", err)
+			os.Exit(1)
+		}
+		config.Script = script
+	}
+
+	vm := fakevm.New(config)
+	if err := vm.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, "start:", err)
+		os.Exit(1)
+	}
+
+	// The VM runs until we're told to shut it down, the proxy then sees
+	// the VM as lost.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	vm.Stop()
+}
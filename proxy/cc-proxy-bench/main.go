@@ -0,0 +1,495 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// cc-proxy-bench loads a proxy with fake VMs: each VM is registered with
+// hello, then processes are exec'ed in it, their stdin echoed back through the
+// proxy, at the given concurrency and data rate until the end of the run,
+// when the VMs say bye. It reports the throughput, the latency of each step
+// and the fd and memory usage of the proxy, to catch regressions in how the
+// proxy scales with VMs and I/O sessions.
+//
+// The proxy runs in process unless -proxy-socket is given. The usage is then
+// the one of cc-proxy-bench as a whole, fake VMs included. The in process
+// proxy forwards the I/O streams with its event loop when given -event-loop.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/01org/cc-oci-runtime/proxy/fakevm"
+	"github.com/01org/cc-oci-runtime/proxy/server"
+	"github.com/containers/virtcontainers/hyperstart"
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+)
+
+// Command line options
+var (
+	ArgVMs         = flag.Int("vms", 10, "number of VMs")
+	ArgConcurrency = flag.Int("concurrency", 4, "number of processes running at the same time in each VM")
+	ArgDuration    = flag.Duration("duration", 10*time.Second, "how long processes are exec'ed for")
+	ArgSize        = flag.Int("size", 64*1024, "number of bytes each process echoes")
+	ArgChunk       = flag.Int("chunk", 4096, "size of the stdin writes")
+	ArgRate        = flag.Int("rate", 0, "stdin bytes per second of each process, 0 for as fast as possible")
+	ArgReadyDelay  = flag.Duration("ready-delay", 0, "VM boot time")
+	ArgProxySocket = flag.String("proxy-socket", "", "load the proxy listening on this socket instead of an in process one")
+	ArgProxyPid    = flag.Int("proxy-pid", 0, "pid of the -proxy-socket proxy, for its fd and memory usage")
+	ArgSample      = flag.Duration("sample-interval", 100*time.Millisecond, "how often the peak usage is sampled")
+	ArgEventLoop   = flag.Bool("event-loop", false, "run the in process proxy with its epoll event loop")
+)
+
+type bench struct {
+	dir        string
+	socketPath string
+	stats      *stats
+
+	// closed at the end of the run
+	stop chan struct{}
+}
+
+func (b *bench) dial() (*api.Client, error) {
+	conn, err := net.Dial("unix", b.socketPath)
+	if err != nil {
+		return nil, err
+	}
+	return api.NewClient(conn.(*net.UnixConn)), nil
+}
+
+// timed runs op, recording its duration and outcome under name.
+func (b *bench) timed(name string, op func() error) error {
+	start := time.Now()
+	err := op()
+	b.stats.done(name, start, err)
+	return err
+}
+
+// vm is a fake VM registered with the proxy.
+type vm struct {
+	b           *bench
+	containerID string
+	fake        *fakevm.VM
+	client      *api.Client
+}
+
+func (b *bench) startVM(i int) (*vm, error) {
+	dir := filepath.Join(b.dir, fmt.Sprintf("vm%d", i))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	ctl := filepath.Join(dir, "ctl.sock")
+	io := filepath.Join(dir, "io.sock")
+	v := &vm{
+		b:           b,
+		containerID: fmt.Sprintf("bench-container-%d", i),
+		fake: fakevm.New(fakevm.Config{
+			Ctl:        ctl,
+			Io:         io,
+			ReadyDelay: *ArgReadyDelay,
+		}),
+	}
+	if err := v.fake.Start(); err != nil {
+		return nil, err
+	}
+
+	client, err := b.dial()
+	if err != nil {
+		v.fake.Stop()
+		return nil, err
+	}
+	v.client = client
+
+	err = b.timed("hello", func() error {
+		_, err := client.Hello(v.containerID, ctl, io, nil)
+		return err
+	})
+	if err != nil {
+		v.stop()
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (v *vm) stop() {
+	v.b.timed("bye", func() error {
+		return v.client.Bye(v.containerID)
+	})
+	v.client.Close()
+	v.fake.Stop()
+}
+
+// exec runs a process, as the runtime and the shim would: its stdin is
+// written and read back, until it's closed and the process exits.
+func (v *vm) exec(data []byte) error {
+	b := v.b
+
+	client, err := b.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	err = b.timed("attach", func() error {
+		_, err := client.Attach(v.containerID, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var ioBase uint64
+	var conn net.Conn
+	err = b.timed("allocateIO", func() error {
+		var file *os.File
+		var err error
+
+		ioBase, file, err = client.AllocateIo(2)
+		if err != nil {
+			return err
+		}
+		conn, err = net.FileConn(file)
+		file.Close()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	err = b.timed("execcmd", func() error {
+		return client.Hyper(hyperstart.ExecCmd, &hyper.ExecCommand{
+			Container: v.containerID,
+			Process: hyper.Process{
+				Stdio:  ioBase,
+				Stderr: ioBase + 1,
+				Args:   []string{"cc-proxy-bench"},
+			},
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// Read concurrently: the process output can't wait for us to be done
+	// writing
+	read := make(chan error, 1)
+	go func() {
+		read <- b.readOutput(conn, ioBase, len(data))
+	}()
+
+	err = b.writeInput(conn, ioBase, data)
+	if err == nil {
+		err = <-read
+	} else {
+		conn.Close()
+		<-read
+	}
+
+	b.stats.done("exec", start, err)
+	return err
+}
+
+func (b *bench) writeInput(conn net.Conn, ioBase uint64, data []byte) error {
+	start := time.Now()
+
+	for written := 0; written < len(data); {
+		chunk := data[written:]
+		if len(chunk) > *ArgChunk {
+			chunk = chunk[:*ArgChunk]
+		}
+
+		err := hyperstart.SendIoMessageWithConn(conn, &hyper.TtyMessage{
+			Session: ioBase,
+			Message: chunk,
+		})
+		if err != nil {
+			return err
+		}
+		written += len(chunk)
+
+		if *ArgRate > 0 {
+			due := start.Add(time.Duration(written) * time.Second / time.Duration(*ArgRate))
+			time.Sleep(due.Sub(time.Now()))
+		}
+	}
+
+	// Closing stdin makes the process exit
+	return hyperstart.SendIoMessageWithConn(conn, &hyper.TtyMessage{Session: ioBase})
+}
+
+func (b *bench) readOutput(conn net.Conn, ioBase uint64, expected int) error {
+	received := 0
+	closed := false
+
+	for {
+		msg, err := hyperstart.ReadIoMessageWithConn(conn)
+		if err != nil {
+			return err
+		}
+		if msg.Session != ioBase {
+			// Nothing is written on stderr, this is its end
+			continue
+		}
+
+		switch {
+		case len(msg.Message) == 0:
+			closed = true
+		case closed:
+			if received != expected {
+				return fmt.Errorf("received %d bytes, expected %d", received, expected)
+			}
+			if msg.Message[0] != 0 {
+				return fmt.Errorf("exit status %d", msg.Message[0])
+			}
+			return nil
+		default:
+			received += len(msg.Message)
+			b.stats.addBytes(len(msg.Message))
+		}
+	}
+}
+
+// run execs processes in v, from concurrency goroutines, until the end of the
+// run.
+func (v *vm) run(concurrency int, data []byte) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-v.b.stop:
+					return
+				default:
+				}
+
+				if err := v.exec(data); err != nil {
+					// Don't spin on a broken VM
+					time.Sleep(100 * time.Millisecond)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// startProxy starts the in process proxy, returning a function stopping it.
+func (b *bench) startProxy() (func(), error) {
+	b.socketPath = filepath.Join(b.dir, "proxy.sock")
+	l, err := net.Listen("unix", b.socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []server.Option{server.WithListener(l)}
+	if *ArgEventLoop {
+		options = append(options, server.WithEventLoop())
+	}
+
+	srv, err := server.New(options...)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	served := make(chan struct{})
+	go func() {
+		srv.Serve(context.Background())
+		close(served)
+	}()
+
+	return func() {
+		srv.Shutdown(context.Background())
+		<-served
+	}, nil
+}
+
+func benchMain() error {
+	if *ArgVMs <= 0 || *ArgConcurrency <= 0 || *ArgSize < 0 || *ArgChunk <= 0 {
+		return errors.New("-vms, -concurrency and -chunk must be positive")
+	}
+	if *ArgProxySocket == "" && *ArgProxyPid != 0 {
+		return errors.New("-proxy-pid needs -proxy-socket")
+	}
+
+	dir, err := ioutil.TempDir("", "cc-proxy-bench-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	b := &bench{
+		dir:        dir,
+		socketPath: *ArgProxySocket,
+		stats:      newStats(),
+		stop:       make(chan struct{}),
+	}
+
+	sampler := &sampler{pid: os.Getpid(), inProcess: true}
+	stopProxy := func() {}
+	if *ArgProxySocket == "" {
+		if stopProxy, err = b.startProxy(); err != nil {
+			return err
+		}
+	} else {
+		sampler.pid = *ArgProxyPid
+		sampler.inProcess = false
+	}
+	// Without a pid, we don't know anything about the proxy usage
+	sampling := sampler.pid != 0
+
+	var points []string
+	var samples []sample
+	checkpoint := func(name string) {
+		if !sampling {
+			return
+		}
+		runtime.GC()
+		smp, err := sampler.sample()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sampling: %v\n", err)
+			sampling = false
+			return
+		}
+		points = append(points, name)
+		samples = append(samples, smp)
+	}
+
+	stopSampling := make(chan struct{})
+	checkpoint("start")
+	if sampling {
+		go sampler.run(*ArgSample, stopSampling)
+	}
+
+	// Register the VMs, all at once
+	vms := make([]*vm, *ArgVMs)
+	var wg sync.WaitGroup
+	for i := range vms {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			v, err := b.startVM(i)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "vm %d: %v\n", i, err)
+				return
+			}
+			vms[i] = v
+		}(i)
+	}
+	wg.Wait()
+	checkpoint("registered")
+
+	data := make([]byte, *ArgSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	start := time.Now()
+	time.AfterFunc(*ArgDuration, func() { close(b.stop) })
+	for _, v := range vms {
+		if v == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(v *vm) {
+			v.run(*ArgConcurrency, data)
+			wg.Done()
+		}(v)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	checkpoint("running")
+
+	for _, v := range vms {
+		if v != nil {
+			v.stop()
+		}
+	}
+
+	// Give the proxy a moment to notice the clients are gone
+	time.Sleep(100 * time.Millisecond)
+	checkpoint("end")
+	close(stopSampling)
+
+	stopProxy()
+
+	report(b.stats, elapsed, sampler, points, samples)
+
+	if n := b.stats.totalErrors(); n > 0 {
+		return fmt.Errorf("%d errors", n)
+	}
+	return nil
+}
+
+func report(s *stats, elapsed time.Duration, sampler *sampler, points []string, samples []sample) {
+	s.Lock()
+	execs := len(s.latencies["exec"])
+	bytes := s.bytes
+	s.Unlock()
+
+	w := os.Stdout
+	seconds := elapsed.Seconds()
+
+	fmt.Fprintf(w, "VMs: %d, concurrency: %d, size: %d bytes, duration: %v\n",
+		*ArgVMs, *ArgConcurrency, *ArgSize, elapsed)
+	fmt.Fprintf(w, "execs: %d (%.1f/s), throughput: %s/s\n\n", execs,
+		float64(execs)/seconds, mib(int64(float64(bytes)/seconds)))
+
+	s.writeLatencies(w)
+
+	if len(samples) == 0 {
+		return
+	}
+
+	// Once the VMs are gone, the proxy should be back where it started
+	first, last := samples[0], samples[len(samples)-1]
+	points = append(points, "growth")
+	samples = append(samples, sample{
+		fds:        last.fds - first.fds,
+		rss:        last.rss - first.rss,
+		goroutines: last.goroutines - first.goroutines,
+		heap:       last.heap - first.heap,
+	})
+
+	fmt.Fprintln(w)
+	sampler.writeUsage(w, points, samples)
+}
+
+func main() {
+	// Same defaults as cc-proxy
+	flag.Set("logtostderr", "true")
+	flag.Parse()
+
+	if err := benchMain(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
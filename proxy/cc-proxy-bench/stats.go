@@ -0,0 +1,255 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations whose latency is measured, in lifecycle order
+var operations = []string{"hello", "attach", "allocateIO", "execcmd", "exec", "bye"}
+
+// stats collects the outcome of the operations.
+type stats struct {
+	sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+	firstErr  map[string]error
+
+	// bytes echoed back by the exec'ed processes
+	bytes int64
+}
+
+func newStats() *stats {
+	return &stats{
+		latencies: make(map[string][]time.Duration),
+		errors:    make(map[string]int),
+		firstErr:  make(map[string]error),
+	}
+}
+
+// done records the outcome of op, started at start.
+func (s *stats) done(op string, start time.Time, err error) {
+	d := time.Since(start)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err != nil {
+		s.errors[op]++
+		if s.firstErr[op] == nil {
+			s.firstErr[op] = err
+		}
+		return
+	}
+	s.latencies[op] = append(s.latencies[op], d)
+}
+
+func (s *stats) addBytes(n int) {
+	s.Lock()
+	s.bytes += int64(n)
+	s.Unlock()
+}
+
+func (s *stats) totalErrors() int {
+	s.Lock()
+	defer s.Unlock()
+
+	total := 0
+	for _, n := range s.errors {
+		total += n
+	}
+	return total
+}
+
+// byDuration implements sort.Interface for []time.Duration.
+type byDuration []time.Duration
+
+func (a byDuration) Len() int           { return len(a) }
+func (a byDuration) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDuration) Less(i, j int) bool { return a[i] < a[j] }
+
+// percentile returns the p-th percentile of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func (s *stats) writeLatencies(w io.Writer) {
+	s.Lock()
+	defer s.Unlock()
+
+	fmt.Fprintf(w, "%-12s %8s %8s %10s %10s %10s %10s\n", "latency", "count", "errors",
+		"p50", "p90", "p99", "max")
+	for _, op := range operations {
+		l := s.latencies[op]
+		sort.Sort(byDuration(l))
+
+		fmt.Fprintf(w, "%-12s %8d %8d %10s %10s %10s %10s\n", op, len(l), s.errors[op],
+			ms(percentile(l, 50)), ms(percentile(l, 90)),
+			ms(percentile(l, 99)), ms(percentile(l, 100)))
+	}
+
+	for _, op := range operations {
+		if err := s.firstErr[op]; err != nil {
+			fmt.Fprintf(w, "first %s error: %v\n", op, err)
+		}
+	}
+}
+
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.3fms", float64(d)/float64(time.Millisecond))
+}
+
+// sample is the resource usage of the proxy at some point.
+type sample struct {
+	fds int
+	rss int64
+
+	// Only known when the proxy runs in process
+	goroutines int
+	heap       int64
+}
+
+// sampler samples the resource usage of the process pid.
+type sampler struct {
+	pid       int
+	inProcess bool
+
+	sync.Mutex
+	peak sample
+}
+
+func (s *sampler) sample() (sample, error) {
+	var smp sample
+
+	fds, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/fd", s.pid))
+	if err != nil {
+		return smp, err
+	}
+	smp.fds = len(fds)
+
+	if smp.rss, err = readRSS(s.pid); err != nil {
+		return smp, err
+	}
+
+	if s.inProcess {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		smp.goroutines = runtime.NumGoroutine()
+		smp.heap = int64(m.HeapInuse)
+	}
+
+	s.Lock()
+	if smp.fds > s.peak.fds {
+		s.peak.fds = smp.fds
+	}
+	if smp.rss > s.peak.rss {
+		s.peak.rss = smp.rss
+	}
+	if smp.goroutines > s.peak.goroutines {
+		s.peak.goroutines = smp.goroutines
+	}
+	if smp.heap > s.peak.heap {
+		s.peak.heap = smp.heap
+	}
+	s.Unlock()
+
+	return smp, nil
+}
+
+// run samples every interval, for the peak usage, until stop is closed.
+func (s *sampler) run(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sample()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// readRSS returns the resident set size of pid, in bytes.
+func readRSS(pid int) (int64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "VmRSS:" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb * 1024, nil
+	}
+
+	return 0, fmt.Errorf("no VmRSS for pid %d", pid)
+}
+
+func mib(n int64) string {
+	return fmt.Sprintf("%.1fMiB", float64(n)/(1024*1024))
+}
+
+func (s *sampler) writeUsage(w io.Writer, points []string, samples []sample) {
+	s.Lock()
+	samples = append(samples, s.peak)
+	s.Unlock()
+	points = append(points, "peak")
+
+	if s.inProcess {
+		fmt.Fprintf(w, "%-12s %8s %10s %10s %10s\n", "usage", "fds", "rss",
+			"goroutines", "heap")
+	} else {
+		fmt.Fprintf(w, "%-12s %8s %10s\n", "usage", "fds", "rss")
+	}
+
+	for i, smp := range samples {
+		if s.inProcess {
+			fmt.Fprintf(w, "%-12s %8d %10s %10d %10s\n", points[i], smp.fds,
+				mib(smp.rss), smp.goroutines, mib(smp.heap))
+		} else {
+			fmt.Fprintf(w, "%-12s %8d %10s\n", points[i], smp.fds, mib(smp.rss))
+		}
+	}
+}
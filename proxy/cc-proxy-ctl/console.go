@@ -0,0 +1,118 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+// Ctrl-], as in telnet
+const detachKey = 0x1d
+
+func ioctl(fd, request uintptr, termios *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request,
+		uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// makeRaw puts the terminal fd in raw mode, returning its previous state.
+func makeRaw(fd uintptr) (*syscall.Termios, error) {
+	var old syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, &old); err != nil {
+		return nil, err
+	}
+
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+
+	if err := ioctl(fd, syscall.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+
+	return &old, nil
+}
+
+// stdinToConsole forwards stdin to the console until the detach key is
+// pressed or stdin is closed.
+func stdinToConsole(console io.Writer, done chan<- error) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := os.Stdin.Read(buf)
+		for i := 0; i < n; i++ {
+			if buf[i] == detachKey {
+				console.Write(buf[:i])
+				done <- nil
+				return
+			}
+		}
+		if n > 0 {
+			if _, err := console.Write(buf[:n]); err != nil {
+				done <- err
+				return
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			done <- err
+			return
+		}
+	}
+}
+
+func consoleCommand(client *api.Client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: console <container>")
+	}
+
+	console, err := client.ConsoleAttach(args[0])
+	if err != nil {
+		return err
+	}
+	defer console.Close()
+
+	stdin := os.Stdin.Fd()
+	if old, err := makeRaw(stdin); err == nil {
+		defer ioctl(stdin, syscall.TCSETS, old)
+		fmt.Fprintf(os.Stderr, "Connected to %s console, Ctrl-] to detach\r\n", args[0])
+	}
+
+	done := make(chan error, 2)
+	go stdinToConsole(console, done)
+	go func() {
+		_, err := io.Copy(os.Stdout, console)
+		done <- err
+	}()
+
+	return <-done
+}
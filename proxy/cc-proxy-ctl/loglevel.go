@@ -0,0 +1,52 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"strconv"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+const logLevelUsage = "usage: log-level [-container <container>] <level>|reset"
+
+func logLevelCommand(client *api.Client, args []string) error {
+	flags := flag.NewFlagSet("log-level", flag.ContinueOnError)
+	containerID := flags.String("container", "", "only change the log level of that VM")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New(logLevelUsage)
+	}
+
+	options := &api.SetLogLevelOptions{
+		ContainerID: *containerID,
+	}
+
+	if flags.Arg(0) == "reset" {
+		options.Reset = true
+		return client.SetLogLevel(0, options)
+	}
+
+	level, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		return errors.New(logLevelUsage)
+	}
+
+	return client.SetLogLevel(level, options)
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// cc-proxy-ctl is a small tool to inspect and debug a running cc-proxy.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+// DefaultSocketPath is populated at link time with the value of:
+//   ${locatestatedir}/run/cc-oci-runtime/proxy.sock
+var DefaultSocketPath string
+
+// ArgSocketPath is populated at runtime from the option -socket-path
+var ArgSocketPath = flag.String("socket-path", "", "path to the proxy socket")
+
+type command struct {
+	usage string
+	help  string
+	run   func(client *api.Client, args []string) error
+}
+
+var commands = map[string]*command{
+	"console": {
+		usage: "console <container>",
+		help:  "attach to the VM console, Ctrl-] to detach",
+		run:   consoleCommand,
+	},
+	"log-level": {
+		usage: "log-level [-container <container>] <level>|reset",
+		help:  "change the log level, globally or for a single VM",
+		run:   logLevelCommand,
+	},
+	"tap": {
+		usage: "tap [-data] <container>",
+		help:  "display the traffic between the proxy and hyperstart",
+		run:   tapCommand,
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] <command> [arguments]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-24s %s\n", commands[name].usage, commands[name].help)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+func connect() (*api.Client, error) {
+	socketPath := DefaultSocketPath
+	if *ArgSocketPath != "" {
+		socketPath = *ArgSocketPath
+	}
+	if socketPath == "" {
+		return nil, fmt.Errorf("no proxy socket path, use -socket-path")
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return api.NewClient(conn.(*net.UnixConn)), nil
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	cmd := commands[flag.Arg(0)]
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n", flag.Arg(0))
+		usage()
+		os.Exit(1)
+	}
+
+	client, err := connect()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "couldn't connect to the proxy:", err)
+		os.Exit(1)
+	}
+
+	err = cmd.run(client, flag.Args()[1:])
+	client.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
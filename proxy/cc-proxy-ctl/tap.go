@@ -0,0 +1,101 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+func formatTapFrame(frame *api.TapFrame) string {
+	t := frame.Time
+	if parsed, err := time.Parse(time.RFC3339Nano, frame.Time); err == nil {
+		t = parsed.Local().Format("15:04:05.000000")
+	}
+
+	dir := "->"
+	if frame.Direction == api.TapFromVM {
+		dir = "<-"
+	}
+
+	var what string
+	switch frame.Channel {
+	case api.TapChannelCtl:
+		what = fmt.Sprintf("%s (%d bytes)", frame.Cmd, frame.Length)
+	case api.TapChannelSession:
+		what = fmt.Sprintf("ioBase %d, %d streams", frame.Seq, frame.Length)
+	default:
+		what = fmt.Sprintf("seq %d (%d bytes)", frame.Seq, frame.Length)
+	}
+
+	s := fmt.Sprintf("%s %-7s %s %s", t, frame.Channel, dir, what)
+	if frame.Dropped > 0 {
+		s += fmt.Sprintf(" [%d frames dropped]", frame.Dropped)
+	}
+	if len(frame.Data) == 0 {
+		return s
+	}
+
+	// Control messages are JSON, I/O data can be anything
+	if frame.Channel == api.TapChannelCtl {
+		return s + "\n  " + string(frame.Data)
+	}
+	return s + "\n" + hex.Dump(frame.Data)
+}
+
+func tapCommand(client *api.Client, args []string) error {
+	flags := flag.NewFlagSet("tap", flag.ContinueOnError)
+	data := flags.Bool("data", false, "display the data of each frame")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: tap [-data] <container>")
+	}
+
+	err := client.Tap(&api.TapOptions{
+		ContainerID: flags.Arg(0),
+		Data:        *data,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		notification, err := client.WaitNotification()
+		if err != nil {
+			return err
+		}
+
+		switch notification.ID {
+		case "tapFrame":
+			frame := api.TapFrame{}
+			if err := json.Unmarshal(notification.Data, &frame); err != nil {
+				return err
+			}
+			fmt.Println(formatTapFrame(&frame))
+		case "vmLost":
+			vmLost := api.VMLost{}
+			json.Unmarshal(notification.Data, &vmLost)
+			fmt.Printf("vm lost (%s)\n", vmLost.Reason)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// cc-proxy-replay replays a recording made by cc-proxy -record-dir, either
+// directly on hyperstart's sockets or through a running proxy.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/01org/cc-oci-runtime/proxy/record"
+	"github.com/containers/virtcontainers/hyperstart"
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+)
+
+// Command line options
+var (
+	ArgCtl        = flag.String("ctl", "", "path to the hyperstart ctl socket")
+	ArgIo         = flag.String("io", "", "path to the hyperstart io socket")
+	ArgSocketPath = flag.String("socket-path", "",
+		"replay through the proxy listening on this socket instead of talking to hyperstart directly")
+	ArgContainerID = flag.String("container-id", "",
+		"container ID used when registering the VM to the proxy")
+	ArgSpeed = flag.Float64("speed", 0,
+		"replay speed factor, 1 for the recorded pace, 0 for as fast as possible")
+	ArgDump    = flag.Bool("dump", false, "print the frames of the recording and exit")
+	ArgVerbose = flag.Bool("v", false, "print the frames while replaying them")
+)
+
+// proxyTarget replays a recording through the proxy: control commands are
+// sent with the hyper payload and I/O data through allocated I/O sessions.
+type proxyTarget struct {
+	client *api.Client
+
+	// I/O sessions, hashed by sequence numbers
+	sessions map[uint64]net.Conn
+}
+
+func (t *proxyTarget) Session(ioBase uint64, nStreams int) error {
+	base, file, err := t.client.AllocateIo(nStreams)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.FileConn(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	// The proxy allocates sequence numbers in order, so we end up with
+	// the recorded ones as long as the recording started with the VM.
+	if base != ioBase {
+		conn.Close()
+		return fmt.Errorf("recorded ioBase %d, got %d", ioBase, base)
+	}
+
+	for i := 0; i < nStreams; i++ {
+		t.sessions[ioBase+uint64(i)] = conn
+	}
+
+	// We don't check the process output, but still need to read it
+	go io.Copy(ioutil.Discard, conn)
+
+	return nil
+}
+
+func (t *proxyTarget) Ctl(code uint32, data []byte) (uint32, error) {
+	var msg interface{}
+	if len(data) > 0 {
+		msg = json.RawMessage(data)
+	}
+
+	if err := t.client.Hyper(record.CmdName(code), msg); err != nil {
+		return hyper.INIT_ERROR, nil
+	}
+	return hyper.INIT_ACK, nil
+}
+
+func (t *proxyTarget) Io(seq uint64, data []byte) error {
+	conn := t.sessions[seq]
+	if conn == nil {
+		return fmt.Errorf("no I/O session for seq %d", seq)
+	}
+
+	return hyperstart.SendIoMessageWithConn(conn, &hyper.TtyMessage{
+		Session: seq,
+		Message: data,
+	})
+}
+
+func (t *proxyTarget) Close() {
+	for _, conn := range t.sessions {
+		conn.Close()
+	}
+	t.client.Close()
+}
+
+func newProxyTarget(socketPath, containerID, ctl, io string) (*proxyTarget, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	client := api.NewClient(conn.(*net.UnixConn))
+	if _, err := client.Hello(containerID, ctl, io, nil); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &proxyTarget{
+		client:   client,
+		sessions: make(map[uint64]net.Conn),
+	}, nil
+}
+
+func dump(path string) error {
+	r, err := record.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for {
+		frame, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println(frame)
+	}
+}
+
+func replay(path string) (*record.Result, error) {
+	if *ArgCtl == "" || *ArgIo == "" {
+		return nil, fmt.Errorf("-ctl and -io are needed to replay a recording")
+	}
+
+	r, err := record.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var target record.Target
+	if *ArgSocketPath != "" {
+		containerID := *ArgContainerID
+		if containerID == "" {
+			containerID = fmt.Sprintf("cc-proxy-replay-%d", os.Getpid())
+		}
+		t, err := newProxyTarget(*ArgSocketPath, containerID, *ArgCtl, *ArgIo)
+		if err != nil {
+			return nil, err
+		}
+		defer t.Close()
+		target = t
+	} else {
+		h := hyperstart.NewHyperstart(*ArgCtl, *ArgIo, "unix")
+		if err := h.OpenSockets(); err != nil {
+			return nil, err
+		}
+		defer h.CloseSockets()
+		if err := h.WaitForReady(); err != nil {
+			return nil, err
+		}
+		target = record.NewHyperstartTarget(h)
+	}
+
+	options := &record.Options{
+		Speed: *ArgSpeed,
+	}
+	if *ArgVerbose {
+		options.OnFrame = func(frame *record.Frame) {
+			fmt.Println(frame)
+		}
+	}
+
+	return record.Replay(r, target, options)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <recording>\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *ArgDump {
+		if err := dump(flag.Arg(0)); err != nil {
+			fmt.Fprintln(os.Stderr, "dump:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	result, err := replay(flag.Arg(0))
+	if result != nil {
+		fmt.Printf("%d frames read, %d replayed\n", result.Frames, result.Replayed)
+		for _, mismatch := range result.Mismatches {
+			fmt.Println("mismatch:", mismatch.String())
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		os.Exit(1)
+	}
+	if len(result.Mismatches) > 0 {
+		os.Exit(2)
+	}
+}
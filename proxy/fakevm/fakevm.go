@@ -0,0 +1,467 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fakevm implements a fake Clear Containers VM. It listens on the ctl
+// and io channels the way qemu does for a VM and plays hyperstart on them:
+// READY is sent once the proxy connects, commands are acknowledged and the
+// container processes are simulated from a Script.
+//
+// It speaks the same protocol as the hyperstart mock of virtcontainers
+// (hyperstart/mock), which can only be used from go test, and can be embedded
+// in any program, eg. cc-fake-vm.
+package fakevm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/record"
+	"github.com/containers/virtcontainers/hyperstart"
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+)
+
+const (
+	ctlHeaderSize = 8
+	ioHeaderSize  = 12
+
+	// Maximum size of a message, header included, hyperstart exchanges.
+	// That limit is from hyperstart src/init.c, hyper_channel_ops,
+	// rbuf_size.
+	maxMessageSize = 10240
+)
+
+// Config describes a fake VM.
+type Config struct {
+	// Ctl and Io are the endpoints of the hyperstart channels, a socket
+	// path or unix:<path> for AF_UNIX sockets, tcp:<host>:<port> for TCP.
+	Ctl, Io string
+
+	// Console is the optional endpoint of the VM console, where the VM
+	// writes its boot messages and the life of processes.
+	Console string
+
+	// Script decides how the processes behave.
+	Script *Script
+
+	// ReadyDelay is how long the VM takes to send READY once the ctl
+	// channel is connected, to simulate the boot time.
+	ReadyDelay time.Duration
+
+	// Log, if not nil, is given a line for each event of the VM.
+	Log func(format string, a ...interface{})
+}
+
+// VM is a fake VM. Each of its channels accepts a single connection, as qemu
+// does.
+type VM struct {
+	config Config
+
+	ctlListener, ioListener, consoleListener net.Listener
+
+	sync.Mutex
+	ctl, io, console net.Conn
+	ioConnected      chan struct{}
+	ioConnectedOnce  sync.Once
+	consoleConnected chan struct{}
+
+	// ioLock serializes the writes on io, messages of different
+	// processes can't be interleaved
+	ioLock sync.Mutex
+
+	// processes are hashed by the sequence number of their stdio stream
+	processes map[uint64]*process
+
+	// commands received, see Commands
+	commands []hyper.DecodedMessage
+
+	stopping chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// New creates a fake VM. It doesn't listen until Start is called.
+func New(config Config) *VM {
+	if config.Script == nil {
+		config.Script = &Script{}
+	}
+
+	return &VM{
+		config:           config,
+		ioConnected:      make(chan struct{}),
+		consoleConnected: make(chan struct{}),
+		processes:        make(map[uint64]*process),
+		stopping:         make(chan struct{}),
+	}
+}
+
+// listen listens on the endpoint s, in the proxy endpoint syntax.
+func listen(s string) (net.Listener, error) {
+	network, address := "unix", s
+	if i := strings.Index(s, ":"); i >= 0 && !strings.HasPrefix(s, "/") {
+		network, address = s[:i], s[i+1:]
+	}
+
+	switch network {
+	case "unix":
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	case "tcp":
+	default:
+		return nil, fmt.Errorf("%s: unsupported transport '%s'", s, network)
+	}
+
+	return net.Listen(network, address)
+}
+
+func (vm *VM) logf(format string, a ...interface{}) {
+	if vm.config.Log != nil {
+		vm.config.Log(format, a...)
+	}
+}
+
+// consolef writes a line on the console, if connected.
+func (vm *VM) consolef(format string, a ...interface{}) {
+	vm.Lock()
+	console := vm.console
+	vm.Unlock()
+
+	if console != nil {
+		fmt.Fprintf(console, format+"\n", a...)
+	}
+}
+
+// Start listens on the VM channels and serves them in the background.
+func (vm *VM) Start() error {
+	var err error
+
+	if vm.config.Console != "" {
+		if vm.consoleListener, err = listen(vm.config.Console); err != nil {
+			return err
+		}
+	}
+	if vm.ctlListener, err = listen(vm.config.Ctl); err != nil {
+		vm.closeListeners()
+		return err
+	}
+	if vm.ioListener, err = listen(vm.config.Io); err != nil {
+		vm.closeListeners()
+		return err
+	}
+
+	if vm.consoleListener != nil {
+		vm.accept(vm.consoleListener, &vm.console, func(conn net.Conn) {
+			vm.consolef("fake VM booting")
+			close(vm.consoleConnected)
+		})
+	}
+	vm.accept(vm.ctlListener, &vm.ctl, vm.serveCtl)
+	vm.accept(vm.ioListener, &vm.io, func(conn net.Conn) {
+		vm.ioConnectedOnce.Do(func() { close(vm.ioConnected) })
+		vm.serveIo(conn)
+	})
+
+	return nil
+}
+
+// accept accepts a single connection on l, stored in *conn and handled by
+// serve.
+func (vm *VM) accept(l net.Listener, conn *net.Conn, serve func(conn net.Conn)) {
+	vm.wg.Add(1)
+	go func() {
+		defer vm.wg.Done()
+
+		c, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return
+		}
+		vm.logf("%s: connected", l.Addr())
+
+		// Stop closes the connections it knows about
+		vm.Lock()
+		select {
+		case <-vm.stopping:
+			vm.Unlock()
+			c.Close()
+			return
+		default:
+		}
+		*conn = c
+		vm.Unlock()
+
+		serve(c)
+	}()
+}
+
+// ConsoleConnected returns a channel closed once the console connection has
+// been accepted and the boot message written on it. Lines written before are
+// lost, as nobody is there to read them.
+func (vm *VM) ConsoleConnected() <-chan struct{} {
+	return vm.consoleConnected
+}
+
+func (vm *VM) closeListeners() {
+	for _, l := range []net.Listener{vm.ctlListener, vm.ioListener, vm.consoleListener} {
+		if l != nil {
+			l.Close()
+		}
+	}
+}
+
+// Stop shuts the VM down: processes are terminated, as killed by SIGKILL, and
+// the channels are closed, which the proxy sees as the VM being lost.
+func (vm *VM) Stop() {
+	vm.stopOnce.Do(func() {
+		close(vm.stopping)
+		vm.closeListeners()
+
+		vm.killProcesses("", 9)
+
+		vm.Lock()
+		for _, conn := range []net.Conn{vm.ctl, vm.io, vm.console} {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+		vm.Unlock()
+	})
+
+	vm.wg.Wait()
+}
+
+// Commands returns the commands received since the VM started or the last
+// call to Commands, older first.
+func (vm *VM) Commands() []hyper.DecodedMessage {
+	vm.Lock()
+	defer vm.Unlock()
+
+	commands := vm.commands
+	vm.commands = nil
+	return commands
+}
+
+//
+// ctl channel
+//
+
+func writeCtlMessage(conn net.Conn, code uint32, data []byte) error {
+	length := ctlHeaderSize + len(data)
+	msg := make([]byte, length)
+	binary.BigEndian.PutUint32(msg, code)
+	binary.BigEndian.PutUint32(msg[4:], uint32(length))
+	copy(msg[ctlHeaderSize:], data)
+
+	_, err := conn.Write(msg)
+	return err
+}
+
+// next acknowledges the reception of n bytes, as hyperstart does.
+func next(conn net.Conn, n int) error {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(n))
+	return writeCtlMessage(conn, hyper.INIT_NEXT, data)
+}
+
+func readCtlMessage(conn net.Conn) (*hyper.DecodedMessage, error) {
+	header := make([]byte, ctlHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if err := next(conn, len(header)); err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint32(header[4:]))
+	if length < ctlHeaderSize || length > maxMessageSize {
+		return nil, fmt.Errorf("invalid message length %d", length)
+	}
+
+	msg := &hyper.DecodedMessage{
+		Code:    binary.BigEndian.Uint32(header),
+		Message: make([]byte, length-ctlHeaderSize),
+	}
+	if len(msg.Message) == 0 {
+		return msg, nil
+	}
+
+	if _, err := io.ReadFull(conn, msg.Message); err != nil {
+		return nil, err
+	}
+	if err := next(conn, len(msg.Message)); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (vm *VM) serveCtl(conn net.Conn) {
+	select {
+	case <-time.After(vm.config.ReadyDelay):
+	case <-vm.stopping:
+		return
+	}
+
+	vm.consolef("fake VM ready")
+	if err := writeCtlMessage(conn, hyper.INIT_READY, nil); err != nil {
+		return
+	}
+
+	for {
+		msg, err := readCtlMessage(conn)
+		if err != nil {
+			if err != io.EOF {
+				vm.logf("ctl: %v", err)
+			}
+			return
+		}
+
+		vm.Lock()
+		vm.commands = append(vm.commands, *msg)
+		vm.Unlock()
+
+		name := record.CmdName(msg.Code)
+		vm.logf("ctl: --> %s %s", name, msg.Message)
+
+		code := uint32(hyper.INIT_ACK)
+		if err := vm.handleCommand(name, msg.Message); err != nil {
+			vm.logf("ctl: <-- %s failed: %v", name, err)
+			code = hyper.INIT_ERROR
+		}
+
+		if err := writeCtlMessage(conn, code, nil); err != nil {
+			return
+		}
+	}
+}
+
+func (vm *VM) handleCommand(name string, data []byte) error {
+	if _, ok := record.CmdCode(name); !ok {
+		return fmt.Errorf("unknown command")
+	}
+	if vm.config.Script.fails(name) {
+		return fmt.Errorf("%s scripted to fail", name)
+	}
+
+	switch name {
+	case hyperstart.StartPod:
+		pod := hyper.Pod{}
+		if err := json.Unmarshal(data, &pod); err != nil {
+			return err
+		}
+		for _, c := range pod.Containers {
+			vm.startProcess(c.Id, &c.Process)
+		}
+	case hyperstart.NewContainer:
+		c := hyper.Container{}
+		if err := json.Unmarshal(data, &c); err != nil {
+			return err
+		}
+		vm.startProcess(c.Id, &c.Process)
+	case hyperstart.ExecCmd:
+		exec := hyper.ExecCommand{}
+		if err := json.Unmarshal(data, &exec); err != nil {
+			return err
+		}
+		vm.startProcess(exec.Container, &exec.Process)
+	case hyperstart.KillContainer:
+		kill := hyper.KillCommand{}
+		if err := json.Unmarshal(data, &kill); err != nil {
+			return err
+		}
+		vm.killProcesses(kill.Container, int(kill.Signal))
+	case hyperstart.DestroyPod:
+		vm.killProcesses("", 9)
+	}
+
+	return nil
+}
+
+//
+// io channel
+//
+
+// SendIo sends data on the stream seq. An empty data closes the stream.
+func (vm *VM) SendIo(seq uint64, data []byte) error {
+	select {
+	case <-vm.ioConnected:
+	case <-vm.stopping:
+		return fmt.Errorf("VM stopped")
+	}
+
+	vm.ioLock.Lock()
+	defer vm.ioLock.Unlock()
+
+	for {
+		chunk := data
+		if len(chunk) > maxMessageSize-ioHeaderSize {
+			chunk = chunk[:maxMessageSize-ioHeaderSize]
+		}
+
+		err := hyperstart.SendIoMessageWithConn(vm.io, &hyper.TtyMessage{
+			Session: seq,
+			Message: chunk,
+		})
+		if err != nil {
+			return err
+		}
+
+		data = data[len(chunk):]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// CloseIo closes the stream seq.
+func (vm *VM) CloseIo(seq uint64) error {
+	return vm.SendIo(seq, nil)
+}
+
+// SendExitStatus sends the exit status of the process whose stdio stream is
+// seq. The stream should have been closed with CloseIo first.
+func (vm *VM) SendExitStatus(seq uint64, status uint8) error {
+	return vm.SendIo(seq, []byte{status})
+}
+
+func (vm *VM) serveIo(conn net.Conn) {
+	for {
+		msg, err := hyperstart.ReadIoMessageWithConn(conn)
+		if err != nil {
+			if err != io.EOF {
+				vm.logf("io: %v", err)
+			}
+			return
+		}
+
+		vm.logf("io: --> %d bytes for seq %d", len(msg.Message), msg.Session)
+
+		vm.Lock()
+		p := vm.processes[msg.Session]
+		vm.Unlock()
+		if p == nil {
+			vm.logf("io: no process for seq %d", msg.Session)
+			continue
+		}
+
+		p.input(msg.Message)
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakevm
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/virtcontainers/hyperstart"
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+	"github.com/stretchr/testify/assert"
+)
+
+type testVM struct {
+	t   *testing.T
+	dir string
+	vm  *VM
+	h   *hyperstart.Hyperstart
+}
+
+// startTestVM starts a VM with script and connects a hyperstart client, the
+// proxy side, to it.
+func startTestVM(t *testing.T, script *Script, console bool) *testVM {
+	dir, err := ioutil.TempDir("", "fakevm-test-")
+	assert.Nil(t, err)
+
+	config := Config{
+		Ctl:    filepath.Join(dir, "ctl"),
+		Io:     filepath.Join(dir, "io"),
+		Script: script,
+		Log:    t.Logf,
+	}
+	if console {
+		config.Console = filepath.Join(dir, "console")
+	}
+
+	vm := New(config)
+	assert.Nil(t, vm.Start())
+
+	return &testVM{
+		t:   t,
+		dir: dir,
+		vm:  vm,
+		h:   hyperstart.NewHyperstart(config.Ctl, config.Io, "unix"),
+	}
+}
+
+func (v *testVM) connect() {
+	assert.Nil(v.t, v.h.OpenSockets())
+	assert.Nil(v.t, v.h.WaitForReady())
+}
+
+func (v *testVM) stop() {
+	v.vm.Stop()
+	v.h.CloseSockets()
+	os.RemoveAll(v.dir)
+}
+
+func (v *testVM) newContainer(id string, stdio, stderr uint64, args ...string) error {
+	data, err := json.Marshal(&hyper.Container{
+		Id: id,
+		Process: hyper.Process{
+			Stdio:  stdio,
+			Stderr: stderr,
+			Args:   args,
+		},
+	})
+	assert.Nil(v.t, err)
+
+	_, err = v.h.SendCtlMessage(hyperstart.NewContainer, data)
+	return err
+}
+
+// readIo reads an io message, failing the test if seq doesn't match.
+func (v *testVM) readIo(seq uint64) []byte {
+	msg, err := v.h.ReadIoMessage()
+	assert.Nil(v.t, err)
+	if msg == nil {
+		return nil
+	}
+	assert.Equal(v.t, seq, msg.Session)
+	return msg.Message
+}
+
+// readExit reads the end of a process: the stream closing then the exit
+// status.
+func (v *testVM) readExit(seq uint64) uint8 {
+	assert.Len(v.t, v.readIo(seq), 0)
+	status := v.readIo(seq)
+	assert.Len(v.t, status, 1)
+	if len(status) != 1 {
+		return 0
+	}
+	return status[0]
+}
+
+func TestScriptedProcess(t *testing.T) {
+	v := startTestVM(t, &Script{
+		Processes: []ProcessScript{
+			{Args: []string{"/bin/false"}, ExitCode: 1},
+			{Args: []string{"/bin/sh", "-c"}, Stdout: "out", Stderr: "err", ExitCode: 3},
+		},
+	}, false)
+	defer v.stop()
+	v.connect()
+
+	// Output on stdout and stderr, then exit
+	assert.Nil(t, v.newContainer("c1", 1, 2, "/bin/sh", "-c", "true"))
+	assert.Equal(t, []byte("out"), v.readIo(1))
+	assert.Equal(t, []byte("err"), v.readIo(2))
+	assert.Len(t, v.readIo(2), 0)
+	assert.Equal(t, uint8(3), v.readExit(1))
+
+	// stderr multiplexed on stdio
+	assert.Nil(t, v.newContainer("c2", 3, 0, "/bin/false", "-x"))
+	assert.Equal(t, uint8(1), v.readExit(3))
+
+	commands := v.vm.Commands()
+	assert.Len(t, commands, 2)
+	assert.Len(t, v.vm.Commands(), 0)
+}
+
+func TestEchoProcess(t *testing.T) {
+	v := startTestVM(t, nil, false)
+	defer v.stop()
+	v.connect()
+
+	assert.Nil(t, v.newContainer("c1", 1, 2, "/bin/cat"))
+
+	for _, data := range []string{"foo", "bar"} {
+		err := v.h.SendIoMessage(&hyper.TtyMessage{Session: 1, Message: []byte(data)})
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(data), v.readIo(1))
+	}
+
+	// Closing stdin terminates the process
+	err := v.h.SendIoMessage(&hyper.TtyMessage{Session: 1})
+	assert.Nil(t, err)
+	assert.Len(t, v.readIo(2), 0)
+	assert.Equal(t, uint8(0), v.readExit(1))
+}
+
+func TestKillProcess(t *testing.T) {
+	v := startTestVM(t, &Script{
+		Processes: []ProcessScript{{Sleep: "1h"}},
+	}, false)
+	defer v.stop()
+	v.connect()
+
+	assert.Nil(t, v.newContainer("c1", 1, 0, "/bin/sleep"))
+
+	data, err := json.Marshal(&hyper.KillCommand{Container: "c1", Signal: 15})
+	assert.Nil(t, err)
+	_, err = v.h.SendCtlMessage(hyperstart.KillContainer, data)
+	assert.Nil(t, err)
+
+	assert.Equal(t, uint8(128+15), v.readExit(1))
+}
+
+func TestFailCommand(t *testing.T) {
+	v := startTestVM(t, &Script{Fail: []string{hyperstart.NewContainer}}, false)
+	defer v.stop()
+	v.connect()
+
+	assert.NotNil(t, v.newContainer("c1", 1, 0, "/bin/true"))
+
+	// The VM is still usable
+	_, err := v.h.SendCtlMessage(hyperstart.Ping, nil)
+	assert.Nil(t, err)
+}
+
+func TestSendIo(t *testing.T) {
+	v := startTestVM(t, nil, false)
+	defer v.stop()
+	v.connect()
+
+	// Big messages are split to what hyperstart can handle
+	data := make([]byte, 2*maxMessageSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	assert.Nil(t, v.vm.SendIo(5, data))
+
+	var received []byte
+	for len(received) < len(data) {
+		msg := v.readIo(5)
+		assert.True(t, len(msg) <= maxMessageSize-ioHeaderSize)
+		received = append(received, msg...)
+	}
+	assert.Equal(t, data, received)
+}
+
+func TestConsole(t *testing.T) {
+	v := startTestVM(t, &Script{
+		Processes: []ProcessScript{{ExitCode: 2}},
+	}, true)
+	defer v.stop()
+
+	console, err := net.Dial("unix", v.vm.config.Console)
+	assert.Nil(t, err)
+	defer console.Close()
+	lines := bufio.NewScanner(console)
+
+	// Get the VM ready once the console is connected, not to lose the
+	// lines written before
+	<-v.vm.ConsoleConnected()
+	v.connect()
+	assert.Nil(t, v.newContainer("c1", 1, 0, "/bin/true"))
+	v.readExit(1)
+
+	for _, expected := range []string{
+		"fake VM booting",
+		"fake VM ready",
+		"container c1: started /bin/true",
+		"container c1: /bin/true exited with status 2",
+	} {
+		assert.True(t, lines.Scan())
+		assert.Equal(t, expected, lines.Text())
+	}
+}
+
+func TestStop(t *testing.T) {
+	v := startTestVM(t, &Script{
+		Processes: []ProcessScript{{Sleep: "1h"}},
+	}, false)
+	defer v.stop()
+	v.connect()
+
+	assert.Nil(t, v.newContainer("c1", 1, 0, "/bin/sleep"))
+
+	done := make(chan struct{})
+	go func() {
+		v.vm.Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop didn't terminate the processes")
+	}
+
+	// The proxy sees the VM going away
+	_, err := v.h.ReadIoMessage()
+	assert.NotNil(t, err)
+	assert.NotNil(t, v.vm.SendIo(1, []byte("foo")))
+}
+
+func TestLoadScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakevm-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		script string
+		valid  bool
+	}{
+		{`{"processes": [{"args": ["/bin/sh"], "stdout": "foo", "exitCode": 1}]}`, true},
+		{`{"fail": ["killcontainer"]}`, true},
+		{`{"processes": [{"sleep": "forever"}]}`, false},
+		{`{"processes": `, false},
+	}
+
+	path := filepath.Join(dir, "script.json")
+	for _, test := range tests {
+		err := ioutil.WriteFile(path, []byte(test.script), 0644)
+		assert.Nil(t, err)
+
+		script, err := LoadScript(path)
+		if test.valid {
+			assert.Nil(t, err)
+			assert.NotNil(t, script)
+		} else {
+			assert.NotNil(t, err, test.script)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	script := &Script{
+		Processes: []ProcessScript{
+			{Args: []string{"/bin/sh", "-c"}, ExitCode: 1},
+			{Args: []string{"/bin/sh"}, ExitCode: 2},
+			{ExitCode: 3},
+		},
+	}
+
+	assert.Equal(t, uint8(1), script.match([]string{"/bin/sh", "-c", "ls"}).ExitCode)
+	assert.Equal(t, uint8(2), script.match([]string{"/bin/sh"}).ExitCode)
+	assert.Equal(t, uint8(3), script.match([]string{"/bin/ls"}).ExitCode)
+	assert.True(t, (&Script{}).match([]string{"/bin/ls"}).Echo)
+}
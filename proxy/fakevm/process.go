@@ -0,0 +1,268 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakevm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+)
+
+// ProcessScript describes how the processes started with given arguments
+// behave.
+type ProcessScript struct {
+	// Args is matched against the beginning of the process arguments,
+	// an empty Args matches every process.
+	Args []string `json:"args,omitempty"`
+
+	// Stdout and Stderr are written on the process output streams when
+	// it starts.
+	Stdout string `json:"stdout,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+
+	// Echo makes the process write its stdin back on stdout, until stdin
+	// is closed.
+	Echo bool `json:"echo,omitempty"`
+
+	// Sleep is how long the process runs, after writing its output, eg.
+	// "2s".
+	Sleep string `json:"sleep,omitempty"`
+
+	// ExitCode is the exit status of the process.
+	ExitCode uint8 `json:"exitCode,omitempty"`
+}
+
+// Script decides how the VM processes behave. A process runs the first entry
+// of Processes matching its arguments and, if none does, echoes its stdin
+// until it's closed, as cat would.
+type Script struct {
+	Processes []ProcessScript `json:"processes,omitempty"`
+
+	// Fail lists the hyperstart commands, eg. "killcontainer", answered
+	// with an error.
+	Fail []string `json:"fail,omitempty"`
+}
+
+// defaultProcess is what processes not matching any script entry do.
+var defaultProcess = ProcessScript{Echo: true}
+
+// LoadScript reads a JSON script file.
+func LoadScript(path string) (*Script, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	script := &Script{}
+	if err := json.Unmarshal(data, script); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := script.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return script, nil
+}
+
+func (s *Script) validate() error {
+	for i, p := range s.Processes {
+		if _, err := p.sleepDuration(); err != nil {
+			return fmt.Errorf("process %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *ProcessScript) sleepDuration() (time.Duration, error) {
+	if p.Sleep == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(p.Sleep)
+}
+
+func (s *Script) fails(cmd string) bool {
+	for _, f := range s.Fail {
+		if f == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the script of a process started with args.
+func (s *Script) match(args []string) *ProcessScript {
+	for i := range s.Processes {
+		p := &s.Processes[i]
+		if len(p.Args) > len(args) {
+			continue
+		}
+
+		matched := true
+		for j := range p.Args {
+			if p.Args[j] != args[j] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return p
+		}
+	}
+
+	return &defaultProcess
+}
+
+// process is a running process of the VM.
+type process struct {
+	vm        *VM
+	container string
+	args      []string
+	script    *ProcessScript
+
+	// Sequence numbers of the process streams, stderr is 0 when it's
+	// multiplexed with stdout
+	stdio, stderr uint64
+
+	stdin chan []byte
+
+	// killed receives the signal terminating the process
+	killed chan int
+}
+
+func (vm *VM) startProcess(container string, p *hyper.Process) {
+	proc := &process{
+		vm:        vm,
+		container: container,
+		args:      p.Args,
+		script:    vm.config.Script.match(p.Args),
+		stdio:     p.Stdio,
+		stderr:    p.Stderr,
+		stdin:     make(chan []byte, 16),
+		killed:    make(chan int, 1),
+	}
+
+	vm.Lock()
+	vm.processes[proc.stdio] = proc
+	vm.Unlock()
+
+	vm.logf("container %s: starting %v (stdio=%d, stderr=%d)", container, p.Args,
+		p.Stdio, p.Stderr)
+	vm.consolef("container %s: started %s", container, strings.Join(p.Args, " "))
+
+	vm.wg.Add(1)
+	go func() {
+		proc.run()
+		vm.wg.Done()
+	}()
+}
+
+// killProcesses kills the processes of container, or all of them if container
+// is empty, with signal.
+func (vm *VM) killProcesses(container string, signal int) {
+	vm.Lock()
+	defer vm.Unlock()
+
+	for _, p := range vm.processes {
+		if container != "" && p.container != container {
+			continue
+		}
+
+		select {
+		case p.killed <- signal:
+		default:
+		}
+	}
+}
+
+// input gives data received on the process stdin.
+func (p *process) input(data []byte) {
+	if !p.script.Echo {
+		return
+	}
+
+	select {
+	case p.stdin <- data:
+	case <-p.vm.stopping:
+	}
+}
+
+func (p *process) run() {
+	vm := p.vm
+	status := p.script.ExitCode
+
+	stderr := p.stderr
+	if stderr == 0 {
+		stderr = p.stdio
+	}
+
+	if p.script.Stdout != "" {
+		vm.SendIo(p.stdio, []byte(p.script.Stdout))
+	}
+	if p.script.Stderr != "" {
+		vm.SendIo(stderr, []byte(p.script.Stderr))
+	}
+
+	var sleep <-chan time.Time
+	if d, err := p.script.sleepDuration(); err != nil {
+		vm.logf("container %s: %v", p.container, err)
+	} else if d > 0 {
+		sleep = time.After(d)
+	}
+
+	for running := p.script.Echo || sleep != nil; running; {
+		select {
+		case data := <-p.stdin:
+			// An empty message closes stdin
+			if len(data) == 0 {
+				if sleep == nil {
+					running = false
+				}
+				continue
+			}
+			vm.SendIo(p.stdio, data)
+		case <-sleep:
+			running = false
+		case signal := <-p.killed:
+			status = uint8(128 + signal)
+			running = false
+		}
+	}
+
+	vm.Lock()
+	delete(vm.processes, p.stdio)
+	vm.Unlock()
+
+	vm.logf("container %s: %v exited with status %d", p.container, p.args, status)
+	vm.consolef("container %s: %s exited with status %d", p.container,
+		strings.Join(p.args, " "), status)
+
+	// Stop or a broken io channel, no one to tell
+	select {
+	case <-vm.stopping:
+		return
+	default:
+	}
+
+	if p.stderr != 0 {
+		vm.CloseIo(p.stderr)
+	}
+	vm.CloseIo(p.stdio)
+	vm.SendExitStatus(p.stdio, status)
+}
@@ -12,19 +12,21 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+// Package fdleak detects file descriptor leaks, comparing the fds opened by
+// the process at different points of a test.
+package fdleak
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"syscall"
-	"testing"
+	"time"
 )
 
 func fcntl(fd int, cmd int, arg int) (val int, err error) {
@@ -125,9 +127,32 @@ func NewFdLeadDetector() *FdLeakDetector {
 
 const selfFdPath = "/proc/self/fd"
 
+// runFinalizers runs the finalizers of the unreachable objects. Files and
+// sockets garbage collected without being closed are closed by finalizers, and
+// would otherwise disappear from a later snapshot at some random point.
+func runFinalizers() {
+	runtime.GC()
+
+	// Finalizers are run one at a time, in the order objects are found
+	// unreachable: once the sentinel is finalized, the ones before it are
+	// done.
+	done := make(chan struct{})
+	sentinel := &struct{ pad [64]byte }{}
+	runtime.SetFinalizer(sentinel, func(interface{}) { close(done) })
+	sentinel = nil
+	runtime.GC()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+}
+
 // Snapshot captures the list of opened file descriptors of the current
 // process
 func (d *FdLeakDetector) Snapshot() (snap *FdSnapshot, err error) {
+	runFinalizers()
+
 	root, err := os.Open(selfFdPath)
 	if err != nil {
 		return nil, err
@@ -195,11 +220,11 @@ func (d *FdLeakDetector) Compare(w io.Writer, a, b *FdSnapshot) bool {
 
 		if aInfo.Fd == bInfo.Fd {
 			// File descriptor found in both snapshots
-			equal = aInfo.equal(bInfo)
 			i++
 			j++
 
-			if !equal {
+			if !aInfo.equal(bInfo) {
+				equal = false
 				fmt.Fprintf(w, "- fd %d\n", aInfo.Fd)
 				aInfo.dump(w)
 				fmt.Fprintf(w, "+ fd %d\n", bInfo.Fd)
@@ -242,252 +267,3 @@ func (d *FdLeakDetector) Compare(w io.Writer, a, b *FdSnapshot) bool {
 
 	return equal
 }
-
-func TestFdDetectorNoLeak(t *testing.T) {
-	detector := NewFdLeadDetector()
-
-	old, err := detector.Snapshot()
-	if err != nil {
-		t.Error(err)
-	}
-
-	new, err := detector.Snapshot()
-	if err != nil {
-		t.Error(err)
-	}
-
-	buffer := bytes.NewBuffer(nil)
-	equal := detector.Compare(buffer, old, new)
-	if buffer.Len() != 0 {
-		fmt.Print(buffer.String())
-		t.Fatal()
-	}
-	if !equal {
-		fmt.Print(buffer.String())
-		t.Fatal()
-	}
-}
-
-func TestFdDetectorLeak(t *testing.T) {
-	detector := NewFdLeadDetector()
-
-	old, err := detector.Snapshot()
-	if err != nil {
-		t.Error(err)
-	}
-
-	_, err = os.Open("/dev/null")
-	if err != nil {
-		t.Error(err)
-	}
-
-	new, err := detector.Snapshot()
-	if err != nil {
-		t.Error(err)
-	}
-
-	buffer := bytes.NewBuffer(nil)
-	equal := detector.Compare(buffer, old, new)
-	if equal {
-		fmt.Print(buffer.String())
-		t.Fatal()
-	}
-}
-
-func TestFdDetectorCompare(t *testing.T) {
-	tests := []struct {
-		old, new *FdSnapshot
-		equal    bool
-	}{
-		// Same fds
-		{
-			old: &FdSnapshot{
-				Fds: []FdInfo{
-					{
-						Fd:    0,
-						Flags: syscall.O_RDWR,
-					},
-					{
-						Fd:    1,
-						Flags: syscall.O_RDWR,
-						Text:  "/foo",
-					},
-				},
-			},
-			new: &FdSnapshot{
-				Fds: []FdInfo{
-					{
-						Fd:    0,
-						Flags: syscall.O_RDWR,
-					},
-					{
-						Fd:    1,
-						Flags: syscall.O_RDWR,
-						Text:  "/foo",
-					},
-				},
-			},
-			equal: true,
-		},
-
-		// Same fd number, different flags
-		{
-			old: &FdSnapshot{
-				Fds: []FdInfo{
-					{
-						Fd:    0,
-						Flags: syscall.O_RDWR,
-					},
-					{
-						Fd:    1,
-						Flags: syscall.O_RDWR,
-						Text:  "/foo",
-					},
-				},
-			},
-			new: &FdSnapshot{
-				Fds: []FdInfo{
-					{
-						Fd:    0,
-						Flags: syscall.O_RDWR,
-					},
-					{
-						Fd:    1,
-						Flags: syscall.O_RDONLY,
-						Text:  "/foo",
-					},
-				},
-			},
-			equal: false,
-		},
-
-		// Same fd number, different close on exec status
-		{
-			old: &FdSnapshot{
-				Fds: []FdInfo{
-					{
-						Fd:    0,
-						Flags: syscall.O_RDWR,
-					},
-					{
-						Fd:          1,
-						Flags:       syscall.O_RDWR,
-						CloseOnExec: true,
-						Text:        "/foo",
-					},
-				},
-			},
-			new: &FdSnapshot{
-				Fds: []FdInfo{
-					{
-						Fd:    0,
-						Flags: syscall.O_RDWR,
-					},
-					{
-						Fd:    1,
-						Flags: syscall.O_RDWR,
-						Text:  "/foo",
-					},
-				},
-			},
-			equal: false,
-		},
-
-		// Same fd number, different readlink
-		{
-			old: &FdSnapshot{
-				Fds: []FdInfo{
-					{
-						Fd:    0,
-						Flags: syscall.O_RDWR,
-					},
-					{
-						Fd:    1,
-						Flags: syscall.O_RDWR,
-						Text:  "/foo",
-					},
-				},
-			},
-			new: &FdSnapshot{
-				Fds: []FdInfo{
-					{
-						Fd:    0,
-						Flags: syscall.O_RDWR,
-					},
-					{
-						Fd:    1,
-						Flags: syscall.O_RDWR,
-						Text:  "/bar",
-					},
-				},
-			},
-			equal: false,
-		},
-
-		// old has more fds
-		{
-			old: &FdSnapshot{
-				Fds: []FdInfo{
-					{
-						Fd:    0,
-						Flags: syscall.O_RDWR,
-					},
-					{
-						Fd:    1,
-						Flags: syscall.O_RDWR,
-						Text:  "/foo",
-					},
-				},
-			},
-			new: &FdSnapshot{
-				Fds: []FdInfo{
-					{
-						Fd:    0,
-						Flags: syscall.O_RDWR,
-					},
-				},
-			},
-			equal: false,
-		},
-
-		// new has more fds
-		{
-			old: &FdSnapshot{
-				Fds: []FdInfo{
-					{
-						Fd:    0,
-						Flags: syscall.O_RDWR,
-					},
-				},
-			},
-			new: &FdSnapshot{
-				Fds: []FdInfo{
-					{
-						Fd:    0,
-						Flags: syscall.O_RDWR,
-					},
-					{
-						Fd:    1,
-						Flags: syscall.O_RDWR,
-						Text:  "/foo",
-					},
-				},
-			},
-			equal: false,
-		},
-	}
-
-	detector := NewFdLeadDetector()
-
-	for i, test := range tests {
-		buffer := bytes.NewBuffer(nil)
-
-		equal := detector.Compare(buffer, test.old, test.new)
-		if equal != test.equal {
-			test.old.dump(os.Stderr)
-			test.new.dump(os.Stderr)
-			fmt.Print(buffer.String())
-			t.Fatal(fmt.Sprintf("Failed test #%d", i))
-		}
-	}
-}
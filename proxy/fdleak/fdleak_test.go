@@ -0,0 +1,275 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fdleak
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestFdDetectorNoLeak(t *testing.T) {
+	detector := NewFdLeadDetector()
+
+	old, err := detector.Snapshot()
+	if err != nil {
+		t.Error(err)
+	}
+
+	new, err := detector.Snapshot()
+	if err != nil {
+		t.Error(err)
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	equal := detector.Compare(buffer, old, new)
+	if buffer.Len() != 0 {
+		fmt.Print(buffer.String())
+		t.Fatal()
+	}
+	if !equal {
+		fmt.Print(buffer.String())
+		t.Fatal()
+	}
+}
+
+func TestFdDetectorLeak(t *testing.T) {
+	detector := NewFdLeadDetector()
+
+	old, err := detector.Snapshot()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Keep a reference to f, the leaked fd would otherwise be closed by
+	// a finalizer
+	f, err := os.Open("/dev/null")
+	if err != nil {
+		t.Error(err)
+	}
+	defer f.Close()
+
+	new, err := detector.Snapshot()
+	if err != nil {
+		t.Error(err)
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	equal := detector.Compare(buffer, old, new)
+	if equal {
+		fmt.Print(buffer.String())
+		t.Fatal()
+	}
+}
+
+func TestFdDetectorCompare(t *testing.T) {
+	tests := []struct {
+		old, new *FdSnapshot
+		equal    bool
+	}{
+		// Same fds
+		{
+			old: &FdSnapshot{
+				Fds: []FdInfo{
+					{
+						Fd:    0,
+						Flags: syscall.O_RDWR,
+					},
+					{
+						Fd:    1,
+						Flags: syscall.O_RDWR,
+						Text:  "/foo",
+					},
+				},
+			},
+			new: &FdSnapshot{
+				Fds: []FdInfo{
+					{
+						Fd:    0,
+						Flags: syscall.O_RDWR,
+					},
+					{
+						Fd:    1,
+						Flags: syscall.O_RDWR,
+						Text:  "/foo",
+					},
+				},
+			},
+			equal: true,
+		},
+
+		// Same fd number, different flags
+		{
+			old: &FdSnapshot{
+				Fds: []FdInfo{
+					{
+						Fd:    0,
+						Flags: syscall.O_RDWR,
+					},
+					{
+						Fd:    1,
+						Flags: syscall.O_RDWR,
+						Text:  "/foo",
+					},
+				},
+			},
+			new: &FdSnapshot{
+				Fds: []FdInfo{
+					{
+						Fd:    0,
+						Flags: syscall.O_RDWR,
+					},
+					{
+						Fd:    1,
+						Flags: syscall.O_RDONLY,
+						Text:  "/foo",
+					},
+				},
+			},
+			equal: false,
+		},
+
+		// Same fd number, different close on exec status
+		{
+			old: &FdSnapshot{
+				Fds: []FdInfo{
+					{
+						Fd:    0,
+						Flags: syscall.O_RDWR,
+					},
+					{
+						Fd:          1,
+						Flags:       syscall.O_RDWR,
+						CloseOnExec: true,
+						Text:        "/foo",
+					},
+				},
+			},
+			new: &FdSnapshot{
+				Fds: []FdInfo{
+					{
+						Fd:    0,
+						Flags: syscall.O_RDWR,
+					},
+					{
+						Fd:    1,
+						Flags: syscall.O_RDWR,
+						Text:  "/foo",
+					},
+				},
+			},
+			equal: false,
+		},
+
+		// Same fd number, different readlink
+		{
+			old: &FdSnapshot{
+				Fds: []FdInfo{
+					{
+						Fd:    0,
+						Flags: syscall.O_RDWR,
+					},
+					{
+						Fd:    1,
+						Flags: syscall.O_RDWR,
+						Text:  "/foo",
+					},
+				},
+			},
+			new: &FdSnapshot{
+				Fds: []FdInfo{
+					{
+						Fd:    0,
+						Flags: syscall.O_RDWR,
+					},
+					{
+						Fd:    1,
+						Flags: syscall.O_RDWR,
+						Text:  "/bar",
+					},
+				},
+			},
+			equal: false,
+		},
+
+		// old has more fds
+		{
+			old: &FdSnapshot{
+				Fds: []FdInfo{
+					{
+						Fd:    0,
+						Flags: syscall.O_RDWR,
+					},
+					{
+						Fd:    1,
+						Flags: syscall.O_RDWR,
+						Text:  "/foo",
+					},
+				},
+			},
+			new: &FdSnapshot{
+				Fds: []FdInfo{
+					{
+						Fd:    0,
+						Flags: syscall.O_RDWR,
+					},
+				},
+			},
+			equal: false,
+		},
+
+		// new has more fds
+		{
+			old: &FdSnapshot{
+				Fds: []FdInfo{
+					{
+						Fd:    0,
+						Flags: syscall.O_RDWR,
+					},
+				},
+			},
+			new: &FdSnapshot{
+				Fds: []FdInfo{
+					{
+						Fd:    0,
+						Flags: syscall.O_RDWR,
+					},
+					{
+						Fd:    1,
+						Flags: syscall.O_RDWR,
+						Text:  "/foo",
+					},
+				},
+			},
+			equal: false,
+		},
+	}
+
+	detector := NewFdLeadDetector()
+
+	for i, test := range tests {
+		buffer := bytes.NewBuffer(nil)
+
+		equal := detector.Compare(buffer, test.old, test.new)
+		if equal != test.equal {
+			test.old.dump(os.Stderr)
+			test.new.dump(os.Stderr)
+			fmt.Print(buffer.String())
+			t.Fatal(fmt.Sprintf("Failed test #%d", i))
+		}
+	}
+}
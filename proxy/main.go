@@ -0,0 +1,195 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+
+	"github.com/01org/cc-oci-runtime/proxy/server"
+
+	"github.com/golang/glog"
+)
+
+func initLogging() {
+	// We print logs on stderr by default.
+	flag.Set("logtostderr", "true")
+
+	// It can be practical to use an environment variable to trigger a verbose output
+	level := os.Getenv("CC_PROXY_LOG_LEVEL")
+	if level != "" {
+		flag.Set("v", level)
+	}
+}
+
+// config holds the proxy options, set from the command line and the
+// configuration file.
+var config = server.DefaultConfig()
+
+// registerFlags defines the proxy options on fs, bound to the fields of config.
+func registerFlags(fs *flag.FlagSet, config *server.Config) {
+	fs.StringVar(&config.ConfigFile, "config", config.ConfigFile,
+		"path of a JSON configuration file")
+
+	// Proxy socket
+	fs.StringVar(&config.SocketPath, "socket-path", config.SocketPath,
+		"specify path to socket file")
+	fs.Var(&config.SocketMode, "socket-mode", "permissions of the proxy socket")
+	fs.Var(&config.SocketDirMode, "socket-dir-mode",
+		"permissions of the proxy socket directory, when it's created")
+	fs.StringVar(&config.SocketGroup, "socket-group", config.SocketGroup,
+		"group owning the proxy socket, name or gid")
+
+	// Admin API
+	fs.StringVar(&config.AdminSocket, "admin-socket", config.AdminSocket,
+		"path of a unix socket serving the HTTP admin API")
+	fs.Var(&config.AdminSocketMode, "admin-socket-mode", "permissions of the admin socket")
+	fs.StringVar(&config.AdminSocketGroup, "admin-socket-group", config.AdminSocketGroup,
+		"group owning the admin socket, name or gid")
+	fs.StringVar(&config.AdminAddr, "admin-addr", config.AdminAddr,
+		"localhost address (host:port) serving the read-only HTTP admin API")
+
+	// Authorization policy
+	fs.StringVar(&config.AllowedUsers, "allowed-users", config.AllowedUsers,
+		"comma separated list of users, names or uids, allowed to use the proxy socket (everyone when empty)")
+	fs.StringVar(&config.AllowedGroups, "allowed-groups", config.AllowedGroups,
+		"comma separated list of groups, names or gids, allowed to use the proxy socket (everyone when empty)")
+
+	// Console
+	fs.IntVar(&config.ConsoleBufferLines, "console-buffer-lines", config.ConsoleBufferLines,
+		"number of VM console lines kept in memory per VM")
+	fs.StringVar(&config.ConsoleLogDir, "console-log-dir", config.ConsoleLogDir,
+		"directory where to write VM console logs, one file per container")
+	fs.Int64Var(&config.ConsoleLogMaxSize, "console-log-max-size", config.ConsoleLogMaxSize,
+		"size, in bytes, at which a console log file is rotated")
+	fs.IntVar(&config.ConsoleLogMaxFiles, "console-log-max-files", config.ConsoleLogMaxFiles,
+		"number of rotated console log files to keep")
+	fs.Float64Var(&config.ConsoleRate, "console-rate", config.ConsoleRate,
+		"maximum VM console output rate, in bytes per second (0 for unlimited)")
+	fs.IntVar(&config.ConsoleBurst, "console-burst", config.ConsoleBurst,
+		"VM console output burst size, in bytes")
+
+	// Recording
+	fs.StringVar(&config.RecordDir, "record-dir", config.RecordDir,
+		"directory where to write VM traffic recordings")
+	fs.BoolVar(&config.RecordAll, "record-all", config.RecordAll,
+		"record the traffic of all VMs, not only the ones asking for it")
+
+	// Quotas and rate limiting
+	fs.IntVar(&config.MaxClientIoSessions, "max-client-io-sessions", config.MaxClientIoSessions,
+		"maximum number of I/O sessions per client and VM (0 means no limit)")
+	fs.IntVar(&config.MaxVMIoSessions, "max-vm-io-sessions", config.MaxVMIoSessions,
+		"maximum number of I/O sessions per VM (0 means no limit)")
+	fs.IntVar(&config.MaxUserVMs, "max-user-vms", config.MaxUserVMs,
+		"maximum number of VMs registered by a single uid (0 means no limit)")
+	fs.Float64Var(&config.ClientRequestRate, "client-request-rate", config.ClientRequestRate,
+		"maximum number of requests per second per client (0 means no limit)")
+	fs.IntVar(&config.ClientRequestBurst, "client-request-burst", config.ClientRequestBurst,
+		"number of requests a client can issue in a burst, see -client-request-rate")
+	fs.IntVar(&config.MaxMessageSize, "max-message-size", config.MaxMessageSize,
+		"maximum size, in bytes, of the requests clients send")
+
+	// Logging
+	fs.StringVar(&config.LogFormat, "log-format", config.LogFormat,
+		"log format: glog, json or logfmt")
+	fs.BoolVar(&config.LogJournald, "log-journald", config.LogJournald,
+		"send structured logs to the journald native socket")
+	fs.IntVar(&config.DebugLogLevel, "debug-log-level", config.DebugLogLevel,
+		"log level to switch to, and back from, when receiving SIGUSR1")
+
+	// VMs
+	fs.DurationVar(&config.VMLostGracePeriod, "vm-lost-grace-period", config.VMLostGracePeriod,
+		"how long a lost VM stays registered before being forgotten")
+	fs.DurationVar(&config.HelloTimeout, "hello-timeout", config.HelloTimeout,
+		"how long hello waits for the VM sockets and for hyperstart to be ready, 0 to try the sockets once and wait forever for hyperstart")
+	fs.DurationVar(&config.HealthCheckInterval, "health-check-interval", config.HealthCheckInterval,
+		"how often the agent of each VM is pinged, 0 to disable health checks")
+
+	fs.BoolVar(&config.EventLoop, "event-loop", config.EventLoop,
+		"forward the I/O streams from a single epoll event loop instead of goroutines")
+}
+
+// profiler is the HTTP server used for debugging and monitoring purposes. It
+// serves pprof data and/or Prometheus metrics.
+type profiler struct {
+	enabled bool
+	metrics bool
+	host    string
+	port    uint
+}
+
+var pprof profiler
+
+func (p *profiler) setup(srv *server.Server) {
+	if !p.enabled && !p.metrics {
+		return
+	}
+
+	addr := fmt.Sprintf("%s:%d", p.host, p.port)
+	mux := http.NewServeMux()
+
+	if p.enabled {
+		// net/http/pprof registers its handlers on the default mux
+		mux.Handle("/debug/pprof/", http.DefaultServeMux)
+		glog.V(1).Infof("pprof enabled on http://%s/debug/pprof", addr)
+	}
+
+	if p.metrics {
+		mux.Handle("/metrics", srv.MetricsHandler())
+		glog.V(1).Infof("metrics enabled on http://%s/metrics", addr)
+	}
+
+	go func() {
+		http.ListenAndServe(addr, mux)
+	}()
+}
+
+func proxyMain() {
+	srv, err := server.New(server.FromFlags(flag.CommandLine, config))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "init:", err.Error())
+		os.Exit(1)
+	}
+	srv.HandleSignals()
+	pprof.setup(srv)
+
+	if err := srv.Serve(context.Background()); err != nil {
+		fmt.Fprintln(os.Stderr, "serve:", err.Error())
+		os.Exit(1)
+	}
+}
+
+func main() {
+	initLogging()
+
+	registerFlags(flag.CommandLine, config)
+	flag.BoolVar(&pprof.enabled, "pprof", false,
+		"enable pprof ")
+	flag.BoolVar(&pprof.metrics, "metrics", false,
+		"enable the Prometheus /metrics endpoint")
+	flag.StringVar(&pprof.host, "pprof-host", "localhost",
+		"host the pprof and metrics server will be bound to")
+	flag.UintVar(&pprof.port, "pprof-port", 6060,
+		"port the pprof and metrics server will be bound to")
+
+	flag.Parse()
+	defer glog.Flush()
+
+	proxyMain()
+}
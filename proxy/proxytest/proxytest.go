@@ -0,0 +1,371 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proxytest runs a proxy and fake VMs for the tests of the proxy
+// clients, eg. the runtime and the shim:
+//
+//  p := proxytest.Start(t, proxytest.Config{VMs: 1})
+//  defer p.Stop()
+//
+//  vm := p.VMs[0]
+//  shim := vm.NewShim(2)
+//  vm.SendIo(shim.IoBase, []byte("hello"))
+//  vm.Exit(shim.IoBase, 2, 0)
+//  ...
+//
+// Stop fails the test if file descriptors or goroutines were leaked. As the
+// leaks are looked for in the whole process, tests using proxytest can't be
+// run in parallel.
+package proxytest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/01org/cc-oci-runtime/proxy/fakevm"
+	"github.com/01org/cc-oci-runtime/proxy/fdleak"
+	"github.com/01org/cc-oci-runtime/proxy/server"
+	"github.com/containers/virtcontainers/hyperstart"
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+)
+
+// How long Stop waits for the proxy to shut down and the goroutines to
+// terminate.
+const stopTimeout = 5 * time.Second
+
+// Config describes the proxy and VMs to start.
+type Config struct {
+	// VMs is the number of fake VMs to start and register with hello.
+	VMs int
+
+	// Script decides how the processes of the VMs behave.
+	Script *fakevm.Script
+
+	// Console gives a console socket to the VMs.
+	Console bool
+
+	// Options are given to server.New, after the listener.
+	Options []server.Option
+}
+
+// Proxy is a proxy serving on a temporary socket.
+type Proxy struct {
+	t   testing.TB
+	dir string
+
+	// SocketPath is the path of the proxy socket.
+	SocketPath string
+
+	// Server is the proxy.
+	Server *server.Server
+
+	// VMs are the fake VMs, registered with the proxy.
+	VMs []*VM
+
+	served  chan error
+	clients []*api.Client
+	shims   []*Shim
+
+	// leak detection
+	detector   *fdleak.FdLeakDetector
+	startFds   *fdleak.FdSnapshot
+	goroutines int
+}
+
+// VM is a fake VM registered with the proxy.
+type VM struct {
+	*fakevm.VM
+
+	p *Proxy
+
+	// ContainerID is the ID the VM is registered with.
+	ContainerID string
+
+	// CtlSerial, IoSerial and Console are the VM sockets.
+	CtlSerial, IoSerial, Console string
+
+	// Client is the client that issued hello, the runtime.
+	Client *api.Client
+}
+
+// Start starts a proxy and config.VMs fake VMs, saying hello for each of them.
+// Like testing.T.Fatal, it can only be called from the goroutine running the
+// test.
+func Start(t testing.TB, config Config) *Proxy {
+	p := &Proxy{
+		t:        t,
+		served:   make(chan error, 1),
+		detector: fdleak.NewFdLeadDetector(),
+	}
+
+	var err error
+	p.startFds, err = p.detector.Snapshot()
+	if err != nil {
+		t.Fatalf("proxytest: %v", err)
+	}
+	p.goroutines = runtime.NumGoroutine()
+
+	if p.dir, err = ioutil.TempDir("", "proxytest-"); err != nil {
+		t.Fatalf("proxytest: %v", err)
+	}
+
+	p.SocketPath = filepath.Join(p.dir, "proxy.sock")
+	l, err := net.Listen("unix", p.SocketPath)
+	if err != nil {
+		p.fatalf("%v", err)
+	}
+
+	options := append([]server.Option{server.WithListener(l)}, config.Options...)
+	if p.Server, err = server.New(options...); err != nil {
+		l.Close()
+		p.fatalf("%v", err)
+	}
+	go func() {
+		p.served <- p.Server.Serve(context.Background())
+	}()
+
+	for i := 0; i < config.VMs; i++ {
+		p.startVM(i, &config)
+	}
+
+	return p
+}
+
+// fatalf tears down what's been started before failing the test.
+func (p *Proxy) fatalf(format string, a ...interface{}) {
+	p.teardown()
+	p.t.Fatalf("proxytest: "+format, a...)
+}
+
+func (p *Proxy) startVM(i int, config *Config) {
+	dir := filepath.Join(p.dir, fmt.Sprintf("vm%d", i))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		p.fatalf("%v", err)
+	}
+
+	vm := &VM{
+		p:           p,
+		ContainerID: fmt.Sprintf("proxytest-container-%d", i),
+		CtlSerial:   filepath.Join(dir, "ctl.sock"),
+		IoSerial:    filepath.Join(dir, "io.sock"),
+	}
+	if config.Console {
+		vm.Console = filepath.Join(dir, "console.sock")
+	}
+
+	vm.VM = fakevm.New(fakevm.Config{
+		Ctl:     vm.CtlSerial,
+		Io:      vm.IoSerial,
+		Console: vm.Console,
+		Script:  config.Script,
+	})
+	if err := vm.Start(); err != nil {
+		p.fatalf("%s: %v", vm.ContainerID, err)
+	}
+	p.VMs = append(p.VMs, vm)
+
+	vm.Client = p.Dial()
+	_, err := vm.Client.Hello(vm.ContainerID, vm.CtlSerial, vm.IoSerial,
+		&api.HelloOptions{
+			Console: vm.Console,
+			Timeout: stopTimeout,
+		})
+	if err != nil {
+		p.fatalf("%s: hello: %v", vm.ContainerID, err)
+	}
+}
+
+// Dial returns a new client of the proxy. It's closed by Stop.
+func (p *Proxy) Dial() *api.Client {
+	conn, err := net.Dial("unix", p.SocketPath)
+	if err != nil {
+		p.fatalf("%v", err)
+	}
+
+	client := api.NewClient(conn.(*net.UnixConn))
+	p.clients = append(p.clients, client)
+	return client
+}
+
+// teardown stops everything Start started, returning false if that took
+// longer than stopTimeout.
+func (p *Proxy) teardown() bool {
+	ok := true
+
+	for _, shim := range p.shims {
+		shim.close()
+	}
+	for _, client := range p.clients {
+		client.Close()
+	}
+
+	if p.Server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+		if err := p.Server.Shutdown(ctx); err != nil {
+			p.t.Errorf("proxytest: shutdown: %v", err)
+			ok = false
+		} else {
+			<-p.served
+		}
+		cancel()
+	}
+
+	for _, vm := range p.VMs {
+		vm.Stop()
+	}
+
+	os.RemoveAll(p.dir)
+
+	return ok
+}
+
+// Stop stops the proxy and the VMs, failing the test if file descriptors or
+// goroutines have been leaked since Start.
+func (p *Proxy) Stop() {
+	if !p.teardown() {
+		return
+	}
+
+	// Goroutines take a little while to notice their connection is gone
+	deadline := time.Now().Add(stopTimeout)
+	for runtime.NumGoroutine() > p.goroutines {
+		if time.Now().After(deadline) {
+			stack := make([]byte, 1024*1024)
+			stack = stack[:runtime.Stack(stack, true)]
+			p.t.Errorf("proxytest: leaked goroutines (%d, was %d):\n%s",
+				runtime.NumGoroutine(), p.goroutines, stack)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stopFds, err := p.detector.Snapshot()
+	if err != nil {
+		p.t.Errorf("proxytest: %v", err)
+		return
+	}
+	var diff bytes.Buffer
+	if !p.detector.Compare(&diff, p.startFds, stopFds) {
+		p.t.Errorf("proxytest: leaked file descriptors:\n%s", diff.String())
+	}
+}
+
+// Exit makes the process whose I/O streams are the nStreams ones from ioBase
+// exit with status: the streams are closed and the exit status sent, as
+// hyperstart does.
+func (vm *VM) Exit(ioBase uint64, nStreams int, status uint8) {
+	for i := nStreams - 1; i >= 0; i-- {
+		if err := vm.CloseIo(ioBase + uint64(i)); err != nil {
+			vm.p.t.Errorf("proxytest: %s: %v", vm.ContainerID, err)
+			return
+		}
+	}
+
+	if err := vm.SendExitStatus(ioBase, status); err != nil {
+		vm.p.t.Errorf("proxytest: %s: %v", vm.ContainerID, err)
+	}
+}
+
+// Shim is the client end of an I/O session, the one cc-shim has: the process
+// output is read from it and its stdin written to it.
+type Shim struct {
+	// IoBase is the sequence number of the first stream, stdin and
+	// stdout.
+	IoBase uint64
+
+	conn net.Conn
+}
+
+// NewShim allocates an I/O session of nStreams streams with the VM client,
+// the way the runtime does for a shim. It's closed by Stop.
+func (vm *VM) NewShim(nStreams int) *Shim {
+	p := vm.p
+
+	ioBase, file, err := vm.Client.AllocateIo(nStreams)
+	if err != nil {
+		p.fatalf("%s: allocateIO: %v", vm.ContainerID, err)
+	}
+	conn, err := net.FileConn(file)
+	file.Close()
+	if err != nil {
+		p.fatalf("%s: %v", vm.ContainerID, err)
+	}
+
+	shim := &Shim{
+		IoBase: ioBase,
+		conn:   conn,
+	}
+	p.shims = append(p.shims, shim)
+	return shim
+}
+
+func (shim *Shim) close() {
+	shim.conn.Close()
+}
+
+// Write sends data to the process stdin.
+func (shim *Shim) Write(data []byte) error {
+	return hyperstart.SendIoMessageWithConn(shim.conn, &hyper.TtyMessage{
+		Session: shim.IoBase,
+		Message: data,
+	})
+}
+
+// CloseStdin closes the process stdin.
+func (shim *Shim) CloseStdin() error {
+	return shim.Write(nil)
+}
+
+// Read reads the next message of the session, returning the stream it's for.
+// An empty data is the end of that stream.
+func (shim *Shim) Read() (seq uint64, data []byte, err error) {
+	msg, err := hyperstart.ReadIoMessageWithConn(shim.conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	return msg.Session, msg.Message, nil
+}
+
+// WaitExit reads the session until the process exits, returning the exit
+// status and what it wrote on each stream.
+func (shim *Shim) WaitExit() (status uint8, output map[uint64][]byte, err error) {
+	output = make(map[uint64][]byte)
+	closed := make(map[uint64]bool)
+
+	for {
+		seq, data, err := shim.Read()
+		if err != nil {
+			return 0, output, err
+		}
+
+		switch {
+		case len(data) == 0:
+			closed[seq] = true
+		case closed[seq] && seq == shim.IoBase:
+			// Data after the end of stdout is the exit status
+			return data[0], output, nil
+		default:
+			output[seq] = append(output[seq], data...)
+		}
+	}
+}
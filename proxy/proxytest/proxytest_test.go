@@ -0,0 +1,149 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxytest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/01org/cc-oci-runtime/proxy/fakevm"
+	"github.com/01org/cc-oci-runtime/proxy/server"
+	"github.com/containers/virtcontainers/hyperstart"
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartStop(t *testing.T) {
+	p := Start(t, Config{VMs: 3, Console: true})
+	defer p.Stop()
+
+	assert.Len(t, p.VMs, 3)
+
+	vms, err := p.Dial().ListVMs()
+	assert.Nil(t, err)
+	assert.Len(t, vms, 3)
+}
+
+func TestInjectIo(t *testing.T) {
+	p := Start(t, Config{VMs: 2})
+	defer p.Stop()
+
+	// Sessions of different VMs are independent
+	for _, vm := range p.VMs {
+		shim := vm.NewShim(2)
+
+		assert.Nil(t, vm.SendIo(shim.IoBase, []byte("out")))
+		assert.Nil(t, vm.SendIo(shim.IoBase+1, []byte("err")))
+		vm.Exit(shim.IoBase, 2, 42)
+
+		status, output, err := shim.WaitExit()
+		assert.Nil(t, err)
+		assert.Equal(t, uint8(42), status)
+		assert.Equal(t, "out", string(output[shim.IoBase]))
+		assert.Equal(t, "err", string(output[shim.IoBase+1]))
+	}
+}
+
+func TestScriptedProcess(t *testing.T) {
+	p := Start(t, Config{
+		VMs: 1,
+		Script: &fakevm.Script{
+			Processes: []fakevm.ProcessScript{
+				{Args: []string{"/bin/echo"}, Stdout: "hello\n", ExitCode: 3},
+			},
+		},
+	})
+	defer p.Stop()
+
+	vm := p.VMs[0]
+	for _, args := range [][]string{{"/bin/echo"}, {"/bin/cat"}} {
+		shim := vm.NewShim(1)
+
+		err := vm.Client.Hyper(hyperstart.ExecCmd, &hyper.ExecCommand{
+			Container: vm.ContainerID,
+			Process: hyper.Process{
+				Stdio: shim.IoBase,
+				Args:  args,
+			},
+		})
+		assert.Nil(t, err)
+
+		// The default process echoes its stdin
+		expected, code := "hello\n", uint8(3)
+		if args[0] == "/bin/cat" {
+			assert.Nil(t, shim.Write([]byte("ping")))
+			assert.Nil(t, shim.CloseStdin())
+			expected, code = "ping", 0
+		}
+
+		status, output, err := shim.WaitExit()
+		assert.Nil(t, err)
+		assert.Equal(t, code, status)
+		assert.Equal(t, expected, string(output[shim.IoBase]))
+	}
+}
+
+// The proxy options are applied, and what they start is torn down by Stop.
+func TestEventLoop(t *testing.T) {
+	p := Start(t, Config{
+		VMs:     2,
+		Options: []server.Option{server.WithEventLoop()},
+	})
+	defer p.Stop()
+
+	for _, vm := range p.VMs {
+		shim := vm.NewShim(1)
+
+		err := vm.Client.Hyper(hyperstart.ExecCmd, &hyper.ExecCommand{
+			Container: vm.ContainerID,
+			Process: hyper.Process{
+				Stdio: shim.IoBase,
+				Args:  []string{"/bin/cat"},
+			},
+		})
+		assert.Nil(t, err)
+
+		assert.Nil(t, shim.Write([]byte("ping")))
+		assert.Nil(t, shim.CloseStdin())
+
+		status, output, err := shim.WaitExit()
+		assert.Nil(t, err)
+		assert.Equal(t, uint8(0), status)
+		assert.Equal(t, "ping", string(output[shim.IoBase]))
+	}
+}
+
+func TestLeakDetection(t *testing.T) {
+	// Stop failing the test is what we're after, give it a testing.TB of
+	// its own
+	leaky := &recordingT{TB: t}
+
+	p := Start(leaky, Config{VMs: 1})
+	c, err := net.Dial("unix", p.SocketPath)
+	assert.Nil(t, err)
+	p.Stop()
+	c.Close()
+
+	assert.True(t, leaky.failed)
+}
+
+type recordingT struct {
+	testing.TB
+	failed bool
+}
+
+func (t *recordingT) Errorf(format string, a ...interface{}) {
+	t.failed = true
+}
@@ -0,0 +1,354 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package record implements the file format used by cc-proxy to record the
+// traffic between the proxy and a VM, along with the tools to replay such
+// recordings.
+//
+// A recording starts with a header:
+//
+//  +----------------------------+---------+
+//  |   magic ("CCPROXYREC")     | version |
+//  +----------------------------+---------+
+//             10 bytes            1 byte
+//
+// followed by a sequence of frames:
+//
+//  +-------+------+-----+--------+------+
+//  | delta | type | id  | length | data |
+//  +-------+------+-----+--------+------+
+//
+//  - delta is the time elapsed since the previous frame, in nanoseconds,
+//  - type is a byte: the frame Kind in the upper bits and the Direction in
+//    bit 0,
+//  - id is the hyperstart command code for ctl frames, the sequence number
+//    for io and session frames,
+//  - length is the length of data, in bytes.
+//
+// delta, id and length are unsigned varints (see encoding/binary).
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	magic   = "CCPROXYREC"
+	version = 1
+)
+
+// Kind is the type of traffic a frame holds.
+type Kind uint8
+
+const (
+	// KindCtl frames are hyperstart control messages. The frame ID is the
+	// hyperstart command code.
+	KindCtl Kind = iota + 1
+	// KindIo frames are hyperstart I/O messages. The frame ID is the I/O
+	// sequence number.
+	KindIo
+	// KindSession frames record the allocation of an I/O session by a
+	// client. The frame ID is the ioBase of the session and the data a
+	// single byte, the number of streams.
+	KindSession
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindCtl:
+		return "ctl"
+	case KindIo:
+		return "io"
+	case KindSession:
+		return "session"
+	}
+	return fmt.Sprintf("kind(%d)", k)
+}
+
+// Direction tells if a frame was sent to or received from the VM.
+type Direction uint8
+
+const (
+	// ToVM frames are sent by the proxy to the VM.
+	ToVM Direction = iota
+	// FromVM frames are sent by the VM to the proxy.
+	FromVM
+)
+
+func (d Direction) String() string {
+	if d == ToVM {
+		return "->"
+	}
+	return "<-"
+}
+
+// Frame is a single recorded message.
+type Frame struct {
+	// Time elapsed since the start of the recording
+	Time      time.Duration
+	Kind      Kind
+	Direction Direction
+	ID        uint64
+	Data      []byte
+}
+
+func (f *Frame) String() string {
+	id := fmt.Sprintf("%d", f.ID)
+	if f.Kind == KindCtl {
+		id = CmdName(uint32(f.ID))
+	}
+	return fmt.Sprintf("%12s %-7s %s %s (%d bytes)", f.Time, f.Kind, f.Direction,
+		id, len(f.Data))
+}
+
+// Frames larger than this are considered a corrupted recording.
+const maxFrameLength = 16 * 1024 * 1024
+
+// ErrBadHeader is returned when trying to read something that isn't a
+// recording, or a recording from an unknown version of the format.
+var ErrBadHeader = errors.New("record: not a cc-proxy recording")
+
+// Writer writes frames to a recording. It is safe to use from several
+// goroutines.
+type Writer struct {
+	sync.Mutex
+	w      *bufio.Writer
+	closer io.Closer
+	start  time.Time
+	last   time.Duration
+	err    error
+
+	// Can be overridden by tests
+	now func() time.Time
+}
+
+// NewWriter starts a new recording on w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	rw := &Writer{
+		w:     bufio.NewWriter(w),
+		start: time.Now(),
+		now:   time.Now,
+	}
+
+	rw.w.WriteString(magic)
+	rw.w.WriteByte(version)
+	if err := rw.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	if closer, ok := w.(io.Closer); ok {
+		rw.closer = closer
+	}
+
+	return rw, nil
+}
+
+// Create creates the file path and starts a new recording in it.
+func Create(path string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := NewWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *Writer) writeUvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	w.w.Write(buf[:n])
+}
+
+// WriteFrame appends a frame to the recording. The frame time is ignored and
+// replaced by the current time. Frames are flushed right away so a recording
+// is usable even if the proxy dies.
+func (w *Writer) WriteFrame(kind Kind, dir Direction, id uint64, data []byte) error {
+	if w == nil {
+		return nil
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	t := w.now().Sub(w.start)
+	delta := t - w.last
+	if delta < 0 {
+		delta = 0
+	}
+	w.last += delta
+
+	w.writeUvarint(uint64(delta))
+	w.w.WriteByte(byte(kind)<<1 | byte(dir&1))
+	w.writeUvarint(id)
+	w.writeUvarint(uint64(len(data)))
+	w.w.Write(data)
+
+	w.err = w.w.Flush()
+	return w.err
+}
+
+// Ctl records a hyperstart control message.
+func (w *Writer) Ctl(dir Direction, code uint32, data []byte) error {
+	return w.WriteFrame(KindCtl, dir, uint64(code), data)
+}
+
+// Io records a hyperstart I/O message.
+func (w *Writer) Io(dir Direction, seq uint64, data []byte) error {
+	return w.WriteFrame(KindIo, dir, seq, data)
+}
+
+// Session records the allocation of nStreams I/O streams starting at ioBase.
+func (w *Writer) Session(ioBase uint64, nStreams int) error {
+	return w.WriteFrame(KindSession, ToVM, ioBase, []byte{byte(nStreams)})
+}
+
+// Close flushes and closes the recording.
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	err := w.w.Flush()
+	if w.closer != nil {
+		if cerr := w.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if w.err == nil {
+		w.err = errors.New("record: writer closed")
+	}
+	return err
+}
+
+// Reader reads frames from a recording.
+type Reader struct {
+	r      *bufio.Reader
+	closer io.Closer
+	t      time.Duration
+}
+
+// NewReader reads the recording header from r, returning ErrBadHeader if r
+// doesn't contain a recording.
+func NewReader(r io.Reader) (*Reader, error) {
+	rr := &Reader{
+		r: bufio.NewReader(r),
+	}
+
+	header := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(rr.r, header); err != nil {
+		return nil, ErrBadHeader
+	}
+	if string(header[:len(magic)]) != magic || header[len(magic)] != version {
+		return nil, ErrBadHeader
+	}
+
+	if closer, ok := r.(io.Closer); ok {
+		rr.closer = closer
+	}
+
+	return rr, nil
+}
+
+// Open opens the recording stored in path.
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Next returns the next frame of the recording, io.EOF once all the frames
+// have been read.
+func (r *Reader) Next() (*Frame, error) {
+	delta, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, err
+	}
+
+	truncated := func(err error) error {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	t, err := r.r.ReadByte()
+	if err != nil {
+		return nil, truncated(err)
+	}
+	id, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	length, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	if length > maxFrameLength {
+		return nil, fmt.Errorf("record: frame too big (%d bytes)", length)
+	}
+
+	frame := &Frame{
+		Kind:      Kind(t >> 1),
+		Direction: Direction(t & 1),
+		ID:        id,
+	}
+	if length > 0 {
+		frame.Data = make([]byte, length)
+		if _, err := io.ReadFull(r.r, frame.Data); err != nil {
+			return nil, truncated(err)
+		}
+	}
+
+	r.t += time.Duration(delta)
+	frame.Time = r.t
+
+	return frame, nil
+}
+
+// Close closes the underlying reader if it's an io.Closer.
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
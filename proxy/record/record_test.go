@@ -0,0 +1,144 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package record
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/containers/virtcontainers/hyperstart"
+	"github.com/containers/virtcontainers/hyperstart/mock"
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteRead(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := NewWriter(&buf)
+	assert.Nil(t, err)
+
+	now := w.start
+	w.now = func() time.Time { return now }
+
+	frames := []Frame{
+		{Time: 0, Kind: KindCtl, Direction: FromVM, ID: hyper.INIT_READY},
+		{Time: 10 * time.Millisecond, Kind: KindSession, Direction: ToVM, ID: 1, Data: []byte{2}},
+		{Time: 10 * time.Millisecond, Kind: KindCtl, Direction: ToVM, ID: hyper.INIT_EXECCMD,
+			Data: []byte(`{"container":"foo"}`)},
+		{Time: 2 * time.Second, Kind: KindIo, Direction: FromVM, ID: 2, Data: []byte("stderr\n")},
+	}
+
+	for i := range frames {
+		f := &frames[i]
+		now = w.start.Add(f.Time)
+		err := w.WriteFrame(f.Kind, f.Direction, f.ID, f.Data)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, w.Close())
+
+	// Writing after Close is an error
+	assert.NotNil(t, w.Io(ToVM, 1, nil))
+
+	r, err := NewReader(&buf)
+	assert.Nil(t, err)
+	for i := range frames {
+		frame, err := r.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, frames[i], *frame)
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReadErrors(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte("not a recording")))
+	assert.Equal(t, ErrBadHeader, err)
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Io(ToVM, 1, []byte("stdin\n")))
+
+	// Truncated frame
+	data := buf.Bytes()
+	r, err := NewReader(bytes.NewReader(data[:len(data)-2]))
+	assert.Nil(t, err)
+	_, err = r.Next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestCmdNames(t *testing.T) {
+	code, ok := CmdCode(hyperstart.ExecCmd)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(hyper.INIT_EXECCMD), code)
+	assert.Equal(t, hyperstart.ExecCmd, CmdName(code))
+
+	_, ok = CmdCode("foo")
+	assert.False(t, ok)
+	assert.Equal(t, "cmd(1000)", CmdName(1000))
+}
+
+func TestReplayHyperstart(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	assert.Nil(t, err)
+	w.Ctl(FromVM, hyper.INIT_READY, nil)
+	w.Session(1, 1)
+	w.Ctl(ToVM, hyper.INIT_PING, nil)
+	w.Ctl(FromVM, hyper.INIT_ACK, nil)
+	w.Io(ToVM, 1, []byte("stdin\n"))
+	w.Io(FromVM, 1, []byte("stdout\n"))
+	// The mock acks everything, this one will be reported as a mismatch
+	w.Ctl(ToVM, hyper.INIT_WINSIZE, []byte(`{"seq":1,"row":25,"column":80}`))
+	w.Ctl(FromVM, hyper.INIT_ERROR, nil)
+	w.Close()
+
+	m := mock.NewHyperstart(t)
+	m.Start()
+	go m.SendMessage(int(hyper.INIT_READY), nil)
+
+	ctl, io := m.GetSocketPaths()
+	h := hyperstart.NewHyperstart(ctl, io, "unix")
+	assert.Nil(t, h.OpenSockets())
+	assert.Nil(t, h.WaitForReady())
+
+	r, err := NewReader(&buf)
+	assert.Nil(t, err)
+	result, err := Replay(r, NewHyperstartTarget(h), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, result.Frames)
+	assert.Equal(t, 4, result.Replayed)
+	assert.Equal(t, 1, len(result.Mismatches))
+	assert.Equal(t, uint64(hyper.INIT_WINSIZE), result.Mismatches[0].Frame.ID)
+	assert.Equal(t, uint32(hyper.INIT_ERROR), result.Mismatches[0].Expected)
+	assert.Equal(t, uint32(hyper.INIT_ACK), result.Mismatches[0].Got)
+
+	// The mock received what was recorded
+	msgs := m.GetLastMessages()
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, uint32(hyper.INIT_PING), msgs[0].Code)
+	assert.Equal(t, uint32(hyper.INIT_WINSIZE), msgs[1].Code)
+
+	data := make([]byte, 32)
+	n, seq := m.ReadIo(data)
+	assert.Equal(t, uint64(1), seq)
+	assert.Equal(t, "stdin\n", string(data[12:n]))
+
+	h.CloseSockets()
+	m.Stop()
+}
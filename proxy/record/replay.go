@@ -0,0 +1,223 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package record
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/containers/virtcontainers/hyperstart"
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+)
+
+var cmdNames = map[uint32]string{
+	hyper.INIT_VERSION:        hyperstart.Version,
+	hyper.INIT_STARTPOD:       hyperstart.StartPod,
+	hyper.INIT_DESTROYPOD:     hyperstart.DestroyPod,
+	hyper.INIT_EXECCMD:        hyperstart.ExecCmd,
+	hyper.INIT_READY:          hyperstart.Ready,
+	hyper.INIT_ACK:            hyperstart.Ack,
+	hyper.INIT_ERROR:          hyperstart.Error,
+	hyper.INIT_WINSIZE:        hyperstart.WinSize,
+	hyper.INIT_PING:           hyperstart.Ping,
+	hyper.INIT_FINISHPOD:      hyperstart.FinishPod,
+	hyper.INIT_NEXT:           hyperstart.Next,
+	hyper.INIT_WRITEFILE:      hyperstart.WriteFile,
+	hyper.INIT_READFILE:       hyperstart.ReadFile,
+	hyper.INIT_NEWCONTAINER:   hyperstart.NewContainer,
+	hyper.INIT_KILLCONTAINER:  hyperstart.KillContainer,
+	hyper.INIT_ONLINECPUMEM:   hyperstart.OnlineCPUMem,
+	hyper.INIT_SETUPINTERFACE: hyperstart.SetupInterface,
+	hyper.INIT_SETUPROUTE:     hyperstart.SetupRoute,
+}
+
+// CmdName returns the name of the hyperstart command code.
+func CmdName(code uint32) string {
+	if name, ok := cmdNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("cmd(%d)", code)
+}
+
+// CmdCode returns the code of the hyperstart command name.
+func CmdCode(name string) (uint32, bool) {
+	for code, n := range cmdNames {
+		if n == name {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// Target is what a recording is replayed against. Only the frames sent to
+// the VM are replayed, the frames received from the VM being used to check
+// the target behaves as recorded.
+type Target interface {
+	// Session is called when an I/O session was allocated at that point
+	// of the recording.
+	Session(ioBase uint64, nStreams int) error
+	// Ctl sends the control command code and returns the code of the
+	// answer, hyper.INIT_ACK or hyper.INIT_ERROR.
+	Ctl(code uint32, data []byte) (uint32, error)
+	// Io sends I/O data on the stream seq.
+	Io(seq uint64, data []byte) error
+}
+
+// Options tune how a recording is replayed.
+type Options struct {
+	// Speed factor applied to the recorded timings, 1 replaying the
+	// frames at the pace they were recorded, 2 twice as fast. <= 0 means
+	// as fast as possible.
+	Speed float64
+
+	// Called for each frame of the recording before replaying it.
+	OnFrame func(frame *Frame)
+}
+
+// Mismatch is a control command for which the target didn't answer as
+// recorded.
+type Mismatch struct {
+	Frame    *Frame
+	Expected uint32
+	Got      uint32
+}
+
+func (m *Mismatch) String() string {
+	return fmt.Sprintf("%s at %s: expected %s, got %s", CmdName(uint32(m.Frame.ID)),
+		m.Frame.Time, CmdName(m.Expected), CmdName(m.Got))
+}
+
+// Result sums up a replay.
+type Result struct {
+	// Number of frames replayed, sent to the target
+	Replayed int
+	// Number of frames read from the recording
+	Frames     int
+	Mismatches []Mismatch
+}
+
+// Replay replays the frames read from r against target.
+func Replay(r *Reader, target Target, options *Options) (*Result, error) {
+	if options == nil {
+		options = &Options{}
+	}
+
+	result := &Result{}
+	start := time.Now()
+
+	// Last control command replayed, waiting for its recorded answer
+	var pending *Frame
+	var got uint32
+
+	for {
+		frame, err := r.Next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Frames++
+
+		if options.OnFrame != nil {
+			options.OnFrame(frame)
+		}
+
+		if frame.Direction == FromVM {
+			if frame.Kind == KindCtl && pending != nil &&
+				(frame.ID == hyper.INIT_ACK || frame.ID == hyper.INIT_ERROR) {
+				if uint32(frame.ID) != got {
+					result.Mismatches = append(result.Mismatches, Mismatch{
+						Frame:    pending,
+						Expected: uint32(frame.ID),
+						Got:      got,
+					})
+				}
+				pending = nil
+			}
+			continue
+		}
+
+		if options.Speed > 0 {
+			at := time.Duration(float64(frame.Time) / options.Speed)
+			if wait := at - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		switch frame.Kind {
+		case KindSession:
+			if len(frame.Data) != 1 {
+				return result, fmt.Errorf("malformed session frame at %s", frame.Time)
+			}
+			err = target.Session(frame.ID, int(frame.Data[0]))
+		case KindCtl:
+			got, err = target.Ctl(uint32(frame.ID), frame.Data)
+			pending = frame
+		case KindIo:
+			err = target.Io(frame.ID, frame.Data)
+		default:
+			err = fmt.Errorf("unknown frame type %s", frame.Kind)
+		}
+		if err != nil {
+			return result, fmt.Errorf("%s at %s: %v", frame.Kind, frame.Time, err)
+		}
+
+		result.Replayed++
+	}
+}
+
+// hyperstartTarget replays a recording directly on hyperstart's sockets, eg.
+// on the hyperstart mock.
+type hyperstartTarget struct {
+	h *hyperstart.Hyperstart
+}
+
+// NewHyperstartTarget returns a Target talking to h. h must be connected and
+// ready.
+func NewHyperstartTarget(h *hyperstart.Hyperstart) Target {
+	return &hyperstartTarget{h}
+}
+
+func (t *hyperstartTarget) Session(ioBase uint64, nStreams int) error {
+	// Sequence numbers are used as recorded
+	return nil
+}
+
+var errCtlChannelClosed = errors.New("hyperstart control channel closed")
+
+func (t *hyperstartTarget) Ctl(code uint32, data []byte) (uint32, error) {
+	resp, err := t.h.SendCtlMessage(CmdName(code), data)
+	if _, ok := err.(net.Error); ok {
+		return 0, err
+	}
+	if err != nil {
+		return hyper.INIT_ERROR, nil
+	}
+	if resp == nil {
+		return 0, errCtlChannelClosed
+	}
+	return resp.Code, nil
+}
+
+func (t *hyperstartTarget) Io(seq uint64, data []byte) error {
+	return t.h.SendIoMessage(&hyper.TtyMessage{
+		Session: seq,
+		Message: data,
+	})
+}
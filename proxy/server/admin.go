@@ -0,0 +1,501 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+// adminConfig says where the admin API is served, see setupAdmin.
+type adminConfig struct {
+	// unix socket, empty when none
+	socket      string
+	socketMode  FileMode
+	socketGroup string
+	// localhost TCP address, empty when none
+	addr string
+}
+
+func adminConfigFrom(options *Config) adminConfig {
+	return adminConfig{
+		socket:      options.AdminSocket,
+		socketMode:  options.AdminSocketMode,
+		socketGroup: options.AdminSocketGroup,
+		addr:        options.AdminAddr,
+	}
+}
+
+// state returns the public view of vm. attached is the number of clients
+// attached to the VM and containers the pod containers registered with it.
+func (vm *vm) state(attached int, containers []string) api.VMState {
+	state := api.VMState{
+		ContainerID: vm.containerID,
+		Containers:  containers,
+		CtlSerial:   vm.ctlSerial,
+		IoSerial:    vm.ioSerial,
+		Console:     vm.console.socketPath,
+		IoSessions:  vm.numSessions(),
+		Clients:     attached,
+	}
+	if reason, lost := vm.LostReason(); lost {
+		state.Lost = reason
+	}
+	if level := int(atomic.LoadInt32(&vm.logLevel)); level != noLogLevel {
+		state.LogLevel = &level
+	}
+	return state
+}
+
+// snapshot returns the known VMs, sorted by container ID, and the connected
+// clients, sorted by ID.
+func (proxy *proxy) snapshot() ([]*vm, []*client) {
+	proxy.Lock()
+	vms := make([]*vm, 0, len(proxy.vms))
+	for _, vm := range proxy.vms {
+		vms = append(vms, vm)
+	}
+	clients := make([]*client, 0, len(proxy.clients))
+	for _, client := range proxy.clients {
+		clients = append(clients, client)
+	}
+	proxy.Unlock()
+
+	sort.Sort(byContainerID(vms))
+	sort.Sort(byClientID(clients))
+
+	return vms, clients
+}
+
+type byClientID []*client
+
+func (s byClientID) Len() int           { return len(s) }
+func (s byClientID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byClientID) Less(i, j int) bool { return s[i].id < s[j].id }
+
+func attachedClients(vm *vm, clients []*client) int {
+	n := 0
+	for _, client := range clients {
+		if client.attachedVM() == vm {
+			n++
+		}
+	}
+	return n
+}
+
+// "listVMs"
+func listVMsHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	client := userData.(*client)
+
+	proxy := client.proxy
+	vms, clients := proxy.snapshot()
+	states := make([]api.VMState, 0, len(vms))
+	for _, vm := range vms {
+		proxy.Lock()
+		containers := proxy.vmContainers(vm)
+		proxy.Unlock()
+		states = append(states, vm.state(attachedClients(vm, clients), containers))
+	}
+
+	response.SetResult(&api.ListVMsResult{VMs: states})
+}
+
+// "vmInfo"
+func vmInfoHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	client := userData.(*client)
+
+	info := api.VMInfo{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		response.SetError(invalidRequestError(err))
+		return
+	}
+
+	vm, err := client.findVM(info.ContainerID)
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+
+	proxy := client.proxy
+	_, clients := proxy.snapshot()
+	proxy.Lock()
+	containers := proxy.vmContainers(vm)
+	proxy.Unlock()
+	result := &api.VMInfoResult{
+		VM: vm.state(attachedClients(vm, clients), containers),
+	}
+	if info.Sessions {
+		result.Sessions = vm.sessions()
+	}
+	response.SetResult(result)
+}
+
+// "listClients"
+func listClientsHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	client := userData.(*client)
+
+	_, clients := client.proxy.snapshot()
+	states := make([]api.ClientState, 0, len(clients))
+	for _, c := range clients {
+		state := api.ClientState{
+			ID: c.id,
+		}
+		if c.cred != nil {
+			state.Pid = c.cred.Pid
+			state.Uid = c.cred.Uid
+		}
+		state.ContainerID = c.attachedContainer()
+		states = append(states, state)
+	}
+
+	response.SetResult(&api.ListClientsResult{Clients: states})
+}
+
+// adminServer exposes the proxy state and a few operations as a HTTP/JSON
+// API. Requests are translated into native payloads and handled by the same
+// handlers, each HTTP request being an anonymous, short lived, client. Those
+// clients share a request rate limit, the one of the protocol clients.
+type adminServer struct {
+	proxy *proxy
+	proto *Protocol
+
+	// Only GET requests are served when true
+	readOnly bool
+
+	requestsLock sync.Mutex
+	requests     *tokenBucket
+}
+
+func (proxy *proxy) adminHandler(proto *Protocol, readOnly bool) http.Handler {
+	return &adminServer{
+		proxy:    proxy,
+		proto:    proto,
+		readOnly: readOnly,
+	}
+}
+
+// requestBucket returns the token bucket rate limiting the admin requests,
+// following the changes of the limits when the configuration is reloaded.
+func (s *adminServer) requestBucket() *tokenBucket {
+	s.proxy.Lock()
+	rate, burst := s.proxy.limits.requestRate, s.proxy.limits.requestBurst
+	s.proxy.Unlock()
+
+	s.requestsLock.Lock()
+	defer s.requestsLock.Unlock()
+
+	if s.requests == nil || s.requests.rate != rate ||
+		s.requests.burst != float64(burst) {
+		s.requests = newTokenBucket(rate, burst)
+	}
+	return s.requests
+}
+
+type adminError struct {
+	Error string        `json:"error"`
+	Code  api.ErrorCode `json:"code,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	writeJSON(w, status, &adminError{Error: fmt.Sprintf(format, a...)})
+}
+
+// adminStatus returns the HTTP status of a request failing with the error
+// code.
+func adminStatus(code api.ErrorCode) int {
+	switch code {
+	case api.ErrorCodeUnknownContainer, api.ErrorCodeContainerNotInVM,
+		api.ErrorCodeNoConsole:
+		return http.StatusNotFound
+	case api.ErrorCodeInvalidRequest, api.ErrorCodeUnknownPayload,
+		api.ErrorCodeNotAttached, api.ErrorCodeNotPodContainer:
+		return http.StatusBadRequest
+	case api.ErrorCodeContainerAlreadyRegistered, api.ErrorCodeConsoleAlreadyAttached:
+		return http.StatusConflict
+	case api.ErrorCodeRateLimited, api.ErrorCodeTooManyClientIoSessions,
+		api.ErrorCodeTooManyVMIoSessions, api.ErrorCodeTooManyUserVMs:
+		return http.StatusTooManyRequests
+	case api.ErrorCodeVMLost:
+		return http.StatusGone
+	case api.ErrorCodeVMNotReady:
+		return http.StatusServiceUnavailable
+	case api.ErrorCodeAgentFailed:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// call runs the payload handler for id with data as argument, on behalf of a
+// client attached to vm (which can be nil). On success, the result named key
+// is sent back, or nothing if key is empty.
+func (s *adminServer) call(w http.ResponseWriter, vm *vm, id string, data interface{}, key string) {
+	c := &client{
+		id:       atomic.AddUint64(&nextClientID, 1) - 1,
+		proxy:    s.proxy,
+		vm:       vm,
+		requests: s.requestBucket(),
+	}
+	c.ctx = newClientCtx(nil, c)
+
+	req := api.Request{
+		ID: id,
+	}
+	if data != nil {
+		var err error
+		if req.Data, err = json.Marshal(data); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+
+	hr := HandlerResponse{}
+	resp := s.proto.handleRequest(c.ctx, &req, &hr)
+	if hr.file != nil {
+		hr.file.Close()
+	}
+
+	if !resp.Success {
+		writeJSON(w, adminStatus(resp.Code), &adminError{
+			Error: resp.Error,
+			Code:  resp.Code,
+		})
+		return
+	}
+
+	if key == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var results map[string]json.RawMessage
+	if err := json.Unmarshal(resp.Data, &results); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, results[key])
+}
+
+func checkMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeAdminError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	return false
+}
+
+// checkJSON makes sure a request changing something is sent as JSON. HTML
+// forms can't do that, which keeps web pages from having a browser send
+// those requests.
+func checkJSON(w http.ResponseWriter, r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && mediaType == "application/json" {
+		return true
+	}
+	writeAdminError(w, http.StatusUnsupportedMediaType,
+		"Content-Type must be application/json")
+	return false
+}
+
+func (s *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.readOnly && r.Method != "GET" {
+		writeAdminError(w, http.StatusForbidden,
+			"read-only admin API, %s needs the admin socket", r.Method)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	// /vms, /clients
+	if len(parts) == 1 {
+		switch parts[0] {
+		case "vms":
+			if checkMethod(w, r, "GET") {
+				s.call(w, nil, "listVMs", nil, "vms")
+			}
+			return
+		case "clients":
+			if checkMethod(w, r, "GET") {
+				s.call(w, nil, "listClients", nil, "clients")
+			}
+			return
+		}
+	}
+
+	if len(parts) < 2 || parts[0] != "vms" {
+		writeAdminError(w, http.StatusNotFound, "%s not found", r.URL.Path)
+		return
+	}
+
+	containerID := parts[1]
+	s.proxy.Lock()
+	vm := s.proxy.lookupVM(containerID)
+	s.proxy.Unlock()
+	if vm == nil {
+		writeAdminError(w, http.StatusNotFound, "unknown containerID: %s", containerID)
+		return
+	}
+
+	switch {
+	// /vms/{id}
+	case len(parts) == 2:
+		switch r.Method {
+		case "GET":
+			s.call(w, nil, "vmInfo", &api.VMInfo{ContainerID: containerID}, "vm")
+		case "DELETE":
+			if checkJSON(w, r) {
+				s.call(w, nil, "bye", &api.Bye{ContainerID: containerID}, "")
+			}
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			writeAdminError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		}
+	// /vms/{id}/sessions
+	case len(parts) == 3 && parts[2] == "sessions":
+		if checkMethod(w, r, "GET") {
+			s.call(w, nil, "vmInfo",
+				&api.VMInfo{ContainerID: containerID, Sessions: true}, "sessions")
+		}
+	// /vms/{id}/hyper/{cmd}, the request body being the command data
+	case len(parts) == 4 && parts[2] == "hyper":
+		if !checkMethod(w, r, "POST") || !checkJSON(w, r) {
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		hyper := api.Hyper{
+			HyperName: parts[3],
+		}
+		if len(strings.TrimSpace(string(body))) > 0 {
+			var data json.RawMessage
+			if err := json.Unmarshal(body, &data); err != nil {
+				writeAdminError(w, http.StatusBadRequest, "invalid command data: %v", err)
+				return
+			}
+			hyper.Data = data
+		}
+		s.call(w, vm, "hyper", &hyper, "")
+	default:
+		writeAdminError(w, http.StatusNotFound, "%s not found", r.URL.Path)
+	}
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// adminListener only accepts the connections of the processes the
+// authorization policy allows, as the proxy socket does.
+type adminListener struct {
+	net.Listener
+	proxy *proxy
+}
+
+func (l *adminListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		cred, err := getPeerCred(conn)
+		if err != nil {
+			cred = nil
+		}
+		l.proxy.Lock()
+		allowed := l.proxy.auth.allows(cred)
+		l.proxy.Unlock()
+		if allowed {
+			return conn, nil
+		}
+
+		l.proxy.metrics.errors.Inc(errorUnauthorized)
+		l.proxy.log.infof(1, "admin client not allowed by the authorization policy")
+		conn.Close()
+	}
+}
+
+// setupAdmin starts serving the admin API on the unix socket and/or on the
+// localhost TCP address of config, whichever is not empty. The TCP address,
+// any local process being able to connect to it, only serves GET requests.
+func (proxy *proxy) setupAdmin(proto *Protocol, config adminConfig) error {
+	if config.socket != "" {
+		socketPath := config.socket
+		if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("couldn't remove existing admin socket: %v", err)
+		}
+		l, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return fmt.Errorf("couldn't create admin socket: %v", err)
+		}
+		if err = setSocketOwnership(socketPath, config.socketMode, config.socketGroup); err != nil {
+			l.Close()
+			return fmt.Errorf("admin socket: %v", err)
+		}
+		proxy.log.infof(1, "admin API listening on %s", socketPath)
+		proxy.Lock()
+		proxy.adminListeners = append(proxy.adminListeners, l)
+		proxy.Unlock()
+		go http.Serve(&adminListener{l, proxy}, proxy.adminHandler(proto, false))
+	}
+
+	if addr := config.addr; addr != "" {
+		// The TCP address isn't authenticated, don't expose it
+		if !isLoopback(addr) {
+			return fmt.Errorf("admin address %s isn't a localhost address", addr)
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("couldn't listen on admin address: %v", err)
+		}
+		proxy.log.infof(1, "read-only admin API listening on http://%s", addr)
+		proxy.Lock()
+		proxy.adminListeners = append(proxy.adminListeners, l)
+		proxy.Unlock()
+		go http.Serve(l, proxy.adminHandler(proto, true))
+	}
+
+	return nil
+}
@@ -0,0 +1,363 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/containers/virtcontainers/hyperstart/mock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntrospection(t *testing.T) {
+	rig := newTestRig(t, newProxyProtocol())
+	rig.Start()
+
+	vms, err := rig.Client.ListVMs()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(vms))
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err = rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath, nil)
+	assert.Nil(t, err)
+
+	ioBase, ioFile, err := rig.Client.AllocateIo(2)
+	assert.Nil(t, err)
+	ioFile.Close()
+
+	expected := api.VMState{
+		ContainerID: testContainerID,
+		CtlSerial:   ctlSocketPath,
+		IoSerial:    ioSocketPath,
+		IoSessions:  1,
+		Clients:     1,
+	}
+
+	vms, err = rig.Client.ListVMs()
+	assert.Nil(t, err)
+	assert.Equal(t, []api.VMState{expected}, vms)
+
+	info, err := rig.Client.VMInfo(testContainerID, false)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, info.VM)
+	assert.Nil(t, info.Sessions)
+
+	// An empty containerID means the VM we're attached to
+	info, err = rig.Client.VMInfo("", true)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, info.VM)
+	assert.Equal(t, 1, len(info.Sessions))
+	assert.Equal(t, ioBase, info.Sessions[0].IoBase)
+	assert.Equal(t, 2, info.Sessions[0].NStreams)
+
+	_, err = rig.Client.VMInfo("foo", false)
+	assert.NotNil(t, err)
+
+	clients, err := rig.Client.ListClients()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(clients))
+	assert.Equal(t, testContainerID, clients[0].ContainerID)
+	assert.Equal(t, clients[0].ID, info.Sessions[0].ClientID)
+
+	rig.Stop()
+}
+
+// adminRequest sends a request to handler, as JSON unless it's a GET.
+func adminRequest(t *testing.T, handler http.Handler, method, path, body string) (int, []byte) {
+	contentType := ""
+	if method != "GET" {
+		contentType = "application/json"
+	}
+	return adminRequestType(t, handler, method, path, contentType, body)
+}
+
+func adminRequestType(t *testing.T, handler http.Handler, method, path, contentType, body string) (int, []byte) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w.Code, w.Body.Bytes()
+}
+
+func TestAdminAPI(t *testing.T) {
+	proto := newProxyProtocol()
+	rig := newTestRig(t, proto)
+	rig.Start()
+
+	handler := rig.proxy.adminHandler(proto, false)
+
+	code, body := adminRequest(t, handler, "GET", "/vms", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]\n", string(body))
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err := rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath, nil)
+	assert.Nil(t, err)
+
+	ioBase, ioFile, err := rig.Client.AllocateIo(1)
+	assert.Nil(t, err)
+	ioFile.Close()
+
+	// List and inspect VMs
+	code, body = adminRequest(t, handler, "GET", "/vms", "")
+	assert.Equal(t, http.StatusOK, code)
+	var vms []api.VMState
+	assert.Nil(t, json.Unmarshal(body, &vms))
+	assert.Equal(t, 1, len(vms))
+	assert.Equal(t, testContainerID, vms[0].ContainerID)
+
+	code, body = adminRequest(t, handler, "GET", "/vms/"+testContainerID, "")
+	assert.Equal(t, http.StatusOK, code)
+	var vm api.VMState
+	assert.Nil(t, json.Unmarshal(body, &vm))
+	assert.Equal(t, vms[0], vm)
+
+	code, body = adminRequest(t, handler, "GET", "/vms/"+testContainerID+"/sessions", "")
+	assert.Equal(t, http.StatusOK, code)
+	var sessions []api.SessionState
+	assert.Nil(t, json.Unmarshal(body, &sessions))
+	assert.Equal(t, 1, len(sessions))
+	assert.Equal(t, ioBase, sessions[0].IoBase)
+
+	code, body = adminRequest(t, handler, "GET", "/clients", "")
+	assert.Equal(t, http.StatusOK, code)
+	var clients []api.ClientState
+	assert.Nil(t, json.Unmarshal(body, &clients))
+	assert.Equal(t, 1, len(clients))
+
+	// Send a command to hyperstart
+	code, _ = adminRequest(t, handler, "POST", "/vms/"+testContainerID+"/hyper/ping", "")
+	assert.Equal(t, http.StatusNoContent, code)
+
+	code, _ = adminRequest(t, handler, "POST", "/vms/"+testContainerID+"/hyper/ping", "{")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, body = adminRequest(t, handler, "POST", "/vms/"+testContainerID+"/hyper/foo", "")
+	assert.Equal(t, http.StatusBadGateway, code)
+	var adminErr adminError
+	assert.Nil(t, json.Unmarshal(body, &adminErr))
+	assert.NotEqual(t, "", adminErr.Error)
+	assert.Equal(t, api.ErrorCodeAgentFailed, adminErr.Code)
+
+	// Errors
+	code, _ = adminRequest(t, handler, "GET", "/foo", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = adminRequest(t, handler, "GET", "/vms/foo", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = adminRequest(t, handler, "GET", "/vms/"+testContainerID+"/foo", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = adminRequest(t, handler, "POST", "/vms", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	code, _ = adminRequest(t, handler, "PUT", "/vms/"+testContainerID, "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// Requests changing something have to be sent as JSON
+	for _, contentType := range []string{"", "application/x-www-form-urlencoded", "text/plain"} {
+		code, _ = adminRequestType(t, handler, "POST", "/vms/"+testContainerID+"/hyper/ping",
+			contentType, "")
+		assert.Equal(t, http.StatusUnsupportedMediaType, code, contentType)
+		code, _ = adminRequestType(t, handler, "DELETE", "/vms/"+testContainerID,
+			contentType, "")
+		assert.Equal(t, http.StatusUnsupportedMediaType, code, contentType)
+	}
+	code, _ = adminRequestType(t, handler, "POST", "/vms/"+testContainerID+"/hyper/ping",
+		"application/json; charset=utf-8", "")
+	assert.Equal(t, http.StatusNoContent, code)
+
+	// Unregister the VM
+	code, _ = adminRequest(t, handler, "DELETE", "/vms/"+testContainerID, "")
+	assert.Equal(t, http.StatusNoContent, code)
+
+	code, body = adminRequest(t, handler, "GET", "/vms", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]\n", string(body))
+
+	rig.Stop()
+}
+
+// The admin TCP address only serves GET requests
+func TestAdminReadOnly(t *testing.T) {
+	proto := newProxyProtocol()
+	rig := newTestRig(t, proto)
+	rig.Start()
+
+	handler := rig.proxy.adminHandler(proto, true)
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err := rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath, nil)
+	assert.Nil(t, err)
+
+	code, _ := adminRequest(t, handler, "GET", "/vms/"+testContainerID, "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = adminRequest(t, handler, "POST", "/vms/"+testContainerID+"/hyper/ping", "")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = adminRequest(t, handler, "DELETE", "/vms/"+testContainerID, "")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	vms, err := rig.Client.ListVMs()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(vms))
+
+	rig.Stop()
+}
+
+// Admin requests are rate limited as the protocol clients are
+func TestAdminRateLimit(t *testing.T) {
+	proto := newProxyProtocol()
+	rig := newTestRig(t, proto)
+	rig.Start()
+
+	handler := rig.proxy.adminHandler(proto, false)
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err := rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath, nil)
+	assert.Nil(t, err)
+
+	rig.proxy.Lock()
+	rig.proxy.limits.requestRate = 0.001
+	rig.proxy.limits.requestBurst = 1
+	rig.proxy.Unlock()
+
+	code, _ := adminRequest(t, handler, "GET", "/vms", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = adminRequest(t, handler, "GET", "/vms", "")
+	assert.Equal(t, http.StatusTooManyRequests, code)
+
+	// Reloaded limits apply right away
+	rig.proxy.Lock()
+	rig.proxy.limits.requestRate = 0
+	rig.proxy.Unlock()
+
+	code, _ = adminRequest(t, handler, "GET", "/vms", "")
+	assert.Equal(t, http.StatusOK, code)
+
+	rig.Stop()
+}
+
+// The admin socket has the configured permissions and follows the
+// authorization policy
+func TestAdminSocket(t *testing.T) {
+	proto := newProxyProtocol()
+	rig := newTestRig(t, proto)
+	rig.Start()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err := rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath, nil)
+	assert.Nil(t, err)
+
+	path := mock.GetTmpPath("test-admin.%s.sock")
+	defer os.Remove(path)
+	err = rig.proxy.setupAdmin(proto, adminConfig{
+		socket:      path,
+		socketMode:  0600,
+		socketGroup: strconv.Itoa(os.Getgid()),
+	})
+	assert.Nil(t, err)
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	uid := uint32(os.Getuid())
+	rig.proxy.Lock()
+	if uid == 0 {
+		// root is always allowed, deny everyone else
+		rig.proxy.auth.uids = map[uint32]bool{1: true}
+	} else {
+		rig.proxy.auth.uids = map[uint32]bool{uid + 1: true}
+	}
+	rig.proxy.Unlock()
+
+	if uid != 0 {
+		_, err = client.Get("http://admin/vms")
+		assert.NotNil(t, err)
+	}
+
+	rig.proxy.Lock()
+	rig.proxy.auth.uids[uid] = true
+	rig.proxy.Unlock()
+
+	resp, err := client.Get("http://admin/vms")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	rig.proxy.Lock()
+	for _, l := range rig.proxy.adminListeners {
+		l.Close()
+	}
+	rig.proxy.adminListeners = nil
+	rig.proxy.Unlock()
+
+	rig.Stop()
+}
+
+func TestAdminStatus(t *testing.T) {
+	tests := []struct {
+		code   api.ErrorCode
+		status int
+	}{
+		{api.ErrorCodeUnknownContainer, http.StatusNotFound},
+		{api.ErrorCodeInvalidRequest, http.StatusBadRequest},
+		{api.ErrorCodeUnknownPayload, http.StatusBadRequest},
+		{api.ErrorCodeRateLimited, http.StatusTooManyRequests},
+		{api.ErrorCodeTooManyUserVMs, http.StatusTooManyRequests},
+		{api.ErrorCodeInternal, http.StatusInternalServerError},
+		{"", http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.status, adminStatus(test.code), string(test.code))
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := []struct {
+		addr     string
+		loopback bool
+	}{
+		{"localhost:8080", true},
+		{"127.0.0.1:8080", true},
+		{"[::1]:8080", true},
+		{"0.0.0.0:8080", false},
+		{":8080", false},
+		{"192.168.1.1:8080", false},
+		{"localhost", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.loopback, isLoopback(test.addr), test.addr)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// An Agent is the process running inside the VM the proxy talks to. The
+// proxy forwards the commands of its clients to the agent, and multiplexes
+// the I/O streams of the processes running in the VM, each stream being
+// identified by a sequence number.
+//
+// The ctl/io protocol between the runtime, shims and the proxy is the
+// hyperstart one, command names included, whatever the agent.
+type Agent interface {
+	// Connect establishes the connection to the agent, waiting until
+	// deadline for the VM to accept it. A zero deadline means a single
+	// attempt.
+	Connect(deadline time.Time) error
+	// WaitReady waits for the agent to be ready to receive commands,
+	// until deadline when not zero. Exceeding the deadline returns an
+	// error with a Timeout() method returning true.
+	WaitReady(deadline time.Time) error
+	// SendCommand executes the command cmd, returning the data sent back
+	// by the agent. Errors of the underlying transport, meaning the VM is
+	// gone, are returned as *ChannelError.
+	SendCommand(cmd string, data []byte) ([]byte, error)
+	// ReadStream returns the next chunk of data sent by the agent on one
+	// of the I/O streams. An empty chunk signals the end of the stream.
+	// It's called from a single goroutine and data only has to be valid
+	// until the next call.
+	ReadStream() (seq uint64, data []byte, err error)
+	// WriteStream sends data to the agent on the stream seq. data is
+	// reused once WriteStream returns.
+	WriteStream(seq uint64, data []byte) error
+	// Close tears down the connection to the agent. It can be called
+	// whether Connect has been called or not.
+	Close()
+}
+
+// streamBuffer is implemented by agents reading the I/O streams through a
+// buffer, to let the proxy know when more data is there already and writing
+// to the clients can wait.
+type streamBuffer interface {
+	// StreamBuffered returns true when ReadStream has data buffered.
+	StreamBuffered() bool
+}
+
+// streamConn is implemented by agents whose I/O streams are frames on a
+// socket, for the event loop to read and write them directly instead of going
+// through ReadStream and WriteStream.
+type streamConn interface {
+	// StreamConn returns the socket carrying the I/O streams, once
+	// connected.
+	StreamConn() net.Conn
+}
+
+// ChannelError wraps the errors of the transport between the proxy and the
+// agent, a sign the VM is gone.
+type ChannelError struct {
+	// Error of the transport, eg. io.EOF
+	Err error
+}
+
+// Error implements error.
+func (e *ChannelError) Error() string {
+	return fmt.Sprintf("agent channel: %v", e.Err)
+}
+
+// Timeout is true when the error is due to a deadline being exceeded.
+func (e *ChannelError) Timeout() bool {
+	timeout, ok := e.Err.(interface {
+		Timeout() bool
+	})
+	return ok && timeout.Timeout()
+}
+
+// NewAgentFunc creates an agent for the VM whose channels are at the ctl and
+// io endpoints given to hello.
+type NewAgentFunc func(ctlSerial, ioSerial string) (Agent, error)
+
+// defaultAgent is the agent used when hello doesn't name one.
+const defaultAgent = "hyperstart"
+
+// agents are the agent backends every proxy knows about, indexed by the name
+// given to hello. More can be added with the WithAgent option.
+var agents = map[string]NewAgentFunc{
+	"hyperstart": newHyperstartAgent,
+}
+
+// newAgent creates an agent of the backend name.
+func (proxy *proxy) newAgent(name, ctlSerial, ioSerial string) (Agent, error) {
+	if name == "" {
+		name = defaultAgent
+	}
+
+	newFunc, ok := proxy.agents[name]
+	if !ok {
+		names := make([]string, 0, len(proxy.agents))
+		for n := range proxy.agents {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown agent '%s', expected one of %v", name, names)
+	}
+
+	return newFunc(ctlSerial, ioSerial)
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryCommand struct {
+	cmd  string
+	data []byte
+}
+
+type memoryChunk struct {
+	seq  uint64
+	data []byte
+}
+
+// memoryAgent is an agent living in the test process: the test drives it
+// through channels.
+type memoryAgent struct {
+	// Closed by the test to make the agent ready
+	ready chan struct{}
+	// Commands received by the agent
+	commands chan memoryCommand
+	// Stream data the agent sends to the proxy
+	fromVM chan memoryChunk
+	// Stream data the agent receives from the proxy
+	toVM chan memoryChunk
+	// Closed when the VM goes away, see exit()
+	gone     chan struct{}
+	goneOnce sync.Once
+}
+
+func newMemoryAgent() *memoryAgent {
+	return &memoryAgent{
+		ready:    make(chan struct{}),
+		commands: make(chan memoryCommand, 16),
+		fromVM:   make(chan memoryChunk),
+		toVM:     make(chan memoryChunk, 16),
+		gone:     make(chan struct{}),
+	}
+}
+
+type memoryTimeout struct{}
+
+func (e memoryTimeout) Error() string { return "timeout" }
+func (e memoryTimeout) Timeout() bool { return true }
+
+func (a *memoryAgent) Connect(deadline time.Time) error {
+	return nil
+}
+
+func (a *memoryAgent) WaitReady(deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timeout = time.After(time.Until(deadline))
+	}
+
+	select {
+	case <-a.ready:
+		return nil
+	case <-a.gone:
+		return &ChannelError{io.EOF}
+	case <-timeout:
+		return &ChannelError{memoryTimeout{}}
+	}
+}
+
+func (a *memoryAgent) SendCommand(cmd string, data []byte) ([]byte, error) {
+	select {
+	case <-a.gone:
+		return nil, &ChannelError{io.EOF}
+	default:
+	}
+
+	a.commands <- memoryCommand{cmd, data}
+	if cmd == "error" {
+		return nil, fmt.Errorf("command failed")
+	}
+	return nil, nil
+}
+
+func (a *memoryAgent) ReadStream() (uint64, []byte, error) {
+	select {
+	case chunk := <-a.fromVM:
+		return chunk.seq, chunk.data, nil
+	case <-a.gone:
+		return 0, nil, io.EOF
+	}
+}
+
+func (a *memoryAgent) WriteStream(seq uint64, data []byte) error {
+	// data is reused once we return
+	a.toVM <- memoryChunk{seq, append([]byte(nil), data...)}
+	return nil
+}
+
+// exit simulates the VM going away.
+func (a *memoryAgent) exit() {
+	a.goneOnce.Do(func() {
+		close(a.gone)
+	})
+}
+
+func (a *memoryAgent) Close() {
+	a.exit()
+}
+
+// The memory agents a test can use, indexed by the ctl endpoint given to
+// hello.
+var memoryAgents = struct {
+	sync.Mutex
+	agents map[string]*memoryAgent
+}{
+	agents: make(map[string]*memoryAgent),
+}
+
+func registerMemoryAgent(name string, a *memoryAgent) {
+	memoryAgents.Lock()
+	memoryAgents.agents[name] = a
+	memoryAgents.Unlock()
+}
+
+func init() {
+	agents["memory"] = func(ctlSerial, ioSerial string) (Agent, error) {
+		memoryAgents.Lock()
+		defer memoryAgents.Unlock()
+
+		a, ok := memoryAgents.agents[ctlSerial]
+		if !ok {
+			return nil, fmt.Errorf("no memory agent %s", ctlSerial)
+		}
+		return a, nil
+	}
+}
+
+func TestMemoryAgent(t *testing.T) {
+	rig := newTestRig(t, newProxyProtocol())
+	rig.Start()
+
+	a := newMemoryAgent()
+	registerMemoryAgent("memory-1", a)
+	close(a.ready)
+
+	_, err := rig.Client.Hello("memory", "memory-1", "memory-1",
+		&api.HelloOptions{Agent: "memory", Notifications: true})
+	assert.Nil(t, err)
+
+	// Commands
+	err = rig.Client.Hyper("ping", nil)
+	assert.Nil(t, err)
+	cmd := <-a.commands
+	assert.Equal(t, "ping", cmd.cmd)
+
+	err = rig.Client.Hyper("error", nil)
+	assert.NotNil(t, err)
+	<-a.commands
+
+	// Streams
+	ioBase, ioFile, err := rig.Client.AllocateIo(1)
+	assert.Nil(t, err)
+
+	a.fromVM <- memoryChunk{ioBase, []byte("stdout\n")}
+	seq, data := readIo(t, ioFile)
+	assert.Equal(t, ioBase, seq)
+	assert.Equal(t, "stdout\n", string(data))
+
+	writeIo(t, ioFile, ioBase, []byte("stdin\n"))
+	chunk := <-a.toVM
+	assert.Equal(t, ioBase, chunk.seq)
+	assert.Equal(t, "stdin\n", string(chunk.data))
+
+	// The VM going away
+	a.exit()
+
+	notification, err := rig.Client.WaitNotification()
+	assert.Nil(t, err)
+	assert.Equal(t, "vmLost", notification.ID)
+	vmLost := api.VMLost{}
+	err = json.Unmarshal(notification.Data, &vmLost)
+	assert.Nil(t, err)
+	assert.Equal(t, "memory", vmLost.ContainerID)
+	assert.Equal(t, api.VMLostIoEOF, vmLost.Reason)
+
+	ioFile.Close()
+
+	helloRig(t, rig)
+	rig.Stop()
+}
+
+func TestUnknownAgent(t *testing.T) {
+	rig := newTestRig(t, newProxyProtocol())
+	rig.Start()
+
+	_, err := rig.Client.Hello("unknown", "ctl", "io", &api.HelloOptions{Agent: "foo"})
+	assert.NotNil(t, err)
+
+	helloRig(t, rig)
+	rig.Stop()
+}
+
+// The ctl messages hyperstart sends are bounded like the I/O frames
+func TestHyperstartCtlMessageTooLong(t *testing.T) {
+	proxyEnd, vmEnd := net.Pipe()
+	defer proxyEnd.Close()
+	defer vmEnd.Close()
+
+	h := &hyperstartAgent{ctl: proxyEnd}
+
+	go func() {
+		header := make([]byte, ctlHeaderSize)
+		binary.BigEndian.PutUint32(header, hyper.INIT_ACK)
+		binary.BigEndian.PutUint32(header[4:], 0xffffffff)
+		vmEnd.Write(header)
+	}()
+
+	_, err := h.readCtlMessage()
+	_, ok := err.(*ChannelError)
+	assert.True(t, ok, "%v", err)
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// authConfig is the authorization policy: who can use the proxy socket, on
+// top of what the socket permissions allow. Clients are identified by the
+// credentials of the process at the other end of the socket, root being
+// always allowed.
+type authConfig struct {
+	// uids and primary gids of the processes allowed to connect. Everyone
+	// is when both are empty.
+	uids map[uint32]bool
+	gids map[uint32]bool
+}
+
+// lookupUser returns the uid of user, a user name or a numeric uid.
+func lookupUser(name string) (int, error) {
+	if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// parseIDs parses list, a comma separated list of names or numeric IDs looked
+// up with lookup.
+func parseIDs(list string, lookup func(string) (int, error)) (map[uint32]bool, error) {
+	ids := make(map[uint32]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, err := lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		if id < 0 {
+			return nil, fmt.Errorf("invalid id %d", id)
+		}
+		ids[uint32(id)] = true
+	}
+	return ids, nil
+}
+
+func authConfigFrom(options *Config) (authConfig, error) {
+	var config authConfig
+	var err error
+
+	if config.uids, err = parseIDs(options.AllowedUsers, lookupUser); err != nil {
+		return config, fmt.Errorf("-allowed-users: %v", err)
+	}
+	if config.gids, err = parseIDs(options.AllowedGroups, lookupGroup); err != nil {
+		return config, fmt.Errorf("-allowed-groups: %v", err)
+	}
+
+	return config, nil
+}
+
+// allows returns true if the process with the credentials cred can use the
+// proxy. cred is nil when the credentials couldn't be retrieved, those
+// clients are only allowed when there's no restriction.
+func (config authConfig) allows(cred *syscall.Ucred) bool {
+	if len(config.uids) == 0 && len(config.gids) == 0 {
+		return true
+	}
+	if cred == nil {
+		return false
+	}
+
+	return cred.Uid == 0 || config.uids[cred.Uid] || config.gids[cred.Gid]
+}
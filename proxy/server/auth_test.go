@@ -0,0 +1,104 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthConfigFrom(t *testing.T) {
+	options := DefaultConfig()
+
+	config, err := authConfigFrom(options)
+	assert.Nil(t, err)
+	assert.True(t, config.allows(nil))
+
+	options.AllowedUsers = "root, 1000,"
+	options.AllowedGroups = "0"
+	config, err = authConfigFrom(options)
+	assert.Nil(t, err)
+	assert.Equal(t, map[uint32]bool{0: true, 1000: true}, config.uids)
+	assert.Equal(t, map[uint32]bool{0: true}, config.gids)
+
+	for _, users := range []string{"-1", "cc-proxy-no-such-user"} {
+		options.AllowedUsers = users
+		_, err = authConfigFrom(options)
+		assert.NotNil(t, err, users)
+	}
+}
+
+func TestAuthConfigAllows(t *testing.T) {
+	config := authConfig{
+		uids: map[uint32]bool{1000: true},
+		gids: map[uint32]bool{100: true},
+	}
+
+	tests := []struct {
+		cred    *syscall.Ucred
+		allowed bool
+	}{
+		{nil, false},
+		{&syscall.Ucred{Uid: 0, Gid: 0}, true},
+		{&syscall.Ucred{Uid: 1000, Gid: 1000}, true},
+		{&syscall.Ucred{Uid: 1001, Gid: 100}, true},
+		{&syscall.Ucred{Uid: 1001, Gid: 1001}, false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.allowed, config.allows(test.cred), "%+v", test.cred)
+	}
+}
+
+// Clients the authorization policy doesn't allow are disconnected
+func TestAuthorization(t *testing.T) {
+	l, path := listenTestServer(t)
+	defer os.Remove(path)
+	srv, err := New(WithListener(l))
+	assert.Nil(t, err)
+
+	uid := uint32(os.Getuid())
+	if uid == 0 {
+		// root is always allowed, deny everyone else
+		srv.proxy.auth.uids = map[uint32]bool{1: true}
+	} else {
+		srv.proxy.auth.uids = map[uint32]bool{uid + 1: true}
+	}
+	go srv.Serve(context.Background())
+
+	if uid != 0 {
+		client := dialTestServer(t, path)
+		_, err = client.ListVMs()
+		assert.NotNil(t, err)
+		client.Close()
+	}
+
+	srv.proxy.Lock()
+	srv.proxy.auth.uids[uid] = true
+	srv.proxy.Unlock()
+
+	client := dialTestServer(t, path)
+	_, err = client.ListVMs()
+	assert.Nil(t, err)
+	client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, srv.Shutdown(ctx))
+}
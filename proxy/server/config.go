@@ -0,0 +1,447 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+// The configuration file is a JSON object whose keys are command line option
+// names, without the leading dash, eg.:
+//
+//  {
+//    "socket-group": "kvm",
+//    "v": 1,
+//    "console-log-dir": "/var/log/cc-proxy/console",
+//    "max-client-io-sessions": 64,
+//    "vm-lost-grace-period": "30s"
+//  }
+//
+// Options given on the command line take precedence over the configuration
+// file.
+
+// Config holds the values of the cc-proxy command line options, the flags of
+// the cc-proxy command being bound to its fields. See FromFlags.
+type Config struct {
+	// Path of a JSON configuration file setting the flags, -config
+	ConfigFile string
+
+	// Proxy socket, when not socket activated, its permissions, those of
+	// its directory if it's created, and its group
+	SocketPath    string
+	SocketMode    FileMode
+	SocketDirMode FileMode
+	SocketGroup   string
+
+	// Admin API unix socket, its permissions and group, and localhost TCP
+	// address. See the Admin API section of the README.
+	AdminSocket      string
+	AdminSocketMode  FileMode
+	AdminSocketGroup string
+	AdminAddr        string
+
+	// Comma separated lists of the users and groups, names or IDs,
+	// allowed to use the proxy. Everyone is when both are empty.
+	AllowedUsers  string
+	AllowedGroups string
+
+	// VM console capture: lines kept in memory, log files and rate limit
+	// in bytes per second
+	ConsoleBufferLines int
+	ConsoleLogDir      string
+	ConsoleLogMaxSize  int64
+	ConsoleLogMaxFiles int
+	ConsoleRate        float64
+	ConsoleBurst       int
+
+	// Traffic recordings directory, and whether all VMs are recorded
+	RecordDir string
+	RecordAll bool
+
+	// Quotas and rate limits, see Limits. 0 means no limit.
+	MaxClientIoSessions int
+	MaxVMIoSessions     int
+	MaxUserVMs          int
+	ClientRequestRate   float64
+	ClientRequestBurst  int
+	// Maximum size, in bytes, of the requests clients send
+	MaxMessageSize int
+
+	// Log format (glog, json or logfmt), whether logs go to journald and
+	// the log level SIGUSR1 toggles
+	LogFormat     string
+	LogJournald   bool
+	DebugLogLevel int
+
+	// How long a lost VM stays registered, how long hello waits for a VM
+	// by default (0 for no limit) and how often the VM agents are pinged
+	// (0 for never)
+	VMLostGracePeriod   time.Duration
+	HelloTimeout        time.Duration
+	HealthCheckInterval time.Duration
+
+	// Forward the I/O streams from an epoll event loop
+	EventLoop bool
+}
+
+// DefaultConfig returns the default values of the cc-proxy options.
+func DefaultConfig() *Config {
+	return &Config{
+		SocketMode:         0660,
+		SocketDirMode:      0750,
+		AdminSocketMode:    0660,
+		ConsoleBufferLines: defaultConsoleConfig.bufferLines,
+		ConsoleLogMaxSize:  defaultConsoleConfig.logMaxSize,
+		ConsoleLogMaxFiles: defaultConsoleConfig.logMaxFiles,
+		ConsoleRate:        defaultConsoleConfig.rate,
+		ConsoleBurst:       defaultConsoleConfig.burst,
+		ClientRequestBurst: 50,
+		MaxMessageSize:     api.DefaultMaxMessageSize,
+		LogFormat:          logFormatGlog,
+		DebugLogLevel:      2,
+		VMLostGracePeriod:  defaultVMLostGracePeriod,
+	}
+}
+
+// FileMode is a flag.Value holding file permission bits, written in octal.
+type FileMode os.FileMode
+
+// String implements flag.Value.
+func (m *FileMode) String() string {
+	return fmt.Sprintf("%#o", os.FileMode(*m).Perm())
+}
+
+// Set implements flag.Value.
+func (m *FileMode) Set(value string) error {
+	v, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || os.FileMode(v)&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid file mode '%s'", value)
+	}
+	*m = FileMode(v)
+	return nil
+}
+
+// configState is what the proxy keeps around to reload its configuration.
+type configState struct {
+	// The option values, flags being bound to them. flags is nil when the
+	// Server wasn't configured with FromFlags.
+	options *Config
+	flags   *flag.FlagSet
+	// Path of the configuration file, empty when there's none
+	path string
+	// Option values from the configuration file, as last applied
+	values map[string]string
+	// Options given on the command line
+	cmdline map[string]bool
+}
+
+// reloadableOptions are the options that are taken into account when
+// reloading the configuration file. Changing any other option needs a
+// restart.
+var reloadableOptions = map[string]bool{
+	"v":                      true,
+	"debug-log-level":        true,
+	"console-buffer-lines":   true,
+	"console-log-dir":        true,
+	"console-log-max-size":   true,
+	"console-log-max-files":  true,
+	"console-rate":           true,
+	"console-burst":          true,
+	"record-dir":             true,
+	"record-all":             true,
+	"max-client-io-sessions": true,
+	"max-vm-io-sessions":     true,
+	"max-user-vms":           true,
+	"client-request-rate":    true,
+	"client-request-burst":   true,
+	"vm-lost-grace-period":   true,
+	"hello-timeout":          true,
+	"health-check-interval":  true,
+	"allowed-users":          true,
+	"allowed-groups":         true,
+}
+
+// configValue converts a JSON value to a string flag.Set understands.
+func configValue(v interface{}) (string, error) {
+	switch value := v.(type) {
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("unexpected value %v", v)
+	}
+}
+
+// loadConfigFile parses the configuration file at path, returning the option
+// values it contains. They have to be flags of fs.
+func loadConfigFile(fs *flag.FlagSet, path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	values := make(map[string]string)
+	for name, v := range raw {
+		if name == "config" || fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s: unknown option '%s'", path, name)
+		}
+		value, err := configValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+		values[name] = value
+	}
+
+	return values, nil
+}
+
+// commandLineOptions returns the set of options of fs explicitly given on
+// the command line.
+func commandLineOptions(fs *flag.FlagSet) map[string]bool {
+	options := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		options[f.Name] = true
+	})
+	return options
+}
+
+// optionsLock serializes the accesses to the option values once serving: they
+// are changed by configuration reloads, the debug log level toggle and
+// setLogLevel requests, from different goroutines.
+var optionsLock sync.Mutex
+
+// optionValues returns the current value of all the options of fs.
+func optionValues(fs *flag.FlagSet) map[string]string {
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+// restoreOptions sets the options of fs back to values, as returned by
+// optionValues.
+func restoreOptions(fs *flag.FlagSet, values map[string]string) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if value, ok := values[f.Name]; ok && f.Value.String() != value {
+			f.Value.Set(value)
+		}
+	})
+}
+
+// applyConfig sets the options to their values in the configuration file.
+// previous holds the values of the configuration file applied before, if any:
+// options that have disappeared from the file are set back to their default
+// value. Options given on the command line are left untouched.
+//
+// When reloading, only reloadableOptions are changed and the other options
+// whose value would have changed are returned in needRestart.
+func applyConfig(fs *flag.FlagSet, values, previous map[string]string, cmdline map[string]bool,
+	reloading bool) (changed, needRestart []string, err error) {
+	names := make([]string, 0, len(values)+len(previous))
+	for name := range values {
+		names = append(names, name)
+	}
+	for name := range previous {
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var errs []string
+
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil || name == "config" || cmdline[name] {
+			continue
+		}
+
+		if reloading && !reloadableOptions[name] {
+			if values[name] != previous[name] {
+				needRestart = append(needRestart, name)
+			}
+			continue
+		}
+
+		value, ok := values[name]
+		if !ok {
+			value = f.DefValue
+		}
+
+		old := f.Value.String()
+		if err := f.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		if f.Value.String() != old {
+			changed = append(changed, name+"="+f.Value.String())
+		}
+	}
+
+	if len(errs) > 0 {
+		err = fmt.Errorf("invalid options: %s", strings.Join(errs, ", "))
+	}
+
+	return
+}
+
+// loadConfig applies the configuration file of options, if any, to the flags
+// of fs, which are bound to the fields of options. It's called before reading
+// the options.
+func (proxy *proxy) loadConfig(fs *flag.FlagSet, options *Config) error {
+	config := &proxy.config
+	config.flags = fs
+	config.options = options
+	config.cmdline = commandLineOptions(fs)
+	config.path = options.ConfigFile
+	if config.path == "" {
+		return nil
+	}
+
+	values, err := loadConfigFile(fs, config.path)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err = applyConfig(fs, values, nil, config.cmdline, false); err != nil {
+		return err
+	}
+	config.values = values
+
+	return nil
+}
+
+// reloadConfig reads the configuration file again and applies the changes that
+// don't need a restart. Options are left untouched if the new configuration is
+// invalid.
+func (proxy *proxy) reloadConfig() error {
+	config := &proxy.config
+	if config.path == "" {
+		return fmt.Errorf("no configuration file, see -config")
+	}
+	fs, options := config.flags, config.options
+
+	values, err := loadConfigFile(fs, config.path)
+	if err != nil {
+		return err
+	}
+
+	optionsLock.Lock()
+	defer optionsLock.Unlock()
+
+	saved := optionValues(fs)
+	fail := func(err error) error {
+		restoreOptions(fs, saved)
+		return err
+	}
+
+	changed, needRestart, err := applyConfig(fs, values, config.values, config.cmdline, true)
+	if err != nil {
+		return fail(err)
+	}
+	record, err := recordConfigFrom(options)
+	if err != nil {
+		return fail(err)
+	}
+	limits, err := limitsConfigFrom(options)
+	if err != nil {
+		return fail(err)
+	}
+	healthCheckInterval, err := healthCheckIntervalFrom(options)
+	if err != nil {
+		return fail(err)
+	}
+	auth, err := authConfigFrom(options)
+	if err != nil {
+		return fail(err)
+	}
+
+	// Remember what has been applied, the options needing a restart keep
+	// their previous value.
+	applied := make(map[string]string)
+	for name, value := range values {
+		if reloadableOptions[name] {
+			applied[name] = value
+		}
+	}
+	for name, value := range config.values {
+		if !reloadableOptions[name] {
+			applied[name] = value
+		}
+	}
+	config.values = applied
+
+	// Changes only affect VMs and clients created from now on, except for
+	// the I/O sessions and VMs quotas, checked when allocating them, and
+	// the health check interval.
+	proxy.Lock()
+	proxy.console = consoleConfigFrom(options)
+	proxy.record = record
+	proxy.limits = limits
+	proxy.auth = auth
+	proxy.vmLostGracePeriod = options.VMLostGracePeriod
+	proxy.helloTimeout = options.HelloTimeout
+	proxy.setHealthCheckInterval(healthCheckInterval)
+	proxy.Unlock()
+
+	if len(changed) == 0 {
+		proxy.log.infof(0, "configuration reloaded from %s, nothing changed", config.path)
+	} else {
+		proxy.log.infof(0, "configuration reloaded from %s: %s", config.path,
+			strings.Join(changed, ", "))
+	}
+	if len(needRestart) > 0 {
+		proxy.log.infof(0, "configuration: changing %s needs a restart, ignored",
+			strings.Join(needRestart, ", "))
+	}
+
+	return nil
+}
+
+// handleReload reloads the configuration file on SIGHUP.
+func (proxy *proxy) handleReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			if err := proxy.reloadConfig(); err != nil {
+				proxy.log.infof(0, "couldn't reload configuration: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, path, content string) {
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	assert.Nil(t, err)
+}
+
+// testFlags returns a flag set bound to config, with the cc-proxy options the
+// tests use.
+func testFlags(config *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("cc-proxy-test", flag.ContinueOnError)
+	fs.StringVar(&config.SocketGroup, "socket-group", config.SocketGroup, "")
+	fs.Var(&config.SocketMode, "socket-mode", "")
+	fs.BoolVar(&config.RecordAll, "record-all", config.RecordAll, "")
+	fs.IntVar(&config.MaxUserVMs, "max-user-vms", config.MaxUserVMs, "")
+	fs.IntVar(&config.MaxVMIoSessions, "max-vm-io-sessions", config.MaxVMIoSessions, "")
+	fs.Float64Var(&config.ConsoleRate, "console-rate", config.ConsoleRate, "")
+	fs.DurationVar(&config.VMLostGracePeriod, "vm-lost-grace-period", config.VMLostGracePeriod, "")
+	fs.DurationVar(&config.HealthCheckInterval, "health-check-interval",
+		config.HealthCheckInterval, "")
+	fs.IntVar(&config.DebugLogLevel, "debug-log-level", config.DebugLogLevel, "")
+	return fs
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.json")
+
+	writeConfig(t, path, `{
+		"socket-group": "kvm",
+		"record-all": true,
+		"max-user-vms": 4,
+		"console-rate": 1.5,
+		"vm-lost-grace-period": "1m"
+	}`)
+	fs := testFlags(DefaultConfig())
+	values, err := loadConfigFile(fs, path)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"socket-group":         "kvm",
+		"record-all":           "true",
+		"max-user-vms":         "4",
+		"console-rate":         "1.5",
+		"vm-lost-grace-period": "1m",
+	}, values)
+
+	tests := []string{
+		`{`,
+		`[]`,
+		`{"foo": 1}`,
+		`{"config": "/etc/foo.json"}`,
+		`{"max-user-vms": [1, 2]}`,
+	}
+	for _, test := range tests {
+		writeConfig(t, path, test)
+		_, err = loadConfigFile(fs, path)
+		assert.NotNil(t, err, test)
+	}
+
+	_, err = loadConfigFile(fs, filepath.Join(dir, "missing.json"))
+	assert.NotNil(t, err)
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.json")
+
+	options := DefaultConfig()
+	fs := testFlags(options)
+
+	proxy := newProxy()
+
+	// Reloading without a configuration file
+	err = proxy.reloadConfig()
+	assert.NotNil(t, err)
+
+	options.ConfigFile = path
+	writeConfig(t, path, `{"max-user-vms": 2, "socket-mode": "0600"}`)
+	err = proxy.loadConfig(fs, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, options.MaxUserVMs)
+	assert.Equal(t, FileMode(0600), options.SocketMode)
+
+	// socket-mode needs a restart
+	writeConfig(t, path, `{
+		"max-user-vms": 3,
+		"console-rate": 10,
+		"vm-lost-grace-period": "1m",
+		"health-check-interval": "10s",
+		"socket-mode": "0666"
+	}`)
+	_, healthCheckChanged := proxy.healthCheckConfig()
+	err = proxy.reloadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, proxy.limits.userVMs)
+	assert.Equal(t, float64(10), proxy.console.rate)
+	assert.Equal(t, 1*time.Minute, proxy.vmLostGracePeriod)
+	assert.Equal(t, 10*time.Second, proxy.healthCheckInterval)
+	_, ok := <-healthCheckChanged
+	assert.False(t, ok)
+	assert.Equal(t, FileMode(0600), options.SocketMode)
+
+	// Invalid configurations leave the options untouched
+	for _, config := range []string{
+		`{"max-user-vms": -1}`,
+		`{"max-user-vms": 4, "vm-lost-grace-period": "foo"}`,
+		`{"record-all": true}`,
+		`{"health-check-interval": "-1s"}`,
+	} {
+		writeConfig(t, path, config)
+		err = proxy.reloadConfig()
+		assert.NotNil(t, err, config)
+		assert.Equal(t, 3, options.MaxUserVMs)
+		assert.Equal(t, 3, proxy.limits.userVMs)
+		assert.Equal(t, 1*time.Minute, options.VMLostGracePeriod)
+		assert.False(t, options.RecordAll)
+		assert.Equal(t, 10*time.Second, proxy.healthCheckInterval)
+	}
+
+	// Options given on the command line take precedence
+	proxy.config.cmdline["max-vm-io-sessions"] = true
+	options.MaxVMIoSessions = 8
+	writeConfig(t, path, `{"max-vm-io-sessions": 16}`)
+	err = proxy.reloadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, 8, proxy.limits.vmIoSessions)
+
+	// Options removed from the file are back to their default value
+	writeConfig(t, path, `{}`)
+	err = proxy.reloadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, proxy.limits.userVMs)
+	assert.Equal(t, defaultConsoleConfig.rate, proxy.console.rate)
+	assert.Equal(t, defaultVMLostGracePeriod, proxy.vmLostGracePeriod)
+}
+
+func TestFileMode(t *testing.T) {
+	var m FileMode
+
+	assert.Nil(t, m.Set("0640"))
+	assert.Equal(t, FileMode(0640), m)
+	assert.Equal(t, "0640", m.String())
+
+	assert.Nil(t, m.Set("750"))
+	assert.Equal(t, FileMode(0750), m)
+
+	assert.NotNil(t, m.Set("0999"))
+	assert.NotNil(t, m.Set("01777"))
+	assert.NotNil(t, m.Set("rw-r-----"))
+}
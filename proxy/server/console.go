@@ -0,0 +1,395 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+// Console capture configuration, shared by all VMs.
+type consoleConfig struct {
+	// Number of lines kept in memory per VM
+	bufferLines int
+
+	// When not empty, console output is also written to
+	// logDir/<containerID>.log
+	logDir string
+	// Size at which a log file is rotated, in bytes
+	logMaxSize int64
+	// Number of rotated files kept around
+	logMaxFiles int
+
+	// Console output rate limit, in bytes per second. A rate <= 0
+	// disables rate limiting.
+	rate  float64
+	burst int
+
+	// Lines longer than this are truncated
+	maxLineLength int
+}
+
+var defaultConsoleConfig = consoleConfig{
+	bufferLines:   1000,
+	logMaxSize:    1024 * 1024,
+	logMaxFiles:   3,
+	rate:          64 * 1024,
+	burst:         256 * 1024,
+	maxLineLength: 4096,
+}
+
+func consoleConfigFrom(options *Config) consoleConfig {
+	config := defaultConsoleConfig
+	config.bufferLines = options.ConsoleBufferLines
+	config.logDir = options.ConsoleLogDir
+	config.logMaxSize = options.ConsoleLogMaxSize
+	config.logMaxFiles = options.ConsoleLogMaxFiles
+	config.rate = options.ConsoleRate
+	config.burst = options.ConsoleBurst
+	return config
+}
+
+// lineRing is a fixed size circular buffer of lines.
+type lineRing struct {
+	lines []string
+	// index of the oldest line
+	start int
+	// number of valid lines
+	n int
+}
+
+func newLineRing(capacity int) *lineRing {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &lineRing{
+		lines: make([]string, capacity),
+	}
+}
+
+func (r *lineRing) Add(line string) {
+	capacity := len(r.lines)
+	if r.n < capacity {
+		r.lines[(r.start+r.n)%capacity] = line
+		r.n++
+		return
+	}
+
+	r.lines[r.start] = line
+	r.start = (r.start + 1) % capacity
+}
+
+// Last returns the last n lines, oldest first. n <= 0 means all the lines.
+func (r *lineRing) Last(n int) []string {
+	if n <= 0 || n > r.n {
+		n = r.n
+	}
+
+	capacity := len(r.lines)
+	lines := make([]string, 0, n)
+	for i := r.n - n; i < r.n; i++ {
+		lines = append(lines, r.lines[(r.start+i)%capacity])
+	}
+	return lines
+}
+
+// rotatingFile is a log file rotated when reaching maxSize. Rotated files
+// are named path.1, path.2, ..., path.1 being the most recent.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	r.file = nil
+
+	if r.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxFiles))
+		for i := r.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i),
+				fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+
+	return r.open()
+}
+
+func (r *rotatingFile) Write(data []byte) (int, error) {
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(data)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(data)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// Console lines are delivered to followers from a dedicated goroutine so a
+// slow client cannot stall the capture. Lines are dropped when the client
+// falls too far behind.
+const consoleFollowerQueueLength = 256
+
+type consoleFollower struct {
+	client *client
+	lines  chan string
+	wg     sync.WaitGroup
+}
+
+func (f *consoleFollower) run(containerID string) {
+	for line := range f.lines {
+		output := api.ConsoleOutput{
+			ContainerID: containerID,
+			Lines:       []string{line},
+		}
+
+		// Batch the lines already queued
+	drain:
+		for {
+			select {
+			case more, ok := <-f.lines:
+				if !ok {
+					break drain
+				}
+				output.Lines = append(output.Lines, more)
+			default:
+				break drain
+			}
+		}
+
+		f.client.ctx.SendNotification("consoleOutput", &output)
+	}
+
+	f.wg.Done()
+}
+
+// consoleCapture stores the console output of a VM.
+type consoleCapture struct {
+	sync.Mutex
+
+	containerID string
+	config      consoleConfig
+	metrics     *metrics
+
+	ring    *lineRing
+	file    *rotatingFile
+	limiter *tokenBucket
+
+	// Number of lines dropped because of rate limiting since the last
+	// line we've let through.
+	dropped uint64
+
+	followers map[uint64]*consoleFollower
+}
+
+// fileUnder returns the path of the file name in dir, making sure name
+// doesn't designate a file elsewhere.
+func fileUnder(dir, name string) (string, error) {
+	path := filepath.Join(dir, name)
+	if filepath.Dir(path) != filepath.Clean(dir) {
+		return "", fmt.Errorf("%s isn't a file name", name)
+	}
+	return path, nil
+}
+
+// newConsoleCapture creates the console capture of the container containerID,
+// counting the lines dropped by the rate limiter in metrics.
+func newConsoleCapture(containerID string, config consoleConfig,
+	metrics *metrics) (*consoleCapture, error) {
+	c := &consoleCapture{
+		containerID: containerID,
+		config:      config,
+		metrics:     metrics,
+		ring:        newLineRing(config.bufferLines),
+		limiter:     newTokenBucket(config.rate, config.burst),
+		followers:   make(map[uint64]*consoleFollower),
+	}
+
+	if config.logDir != "" {
+		if err := os.MkdirAll(config.logDir, 0750); err != nil {
+			return nil, err
+		}
+
+		path, err := fileUnder(config.logDir, containerID+".log")
+		if err != nil {
+			return nil, err
+		}
+		file, err := openRotatingFile(path, config.logMaxSize, config.logMaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		c.file = file
+	}
+
+	return c, nil
+}
+
+// Add captures a new line of console output. It returns the lines actually
+// stored, which can include a message about lines dropped by the rate
+// limiter, or nothing if line itself is dropped.
+func (c *consoleCapture) Add(line string) []string {
+	if c.config.maxLineLength > 0 && len(line) > c.config.maxLineLength {
+		line = line[:c.config.maxLineLength]
+	}
+
+	if !c.limiter.AllowN(len(line)) {
+		c.Lock()
+		c.dropped++
+		c.Unlock()
+		c.metrics.errors.Inc(errorConsoleRateLimited)
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	lines := make([]string, 0, 2)
+	if c.dropped > 0 {
+		lines = append(lines, fmt.Sprintf("[cc-proxy] %d console lines dropped", c.dropped))
+		c.dropped = 0
+	}
+	lines = append(lines, line)
+
+	for _, l := range lines {
+		c.ring.Add(l)
+		if c.file != nil {
+			c.file.Write([]byte(l + "\n"))
+		}
+		for _, follower := range c.followers {
+			select {
+			case follower.lines <- l:
+			default:
+			}
+		}
+	}
+
+	return lines
+}
+
+// Last returns the last n lines captured, all of them if n <= 0.
+func (c *consoleCapture) Last(n int) []string {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.ring.Last(n)
+}
+
+// Follow makes client receive the console output as consoleOutput
+// notifications.
+func (c *consoleCapture) Follow(client *client) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.followers == nil || c.followers[client.id] != nil {
+		return
+	}
+
+	follower := &consoleFollower{
+		client: client,
+		lines:  make(chan string, consoleFollowerQueueLength),
+	}
+	follower.wg.Add(1)
+	go follower.run(c.containerID)
+	c.followers[client.id] = follower
+}
+
+// Unfollow stops sending console output to the client identified by clientID.
+func (c *consoleCapture) Unfollow(clientID uint64) {
+	c.Lock()
+	follower := c.followers[clientID]
+	delete(c.followers, clientID)
+	c.Unlock()
+
+	if follower == nil {
+		return
+	}
+
+	close(follower.lines)
+	follower.wg.Wait()
+}
+
+// Close stops the capture, releasing the log file and the followers.
+func (c *consoleCapture) Close() {
+	c.Lock()
+	followers := c.followers
+	c.followers = nil
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+	c.Unlock()
+
+	for _, follower := range followers {
+		close(follower.lines)
+		follower.wg.Wait()
+	}
+}
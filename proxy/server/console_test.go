@@ -0,0 +1,268 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/containers/virtcontainers/hyperstart/mock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineRing(t *testing.T) {
+	r := newLineRing(3)
+	assert.Equal(t, []string{}, r.Last(0))
+
+	r.Add("a")
+	r.Add("b")
+	assert.Equal(t, []string{"a", "b"}, r.Last(0))
+	assert.Equal(t, []string{"b"}, r.Last(1))
+
+	r.Add("c")
+	r.Add("d")
+	assert.Equal(t, []string{"b", "c", "d"}, r.Last(0))
+	assert.Equal(t, []string{"c", "d"}, r.Last(2))
+	assert.Equal(t, []string{"b", "c", "d"}, r.Last(10))
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "console.log")
+	f, err := openRotatingFile(path, 10, 2)
+	assert.Nil(t, err)
+
+	for _, line := range []string{"line 1\n", "line 2\n", "line 3\n", "line 4\n"} {
+		_, err := f.Write([]byte(line))
+		assert.Nil(t, err)
+	}
+	f.Close()
+
+	for file, expected := range map[string]string{
+		path:        "line 4\n",
+		path + ".1": "line 3\n",
+		path + ".2": "line 2\n",
+	} {
+		data, err := ioutil.ReadFile(file)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+
+	// Only maxFiles rotated files are kept
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// Console logs can't be written outside of the log directory
+func TestConsoleLogPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	config := defaultConsoleConfig
+	config.logDir = filepath.Join(dir, "console")
+
+	for _, id := range []string{"../foo", "foo/bar", "../../foo"} {
+		_, err := newConsoleCapture(id, config, newMetrics())
+		assert.NotNil(t, err, id)
+	}
+	_, err = os.Stat(filepath.Join(dir, "foo.log"))
+	assert.True(t, os.IsNotExist(err))
+
+	c, err := newConsoleCapture(testContainerID, config, newMetrics())
+	assert.Nil(t, err)
+	c.Close()
+}
+
+func TestConsoleCaptureRateLimit(t *testing.T) {
+	config := defaultConsoleConfig
+	config.rate = 1
+	config.burst = 10
+
+	c, err := newConsoleCapture(testContainerID, config, newMetrics())
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"0123456789"}, c.Add("0123456789"))
+	// The bucket is now empty, those are dropped
+	assert.Equal(t, 0, len(c.Add("foo")))
+	assert.Equal(t, 0, len(c.Add("bar")))
+
+	// Refill the bucket
+	c.limiter.tokens = 10
+	assert.Equal(t, []string{"[cc-proxy] 2 console lines dropped", "baz"}, c.Add("baz"))
+
+	c.Close()
+}
+
+func TestConsole(t *testing.T) {
+	proto := NewProtocol()
+	proto.Handle("hello", helloHandler)
+	proto.Handle("console", consoleHandler)
+
+	rig := newTestRig(t, proto)
+	rig.Start()
+
+	// Fake VM console
+	consolePath := mock.GetTmpPath("test-console.%s.sock")
+	listener, err := net.Listen("unix", consolePath)
+	assert.Nil(t, err)
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := listener.Accept()
+		assert.Nil(t, err)
+		accepted <- conn
+	}()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err = rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath,
+		&api.HelloOptions{Console: consolePath})
+	assert.Nil(t, err)
+	console := <-accepted
+
+	// Follow the console output
+	lines, err := rig.Client.Console(0, &api.ConsoleOptions{Follow: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(lines))
+
+	received := []string{}
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(console, "line %d\r\n", i)
+	}
+	for len(received) < 3 {
+		notification, err := rig.Client.WaitNotification()
+		assert.Nil(t, err)
+		assert.Equal(t, "consoleOutput", notification.ID)
+
+		output := api.ConsoleOutput{}
+		err = json.Unmarshal(notification.Data, &output)
+		assert.Nil(t, err)
+		assert.Equal(t, testContainerID, output.ContainerID)
+		received = append(received, output.Lines...)
+	}
+	assert.Equal(t, []string{"line 0", "line 1", "line 2"}, received)
+
+	// The lines are kept by the proxy
+	lines, err = rig.Client.Console(2, &api.ConsoleOptions{ContainerID: testContainerID})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"line 1", "line 2"}, lines)
+
+	err = rig.Client.ConsoleUnfollow(testContainerID)
+	assert.Nil(t, err)
+
+	// Unknown VM
+	_, err = rig.Client.Console(0, &api.ConsoleOptions{ContainerID: "foo"})
+	assert.True(t, errors.Is(err, api.ErrorCodeUnknownContainer))
+
+	console.Close()
+	listener.Close()
+
+	rig.Stop()
+}
+
+func TestConsoleAttach(t *testing.T) {
+	proto := NewProtocol()
+	proto.Handle("hello", helloHandler)
+	proto.Handle("console", consoleHandler)
+	proto.Handle("consoleAttach", consoleAttachHandler)
+
+	rig := newTestRig(t, proto)
+	rig.Start()
+
+	// Fake VM console
+	consolePath := mock.GetTmpPath("test-console.%s.sock")
+	listener, err := net.Listen("unix", consolePath)
+	assert.Nil(t, err)
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := listener.Accept()
+		assert.Nil(t, err)
+		accepted <- conn
+	}()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err = rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath,
+		&api.HelloOptions{Console: consolePath})
+	assert.Nil(t, err)
+	console := <-accepted
+
+	// Unknown VM
+	_, err = rig.Client.ConsoleAttach("foo")
+	assert.True(t, errors.Is(err, api.ErrorCodeUnknownContainer))
+
+	session, err := rig.Client.ConsoleAttach(testContainerID)
+	assert.Nil(t, err)
+
+	// Only one interactive session at a time
+	_, err = rig.Client.ConsoleAttach(testContainerID)
+	assert.True(t, errors.Is(err, api.ErrorCodeConsoleAlreadyAttached))
+
+	// Input goes to the VM console
+	_, err = session.Write([]byte("ls\n"))
+	assert.Nil(t, err)
+	buf := make([]byte, 32)
+	n, err := console.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ls\n", string(buf[:n]))
+
+	// Output goes to the session, even incomplete lines
+	_, err = console.Write([]byte("bin\n# "))
+	assert.Nil(t, err)
+	received := ""
+	for received != "bin\n# " {
+		n, err = session.Read(buf)
+		assert.Nil(t, err)
+		received += string(buf[:n])
+	}
+
+	// and the complete lines are still captured
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines, err = rig.Client.Console(0, nil)
+		assert.Nil(t, err)
+		if len(lines) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"bin"}, lines)
+
+	// Once the session is closed, we can attach again
+	session.Close()
+	for i := 0; i < 100; i++ {
+		session, err = rig.Client.ConsoleAttach(testContainerID)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(t, err)
+	session.Close()
+
+	console.Close()
+	listener.Close()
+
+	rig.Stop()
+}
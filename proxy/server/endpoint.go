@@ -0,0 +1,130 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// An endpoint is the address of one of the VM channels, as given to hello:
+//
+//  unix:/run/vm/hyper.ctl.sock  an AF_UNIX socket, eg. a qemu serial port
+//  /run/vm/hyper.ctl.sock       same, for compatibility
+//  tcp:127.0.0.1:5555           a TCP address
+//  vsock:3:1024                 port 1024 of the VM with context ID 3
+type endpoint struct {
+	// "unix", "tcp" or "vsock"
+	network string
+	// Socket path or TCP address
+	address string
+	// vsock context ID and port
+	cid, port uint32
+}
+
+// parseEndpoint parses the endpoint given to hello.
+func parseEndpoint(s string) (*endpoint, error) {
+	network, address := "unix", s
+	if i := strings.Index(s, ":"); i >= 0 && !strings.HasPrefix(s, "/") {
+		network, address = s[:i], s[i+1:]
+	}
+
+	e := &endpoint{
+		network: network,
+		address: address,
+	}
+
+	switch network {
+	case "unix":
+		if address == "" {
+			return nil, fmt.Errorf("%s: empty socket path", s)
+		}
+	case "tcp":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("%s: %v", s, err)
+		}
+	case "vsock":
+		parts := strings.Split(address, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s: expected vsock:<cid>:<port>", s)
+		}
+		cid, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid context ID", s)
+		}
+		port, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid port", s)
+		}
+		e.cid, e.port = uint32(cid), uint32(port)
+	default:
+		return nil, fmt.Errorf("%s: unknown transport '%s'", s, network)
+	}
+
+	return e, nil
+}
+
+func (e *endpoint) String() string {
+	return e.network + ":" + e.address
+}
+
+func (e *endpoint) dial() (net.Conn, error) {
+	if e.network == "vsock" {
+		return dialVsock(e.cid, e.port)
+	}
+	return net.Dial(e.network, e.address)
+}
+
+// notListening returns true if err means nothing is listening at the endpoint
+// yet: the socket file doesn't exist or the connection is refused.
+func notListening(err error) bool {
+	switch e := err.(type) {
+	case *net.OpError:
+		return notListening(e.Err)
+	case *os.SyscallError:
+		return notListening(e.Err)
+	case syscall.Errno:
+		return e == syscall.ENOENT || e == syscall.ECONNREFUSED ||
+			e == syscall.ENODEV || e == syscall.ETIMEDOUT
+	}
+	return false
+}
+
+// How often we try to connect to a VM channel while waiting for it to show up.
+const dialRetryInterval = 10 * time.Millisecond
+
+// dialUntil connects to e, retrying until deadline while nothing listens at e.
+// The VM channels are created when the VM boots, which may not have got that
+// far when hello is issued. A zero deadline means a single attempt.
+func (e *endpoint) dialUntil(deadline time.Time) (net.Conn, error) {
+	for {
+		conn, err := e.dial()
+		if err == nil {
+			return conn, nil
+		}
+		if deadline.IsZero() || !notListening(err) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, newNotReadyError("timed out waiting for %s", e)
+		}
+		time.Sleep(dialRetryInterval)
+	}
+}
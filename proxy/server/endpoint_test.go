@@ -0,0 +1,158 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		s        string
+		valid    bool
+		expected endpoint
+	}{
+		{"/tmp/hyper.sock", true, endpoint{network: "unix", address: "/tmp/hyper.sock"}},
+		{"unix:/tmp/hyper.sock", true, endpoint{network: "unix", address: "/tmp/hyper.sock"}},
+		{"unix:", false, endpoint{}},
+		{"tcp:127.0.0.1:5555", true, endpoint{network: "tcp", address: "127.0.0.1:5555"}},
+		{"tcp:[::1]:5555", true, endpoint{network: "tcp", address: "[::1]:5555"}},
+		{"tcp:127.0.0.1", false, endpoint{}},
+		{"vsock:3:1024", true, endpoint{network: "vsock", address: "3:1024", cid: 3, port: 1024}},
+		{"vsock:3", false, endpoint{}},
+		{"vsock:foo:1024", false, endpoint{}},
+		{"vsock:3:-1", false, endpoint{}},
+		{"udp:127.0.0.1:5555", false, endpoint{}},
+	}
+
+	for _, test := range tests {
+		e, err := parseEndpoint(test.s)
+		if !test.valid {
+			assert.NotNil(t, err, test.s)
+			continue
+		}
+		if assert.Nil(t, err, test.s) {
+			assert.Equal(t, test.expected, *e, test.s)
+		}
+	}
+}
+
+// relayTCP stands for a VM channel exposed over TCP: it forwards the first
+// connection accepted on a loopback port to the unix socket at path, returning
+// the address of that port.
+func (rig *testRig) relayTCP(path string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(rig.t, err)
+
+	rig.wg.Add(1)
+	go func() {
+		defer rig.wg.Done()
+
+		c, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return
+		}
+		u, err := net.Dial("unix", path)
+		if err != nil {
+			c.Close()
+			return
+		}
+
+		// Hide the connection types from io.Copy, using splice() would
+		// leave pipes cached behind, seen as leaked fds.
+		done := make(chan struct{}, 2)
+		go func() {
+			io.Copy(struct{ io.Writer }{u}, struct{ io.Reader }{c})
+			done <- struct{}{}
+		}()
+		go func() {
+			io.Copy(struct{ io.Writer }{c}, struct{ io.Reader }{u})
+			done <- struct{}{}
+		}()
+		<-done
+		c.Close()
+		u.Close()
+		<-done
+	}()
+
+	return l.Addr().String()
+}
+
+func testEndpoints(t *testing.T, endpoints func(rig *testRig) (string, string)) {
+	rig := newTestRig(t, newProxyProtocol())
+	rig.Start()
+
+	ctl, io := endpoints(rig)
+	_, err := rig.Client.Hello(testContainerID, ctl, io, nil)
+	assert.Nil(t, err)
+
+	err = rig.Client.Hyper("ping", nil)
+	assert.Nil(t, err)
+
+	ioBase, ioFile, err := rig.Client.AllocateIo(1)
+	assert.Nil(t, err)
+
+	rig.Hyperstart.SendIoString(ioBase, "stdout\n")
+	seq, data := readIo(t, ioFile)
+	assert.Equal(t, ioBase, seq)
+	assert.Equal(t, "stdout\n", string(data))
+
+	writeIo(t, ioFile, ioBase, []byte("stdin\n"))
+	buf := make([]byte, 32)
+	n, seq := rig.Hyperstart.ReadIo(buf)
+	assert.Equal(t, ioBase, seq)
+	assert.Equal(t, "stdin\n", string(buf[12:n]))
+
+	info, err := rig.Client.VMInfo("", false)
+	assert.Nil(t, err)
+	assert.Equal(t, ctl, info.VM.CtlSerial)
+	assert.Equal(t, io, info.VM.IoSerial)
+
+	ioFile.Close()
+	rig.Stop()
+}
+
+func TestUnixEndpoints(t *testing.T) {
+	testEndpoints(t, func(rig *testRig) (string, string) {
+		ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+		return "unix:" + ctlSocketPath, "unix:" + ioSocketPath
+	})
+}
+
+func TestTCPEndpoints(t *testing.T) {
+	testEndpoints(t, func(rig *testRig) (string, string) {
+		ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+		return "tcp:" + rig.relayTCP(ctlSocketPath), "tcp:" + rig.relayTCP(ioSocketPath)
+	})
+}
+
+func TestInvalidEndpoints(t *testing.T) {
+	rig := newTestRig(t, newProxyProtocol())
+	rig.Start()
+
+	_, err := rig.Client.Hello("invalid", "udp:127.0.0.1:5555", "udp:127.0.0.1:5556", nil)
+	assert.NotNil(t, err)
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err = rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath, nil)
+	assert.Nil(t, err)
+
+	rig.Stop()
+}
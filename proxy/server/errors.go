@@ -0,0 +1,109 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+// proxyError is an error sent back to the client with a code, one of the
+// api.ErrorCode constants, and optional details.
+type proxyError struct {
+	code    api.ErrorCode
+	msg     string
+	details map[string]interface{}
+	// The error proxyError gives a code to, if any
+	err error
+}
+
+func newError(code api.ErrorCode, format string, a ...interface{}) *proxyError {
+	return &proxyError{
+		code: code,
+		msg:  fmt.Sprintf(format, a...),
+	}
+}
+
+// withCode gives code to err, unless err already has a code of its own, more
+// specific than the one the caller can guess.
+func withCode(code api.ErrorCode, err error) error {
+	var coded codedError
+	if errors.As(err, &coded) {
+		return err
+	}
+	return &proxyError{
+		code: code,
+		msg:  err.Error(),
+		err:  err,
+	}
+}
+
+// with adds a detail to e.
+func (e *proxyError) with(key string, value interface{}) *proxyError {
+	if e.details == nil {
+		e.details = make(map[string]interface{})
+	}
+	e.details[key] = value
+	return e
+}
+
+func (e *proxyError) Error() string {
+	return e.msg
+}
+
+// Code implements codedError.
+func (e *proxyError) Code() api.ErrorCode {
+	return e.code
+}
+
+// Details implements detailedError.
+func (e *proxyError) Details() map[string]interface{} {
+	return e.details
+}
+
+// Unwrap returns the error given to withCode.
+func (e *proxyError) Unwrap() error {
+	return e.err
+}
+
+// The errors shared by several payloads.
+
+func invalidRequestError(err error) error {
+	return withCode(api.ErrorCodeInvalidRequest, err)
+}
+
+func unknownContainerError(containerID string) error {
+	return newError(api.ErrorCodeUnknownContainer, "unknown containerID: %s",
+		containerID).with("containerId", containerID)
+}
+
+func alreadyRegisteredError(containerID string) error {
+	return newError(api.ErrorCodeContainerAlreadyRegistered,
+		"%s: container already registered", containerID).with("containerId", containerID)
+}
+
+func vmLostError(containerID, reason string) error {
+	return newError(api.ErrorCodeVMLost, "%s: vm lost (%s)", containerID,
+		reason).with("containerId", containerID).with("reason", reason)
+}
+
+func noConsoleError(containerID string) error {
+	return newError(api.ErrorCodeNoConsole, "%s: no console",
+		containerID).with("containerId", containerID)
+}
+
+var errNotAttached = newError(api.ErrorCodeNotAttached, "client not attached to a vm")
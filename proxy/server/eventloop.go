@@ -0,0 +1,636 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// The event loop forwards the I/O frames between the VMs and the shims from a
+// single goroutine, multiplexing the hyperstart io channels and the I/O
+// session sockets with epoll. Without it, each VM has a goroutine reading its
+// io channel and each I/O session a goroutine reading the shim stdin, each
+// with its own buffers.
+//
+// The sockets are used in non-blocking mode. What's read goes through the
+// loop read buffer, only partial frames being kept per connection. The frames
+// written to a connection are queued, and written once all the events of an
+// epoll round have been handled, the frames of a burst going out in a single
+// write. What the socket doesn't take is written once epoll says it's
+// writable again.
+//
+// A connection whose write queue grows beyond loopQueueSize stops the one
+// feeding it from being read until the queue is drained, the same way a
+// blocked write blocks the goroutine doing it: a shim not reading its output
+// holds the VM io channel.
+//
+// The loop state is only touched from the loop goroutine, other goroutines
+// hand it functions to run with do. The callbacks run on the loop goroutine,
+// they can't use do.
+type eventLoop struct {
+	epfd int
+	// epfd, waited on through the runtime poller rather than in a
+	// blocking epoll_wait, see wait
+	epoll    *os.File
+	epollRaw syscall.RawConn
+
+	// Pipe waking the loop up when there are requests
+	wakeR, wakeW int
+
+	sync.Mutex
+	requests  []func()
+	stopped   bool
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Where errors are reported
+	log     *serverLog
+	metrics *metrics
+
+	// Owned by the loop goroutine
+	conns     map[int32]*loopConn
+	nextToken int32
+	buf       []byte
+	dirty     []*loopConn
+	free      [][]byte
+}
+
+// Size beyond which a write queue stops the connection feeding it.
+const loopQueueSize = ioBufferSize
+
+// The epoll token of the wake up pipe. Connections have positive tokens.
+const wakeToken = 0
+
+// Maximum number of events handled per epoll round
+const maxLoopEvents = 128
+
+// errLoopDetached is what the onClose callback of a connection removed from
+// the loop is given.
+var errLoopDetached = errors.New("connection removed from the event loop")
+
+// loopConn is a connection served by an eventLoop.
+type loopConn struct {
+	loop *eventLoop
+	conn net.Conn
+	raw  syscall.RawConn
+
+	// What's at the other end, for the error messages
+	peer string
+
+	token int32
+	// The events registered in the epoll set, 0 when not in it
+	events uint32
+
+	// onFrame is called with each frame read. data is only valid during
+	// the call. Returning an error stops reading the connection.
+	onFrame func(seq uint64, data []byte) error
+	// onClose, when not nil, is called once the connection isn't read
+	// anymore, err being io.EOF when the peer closed it.
+	onClose func(err error)
+
+	reading bool
+	// Frames can't be read while paused, see loopQueueSize
+	paused bool
+	// Incomplete frame, or the frames left when pausing
+	partial []byte
+
+	// Write queue, wbuf[woff:] being what's still to be written
+	wbuf []byte
+	woff int
+	werr error
+	// In the loop dirty list, waiting to be written
+	dirty bool
+	// Connections paused until the write queue is drained
+	blocked []*loopConn
+
+	detached bool
+}
+
+// newEventLoop creates an event loop reporting its errors to log and metrics.
+func newEventLoop(log *serverLog, metrics *metrics) (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("epoll_create: %v", err)
+	}
+
+	var pipe [2]int
+	if err := syscall.Pipe2(pipe[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, fmt.Errorf("pipe: %v", err)
+	}
+
+	event := syscall.EpollEvent{
+		Events: syscall.EPOLLIN,
+		Fd:     wakeToken,
+	}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, pipe[0], &event); err != nil {
+		syscall.Close(epfd)
+		syscall.Close(pipe[0])
+		syscall.Close(pipe[1])
+		return nil, fmt.Errorf("epoll_ctl: %v", err)
+	}
+
+	// A non-blocking fd makes a pollable os.File
+	if err := syscall.SetNonblock(epfd, true); err != nil {
+		syscall.Close(epfd)
+		syscall.Close(pipe[0])
+		syscall.Close(pipe[1])
+		return nil, err
+	}
+	epoll := os.NewFile(uintptr(epfd), "epoll")
+	epollRaw, err := epoll.SyscallConn()
+	if err != nil {
+		epoll.Close()
+		syscall.Close(pipe[0])
+		syscall.Close(pipe[1])
+		return nil, err
+	}
+
+	l := &eventLoop{
+		epfd:     epfd,
+		epoll:    epoll,
+		epollRaw: epollRaw,
+		wakeR:    pipe[0],
+		wakeW:    pipe[1],
+		done:     make(chan struct{}),
+		log:      log,
+		metrics:  metrics,
+		conns:    make(map[int32]*loopConn),
+		buf:      make([]byte, ioBufferSize),
+	}
+	go l.run()
+
+	return l, nil
+}
+
+// newLoopConn wraps c, which has to be a socket, for l to serve it.
+func (l *eventLoop) newLoopConn(c net.Conn, peer string) (*loopConn, error) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("%s: not a socket", peer)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	return &loopConn{
+		loop: l,
+		conn: c,
+		raw:  raw,
+		peer: peer,
+	}, nil
+}
+
+// do runs f on the loop goroutine and waits for it to be done. f is run
+// directly once the loop is stopped.
+//
+// do must not be called from the loop goroutine, ie. from a function given to
+// do or from an onFrame or onClose callback, it would never return. That
+// includes add and remove: code running on the loop goroutine is to use the
+// loop state directly.
+func (l *eventLoop) do(f func()) {
+	l.Lock()
+	if l.stopped {
+		f()
+		l.flushDirty()
+		l.Unlock()
+		return
+	}
+
+	done := make(chan struct{})
+	l.requests = append(l.requests, func() {
+		f()
+		close(done)
+	})
+	wake := len(l.requests) == 1
+	l.Unlock()
+
+	if wake {
+		syscall.Write(l.wakeW, []byte{0})
+	}
+	<-done
+}
+
+// add starts reading lc, calling onFrame with the frames read and onClose,
+// which can be nil, once lc isn't read anymore. Like do, it can't be called
+// from the loop goroutine.
+func (l *eventLoop) add(lc *loopConn, onFrame func(uint64, []byte) error, onClose func(error)) {
+	l.do(func() {
+		lc.onFrame = onFrame
+		lc.onClose = onClose
+		lc.reading = true
+		l.update(lc)
+	})
+}
+
+// remove takes lc off the loop, calling its onClose if it was still read. It
+// returns the data still queued for lc, for the caller to write. Nothing is
+// queued for lc afterwards. Like do, it can't be called from the loop
+// goroutine.
+func (l *eventLoop) remove(lc *loopConn) []byte {
+	var pending []byte
+
+	l.do(func() {
+		if lc.detached {
+			return
+		}
+
+		l.stopReading(lc, errLoopDetached)
+		lc.detached = true
+		if lc.werr == nil && lc.woff < len(lc.wbuf) {
+			pending = append(pending, lc.wbuf[lc.woff:]...)
+		}
+		l.releaseQueue(lc)
+		l.update(lc)
+		delete(l.conns, lc.token)
+		l.unblock(lc)
+	})
+
+	return pending
+}
+
+// stop stops the loop goroutine, once the pending requests are done.
+func (l *eventLoop) stop() {
+	l.Lock()
+	stopped := l.stopped
+	l.stopped = true
+	l.Unlock()
+
+	if !stopped {
+		syscall.Write(l.wakeW, []byte{0})
+	}
+	<-l.done
+
+	l.closeOnce.Do(func() {
+		l.epoll.Close()
+		syscall.Close(l.wakeR)
+		syscall.Close(l.wakeW)
+	})
+}
+
+func (l *eventLoop) run() {
+	events := make([]syscall.EpollEvent, maxLoopEvents)
+
+	for {
+		n, err := l.wait(events)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			// Not supposed to happen, requests are still served
+			// without the loop
+			l.metrics.errors.Inc(errorIo)
+			l.log.infof(0, "event loop: epoll_wait: %v", err)
+			l.Lock()
+			l.stopped = true
+			l.runRequests()
+			l.Unlock()
+			close(l.done)
+			return
+		}
+
+		woken := false
+		for i := 0; i < n; i++ {
+			if events[i].Fd == wakeToken {
+				woken = true
+				continue
+			}
+			lc := l.conns[events[i].Fd]
+			if lc == nil {
+				continue
+			}
+			l.handle(lc, events[i].Events)
+		}
+		l.flushDirty()
+
+		if woken && l.serveRequests() {
+			close(l.done)
+			return
+		}
+	}
+}
+
+// wait waits for events. The loop goroutine doesn't block in epoll_wait,
+// which would hold a thread and, until the runtime notices, the processor it
+// runs on: it's parked by the runtime poller until the epoll fd is readable,
+// meaning events are there.
+func (l *eventLoop) wait(events []syscall.EpollEvent) (int, error) {
+	var n int
+	var err error
+	rerr := l.epollRaw.Read(func(fd uintptr) bool {
+		n, err = syscall.EpollWait(int(fd), events, 0)
+		return err != nil || n > 0
+	})
+	if rerr != nil {
+		return 0, rerr
+	}
+	return n, err
+}
+
+// serveRequests runs the requests, returning true when the loop is stopped.
+func (l *eventLoop) serveRequests() bool {
+	var b [64]byte
+	for {
+		if n, _ := syscall.Read(l.wakeR, b[:]); n <= 0 {
+			break
+		}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.runRequests()
+	return l.stopped
+}
+
+// runRequests runs the requests. Must be called with the loop lock held.
+func (l *eventLoop) runRequests() {
+	for len(l.requests) > 0 {
+		requests := l.requests
+		l.requests = nil
+		for _, f := range requests {
+			f()
+		}
+		l.flushDirty()
+	}
+}
+
+// handle handles the epoll events of lc. Hang ups and errors are reported
+// whether they've been asked for or not, they are handled by reading or
+// writing lc, depending on what it's registered for.
+func (l *eventLoop) handle(lc *loopConn, events uint32) {
+	if events&(syscall.EPOLLOUT|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 &&
+		lc.events&syscall.EPOLLOUT != 0 {
+		l.flush(lc)
+	}
+	if events&(syscall.EPOLLIN|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 &&
+		lc.events&syscall.EPOLLIN != 0 {
+		l.read(lc)
+	}
+}
+
+// update registers lc in the epoll set for what it's waiting for.
+func (l *eventLoop) update(lc *loopConn) {
+	var events uint32
+	if lc.reading && !lc.paused {
+		events |= syscall.EPOLLIN
+	}
+	if lc.werr == nil && lc.woff < len(lc.wbuf) {
+		events |= syscall.EPOLLOUT
+	}
+	if events == lc.events {
+		return
+	}
+
+	// Connections get a token when first registered. They can be written
+	// to before that, see writeFrame.
+	if lc.token == 0 {
+		l.nextToken++
+		lc.token = l.nextToken
+		l.conns[lc.token] = lc
+	}
+
+	op := syscall.EPOLL_CTL_MOD
+	if lc.events == 0 {
+		op = syscall.EPOLL_CTL_ADD
+	} else if events == 0 {
+		op = syscall.EPOLL_CTL_DEL
+	}
+
+	var err error
+	cerr := lc.raw.Control(func(fd uintptr) {
+		event := syscall.EpollEvent{
+			Events: events,
+			Fd:     lc.token,
+		}
+		err = syscall.EpollCtl(l.epfd, op, int(fd), &event)
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	if err == nil {
+		lc.events = events
+		return
+	}
+
+	// The connection has been closed underneath us, closing a fd removes
+	// it from the epoll set.
+	lc.events = 0
+	if lc.werr == nil {
+		lc.werr = err
+	}
+	l.stopReading(lc, err)
+}
+
+func (l *eventLoop) stopReading(lc *loopConn, err error) {
+	if !lc.reading {
+		return
+	}
+
+	if err == io.EOF && len(lc.partial) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	lc.reading = false
+	lc.partial = nil
+	l.update(lc)
+
+	if lc.onClose != nil {
+		lc.onClose(err)
+	}
+}
+
+func (l *eventLoop) read(lc *loopConn) {
+	buf := l.buf
+	n := copy(buf, lc.partial)
+
+	var m int
+	var err error
+	rerr := lc.raw.Read(func(fd uintptr) bool {
+		m, err = syscall.Read(int(fd), buf[n:])
+		return true
+	})
+	if rerr != nil {
+		err = rerr
+	}
+
+	switch {
+	case err == syscall.EAGAIN || err == syscall.EINTR:
+		return
+	case err != nil:
+		l.stopReading(lc, err)
+		return
+	case m == 0:
+		l.stopReading(lc, io.EOF)
+		return
+	}
+
+	l.parse(lc, buf[:n+m])
+}
+
+// parse hands the frames in buf to lc.onFrame, keeping the incomplete frame
+// at the end, or what's left when lc gets paused, for later.
+func (l *eventLoop) parse(lc *loopConn, buf []byte) {
+	for lc.reading && !lc.paused && len(buf) >= ioHeaderSize {
+		seq := binary.BigEndian.Uint64(buf)
+		length := int(binary.BigEndian.Uint32(buf[8:]))
+
+		// See ioReader.readFrame
+		if length < ioHeaderSize {
+			length = ioHeaderSize
+		}
+		if length > maxHyperstartMessageSize {
+			l.stopReading(lc, fmt.Errorf("I/O frame too long %d", length))
+			return
+		}
+		if len(buf) < length {
+			break
+		}
+
+		if err := lc.onFrame(seq, buf[ioHeaderSize:length]); err != nil {
+			l.stopReading(lc, err)
+			return
+		}
+		buf = buf[length:]
+	}
+
+	if lc.reading {
+		lc.partial = append(lc.partial[:0], buf...)
+	}
+}
+
+// writeFrame queues a frame for dst. src is the connection the frame comes
+// from, paused if dst has too much data queued already. dst doesn't have to
+// have been added to the loop yet.
+func (l *eventLoop) writeFrame(dst, src *loopConn, seq uint64, data []byte) {
+	if dst.detached || dst.werr != nil {
+		return
+	}
+
+	if dst.wbuf == nil {
+		dst.wbuf = l.getBuffer()
+	}
+	var header [ioHeaderSize]byte
+	binary.BigEndian.PutUint64(header[:], seq)
+	binary.BigEndian.PutUint32(header[8:], uint32(ioHeaderSize+len(data)))
+	dst.wbuf = append(dst.wbuf, header[:]...)
+	dst.wbuf = append(dst.wbuf, data...)
+
+	if !dst.dirty {
+		dst.dirty = true
+		l.dirty = append(l.dirty, dst)
+	}
+
+	if src != nil && !src.paused && len(dst.wbuf)-dst.woff > loopQueueSize {
+		src.paused = true
+		l.update(src)
+		dst.blocked = append(dst.blocked, src)
+	}
+}
+
+// flushDirty writes the queues of the connections written to since the last
+// call.
+func (l *eventLoop) flushDirty() {
+	// Unblocking connections can queue more frames, and dirty more
+	// connections
+	for len(l.dirty) > 0 {
+		dirty := l.dirty
+		l.dirty = nil
+		for _, lc := range dirty {
+			lc.dirty = false
+			if !lc.detached {
+				l.flush(lc)
+			}
+		}
+	}
+}
+
+// flush writes as much of the lc queue as the socket takes.
+func (l *eventLoop) flush(lc *loopConn) {
+	for lc.werr == nil && lc.woff < len(lc.wbuf) {
+		var n int
+		var err error
+		rerr := lc.raw.Write(func(fd uintptr) bool {
+			n, err = syscall.Write(int(fd), lc.wbuf[lc.woff:])
+			return true
+		})
+		if rerr != nil {
+			err = rerr
+		}
+
+		if err == syscall.EAGAIN {
+			break
+		} else if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			l.metrics.errors.Inc(errorIo)
+			l.log.infof(0, "error writing I/O data to %s: %v", lc.peer, err)
+			lc.werr = err
+			break
+		}
+		lc.woff += n
+	}
+
+	if lc.werr != nil || lc.woff == len(lc.wbuf) {
+		l.releaseQueue(lc)
+		l.unblock(lc)
+	} else if lc.woff > len(lc.wbuf)/2 {
+		n := copy(lc.wbuf, lc.wbuf[lc.woff:])
+		lc.wbuf = lc.wbuf[:n]
+		lc.woff = 0
+	}
+
+	l.update(lc)
+}
+
+// unblock resumes the connections paused because of lc.
+func (l *eventLoop) unblock(lc *loopConn) {
+	blocked := lc.blocked
+	lc.blocked = nil
+
+	for _, src := range blocked {
+		if !src.paused || src.detached {
+			continue
+		}
+		src.paused = false
+		l.parse(src, src.partial)
+		l.update(src)
+	}
+}
+
+// The write queues come from a free list, only the connections with data
+// waiting to be written holding one.
+func (l *eventLoop) getBuffer() []byte {
+	if n := len(l.free); n > 0 {
+		buf := l.free[n-1]
+		l.free = l.free[:n-1]
+		return buf
+	}
+	return make([]byte, 0, ioBufferSize)
+}
+
+func (l *eventLoop) releaseQueue(lc *loopConn) {
+	if lc.wbuf != nil && cap(lc.wbuf) <= 2*ioBufferSize && len(l.free) < maxLoopEvents {
+		l.free = append(l.free, lc.wbuf[:0])
+	}
+	lc.wbuf = nil
+	lc.woff = 0
+}
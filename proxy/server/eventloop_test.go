@@ -0,0 +1,252 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// loopRig is a VM and a shim, connected through an event loop forwarding
+// their frames to each other.
+type loopRig struct {
+	loop     *eventLoop
+	vm, shim net.Conn
+	vmConn   *loopConn
+	shimConn *loopConn
+	vmClosed chan error
+	conns    []net.Conn
+}
+
+func newLoopRig(t *testing.T) *loopRig {
+	loop, err := newEventLoop(nil, newMetrics())
+	assert.Nil(t, err)
+
+	rig := &loopRig{
+		loop:     loop,
+		vmClosed: make(chan error, 1),
+	}
+
+	var vmSide, shimSide net.Conn
+	rig.vm, vmSide, err = Socketpair()
+	assert.Nil(t, err)
+	shimSide, rig.shim, err = Socketpair()
+	assert.Nil(t, err)
+	rig.conns = []net.Conn{rig.vm, vmSide, shimSide, rig.shim}
+
+	rig.vmConn, err = loop.newLoopConn(vmSide, "vm")
+	assert.Nil(t, err)
+	rig.shimConn, err = loop.newLoopConn(shimSide, "shim")
+	assert.Nil(t, err)
+
+	loop.add(rig.vmConn, func(seq uint64, data []byte) error {
+		loop.writeFrame(rig.shimConn, rig.vmConn, seq, data)
+		return nil
+	}, func(err error) {
+		rig.vmClosed <- err
+	})
+	loop.add(rig.shimConn, func(seq uint64, data []byte) error {
+		loop.writeFrame(rig.vmConn, rig.shimConn, seq, data)
+		return nil
+	}, nil)
+
+	return rig
+}
+
+func (rig *loopRig) Stop() {
+	rig.loop.stop()
+	for _, c := range rig.conns {
+		c.Close()
+	}
+}
+
+// writeChunks writes data in small chunks, for frames to be read in pieces.
+func writeChunks(t *testing.T, w io.Writer, data []byte) {
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		_, err := w.Write(data[:n])
+		assert.Nil(t, err)
+		data = data[n:]
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+func TestEventLoopForward(t *testing.T) {
+	rig := newLoopRig(t)
+	defer rig.Stop()
+
+	var frames bytes.Buffer
+	for _, f := range testFrames {
+		assert.Nil(t, writeIoFrame(&frames, f.seq, []byte(f.data)))
+	}
+	data := frames.Bytes()
+
+	for _, dir := range []struct {
+		from, to net.Conn
+	}{
+		{rig.vm, rig.shim},
+		{rig.shim, rig.vm},
+	} {
+		go writeChunks(t, dir.from, data)
+
+		r := newIoReader(dir.to)
+		for _, f := range testFrames {
+			seq, data, err := r.readFrame()
+			assert.Nil(t, err)
+			assert.Equal(t, f.seq, seq)
+			assert.Equal(t, f.data, string(data))
+		}
+		r.release()
+	}
+
+	// The VM closing its end is reported
+	rig.vm.Close()
+	select {
+	case err := <-rig.vmClosed:
+		assert.Equal(t, io.EOF, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("VM close not reported")
+	}
+}
+
+func TestEventLoopInvalidFrame(t *testing.T) {
+	rig := newLoopRig(t)
+	defer rig.Stop()
+
+	assert.Nil(t, writeIoFrame(rig.vm, 1, []byte("foo")))
+	header := make([]byte, ioHeaderSize)
+	header[8] = 0xff
+	_, err := rig.vm.Write(header)
+	assert.Nil(t, err)
+
+	select {
+	case err := <-rig.vmClosed:
+		assert.NotNil(t, err)
+		assert.NotEqual(t, io.EOF, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("invalid frame not reported")
+	}
+
+	// The frame before the invalid one has been forwarded
+	r := newIoReader(rig.shim)
+	defer r.release()
+	seq, data, err := r.readFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), seq)
+	assert.Equal(t, "foo", string(data))
+}
+
+func (rig *loopRig) vmPaused() bool {
+	var paused bool
+	rig.loop.do(func() {
+		paused = rig.vmConn.paused
+	})
+	return paused
+}
+
+// A shim not reading its output stops the VM from being read, until it reads
+// again.
+func TestEventLoopBackpressure(t *testing.T) {
+	rig := newLoopRig(t)
+	defer rig.Stop()
+
+	const nFrames = 1024
+	payload := make([]byte, 4096)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < nFrames; i++ {
+			payload[0] = byte(i)
+			if err := writeIoFrame(rig.vm, uint64(i), payload); err != nil {
+				break
+			}
+		}
+		close(done)
+	}()
+
+	for i := 0; i < 500 && !rig.vmPaused(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, rig.vmPaused())
+
+	select {
+	case <-done:
+		t.Fatal("the VM shouldn't be able to write everything")
+	default:
+	}
+
+	r := newIoReader(rig.shim)
+	defer r.release()
+	for i := 0; i < nFrames; i++ {
+		seq, data, err := r.readFrame()
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(i), seq)
+		assert.Equal(t, byte(i), data[0])
+		assert.Len(t, data, len(payload))
+	}
+
+	<-done
+	assert.False(t, rig.vmPaused())
+}
+
+// What's queued for a connection taken off the loop is handed back.
+func TestEventLoopRemove(t *testing.T) {
+	rig := newLoopRig(t)
+	defer rig.Stop()
+
+	payload := make([]byte, 4096)
+	go func() {
+		for {
+			if err := writeIoFrame(rig.vm, 1, payload); err != nil {
+				break
+			}
+		}
+	}()
+
+	for i := 0; i < 500 && !rig.vmPaused(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pending := rig.loop.remove(rig.shimConn)
+	assert.NotEmpty(t, pending)
+	assert.Nil(t, rig.loop.remove(rig.shimConn))
+
+	// Removing the VM reports it
+	rig.loop.remove(rig.vmConn)
+	assert.Equal(t, errLoopDetached, <-rig.vmClosed)
+	rig.vm.Close()
+}
+
+func TestEventLoopStop(t *testing.T) {
+	rig := newLoopRig(t)
+	rig.Stop()
+
+	// Requests are run right away once stopped
+	ran := false
+	rig.loop.do(func() {
+		ran = true
+	})
+	assert.True(t, ran)
+
+	rig.loop.stop()
+}
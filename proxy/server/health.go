@@ -0,0 +1,113 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+func healthCheckIntervalFrom(options *Config) (time.Duration, error) {
+	if options.HealthCheckInterval < 0 {
+		return 0, errors.New("-health-check-interval cannot be negative")
+	}
+	return options.HealthCheckInterval, nil
+}
+
+// healthCheckConfig returns the health check interval along with a channel
+// closed when it changes.
+func (proxy *proxy) healthCheckConfig() (time.Duration, <-chan struct{}) {
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	return proxy.healthCheckInterval, proxy.healthCheckChanged
+}
+
+// setHealthCheckInterval changes the health check interval, waking up the
+// VM health checkers. It must be called with the proxy lock held.
+func (proxy *proxy) setHealthCheckInterval(interval time.Duration) {
+	if interval == proxy.healthCheckInterval {
+		return
+	}
+	proxy.healthCheckInterval = interval
+	close(proxy.healthCheckChanged)
+	proxy.healthCheckChanged = make(chan struct{})
+}
+
+// ping sends a ping command to the agent of vm, failing if it isn't
+// acknowledged within timeout. The agent isn't pinged while it's busy with
+// another command, which would make the ping wait: that command tells
+// whether the agent is alive, an error on its channel declaring the VM lost.
+// A timed out ping is left running, vm.Close closing the agent ends it.
+func (vm *vm) ping(timeout time.Duration) error {
+	if !vm.cmdLock.TryLock() {
+		vm.info(2, "ctl", "agent busy, health check skipped")
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := vm.agent.SendCommand("ping", nil)
+		vm.cmdLock.Unlock()
+		done <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return errors.New("no answer to ping")
+	}
+}
+
+// checkHealth pings the agent of vm every health check interval, until vm is
+// lost. A VM whose agent fails to answer within the interval is declared lost
+// with the api.VMLostHealthCheck reason. The interval is read again when the
+// configuration is reloaded, no pings being sent while it's 0.
+func (proxy *proxy) checkHealth(vm *vm) {
+	for {
+		interval, changed := proxy.healthCheckConfig()
+		if interval == 0 {
+			select {
+			case <-vm.OnVMLost():
+				return
+			case <-changed:
+			}
+			continue
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-vm.OnVMLost():
+			timer.Stop()
+			return
+		case <-changed:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		if err := vm.ping(interval); err != nil {
+			vm.infof(1, "ctl", "health check failed: %v", err)
+			vm.signalVMLost(api.VMLostHealthCheck)
+			return
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// hangingAgent is a memoryAgent that can stop answering commands.
+type hangingAgent struct {
+	*memoryAgent
+	// Closed by the test to make the agent hang
+	hang chan struct{}
+	// When not nil, commands other than ping are only answered once it's
+	// closed
+	busy chan struct{}
+}
+
+func (a *hangingAgent) SendCommand(cmd string, data []byte) ([]byte, error) {
+	select {
+	case <-a.hang:
+		<-a.gone
+		return nil, &ChannelError{io.EOF}
+	default:
+	}
+	resp, err := a.memoryAgent.SendCommand(cmd, data)
+	if cmd != "ping" && a.busy != nil {
+		<-a.busy
+	}
+	return resp, err
+}
+
+func TestHealthCheck(t *testing.T) {
+	a := &hangingAgent{memoryAgent: newMemoryAgent(), hang: make(chan struct{})}
+	close(a.ready)
+
+	l, path := listenTestServer(t)
+	defer os.Remove(path)
+	srv, err := New(WithListener(l),
+		WithAgent("test", func(ctlSerial, ioSerial string) (Agent, error) {
+			return a, nil
+		}))
+	assert.Nil(t, err)
+	go srv.Serve(context.Background())
+
+	client := dialTestServer(t, path)
+	_, err = client.Hello(testContainerID, "ctl", "io",
+		&api.HelloOptions{Agent: "test", Notifications: true})
+	assert.Nil(t, err)
+
+	// Health checks are disabled by default, changing the interval
+	// enables them for the VMs already there
+	proxy := srv.proxy
+	proxy.Lock()
+	proxy.setHealthCheckInterval(10 * time.Millisecond)
+	proxy.Unlock()
+
+	for i := 0; i < 2; i++ {
+		cmd := <-a.commands
+		assert.Equal(t, "ping", cmd.cmd)
+	}
+
+	// An agent not answering makes the VM lost
+	close(a.hang)
+
+	notification, err := client.WaitNotification()
+	assert.Nil(t, err)
+	assert.Equal(t, "vmLost", notification.ID)
+	vmLost := api.VMLost{}
+	err = json.Unmarshal(notification.Data, &vmLost)
+	assert.Nil(t, err)
+	assert.Equal(t, api.VMLostHealthCheck, vmLost.Reason)
+
+	client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, srv.Shutdown(ctx))
+}
+
+// An agent busy with a command isn't pinged, however long the command takes
+func TestHealthCheckBusy(t *testing.T) {
+	a := &hangingAgent{
+		memoryAgent: newMemoryAgent(),
+		hang:        make(chan struct{}),
+		busy:        make(chan struct{}),
+	}
+	close(a.ready)
+
+	l, path := listenTestServer(t)
+	defer os.Remove(path)
+	srv, err := New(WithListener(l), WithHealthCheckInterval(10*time.Millisecond),
+		WithAgent("test", func(ctlSerial, ioSerial string) (Agent, error) {
+			return a, nil
+		}))
+	assert.Nil(t, err)
+	go srv.Serve(context.Background())
+
+	client := dialTestServer(t, path)
+	_, err = client.Hello(testContainerID, "ctl", "io", &api.HelloOptions{Agent: "test"})
+	assert.Nil(t, err)
+
+	proxy := srv.proxy
+	proxy.Lock()
+	vm := proxy.lookupVM(testContainerID)
+	proxy.Unlock()
+
+	done := make(chan error)
+	go func() {
+		done <- vm.SendMessage("startpod", nil)
+	}()
+	for cmd := range a.commands {
+		if cmd.cmd == "startpod" {
+			break
+		}
+	}
+
+	select {
+	case cmd := <-a.commands:
+		assert.Fail(t, "unexpected command", cmd.cmd)
+	case <-vm.OnVMLost():
+		assert.Fail(t, "VM lost while busy")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Pings are back once the command is done
+	close(a.busy)
+	assert.Nil(t, <-done)
+	cmd := <-a.commands
+	assert.Equal(t, "ping", cmd.cmd)
+
+	client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, srv.Shutdown(ctx))
+}
+
+func TestHealthCheckOptions(t *testing.T) {
+	l, path := listenTestServer(t)
+	defer os.Remove(path)
+	defer l.Close()
+
+	_, err := New(WithListener(l), WithHealthCheckInterval(-time.Second))
+	assert.NotNil(t, err)
+
+	srv, err := New(WithListener(l), WithHealthCheckInterval(time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second, srv.proxy.healthCheckInterval)
+}
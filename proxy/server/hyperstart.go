@@ -0,0 +1,211 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/record"
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+)
+
+// hyperstartAgent is the agent talking to hyperstart through its ctl and io
+// channels. Unlike hyperstart.Hyperstart, which can only dial the channels
+// with net.Dial, it supports all the endpoint transports.
+type hyperstartAgent struct {
+	ctlEndpoint, ioEndpoint *endpoint
+	ctl, io                 net.Conn
+	ioReader                *ioReader
+
+	// ctl access is arbitrated by ctlLock, only a single "transaction"
+	// (write command + read answer) can be in flight
+	ctlLock sync.Mutex
+}
+
+const ctlHeaderSize = 8
+
+// Maximum size of a message, header included, hyperstart can receive. That
+// limit is from hyperstart src/init.c, hyper_channel_ops, rbuf_size.
+const maxHyperstartMessageSize = 10240
+
+func newHyperstartAgent(ctlSerial, ioSerial string) (Agent, error) {
+	ctlEndpoint, err := parseEndpoint(ctlSerial)
+	if err != nil {
+		return nil, err
+	}
+	ioEndpoint, err := parseEndpoint(ioSerial)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hyperstartAgent{
+		ctlEndpoint: ctlEndpoint,
+		ioEndpoint:  ioEndpoint,
+	}, nil
+}
+
+// Connect implements agent.
+func (h *hyperstartAgent) Connect(deadline time.Time) error {
+	ctlConn, err := h.ctlEndpoint.dialUntil(deadline)
+	if err != nil {
+		return err
+	}
+	ioConn, err := h.ioEndpoint.dialUntil(deadline)
+	if err != nil {
+		ctlConn.Close()
+		return err
+	}
+
+	h.ctl, h.io = ctlConn, ioConn
+	h.ioReader = newIoReader(ioConn)
+	return nil
+}
+
+func (h *hyperstartAgent) readCtlMessage() (*hyper.DecodedMessage, error) {
+	header := make([]byte, ctlHeaderSize)
+	if _, err := io.ReadFull(h.ctl, header); err != nil {
+		return nil, &ChannelError{err}
+	}
+
+	length := int(binary.BigEndian.Uint32(header[4:]))
+	if length < ctlHeaderSize {
+		length = ctlHeaderSize
+	}
+	// The length comes from the VM, don't let it make us allocate
+	// anything it likes
+	if length > maxHyperstartMessageSize {
+		return nil, &ChannelError{fmt.Errorf("ctl message too long %d", length)}
+	}
+	msg := &hyper.DecodedMessage{
+		Code:    binary.BigEndian.Uint32(header),
+		Message: make([]byte, length-ctlHeaderSize),
+	}
+	if _, err := io.ReadFull(h.ctl, msg.Message); err != nil {
+		return nil, &ChannelError{err}
+	}
+
+	return msg, nil
+}
+
+func (h *hyperstartAgent) writeCtlMessage(code uint32, data []byte) error {
+	length := ctlHeaderSize + len(data)
+	if length > maxHyperstartMessageSize {
+		return fmt.Errorf("message too long %d", length)
+	}
+
+	msg := make([]byte, length)
+	binary.BigEndian.PutUint32(msg, code)
+	binary.BigEndian.PutUint32(msg[4:], uint32(length))
+	copy(msg[ctlHeaderSize:], data)
+
+	if _, err := h.ctl.Write(msg); err != nil {
+		return &ChannelError{err}
+	}
+	return nil
+}
+
+// expect reads ctl messages until receiving code.
+func (h *hyperstartAgent) expect(code uint32) (*hyper.DecodedMessage, error) {
+	for {
+		msg, err := h.readCtlMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg.Code {
+		case code:
+			return msg, nil
+		case hyper.INIT_NEXT, hyper.INIT_READY:
+			continue
+		case hyper.INIT_ERROR:
+			return nil, fmt.Errorf("ERROR received from Hyperstart")
+		default:
+			return nil, fmt.Errorf("CMD ID received %d not matching expected %d",
+				msg.Code, code)
+		}
+	}
+}
+
+// WaitReady implements agent, waiting for hyperstart to send READY on the ctl
+// channel.
+func (h *hyperstartAgent) WaitReady(deadline time.Time) error {
+	h.ctlLock.Lock()
+	defer h.ctlLock.Unlock()
+
+	if err := h.ctl.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	defer h.ctl.SetReadDeadline(time.Time{})
+
+	_, err := h.expect(hyper.INIT_READY)
+	return err
+}
+
+// SendCommand implements agent, sending cmd on the ctl channel and waiting
+// for hyperstart to acknowledge it.
+func (h *hyperstartAgent) SendCommand(cmd string, data []byte) ([]byte, error) {
+	code, ok := record.CmdCode(cmd)
+	if !ok {
+		return nil, fmt.Errorf("unknown command '%s'", cmd)
+	}
+
+	h.ctlLock.Lock()
+	defer h.ctlLock.Unlock()
+
+	if err := h.writeCtlMessage(code, data); err != nil {
+		return nil, err
+	}
+
+	msg, err := h.expect(hyper.INIT_ACK)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Message, nil
+}
+
+// ReadStream implements agent, reading the next message of the io channel.
+func (h *hyperstartAgent) ReadStream() (uint64, []byte, error) {
+	return h.ioReader.readFrame()
+}
+
+// StreamBuffered implements streamBuffer.
+func (h *hyperstartAgent) StreamBuffered() bool {
+	return h.ioReader.buffered()
+}
+
+// StreamConn implements streamConn.
+func (h *hyperstartAgent) StreamConn() net.Conn {
+	return h.io
+}
+
+// WriteStream implements agent, writing on the io channel.
+func (h *hyperstartAgent) WriteStream(seq uint64, data []byte) error {
+	return writeIoFrame(h.io, seq, data)
+}
+
+// Close implements agent.
+func (h *hyperstartAgent) Close() {
+	if h.ctl != nil {
+		h.ctl.Close()
+	}
+	if h.io != nil {
+		h.io.Close()
+	}
+}
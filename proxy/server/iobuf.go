@@ -0,0 +1,186 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// I/O frames are the hyperstart io channel messages, exchanged with both
+// hyperstart and the shims:
+//
+//  ┌────────────────────┬──────────────┬──────────────────────────┐
+//  │  Sequence number   │    Length    │           Data           │
+//  │     (64 bits)      │  (32 bits)   │ (length - 12 bytes)      │
+//  └────────────────────┴──────────────┴──────────────────────────┘
+//
+// The length includes the header.
+const ioHeaderSize = 12
+
+// Size of the buffers of ioReader and ioWriter, a few frames.
+const ioBufferSize = 4 * maxHyperstartMessageSize
+
+// ioReaders are pooled, along with their buffers, as sessions come and go.
+var ioReaders = sync.Pool{
+	New: func() interface{} {
+		return &ioReader{
+			r:    bufio.NewReaderSize(nil, ioBufferSize),
+			data: make([]byte, maxHyperstartMessageSize-ioHeaderSize),
+		}
+	},
+}
+
+// ioReader reads I/O frames through a buffered reader, header then body,
+// without allocating.
+type ioReader struct {
+	r      *bufio.Reader
+	header [ioHeaderSize]byte
+	data   []byte
+}
+
+// newIoReader returns an ioReader reading from r. It should be given back
+// with release once done.
+func newIoReader(r io.Reader) *ioReader {
+	reader := ioReaders.Get().(*ioReader)
+	reader.r.Reset(r)
+	return reader
+}
+
+// release puts r back in the pool. r can't be used afterwards.
+func (r *ioReader) release() {
+	r.r.Reset(nil)
+	ioReaders.Put(r)
+}
+
+// readFrame reads the next frame. The data returned is only valid until the
+// next call.
+func (r *ioReader) readFrame() (seq uint64, data []byte, err error) {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	seq = binary.BigEndian.Uint64(r.header[:])
+	length := int(binary.BigEndian.Uint32(r.header[8:]))
+
+	// Hyperstart sends headers with a length smaller than the header
+	// size, meaning no data
+	if length < ioHeaderSize {
+		length = ioHeaderSize
+	}
+	if length > maxHyperstartMessageSize {
+		return 0, nil, fmt.Errorf("I/O frame too long %d", length)
+	}
+
+	data = r.data[:length-ioHeaderSize]
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+
+	return seq, data, nil
+}
+
+// buffered returns true when the next frame, or part of it, has already been
+// read from the underlying reader.
+func (r *ioReader) buffered() bool {
+	return r.r.Buffered() > 0
+}
+
+// ioWriter coalesces the I/O frames written to an io.Writer: they are
+// buffered until flush, the frames read in a burst going out in a single
+// write. It's safe for concurrent use.
+type ioWriter struct {
+	sync.Mutex
+	w      *bufio.Writer
+	header [ioHeaderSize]byte
+}
+
+func newIoWriter(w io.Writer) *ioWriter {
+	return &ioWriter{
+		w: bufio.NewWriterSize(w, ioBufferSize),
+	}
+}
+
+// writeFrame buffers a frame, writing the buffered ones if there's no room
+// left for it.
+func (w *ioWriter) writeFrame(seq uint64, data []byte) error {
+	length := ioHeaderSize + len(data)
+	if length > maxHyperstartMessageSize {
+		return fmt.Errorf("message too long %d", length)
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	binary.BigEndian.PutUint64(w.header[:], seq)
+	binary.BigEndian.PutUint32(w.header[8:], uint32(length))
+	if _, err := w.w.Write(w.header[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(data)
+	return err
+}
+
+// flush writes the buffered frames.
+func (w *ioWriter) flush() error {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.w.Flush()
+}
+
+// writeFrameNow writes a frame and flushes it, along with the ones buffered
+// before.
+func (w *ioWriter) writeFrameNow(seq uint64, data []byte) error {
+	if err := w.writeFrame(seq, data); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// ioFrames are pooled buffers holding a frame, header included, to send it in
+// a single write.
+var ioFrames = sync.Pool{
+	New: func() interface{} {
+		frame := make([]byte, maxHyperstartMessageSize)
+		return &frame
+	},
+}
+
+// writeIoFrame writes a frame to w in a single write, as
+// hyperstart.SendIoMessageWithConn does, without allocating.
+func writeIoFrame(w io.Writer, seq uint64, data []byte) error {
+	length := ioHeaderSize + len(data)
+	if length > maxHyperstartMessageSize {
+		return fmt.Errorf("message too long %d", length)
+	}
+
+	buf := ioFrames.Get().(*[]byte)
+	defer ioFrames.Put(buf)
+	frame := *buf
+
+	binary.BigEndian.PutUint64(frame, seq)
+	binary.BigEndian.PutUint32(frame[8:], uint32(length))
+	copy(frame[ioHeaderSize:], data)
+
+	_, err := w.Write(frame[:length])
+	return err
+}
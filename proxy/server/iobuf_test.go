@@ -0,0 +1,366 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"testing/iotest"
+
+	"github.com/containers/virtcontainers/hyperstart"
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+	"github.com/stretchr/testify/assert"
+)
+
+type testFrame struct {
+	seq  uint64
+	data string
+}
+
+var testFrames = []testFrame{
+	{1, "foo"},
+	{2, ""},
+	{1, string(make([]byte, maxHyperstartMessageSize-ioHeaderSize))},
+	{3, "bar"},
+}
+
+func TestIoReader(t *testing.T) {
+	var buf bytes.Buffer
+	for _, f := range testFrames {
+		assert.Nil(t, writeIoFrame(&buf, f.seq, []byte(f.data)))
+	}
+
+	// Short reads don't matter
+	r := newIoReader(iotest.OneByteReader(&buf))
+	defer r.release()
+
+	for _, f := range testFrames {
+		seq, data, err := r.readFrame()
+		assert.Nil(t, err)
+		assert.Equal(t, f.seq, seq)
+		assert.Equal(t, f.data, string(data))
+	}
+
+	_, _, err := r.readFrame()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestIoReaderInvalid(t *testing.T) {
+	header := func(seq uint64, length uint32) []byte {
+		h := make([]byte, ioHeaderSize)
+		binary.BigEndian.PutUint64(h, seq)
+		binary.BigEndian.PutUint32(h[8:], length)
+		return h
+	}
+
+	tests := []struct {
+		input []byte
+		err   bool
+	}{
+		// Hyperstart can send a 0 length to mean no data
+		{header(1, 0), false},
+		{header(1, maxHyperstartMessageSize+1), true},
+		// Truncated header and data
+		{header(1, 16)[:6], true},
+		{append(header(1, 16), 'a'), true},
+	}
+
+	for _, test := range tests {
+		r := newIoReader(bytes.NewReader(test.input))
+		_, data, err := r.readFrame()
+		if test.err {
+			assert.NotNil(t, err)
+			assert.NotEqual(t, io.EOF, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Len(t, data, 0)
+		}
+		r.release()
+	}
+}
+
+// countingWriter counts the writes reaching the underlying writer.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestIoWriter(t *testing.T) {
+	var out countingWriter
+	w := newIoWriter(&out)
+
+	for _, f := range testFrames[:2] {
+		assert.Nil(t, w.writeFrame(f.seq, []byte(f.data)))
+	}
+	assert.Equal(t, 0, out.writes)
+
+	// Frames are coalesced
+	assert.Nil(t, w.flush())
+	assert.Equal(t, 1, out.writes)
+
+	assert.Nil(t, w.writeFrameNow(testFrames[3].seq, []byte(testFrames[3].data)))
+	assert.Equal(t, 2, out.writes)
+
+	assert.NotNil(t, w.writeFrame(1, make([]byte, maxHyperstartMessageSize)))
+
+	r := newIoReader(&out)
+	defer r.release()
+	for _, f := range []testFrame{testFrames[0], testFrames[1], testFrames[3]} {
+		seq, data, err := r.readFrame()
+		assert.Nil(t, err)
+		assert.Equal(t, f.seq, seq)
+		assert.Equal(t, f.data, string(data))
+	}
+}
+
+// The frames are the ones the hyperstart package reads and writes.
+func TestIoFramesCompatibility(t *testing.T) {
+	c0, c1, err := Socketpair()
+	assert.Nil(t, err)
+	defer c0.Close()
+	defer c1.Close()
+
+	go func() {
+		for _, f := range testFrames {
+			hyperstart.SendIoMessageWithConn(c0, &hyper.TtyMessage{
+				Session: f.seq,
+				Message: []byte(f.data),
+			})
+		}
+	}()
+
+	r := newIoReader(c1)
+	defer r.release()
+	for _, f := range testFrames {
+		seq, data, err := r.readFrame()
+		assert.Nil(t, err)
+		assert.Equal(t, f.seq, seq)
+		assert.Equal(t, f.data, string(data))
+	}
+
+	w := newIoWriter(c1)
+	go func() {
+		for _, f := range testFrames {
+			w.writeFrame(f.seq, []byte(f.data))
+		}
+		w.flush()
+	}()
+
+	for _, f := range testFrames {
+		msg, err := hyperstart.ReadIoMessageWithConn(c0)
+		assert.Nil(t, err)
+		assert.Equal(t, f.seq, msg.Session)
+		assert.Equal(t, f.data, string(msg.Message))
+	}
+}
+
+//
+// Benchmarks. The "hyperstart" ones are what the proxy used to do, with the
+// hyperstart package.
+//
+
+// Size of the frames of the benchmarks, what a process writing a lot of output
+// would send.
+const benchFrameSize = 4096
+
+// frameSource is an endless stream of frames.
+type frameSource struct {
+	net.Conn
+	frames []byte
+	off    int
+}
+
+func newFrameSource(n int) *frameSource {
+	var buf bytes.Buffer
+	data := make([]byte, benchFrameSize-ioHeaderSize)
+	for i := 0; i < n; i++ {
+		writeIoFrame(&buf, uint64(i%4+1), data)
+	}
+	return &frameSource{frames: buf.Bytes()}
+}
+
+func (s *frameSource) Read(p []byte) (int, error) {
+	n := copy(p, s.frames[s.off:])
+	s.off = (s.off + n) % len(s.frames)
+	return n, nil
+}
+
+// discardConn discards what's written to it.
+type discardConn struct {
+	net.Conn
+}
+
+func (c *discardConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func BenchmarkReadFrame(b *testing.B) {
+	b.Run("hyperstart", func(b *testing.B) {
+		src := newFrameSource(16)
+		b.SetBytes(benchFrameSize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := hyperstart.ReadIoMessageWithConn(src); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("ioReader", func(b *testing.B) {
+		r := newIoReader(newFrameSource(16))
+		defer r.release()
+		b.SetBytes(benchFrameSize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := r.readFrame(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkWriteFrame(b *testing.B) {
+	data := make([]byte, benchFrameSize-ioHeaderSize)
+
+	b.Run("hyperstart", func(b *testing.B) {
+		conn := &discardConn{}
+		b.SetBytes(benchFrameSize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := hyperstart.SendIoMessageWithConn(conn, &hyper.TtyMessage{
+				Session: 1,
+				Message: data,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("writeIoFrame", func(b *testing.B) {
+		conn := &discardConn{}
+		b.SetBytes(benchFrameSize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := writeIoFrame(conn, 1, data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// Bursts of 8 frames
+	b.Run("ioWriter", func(b *testing.B) {
+		conn := &discardConn{}
+		w := newIoWriter(conn)
+		b.SetBytes(benchFrameSize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := w.writeFrame(1, data); err != nil {
+				b.Fatal(err)
+			}
+			if i%8 == 7 {
+				w.flush()
+			}
+		}
+		w.flush()
+	})
+}
+
+// BenchmarkForward forwards frames between sockets, as ioHyperToClients does
+// between hyperstart and a shim.
+func BenchmarkForward(b *testing.B) {
+	forward := func(b *testing.B, copyFrames func(in, out net.Conn, n int) error) {
+		vm, in, err := Socketpair()
+		if err != nil {
+			b.Fatal(err)
+		}
+		out, shim, err := Socketpair()
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer func() {
+			for _, c := range []net.Conn{vm, in, out, shim} {
+				c.Close()
+			}
+		}()
+
+		// The VM writes frames as fast as it can, the shim reads them
+		go func() {
+			src := newFrameSource(16)
+			io.CopyN(vm, src, int64(b.N)*benchFrameSize)
+		}()
+		done := make(chan struct{})
+		go func() {
+			io.CopyN(ioutil.Discard, shim, int64(b.N)*benchFrameSize)
+			close(done)
+		}()
+
+		b.SetBytes(benchFrameSize)
+		b.ReportAllocs()
+		b.ResetTimer()
+		if err := copyFrames(in, out, b.N); err != nil {
+			b.Fatal(err)
+		}
+		<-done
+	}
+
+	b.Run("hyperstart", func(b *testing.B) {
+		forward(b, func(in, out net.Conn, n int) error {
+			for i := 0; i < n; i++ {
+				msg, err := hyperstart.ReadIoMessageWithConn(in)
+				if err != nil {
+					return err
+				}
+				if err := hyperstart.SendIoMessageWithConn(out, msg); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+
+	b.Run("ioReader+ioWriter", func(b *testing.B) {
+		forward(b, func(in, out net.Conn, n int) error {
+			r := newIoReader(in)
+			defer r.release()
+			w := newIoWriter(out)
+
+			for i := 0; i < n; i++ {
+				seq, data, err := r.readFrame()
+				if err != nil {
+					return err
+				}
+				if err := w.writeFrame(seq, data); err != nil {
+					return err
+				}
+				if !r.buffered() {
+					if err := w.flush(); err != nil {
+						return err
+					}
+				}
+			}
+			return w.flush()
+		})
+	})
+}
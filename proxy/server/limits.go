@@ -0,0 +1,149 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+// Quotas and rate limits protecting the proxy from misbehaving clients, eg. a
+// buggy shim allocating I/O sessions in a loop. A zero value means no limit.
+type limitsConfig struct {
+	// Maximum number of I/O sessions a client can own in a VM
+	clientIoSessions int
+	// Maximum number of I/O sessions in a VM, all clients included
+	vmIoSessions int
+	// Maximum number of VMs registered by processes running as the same
+	// user
+	userVMs int
+	// Rate, in requests per second, and burst of requests a client can
+	// issue
+	requestRate  float64
+	requestBurst int
+}
+
+// Limits are the quotas and rate limits of a Server, see the WithLimits
+// option. A zero value means no limit.
+type Limits struct {
+	// Maximum number of I/O sessions a client can own in a VM
+	ClientIoSessions int
+	// Maximum number of I/O sessions in a VM, all clients included
+	VMIoSessions int
+	// Maximum number of VMs registered by processes running as the same
+	// user
+	UserVMs int
+	// Rate, in requests per second, and burst of requests a client can
+	// issue
+	RequestRate  float64
+	RequestBurst int
+}
+
+func (l Limits) config() (limitsConfig, error) {
+	config := limitsConfig{
+		clientIoSessions: l.ClientIoSessions,
+		vmIoSessions:     l.VMIoSessions,
+		userVMs:          l.UserVMs,
+		requestRate:      l.RequestRate,
+		requestBurst:     l.RequestBurst,
+	}
+
+	if config.clientIoSessions < 0 || config.vmIoSessions < 0 || config.userVMs < 0 ||
+		config.requestRate < 0 {
+		return config, errors.New("limits cannot be negative")
+	}
+	if config.requestRate > 0 && config.requestBurst < 1 {
+		return config, errors.New("-client-request-burst must be at least 1")
+	}
+
+	return config, nil
+}
+
+func limitsConfigFrom(options *Config) (limitsConfig, error) {
+	return Limits{
+		ClientIoSessions: options.MaxClientIoSessions,
+		VMIoSessions:     options.MaxVMIoSessions,
+		UserVMs:          options.MaxUserVMs,
+		RequestRate:      options.ClientRequestRate,
+		RequestBurst:     options.ClientRequestBurst,
+	}.config()
+}
+
+// Limit names, used as label values for the cc_proxy_limit_violations_total
+// counter.
+var limitNames = map[api.ErrorCode]string{
+	api.ErrorCodeRateLimited:             "client_request_rate",
+	api.ErrorCodeTooManyClientIoSessions: "client_io_sessions",
+	api.ErrorCodeTooManyVMIoSessions:     "vm_io_sessions",
+	api.ErrorCodeTooManyUserVMs:          "user_vms",
+}
+
+// limitError is returned when a request exceeds a quota or a rate limit.
+type limitError struct {
+	code api.ErrorCode
+	msg  string
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+// Code implements codedError.
+func (e *limitError) Code() api.ErrorCode {
+	return e.code
+}
+
+// newLimitError counts the violation of the limit identified by code, one of
+// the api.ErrorCode constants, in metrics and returns the corresponding error.
+func newLimitError(metrics *metrics, code api.ErrorCode, format string,
+	a ...interface{}) *limitError {
+	metrics.limitViolations.Inc(limitNames[code])
+	return &limitError{
+		code: code,
+		msg:  fmt.Sprintf(format, a...),
+	}
+}
+
+// allowRequest implements requestLimiter.
+func (c *client) allowRequest() error {
+	if !c.requests.Allow() {
+		return newLimitError(c.proxy.metrics, api.ErrorCodeRateLimited,
+			"too many requests, slow down")
+	}
+	return nil
+}
+
+// checkUserVMs returns an error if the user running client has reached its
+// maximum number of VMs. Must be called with the proxy lock held.
+func (proxy *proxy) checkUserVMs(client *client) error {
+	if proxy.limits.userVMs == 0 || client.cred == nil {
+		return nil
+	}
+
+	n := 0
+	for _, vm := range proxy.vms {
+		if vm.owner != nil && vm.owner.Uid == client.cred.Uid {
+			n++
+		}
+	}
+	if n >= proxy.limits.userVMs {
+		return newLimitError(proxy.metrics, api.ErrorCodeTooManyUserVMs,
+			"uid %d: too many VMs (max %d)", client.cred.Uid, proxy.limits.userVMs)
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestRateLimit(t *testing.T) {
+	proto := NewProtocol()
+	proto.Handle("echo", echoHandler)
+
+	now := time.Now()
+	c := &client{
+		id:       1,
+		proxy:    newProxy(),
+		requests: newTokenBucket(1, 2),
+	}
+	c.requests.now = func() time.Time { return now }
+	c.requests.last = now
+	ctx := newClientCtx(nil, c)
+
+	request := func() *api.Response {
+		req := api.Request{ID: "echo", Data: []byte(`{"arg":"ping"}`)}
+		return proto.handleRequest(ctx, &req, &HandlerResponse{})
+	}
+
+	// A burst of 2 requests is allowed
+	assert.True(t, request().Success)
+	assert.True(t, request().Success)
+
+	resp := request()
+	assert.False(t, resp.Success)
+	assert.Equal(t, api.ErrorCodeRateLimited, resp.Code)
+	assert.Equal(t, uint64(1), c.proxy.metrics.limitViolations.Get("client_request_rate"))
+
+	// Then 1 request per second
+	now = now.Add(1 * time.Second)
+	assert.True(t, request().Success)
+	assert.False(t, request().Success)
+}
+
+func TestIoSessionsLimits(t *testing.T) {
+	rig := newTestRig(t, newProxyProtocol())
+	rig.Start()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err := rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath, nil)
+	assert.Nil(t, err)
+
+	setLimits := func(limits limitsConfig) {
+		rig.proxy.Lock()
+		rig.proxy.limits = limits
+		rig.proxy.Unlock()
+	}
+
+	checkLimitError := func(err error, code api.ErrorCode) {
+		apiErr, ok := err.(*api.Error)
+		if !assert.True(t, ok) {
+			return
+		}
+		assert.Equal(t, code, apiErr.Code)
+	}
+
+	// Per client quota
+	setLimits(limitsConfig{clientIoSessions: 1})
+
+	_, ioFile, err := rig.Client.AllocateIo(1)
+	assert.Nil(t, err)
+	ioFile.Close()
+
+	_, _, err = rig.Client.AllocateIo(1)
+	checkLimitError(err, api.ErrorCodeTooManyClientIoSessions)
+
+	// Per VM quota
+	setLimits(limitsConfig{vmIoSessions: 1})
+
+	_, _, err = rig.Client.AllocateIo(2)
+	checkLimitError(err, api.ErrorCodeTooManyVMIoSessions)
+
+	setLimits(limitsConfig{vmIoSessions: 2})
+
+	_, ioFile, err = rig.Client.AllocateIo(2)
+	assert.Nil(t, err)
+	ioFile.Close()
+
+	rig.Stop()
+}
+
+func TestUserVMsLimit(t *testing.T) {
+	proxy := newProxy()
+	proxy.limits.userVMs = 2
+
+	alice := &client{cred: &syscall.Ucred{Uid: 1000}}
+	bob := &client{cred: &syscall.Ucred{Uid: 1001}}
+	unknown := &client{}
+
+	for _, id := range []string{"vm1", "vm2"} {
+		assert.Nil(t, proxy.checkUserVMs(alice))
+		vm := newProxy().newVM(id, "ctl", "io", nil)
+		vm.owner = alice.cred
+		proxy.vms[id] = vm
+	}
+
+	err := proxy.checkUserVMs(alice)
+	assert.NotNil(t, err)
+	assert.Equal(t, api.ErrorCodeTooManyUserVMs, err.(*limitError).Code())
+
+	assert.Nil(t, proxy.checkUserVMs(bob))
+	assert.Nil(t, proxy.checkUserVMs(unknown))
+
+	proxy.limits.userVMs = 0
+	assert.Nil(t, proxy.checkUserVMs(alice))
+}
+
+func TestLimitsConfigFrom(t *testing.T) {
+	options := DefaultConfig()
+	config, err := limitsConfigFrom(options)
+	assert.Nil(t, err)
+	assert.Equal(t, limitsConfig{requestBurst: 50}, config)
+
+	options.MaxUserVMs = -1
+	_, err = limitsConfigFrom(options)
+	assert.NotNil(t, err)
+	options.MaxUserVMs = 0
+
+	options.ClientRequestRate = 10
+	options.ClientRequestBurst = 0
+	_, err = limitsConfigFrom(options)
+	assert.NotNil(t, err)
+}
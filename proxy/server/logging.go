@@ -0,0 +1,270 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Log formats, selected with -log-format.
+const (
+	// glog's native format, with [client #id] and [vm id channel]
+	// prefixes. This is the default.
+	logFormatGlog = "glog"
+	// One JSON object per line
+	logFormatJSON = "json"
+	// key=value pairs, one line per message
+	logFormatLogfmt = "logfmt"
+)
+
+// Stable field names for structured logs. In the journald case, field names
+// are upper cased.
+const (
+	fieldContainerID = "container_id"
+	fieldClientID    = "client_id"
+	fieldClientPid   = "client_pid"
+	fieldChannel     = "channel"
+	fieldPayload     = "payload"
+	fieldSeq         = "seq"
+	fieldDuration    = "duration"
+	fieldError       = "error"
+)
+
+// logFields are the key/value pairs attached to a structured log message.
+type logFields map[string]interface{}
+
+const journaldSocketPath = "/run/systemd/journal/socket"
+
+// structuredLogger writes log messages with their fields, either formatted on
+// a writer or sent to journald.
+type structuredLogger struct {
+	sync.Mutex
+	format string
+	w      io.Writer
+
+	// when non nil, messages are sent to journald
+	journald *net.UnixConn
+}
+
+// A Logger receives the proxy log messages in place of glog, see the
+// WithLogger option. level is the glog verbosity of the message and fields
+// its structured context, eg. the client and VM it's about.
+type Logger interface {
+	Log(level int, fields map[string]interface{}, msg string)
+}
+
+// serverLog is where the log messages of a Server go. Each Server has its own,
+// set up before serving. A nil serverLog logs with glog's native format.
+type serverLog struct {
+	// Logger given with WithLogger, if any
+	sink Logger
+	// nil when logging with glog's native format
+	structured *structuredLogger
+}
+
+// setup configures the log output. The glog verbosity (-v) is honoured
+// whatever the format.
+func (l *serverLog) setup(format string, journald bool) error {
+	switch format {
+	case logFormatGlog:
+		if !journald {
+			l.structured = nil
+			return nil
+		}
+	case logFormatJSON, logFormatLogfmt:
+	default:
+		return fmt.Errorf("unknown log format '%s'", format)
+	}
+
+	logger := &structuredLogger{
+		format: format,
+		w:      os.Stderr,
+	}
+
+	if journald {
+		conn, err := net.DialUnix("unixgram", nil,
+			&net.UnixAddr{Name: journaldSocketPath, Net: "unixgram"})
+		if err != nil {
+			return fmt.Errorf("couldn't connect to journald: %v", err)
+		}
+		logger.journald = conn
+	}
+
+	l.structured = logger
+	return nil
+}
+
+func sortedFieldNames(fields logFields) []string {
+	names := make([]string, 0, len(fields))
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func fieldValue(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case error:
+		return value.Error()
+	case time.Duration:
+		return value.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (l *structuredLogger) formatJSON(lvl glog.Level, fields logFields, msg string) []byte {
+	entry := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		switch value := v.(type) {
+		case error:
+			entry[k] = value.Error()
+		case time.Duration:
+			entry[k] = value.Seconds()
+		default:
+			entry[k] = v
+		}
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = lvl
+	entry["msg"] = msg
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{
+			"msg":   msg,
+			"error": err.Error(),
+		})
+	}
+	return append(data, '\n')
+}
+
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (l *structuredLogger) formatLogfmt(lvl glog.Level, fields logFields, msg string) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "time=%s level=%d msg=%s",
+		time.Now().UTC().Format(time.RFC3339Nano), lvl, logfmtValue(msg))
+	for _, k := range sortedFieldNames(fields) {
+		fmt.Fprintf(&buf, " %s=%s", k, logfmtValue(fieldValue(fields[k])))
+	}
+	buf.WriteByte('\n')
+
+	return buf.Bytes()
+}
+
+// journaldField appends a field to a journald native protocol datagram.
+// Values with a new line need the binary encoding.
+func journaldField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+func (l *structuredLogger) formatJournald(lvl glog.Level, fields logFields, msg string) []byte {
+	var buf bytes.Buffer
+
+	journaldField(&buf, "MESSAGE", msg)
+	// LOG_INFO
+	journaldField(&buf, "PRIORITY", "6")
+	journaldField(&buf, "SYSLOG_IDENTIFIER", "cc-proxy")
+	journaldField(&buf, "GLOG_LEVEL", strconv.Itoa(int(lvl)))
+	for _, k := range sortedFieldNames(fields) {
+		journaldField(&buf, strings.ToUpper(k), fieldValue(fields[k]))
+	}
+
+	return buf.Bytes()
+}
+
+func (l *structuredLogger) log(lvl glog.Level, fields logFields, msg string) {
+	msg = strings.TrimRight(msg, "\n")
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.journald != nil {
+		if _, err := l.journald.Write(l.formatJournald(lvl, fields, msg)); err == nil {
+			return
+		}
+		// Fall back to stderr if journald can't take the message
+	}
+
+	if l.format == logFormatLogfmt {
+		l.w.Write(l.formatLogfmt(lvl, fields, msg))
+		return
+	}
+	l.w.Write(l.formatJSON(lvl, fields, msg))
+}
+
+// native returns true when logging with glog's native format.
+func (l *serverLog) native() bool {
+	return l == nil || (l.sink == nil && l.structured == nil)
+}
+
+// output logs msg at verbosity lvl, without checking the verbosity: callers
+// have their own idea of it, eg. VMs with their own log level. glogPrefix is
+// only used with glog's native format while fields are only used with
+// structured logs. depth is the number of stack frames to skip when reporting
+// the file and line of the message with glog's native format.
+func (l *serverLog) output(depth int, lvl glog.Level, glogPrefix string, fields logFields, msg string) {
+	if l != nil && l.sink != nil {
+		l.sink.Log(int(lvl), fields, msg)
+		return
+	}
+
+	if l == nil || l.structured == nil {
+		glog.InfoDepth(depth, glogPrefix+msg)
+		return
+	}
+
+	l.structured.log(lvl, fields, msg)
+}
+
+// infof logs a message that isn't specific to a client or a VM.
+func (l *serverLog) infof(lvl glog.Level, format string, a ...interface{}) {
+	if !glog.V(lvl) {
+		return
+	}
+	l.output(2, lvl, "", nil, fmt.Sprintf(format, a...))
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetupLogging(t *testing.T) {
+	var log serverLog
+
+	assert.NotNil(t, log.setup("xml", false))
+
+	assert.Nil(t, log.setup(logFormatJSON, false))
+	assert.NotNil(t, log.structured)
+	assert.False(t, log.native())
+
+	assert.Nil(t, log.setup(logFormatGlog, false))
+	assert.Nil(t, log.structured)
+	assert.True(t, log.native())
+}
+
+func TestLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &structuredLogger{format: logFormatJSON, w: &buf}
+
+	logger.log(1, logFields{
+		fieldContainerID: testContainerID,
+		fieldClientID:    uint64(3),
+		fieldPayload:     "hyper",
+		fieldDuration:    1500 * time.Millisecond,
+		fieldError:       errors.New("boom"),
+	}, "hyper failed\n")
+
+	assert.True(t, strings.HasSuffix(buf.String(), "}\n"))
+
+	entry := make(map[string]interface{})
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	assert.Nil(t, err)
+	assert.Equal(t, "hyper failed", entry["msg"])
+	assert.Equal(t, float64(1), entry["level"])
+	assert.Equal(t, testContainerID, entry["container_id"])
+	assert.Equal(t, float64(3), entry["client_id"])
+	assert.Equal(t, "hyper", entry["payload"])
+	assert.Equal(t, 1.5, entry["duration"])
+	assert.Equal(t, "boom", entry["error"])
+	assert.NotNil(t, entry["time"])
+}
+
+func TestLogLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &structuredLogger{format: logFormatLogfmt, w: &buf}
+
+	logger.log(2, logFields{
+		fieldContainerID: testContainerID,
+		fieldChannel:     "io",
+		fieldSeq:         uint64(5),
+	}, "<- writing to client #1")
+
+	line := buf.String()
+	assert.True(t, strings.HasPrefix(line, "time="))
+	assert.True(t, strings.HasSuffix(line, ` level=2 msg="<- writing to client #1" `+
+		"channel=io container_id=0987654321 seq=5\n"))
+}
+
+func TestJournaldField(t *testing.T) {
+	var buf bytes.Buffer
+
+	journaldField(&buf, "MESSAGE", "foo")
+	assert.Equal(t, "MESSAGE=foo\n", buf.String())
+
+	// Values with new lines use the binary format
+	buf.Reset()
+	journaldField(&buf, "MESSAGE", "a\nb")
+	assert.Equal(t, "MESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n", buf.String())
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+// logLevel returns the global log level, ie. the value of -v.
+func logLevel() int {
+	level, _ := strconv.Atoi(flag.Lookup("v").Value.String())
+	return level
+}
+
+// setLogLevel changes the global log level. Once serving, it must be called
+// with optionsLock held.
+func setLogLevel(level int) error {
+	return flag.Set("v", strconv.Itoa(level))
+}
+
+// "setLogLevel"
+func setLogLevelHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	client := userData.(*client)
+	setLevel := api.SetLogLevel{}
+
+	if err := json.Unmarshal(data, &setLevel); err != nil {
+		response.SetError(invalidRequestError(err))
+		return
+	}
+
+	if setLevel.Level < 0 {
+		response.SetError(newError(api.ErrorCodeInvalidRequest,
+			"invalid log level %d", setLevel.Level))
+		return
+	}
+
+	if setLevel.ContainerID == "" {
+		if setLevel.Reset {
+			response.SetError(newError(api.ErrorCodeInvalidRequest,
+				"reset needs a containerId"))
+			return
+		}
+		optionsLock.Lock()
+		err := setLogLevel(setLevel.Level)
+		optionsLock.Unlock()
+		if err != nil {
+			response.SetError(withCode(api.ErrorCodeInternal, err))
+			return
+		}
+		client.proxy.log.infof(0, "log level set to %d by client #%d", setLevel.Level,
+			client.id)
+		return
+	}
+
+	proxy := client.proxy
+	proxy.Lock()
+	vm := proxy.lookupVM(setLevel.ContainerID)
+	proxy.Unlock()
+	if vm == nil {
+		response.SetError(unknownContainerError(setLevel.ContainerID))
+		return
+	}
+
+	if setLevel.Reset {
+		vm.setLogLevel(noLogLevel)
+		proxy.log.infof(0, "log level of %s reset by client #%d", vm.containerID, client.id)
+		return
+	}
+
+	vm.setLogLevel(setLevel.Level)
+	proxy.log.infof(0, "log level of %s set to %d by client #%d", vm.containerID,
+		setLevel.Level, client.id)
+}
+
+// debugToggle switches the global log level between its normal value and
+// -debug-log-level.
+type debugToggle struct {
+	enabled bool
+	// log level to go back to
+	saved int
+}
+
+var errDebugLogLevel = errors.New("-debug-log-level cannot be negative")
+
+// Toggle switches the log level, returning the new log level. It must be
+// called with optionsLock held.
+func (t *debugToggle) Toggle(debugLevel int) (int, error) {
+	if t.enabled {
+		t.enabled = false
+		return t.saved, setLogLevel(t.saved)
+	}
+
+	if debugLevel < 0 {
+		return 0, errDebugLogLevel
+	}
+
+	t.saved = logLevel()
+	t.enabled = true
+	return debugLevel, setLogLevel(debugLevel)
+}
+
+// handleDebugToggle toggles the debug log level on SIGUSR1.
+func (proxy *proxy) handleDebugToggle() {
+	var toggle debugToggle
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	go func() {
+		for range signals {
+			proxy.toggleDebugLogLevel(&toggle)
+		}
+	}()
+}
+
+// toggleDebugLogLevel toggles the log level with t, between its normal value
+// and the current -debug-log-level, which a configuration reload can change.
+func (proxy *proxy) toggleDebugLogLevel(t *debugToggle) {
+	optionsLock.Lock()
+	level, err := t.Toggle(proxy.config.options.DebugLogLevel)
+	optionsLock.Unlock()
+
+	if err != nil {
+		proxy.log.infof(0, "couldn't change log level: %v", err)
+		return
+	}
+	proxy.log.infof(0, "log level set to %d", level)
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetLogLevel(t *testing.T) {
+	saved := logLevel()
+	defer setLogLevel(saved)
+
+	rig := newTestRig(t, newProxyProtocol())
+	rig.Start()
+
+	// Global log level
+	err := rig.Client.SetLogLevel(1, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, logLevel())
+
+	assert.NotNil(t, rig.Client.SetLogLevel(-1, nil))
+	assert.NotNil(t, rig.Client.SetLogLevel(0, &api.SetLogLevelOptions{Reset: true}))
+	assert.NotNil(t, rig.Client.SetLogLevel(2, &api.SetLogLevelOptions{ContainerID: "foo"}))
+
+	// Per VM log level
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err = rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath, nil)
+	assert.Nil(t, err)
+
+	info, err := rig.Client.VMInfo(testContainerID, false)
+	assert.Nil(t, err)
+	assert.Nil(t, info.VM.LogLevel)
+
+	err = rig.Client.SetLogLevel(2, &api.SetLogLevelOptions{ContainerID: testContainerID})
+	assert.Nil(t, err)
+
+	info, err = rig.Client.VMInfo(testContainerID, false)
+	assert.Nil(t, err)
+	if assert.NotNil(t, info.VM.LogLevel) {
+		assert.Equal(t, 2, *info.VM.LogLevel)
+	}
+
+	err = rig.Client.SetLogLevel(0, &api.SetLogLevelOptions{
+		ContainerID: testContainerID,
+		Reset:       true,
+	})
+	assert.Nil(t, err)
+
+	info, err = rig.Client.VMInfo(testContainerID, false)
+	assert.Nil(t, err)
+	assert.Nil(t, info.VM.LogLevel)
+
+	rig.Stop()
+}
+
+func TestVMLogLevel(t *testing.T) {
+	saved := logLevel()
+	defer setLogLevel(saved)
+
+	vm := newProxy().newVM(testContainerID, "ctl", "io", nil)
+	c := &client{}
+	c.setVM(vm, testContainerID, false)
+
+	// Follow the global log level by default
+	assert.Nil(t, setLogLevel(1))
+	assert.True(t, vm.v(1))
+	assert.False(t, vm.v(2))
+	assert.False(t, c.v(2))
+
+	// The VM log level can be higher or lower than the global one
+	vm.setLogLevel(2)
+	assert.True(t, vm.v(2))
+	assert.False(t, vm.v(3))
+	assert.True(t, c.v(2))
+
+	vm.setLogLevel(0)
+	assert.True(t, vm.v(0))
+	assert.False(t, vm.v(1))
+	assert.False(t, c.v(1))
+
+	vm.setLogLevel(noLogLevel)
+	assert.True(t, vm.v(1))
+}
+
+func TestDebugToggle(t *testing.T) {
+	saved := logLevel()
+	defer setLogLevel(saved)
+
+	var toggle debugToggle
+
+	assert.Nil(t, setLogLevel(1))
+
+	level, err := toggle.Toggle(3)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, level)
+	assert.Equal(t, 3, logLevel())
+
+	level, err = toggle.Toggle(3)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, level)
+	assert.Equal(t, 1, logLevel())
+
+	_, err = toggle.Toggle(-1)
+	assert.Equal(t, errDebugLogLevel, err)
+	assert.Equal(t, 1, logLevel())
+}
+
+// The debug log level can be toggled while the configuration is reloaded
+func TestDebugToggleReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.json")
+
+	savedLevel := logLevel()
+	defer setLogLevel(savedLevel)
+
+	options := DefaultConfig()
+	options.ConfigFile = path
+
+	assert.Nil(t, setLogLevel(1))
+	writeConfig(t, path, `{"debug-log-level": 3}`)
+	proxy := newProxy()
+	err = proxy.loadConfig(testFlags(options), options)
+	assert.Nil(t, err)
+
+	// Toggle for as long as the configuration is being reloaded, with a
+	// debug log level changing every time
+	var toggle debugToggle
+	done := make(chan struct{})
+	go func() {
+		for i := 1; i <= 50; i++ {
+			writeConfig(t, path, fmt.Sprintf(`{"debug-log-level": %d}`, 3+i%2))
+			assert.Nil(t, proxy.reloadConfig())
+		}
+		close(done)
+	}()
+	toggles := 0
+	for reloading := true; reloading; {
+		select {
+		case <-done:
+			reloading = false
+		default:
+			proxy.toggleDebugLogLevel(&toggle)
+			toggles++
+		}
+	}
+	if toggles%2 == 1 {
+		proxy.toggleDebugLogLevel(&toggle)
+	}
+
+	// An even number of toggles leaves the normal log level
+	assert.Equal(t, 1, logLevel())
+	assert.Equal(t, 3, options.DebugLogLevel)
+}
@@ -0,0 +1,382 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/01org/cc-oci-runtime/proxy/record"
+)
+
+// Metrics are exposed in the Prometheus text exposition format, version 0.0.4:
+//   https://prometheus.io/docs/instrumenting/exposition_formats/
+//
+// The format is simple enough that we implement it here rather than pulling
+// the Prometheus client library in.
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// unknownHyperCommand labels the hyperstart commands metrics of the commands
+// hyperstart doesn't know about.
+const unknownHyperCommand = "unknown"
+
+// hyperCommandLabel returns the label value of the hyperstart command name.
+// Clients can send any name and each label value is kept forever: only the
+// commands hyperstart knows about get their own label.
+func hyperCommandLabel(name string) string {
+	if _, ok := record.CmdCode(name); !ok {
+		return unknownHyperCommand
+	}
+	return name
+}
+
+// Error types, used as label values for the cc_proxy_errors_total counter.
+const (
+	// Malformed requests or unknown payloads
+	errorProtocol = "protocol"
+	// A payload handler returned an error
+	errorPayload = "payload"
+	// hyperstart failed to execute a command
+	errorHyperstart = "hyperstart"
+	// Failure forwarding I/O data between clients and hyperstart
+	errorIo = "io"
+	// A VM has been lost
+	errorVMLost = "vm_lost"
+	// A VM didn't become ready before its hello deadline
+	errorVMNotReady = "vm_not_ready"
+	// VM console output dropped by the rate limiter
+	errorConsoleRateLimited = "console_rate_limited"
+	// A payload handler panicked
+	errorPanic = "panic"
+	// A client was refused by the authorization policy
+	errorUnauthorized = "unauthorized"
+)
+
+// Default histogram buckets, in seconds.
+var defaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Boot buckets, in seconds. Booting a VM takes longer than a hyper command.
+var bootBuckets = []float64{.05, .1, .25, .5, .75, 1, 1.5, 2, 3, 5, 10, 30}
+
+func escapeLabelValue(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	return strings.Replace(v, `"`, `\"`, -1)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labels formats a list of name, value pairs into a label set.
+func labels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], escapeLabelValue(pairs[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// counterVec is a set of counters sharing a name and distinguished by the
+// value of a single label.
+type counterVec struct {
+	sync.Mutex
+	name, help, label string
+	values            map[string]uint64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		label:  label,
+		values: make(map[string]uint64),
+	}
+}
+
+func (c *counterVec) Inc(value string) {
+	c.Lock()
+	c.values[value]++
+	c.Unlock()
+}
+
+func (c *counterVec) Get(value string) uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.values[value]
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, labels(c.label, k), c.values[k])
+	}
+}
+
+// histogram counts observations into buckets. counts[i] holds the number of
+// observations <= buckets[i] but > buckets[i-1], they are made cumulative
+// when exposed.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is a set of histograms sharing a name and buckets, and
+// distinguished by the value of a single label. An empty label name gives a
+// single histogram.
+type histogramVec struct {
+	sync.Mutex
+	name, help, label string
+	buckets           []float64
+	series            map[string]*histogram
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+}
+
+func (h *histogramVec) Observe(value string, v float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	s := h.series[value]
+	if s == nil {
+		s = &histogram{
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.series[value] = s
+	}
+
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := h.series[k]
+		pairs := []string{}
+		if h.label != "" {
+			pairs = append(pairs, h.label, k)
+		}
+
+		bucket := func(le string) string {
+			return labels(append(pairs[:len(pairs):len(pairs)], "le", le)...)
+		}
+
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, bucket(formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, bucket("+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels(pairs...), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels(pairs...), s.count)
+	}
+}
+
+// Metrics of a Server, each Server having its own. Metrics derived from the
+// proxy state (number of VMs, clients, ...) are computed when scraped instead.
+type metrics struct {
+	requests        *counterVec
+	requestDuration *histogramVec
+	hyperCommands   *counterVec
+	hyperDuration   *histogramVec
+	errors          *counterVec
+	bootDuration    *histogramVec
+	// Requests denied by a quota or a rate limit
+	limitViolations *counterVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: newCounterVec("cc_proxy_requests_total",
+			"Number of requests handled, by payload.", "payload"),
+		requestDuration: newHistogramVec("cc_proxy_request_duration_seconds",
+			"Time taken to handle a request, by payload.", "payload",
+			defaultBuckets),
+		hyperCommands: newCounterVec("cc_proxy_hyper_commands_total",
+			"Number of hyperstart commands forwarded.", "command"),
+		hyperDuration: newHistogramVec("cc_proxy_hyper_command_duration_seconds",
+			"Time taken by hyperstart to execute a command.", "command",
+			defaultBuckets),
+		errors: newCounterVec("cc_proxy_errors_total",
+			"Number of errors, by type.", "type"),
+		bootDuration: newHistogramVec("cc_proxy_vm_ready_duration_seconds",
+			"Time between a hello and hyperstart being ready.", "",
+			bootBuckets),
+		limitViolations: newCounterVec("cc_proxy_limit_violations_total",
+			"Number of requests denied by a quota or a rate limit, by limit.", "limit"),
+	}
+}
+
+// I/O statistics of a VM.
+type ioStats struct {
+	// Data sent to the VM, from clients
+	bytesToVM, messagesToVM uint64
+	// Data received from the VM, for clients
+	bytesFromVM, messagesFromVM uint64
+}
+
+func (s *ioStats) toVM(n int) {
+	atomic.AddUint64(&s.bytesToVM, uint64(n))
+	atomic.AddUint64(&s.messagesToVM, 1)
+}
+
+func (s *ioStats) fromVM(n int) {
+	atomic.AddUint64(&s.bytesFromVM, uint64(n))
+	atomic.AddUint64(&s.messagesFromVM, 1)
+}
+
+type byContainerID []*vm
+
+func (s byContainerID) Len() int           { return len(s) }
+func (s byContainerID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byContainerID) Less(i, j int) bool { return s[i].containerID < s[j].containerID }
+
+func writeGauge(w io.Writer, name, help string, v int) {
+	writeHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", name, v)
+}
+
+// writeMetrics writes all the proxy metrics to w.
+func (proxy *proxy) writeMetrics(w io.Writer) {
+	proxy.Lock()
+	nClients := len(proxy.clients)
+	vms := make([]*vm, 0, len(proxy.vms))
+	for _, vm := range proxy.vms {
+		vms = append(vms, vm)
+	}
+	proxy.Unlock()
+
+	sort.Sort(byContainerID(vms))
+
+	nSessions := 0
+	for _, vm := range vms {
+		nSessions += vm.numSessions()
+	}
+
+	writeGauge(w, "cc_proxy_clients", "Number of connected clients.", nClients)
+	writeGauge(w, "cc_proxy_vms", "Number of registered VMs.", len(vms))
+	writeGauge(w, "cc_proxy_io_sessions", "Number of I/O sessions.", nSessions)
+
+	ioCounters := []struct {
+		name, help string
+		direction  string
+		value      func(*ioStats) *uint64
+	}{
+		{"cc_proxy_io_bytes_total", "I/O data bytes forwarded, per VM and direction.",
+			"to_vm", func(s *ioStats) *uint64 { return &s.bytesToVM }},
+		{"cc_proxy_io_bytes_total", "", "from_vm",
+			func(s *ioStats) *uint64 { return &s.bytesFromVM }},
+		{"cc_proxy_io_messages_total", "I/O messages forwarded, per VM and direction.",
+			"to_vm", func(s *ioStats) *uint64 { return &s.messagesToVM }},
+		{"cc_proxy_io_messages_total", "", "from_vm",
+			func(s *ioStats) *uint64 { return &s.messagesFromVM }},
+	}
+	for _, c := range ioCounters {
+		if c.help != "" {
+			writeHeader(w, c.name, c.help, "counter")
+		}
+		for _, vm := range vms {
+			v := atomic.LoadUint64(c.value(&vm.ioStats))
+			fmt.Fprintf(w, "%s%s %d\n", c.name,
+				labels("container_id", vm.containerID, "direction", c.direction), v)
+		}
+	}
+
+	proxy.metrics.requests.writeTo(w)
+	proxy.metrics.requestDuration.writeTo(w)
+	proxy.metrics.hyperCommands.writeTo(w)
+	proxy.metrics.hyperDuration.writeTo(w)
+	proxy.metrics.errors.writeTo(w)
+	proxy.metrics.bootDuration.writeTo(w)
+	proxy.metrics.limitViolations.writeTo(w)
+}
+
+// metricsHandler serves the /metrics endpoint.
+func (proxy *proxy) metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+
+		proxy.writeMetrics(&buf)
+		w.Header().Set("Content-Type", metricsContentType)
+		w.Write(buf.Bytes())
+	})
+}
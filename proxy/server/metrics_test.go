@@ -0,0 +1,129 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterVecFormat(t *testing.T) {
+	c := newCounterVec("test_total", "A test counter.", "kind")
+	c.Inc("b")
+	c.Inc("a")
+	c.Inc("b")
+	c.Inc(`q"uote`)
+
+	var buf bytes.Buffer
+	c.writeTo(&buf)
+
+	expected := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{kind="a"} 1
+test_total{kind="b"} 2
+test_total{kind="q\"uote"} 1
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestHistogramVecFormat(t *testing.T) {
+	h := newHistogramVec("test_seconds", "A test histogram.", "cmd",
+		[]float64{.1, 1})
+	h.Observe("ping", .05)
+	h.Observe("ping", .1)
+	h.Observe("ping", .5)
+	h.Observe("ping", 2)
+
+	var buf bytes.Buffer
+	h.writeTo(&buf)
+
+	expected := `# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{cmd="ping",le="0.1"} 2
+test_seconds_bucket{cmd="ping",le="1"} 3
+test_seconds_bucket{cmd="ping",le="+Inf"} 4
+test_seconds_sum{cmd="ping"} 2.65
+test_seconds_count{cmd="ping"} 4
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	proto := NewProtocol()
+	proto.Handle("hello", helloHandler)
+	proto.Handle("allocateIO", allocateIoHandler)
+	proto.Handle("hyper", hyperHandler)
+
+	rig := newTestRig(t, proto)
+	rig.Start()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err := rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath, nil)
+	assert.Nil(t, err)
+
+	m := rig.proxy.metrics
+	err = rig.Client.Hyper("ping", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), m.hyperCommands.Get("ping"))
+
+	// Commands unknown to hyperstart share the same label
+	err = rig.Client.Hyper("foo", nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(1), m.hyperCommands.Get(unknownHyperCommand))
+	assert.Equal(t, uint64(0), m.hyperCommands.Get("foo"))
+
+	// bye isn't handled by our protocol object
+	err = rig.Client.Bye(testContainerID)
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(1), m.errors.Get(errorProtocol))
+
+	_, ioFile, err := rig.Client.AllocateIo(1)
+	assert.Nil(t, err)
+
+	// Make sure some I/O data goes through
+	rig.Hyperstart.SendIoString(1, "stdout\n")
+	seq, _ := readIo(t, ioFile)
+	assert.Equal(t, uint64(1), seq)
+
+	server := httptest.NewServer(rig.proxy.metricsHandler())
+	resp, err := server.Client().Get(server.URL + "/metrics")
+	assert.Nil(t, err)
+	assert.Equal(t, metricsContentType, resp.Header.Get("Content-Type"))
+	var body bytes.Buffer
+	body.ReadFrom(resp.Body)
+	resp.Body.Close()
+	server.Close()
+
+	metrics := body.String()
+	for _, line := range []string{
+		"cc_proxy_clients 1",
+		"cc_proxy_vms 1",
+		"cc_proxy_io_sessions 1",
+		`cc_proxy_io_bytes_total{container_id="0987654321",direction="from_vm"} 7`,
+		`cc_proxy_io_messages_total{container_id="0987654321",direction="from_vm"} 1`,
+		`cc_proxy_io_bytes_total{container_id="0987654321",direction="to_vm"} 0`,
+		"# TYPE cc_proxy_hyper_command_duration_seconds histogram",
+		"# TYPE cc_proxy_vm_ready_duration_seconds histogram",
+	} {
+		assert.True(t, strings.Contains(metrics, line+"\n"), "missing %q", line)
+	}
+
+	ioFile.Close()
+	rig.Stop()
+}
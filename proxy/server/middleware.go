@@ -0,0 +1,167 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+// Request is a request being handled, as seen by middlewares.
+type Request struct {
+	// ID is the payload name, eg. "hello"
+	ID string
+	// Data is the payload given to the handler
+	Data []byte
+	// Start is when the proxy started handling the request
+	Start time.Time
+
+	ctx     *clientCtx
+	proto   *Protocol
+	handler ProtocolHandler
+}
+
+// UserData returns the user data of the client issuing the request, the one
+// given to Serve.
+func (r *Request) UserData() interface{} {
+	return r.ctx.userData
+}
+
+// SendNotification sends a notification to the client issuing the request.
+func (r *Request) SendNotification(id string, data interface{}) error {
+	return r.ctx.SendNotification(id, data)
+}
+
+// RequestHandler handles a request, filling response.
+type RequestHandler func(req *Request, response *HandlerResponse)
+
+// A Middleware wraps the handling of requests. It can act before and after
+// calling next, or not call it at all to deny a request.
+type Middleware func(next RequestHandler) RequestHandler
+
+// callHandler is the end of the middleware chain, calling the payload
+// handler.
+func callHandler(req *Request, response *HandlerResponse) {
+	req.handler(req.Data, req.UserData(), response)
+}
+
+// defaultMiddlewares are the middlewares of every protocol, outermost first.
+var defaultMiddlewares = []Middleware{
+	LogMiddleware,
+	RecoverMiddleware,
+	LimitMiddleware,
+	MetricsMiddleware,
+}
+
+// requestLogger can be implemented by the user data given to Serve to log the
+// outcome of each request, see LogMiddleware.
+type requestLogger interface {
+	logRequest(payload string, duration time.Duration, err error)
+}
+
+// requestLimiter can be implemented by the user data given to Serve to deny
+// requests before they reach their handler, eg. to rate limit clients. See
+// LimitMiddleware.
+type requestLimiter interface {
+	allowRequest() error
+}
+
+// LogMiddleware logs the outcome of requests, if the client user data
+// implements requestLogger.
+func LogMiddleware(next RequestHandler) RequestHandler {
+	return func(req *Request, response *HandlerResponse) {
+		next(req, response)
+
+		if logger, ok := req.UserData().(requestLogger); ok {
+			logger.logRequest(req.ID, time.Since(req.Start), response.err)
+		}
+	}
+}
+
+// panicError is the error of a request whose handler panicked.
+type panicError struct {
+	payload string
+	value   interface{}
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("internal error handling %s: %v", e.payload, e.value)
+}
+
+// Code implements codedError.
+func (e *panicError) Code() api.ErrorCode {
+	return api.ErrorCodeInternal
+}
+
+// RecoverMiddleware turns a panic of the rest of the chain into an error
+// response, with the api.ErrorCodeInternal code, instead of taking the whole
+// proxy down.
+func RecoverMiddleware(next RequestHandler) RequestHandler {
+	return func(req *Request, response *HandlerResponse) {
+		defer func() {
+			value := recover()
+			if value == nil {
+				return
+			}
+
+			stack := make([]byte, 64*1024)
+			stack = stack[:runtime.Stack(stack, false)]
+			req.proto.log.infof(0, "panic handling %s: %v\n%s", req.ID, value, stack)
+			req.proto.metrics.errors.Inc(errorPanic)
+
+			// Don't send a file the handler might have set
+			if response.file != nil {
+				response.file.Close()
+				response.file = nil
+			}
+			response.SetError(&panicError{req.ID, value})
+		}()
+
+		next(req, response)
+	}
+}
+
+// LimitMiddleware denies requests the client user data doesn't allow, if it
+// implements requestLimiter.
+func LimitMiddleware(next RequestHandler) RequestHandler {
+	return func(req *Request, response *HandlerResponse) {
+		if limiter, ok := req.UserData().(requestLimiter); ok {
+			if err := limiter.allowRequest(); err != nil {
+				response.SetError(err)
+				return
+			}
+		}
+
+		next(req, response)
+	}
+}
+
+// MetricsMiddleware counts requests, their duration and failures.
+func MetricsMiddleware(next RequestHandler) RequestHandler {
+	return func(req *Request, response *HandlerResponse) {
+		start := time.Now()
+		next(req, response)
+
+		metrics := req.proto.metrics
+		metrics.requests.Inc(req.ID)
+		metrics.requestDuration.Observe(req.ID, time.Since(start).Seconds())
+		if response.err != nil {
+			metrics.errors.Inc(errorPayload)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// closeMockServer closes both ends of the connection so the fds don't outlive
+// the test, and the fd leak checks of later tests.
+func closeMockServer(client net.Conn, server *mockServer) {
+	client.Close()
+	server.serverConn.Close()
+}
+
+func panicHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	var m map[string]int
+	m["boom"]++
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var calls []string
+
+	trace := func(name string) Middleware {
+		return func(next RequestHandler) RequestHandler {
+			return func(req *Request, response *HandlerResponse) {
+				calls = append(calls, name+" "+req.ID)
+				next(req, response)
+				calls = append(calls, "/"+name)
+			}
+		}
+	}
+
+	proto := NewProtocol()
+	proto.Use(trace("a"), trace("b"))
+	proto.Handle("simple", func(data []byte, userData interface{}, response *HandlerResponse) {
+		calls = append(calls, "handler")
+	})
+
+	client, server := setupMockServer(t, proto)
+	defer closeMockServer(client, server)
+	err := writeMessage(client, []byte(`{"id": "simple"}`))
+	assert.Nil(t, err)
+	_, err = readMessage(client)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"a simple", "b simple", "handler", "/b", "/a"}, calls)
+}
+
+func TestMiddlewareDeny(t *testing.T) {
+	proto := NewProtocol()
+	proto.Use(func(next RequestHandler) RequestHandler {
+		return func(req *Request, response *HandlerResponse) {
+			if req.ID == "echo" {
+				response.SetError(errors.New("denied"))
+				return
+			}
+			next(req, response)
+		}
+	})
+	proto.Handle("simple", simpleHandler)
+	proto.Handle("echo", echoHandler)
+
+	client, server := setupMockServer(t, proto)
+	defer closeMockServer(client, server)
+
+	tests := []struct {
+		input, output string
+	}{
+		{`{"id": "echo", "data": {"arg": "ping"}}`, `{"success":false,"error":"denied"}`},
+		{`{"id": "simple"}`, `{"success":true}`},
+	}
+	for _, test := range tests {
+		err := writeMessage(client, []byte(test.input))
+		assert.Nil(t, err)
+		buf, err := readMessage(client)
+		assert.Nil(t, err)
+		assert.Equal(t, test.output, string(buf))
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	proto := NewProtocol()
+	proto.Handle("panic", panicHandler)
+	proto.Handle("simple", simpleHandler)
+
+	client, server := setupMockServer(t, proto)
+	defer closeMockServer(client, server)
+
+	// The handler panicking gives an error response
+	err := writeMessage(client, []byte(`{"id": "panic"}`))
+	assert.Nil(t, err)
+	buf, err := readMessage(client)
+	assert.Nil(t, err)
+
+	resp := api.Response{}
+	err = json.Unmarshal(buf, &resp)
+	assert.Nil(t, err)
+	assert.False(t, resp.Success)
+	assert.Equal(t, api.ErrorCodeInternal, resp.Code)
+	assert.True(t, strings.HasPrefix(resp.Error, "internal error handling panic:"))
+	assert.Equal(t, uint64(1), proto.metrics.errors.Get(errorPanic))
+
+	// And the connection is still served
+	err = writeMessage(client, []byte(`{"id": "simple"}`))
+	assert.Nil(t, err)
+	buf, err = readMessage(client)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"success":true}`, string(buf))
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	proto := NewProtocol()
+	proto.Handle("metricsOk", simpleHandler)
+	proto.Handle("metricsError", returnErrorHandler)
+
+	client, server := setupMockServer(t, proto)
+	defer closeMockServer(client, server)
+	for _, input := range []string{`{"id": "metricsOk"}`, `{"id": "metricsOk"}`,
+		`{"id": "metricsError"}`} {
+		err := writeMessage(client, []byte(input))
+		assert.Nil(t, err)
+		_, err = readMessage(client)
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, uint64(2), proto.metrics.requests.Get("metricsOk"))
+	assert.Equal(t, uint64(1), proto.metrics.requests.Get("metricsError"))
+	assert.Equal(t, uint64(1), proto.metrics.errors.Get(errorPayload))
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+// A VM is registered under a single identifier in proxy.vms, the container ID
+// given to hello or, for pods, the pod ID. The containers of a pod are
+// registered in proxy.containers, pointing at the pod VM.
+
+// lookupVM returns the VM designated by id, either a VM or a pod container
+// identifier, nil if there's none. Must be called with the proxy lock held.
+func (proxy *proxy) lookupVM(id string) *vm {
+	if vm := proxy.vms[id]; vm != nil {
+		return vm
+	}
+	return proxy.containers[id]
+}
+
+// unregisterVM removes vm, and its containers, from the known VMs. Must be
+// called with the proxy lock held.
+func (proxy *proxy) unregisterVM(vm *vm) {
+	if proxy.vms[vm.containerID] == vm {
+		delete(proxy.vms, vm.containerID)
+	}
+	for id, v := range proxy.containers {
+		if v == vm {
+			delete(proxy.containers, id)
+		}
+	}
+}
+
+// vmContainers returns the sorted list of containers registered with vm, not
+// including the identifier the VM is registered with. Must be called with the
+// proxy lock held.
+func (proxy *proxy) vmContainers(vm *vm) []string {
+	var containers []string
+	for id, v := range proxy.containers {
+		if v == vm {
+			containers = append(containers, id)
+		}
+	}
+	sort.Strings(containers)
+	return containers
+}
+
+// "registerContainer"
+func registerContainerHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	client := userData.(*client)
+	proxy := client.proxy
+
+	register := api.RegisterContainer{}
+	if err := json.Unmarshal(data, &register); err != nil {
+		response.SetError(invalidRequestError(err))
+		return
+	}
+
+	if register.ContainerID == "" {
+		response.SetError(newError(api.ErrorCodeInvalidRequest,
+			"malformed registerContainer command"))
+		return
+	}
+
+	if err := checkContainerID(register.ContainerID); err != nil {
+		response.SetError(err)
+		return
+	}
+
+	vm, err := client.findVM(register.PodID)
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+
+	if reason, lost := vm.LostReason(); lost {
+		response.SetError(vmLostError(vm.containerID, reason))
+		return
+	}
+
+	proxy.Lock()
+	if proxy.lookupVM(register.ContainerID) != nil {
+		proxy.Unlock()
+		response.SetError(alreadyRegisteredError(register.ContainerID))
+		return
+	}
+	proxy.containers[register.ContainerID] = vm
+	proxy.Unlock()
+
+	client.infof(1, "registerContainer(containerId=%s,podId=%s)", register.ContainerID,
+		vm.containerID)
+}
+
+// "unregisterContainer"
+func unregisterContainerHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	client := userData.(*client)
+	proxy := client.proxy
+
+	unregister := api.UnregisterContainer{}
+	if err := json.Unmarshal(data, &unregister); err != nil {
+		response.SetError(invalidRequestError(err))
+		return
+	}
+
+	proxy.Lock()
+	if proxy.vms[unregister.ContainerID] != nil {
+		proxy.Unlock()
+		response.SetError(newError(api.ErrorCodeNotPodContainer,
+			"%s: not a pod container, use bye", unregister.ContainerID).
+			with("containerId", unregister.ContainerID))
+		return
+	}
+	vm := proxy.containers[unregister.ContainerID]
+	delete(proxy.containers, unregister.ContainerID)
+	proxy.Unlock()
+
+	if vm == nil {
+		response.SetError(unknownContainerError(unregister.ContainerID))
+		return
+	}
+
+	client.infof(1, "unregisterContainer(containerId=%s,podId=%s)", unregister.ContainerID,
+		vm.containerID)
+
+	vm.closeContainerIo(unregister.ContainerID)
+}
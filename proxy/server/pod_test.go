@@ -0,0 +1,115 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPodID = "pod-0987654321"
+
+func TestPod(t *testing.T) {
+	rig := newTestRig(t, newProxyProtocol())
+	rig.Start()
+
+	// Not attached to a VM yet
+	err := rig.Client.RegisterContainer("c2", "")
+	assert.True(t, errors.Is(err, api.ErrorCodeNotAttached))
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err = rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath,
+		&api.HelloOptions{PodID: testPodID})
+	assert.Nil(t, err)
+
+	// Add containers, designating the pod VM by any of its IDs
+	err = rig.Client.RegisterContainer("c2", "")
+	assert.Nil(t, err)
+	err = rig.Client.RegisterContainer("c3", "c2")
+	assert.Nil(t, err)
+	err = rig.Client.RegisterContainer("c4", "foo")
+	assert.True(t, errors.Is(err, api.ErrorCodeUnknownContainer))
+
+	for _, id := range []string{testPodID, testContainerID, "c2"} {
+		err = rig.Client.RegisterContainer(id, "")
+		assert.True(t, errors.Is(err, api.ErrorCodeContainerAlreadyRegistered), id)
+	}
+
+	vms, err := rig.Client.ListVMs()
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(vms)) {
+		assert.Equal(t, testPodID, vms[0].ContainerID)
+		assert.Equal(t, []string{testContainerID, "c2", "c3"}, vms[0].Containers)
+	}
+
+	// I/O sessions are tracked per container, defaulting to the one
+	// given to attach
+	_, err = rig.Client.Attach("c2", nil)
+	assert.Nil(t, err)
+
+	ioBase2, ioFile2, err := rig.Client.AllocateIo(1)
+	assert.Nil(t, err)
+	ioBase3, ioFile3, err := rig.Client.AllocateContainerIo("c3", 1)
+	assert.Nil(t, err)
+	_, _, err = rig.Client.AllocateContainerIo("foo", 1)
+	assert.True(t, errors.Is(err, api.ErrorCodeContainerNotInVM))
+
+	info, err := rig.Client.VMInfo("c3", true)
+	assert.Nil(t, err)
+	assert.Equal(t, testPodID, info.VM.ContainerID)
+	assert.Equal(t, []api.SessionState{
+		{IoBase: ioBase2, NStreams: 1, ClientID: info.Sessions[0].ClientID, ContainerID: "c2"},
+		{IoBase: ioBase3, NStreams: 1, ClientID: info.Sessions[0].ClientID, ContainerID: "c3"},
+	}, info.Sessions)
+
+	// Unregistering a container closes its I/O sessions
+	err = rig.Client.UnregisterContainer("c2")
+	assert.Nil(t, err)
+
+	buf := make([]byte, 32)
+	_, err = ioFile2.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	ioFile2.Close()
+
+	info, err = rig.Client.VMInfo("", true)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{testContainerID, "c3"}, info.VM.Containers)
+	assert.Equal(t, 1, len(info.Sessions))
+	assert.Equal(t, "c3", info.Sessions[0].ContainerID)
+
+	err = rig.Client.UnregisterContainer("c2")
+	assert.True(t, errors.Is(err, api.ErrorCodeUnknownContainer))
+	err = rig.Client.UnregisterContainer(testPodID)
+	assert.True(t, errors.Is(err, api.ErrorCodeNotPodContainer))
+
+	// bye with any container releases the whole pod
+	err = rig.Client.Bye("c3")
+	assert.Nil(t, err)
+
+	vms, err = rig.Client.ListVMs()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(vms))
+
+	rig.proxy.Lock()
+	assert.Equal(t, 0, len(rig.proxy.containers))
+	rig.proxy.Unlock()
+
+	ioFile3.Close()
+	rig.Stop()
+}
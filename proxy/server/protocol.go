@@ -0,0 +1,331 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+// A ProtocolHandler handles a payload, see Protocol.Handle. It's given the
+// payload data, the user data of the client, the one given to Serve, and fills
+// the response.
+type ProtocolHandler func([]byte, interface{}, *HandlerResponse)
+
+// HandlerResponse encapsulates the different parts of what a handler can
+// return: an error or a result, and a file descriptor to pass to the client.
+type HandlerResponse struct {
+	err     error
+	result  interface{}
+	results map[string]interface{}
+	file    *os.File
+}
+
+// SetError makes the request fail with err. The code and details of the error
+// response come from err when it has some, see the api.ErrorCode constants.
+func (r *HandlerResponse) SetError(err error) {
+	r.err = err
+}
+
+// SetErrorMsg makes the request fail with the error message msg.
+func (r *HandlerResponse) SetErrorMsg(msg string) {
+	r.err = errors.New(msg)
+}
+
+// SetErrorf is SetError with an error formatted as fmt.Errorf does.
+func (r *HandlerResponse) SetErrorf(format string, a ...interface{}) {
+	r.SetError(fmt.Errorf(format, a...))
+}
+
+// SetResult sets the result of the request, sent as the data of the
+// response. result is usually one of the api result types, eg.
+// api.AllocateIoResult.
+func (r *HandlerResponse) SetResult(result interface{}) {
+	r.result = result
+}
+
+// AddResult adds the value key to the data of the response. It's there for
+// the handlers predating SetResult, and is ignored once SetResult has been
+// called.
+func (r *HandlerResponse) AddResult(key string, value interface{}) {
+	if r.results == nil {
+		r.results = make(map[string]interface{})
+	}
+	r.results[key] = value
+}
+
+// data encodes the result of the request, if any.
+func (r *HandlerResponse) data() (json.RawMessage, error) {
+	if r.result != nil {
+		return json.Marshal(r.result)
+	}
+	if r.results != nil {
+		return json.Marshal(r.results)
+	}
+	return nil, nil
+}
+
+// SetFile sends f to the client along with the response, as ancillary data.
+// f is closed once sent.
+func (r *HandlerResponse) SetFile(f *os.File) {
+	r.file = f
+}
+
+// Protocol serves the requests of clients, each request going through the
+// middlewares before reaching the handler of its payload.
+type Protocol struct {
+	handlers map[string]ProtocolHandler
+
+	// Requests go through the middlewares, outermost first, before
+	// reaching their handler. chain is the composition of the two.
+	middlewares []Middleware
+	chain       RequestHandler
+
+	// Maximum size of the requests, 0 meaning api.DefaultMaxMessageSize
+	maxMessageSize int
+
+	// Where the middlewares log and count requests, see reportTo
+	log     *serverLog
+	metrics *metrics
+}
+
+// NewProtocol creates a protocol with the default middlewares: logging, panic
+// recovery, rate limiting and metrics.
+func NewProtocol() *Protocol {
+	proto := &Protocol{
+		handlers: make(map[string]ProtocolHandler),
+		metrics:  newMetrics(),
+	}
+	proto.Use(defaultMiddlewares...)
+	return proto
+}
+
+// reportTo makes proto log its messages and count its metrics along with
+// those of proxy.
+func (proto *Protocol) reportTo(proxy *proxy) {
+	proto.log = proxy.log
+	proto.metrics = proxy.metrics
+}
+
+// Handle registers handler for the payload named cmd. Handle isn't safe to
+// call while serving clients.
+func (proto *Protocol) Handle(cmd string, handler ProtocolHandler) {
+	proto.handlers[cmd] = handler
+}
+
+// Use adds middlewares to the ones requests go through, after those already
+// in use. Use isn't safe to call while serving clients.
+func (proto *Protocol) Use(middlewares ...Middleware) {
+	proto.middlewares = append(proto.middlewares, middlewares...)
+
+	proto.chain = callHandler
+	for i := len(proto.middlewares) - 1; i >= 0; i-- {
+		proto.chain = proto.middlewares[i](proto.chain)
+	}
+}
+
+// codedError is implemented by errors having a code to put in the "code"
+// field of the response, see the api.ErrorCode constants.
+type codedError interface {
+	error
+	Code() api.ErrorCode
+}
+
+// detailedError is implemented by errors having values to put in the
+// "details" field of the response.
+type detailedError interface {
+	error
+	Details() map[string]interface{}
+}
+
+// errorResponse builds the response to a failed request.
+func errorResponse(err error, data json.RawMessage) *api.Response {
+	resp := &api.Response{
+		Success: false,
+		Error:   err.Error(),
+		Data:    data,
+	}
+	var coded codedError
+	if errors.As(err, &coded) {
+		resp.Code = coded.Code()
+	}
+	var detailed detailedError
+	if errors.As(err, &detailed) {
+		resp.Details = detailed.Details()
+	}
+	return resp
+}
+
+// notificationWriteTimeout bounds how long sending a notification can take.
+// A client not reading its socket would otherwise block the goroutine sending
+// the notification, eg. the one handling a lost VM.
+const notificationWriteTimeout = 1 * time.Second
+
+type clientCtx struct {
+	conn net.Conn
+
+	// Notifications can be sent from other goroutines than the one
+	// serving requests. writeLock ensures messages aren't interleaved on
+	// conn.
+	writeLock sync.Mutex
+
+	userData interface{}
+}
+
+func newClientCtx(conn net.Conn, userData interface{}) *clientCtx {
+	return &clientCtx{
+		conn:     conn,
+		userData: userData,
+	}
+}
+
+// SendNotification sends the notification id with data as payload to the
+// client. It's safe to call SendNotification from any goroutine. A client
+// failing to take the notification within notificationWriteTimeout is
+// disconnected.
+func (ctx *clientCtx) SendNotification(id string, data interface{}) error {
+	notification := api.Notification{
+		ID: id,
+	}
+
+	if data != nil {
+		var err error
+
+		if notification.Data, err = json.Marshal(data); err != nil {
+			return err
+		}
+	}
+
+	ctx.writeLock.Lock()
+	defer ctx.writeLock.Unlock()
+
+	ctx.conn.SetWriteDeadline(time.Now().Add(notificationWriteTimeout))
+	err := api.WriteNotification(ctx.conn, &notification)
+	ctx.conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		// The notification may have been partially written, nothing
+		// can be sent on conn anymore. Closing it ends serveCtx.
+		ctx.conn.Close()
+	}
+
+	return err
+}
+
+func (proto *Protocol) handleRequest(ctx *clientCtx, req *api.Request, hr *HandlerResponse) *api.Response {
+	if req.ID == "" {
+		proto.metrics.errors.Inc(errorProtocol)
+		return &api.Response{
+			Success: false,
+			Error:   "no 'id' field in request",
+			Code:    api.ErrorCodeInvalidRequest,
+		}
+	}
+
+	handler, ok := proto.handlers[req.ID]
+	if !ok {
+		proto.metrics.errors.Inc(errorProtocol)
+		return &api.Response{
+			Success: false,
+			Error:   fmt.Sprintf("no payload named '%s'", req.ID),
+			Code:    api.ErrorCodeUnknownPayload,
+		}
+	}
+
+	proto.chain(&Request{
+		ID:      req.ID,
+		Data:    req.Data,
+		Start:   time.Now(),
+		ctx:     ctx,
+		proto:   proto,
+		handler: handler,
+	}, hr)
+	data, err := hr.data()
+	if err != nil && hr.err == nil {
+		hr.err = withCode(api.ErrorCodeInternal,
+			fmt.Errorf("couldn't encode the %s result: %v", req.ID, err))
+	}
+	if hr.err != nil {
+		return errorResponse(hr.err, data)
+	}
+
+	return &api.Response{
+		Success: true,
+		Data:    data,
+	}
+}
+
+// Serve handles the requests read from conn until the client disconnects or
+// sends something that isn't a request. userData is handed to the handlers and
+// middlewares, see Request.UserData.
+func (proto *Protocol) Serve(conn net.Conn, userData interface{}) error {
+	return proto.serveCtx(newClientCtx(conn, userData))
+}
+
+// serveCtx is Serve for callers needing to keep a reference to the client
+// context, eg. to send notifications.
+func (proto *Protocol) serveCtx(ctx *clientCtx) error {
+	reader := api.NewReader(ctx.conn)
+	reader.MaxMessageSize = proto.maxMessageSize
+
+	for {
+		// Parse a request.
+		req := api.Request{}
+		hr := HandlerResponse{}
+
+		err := reader.ReadMessage(&req)
+		if err != nil {
+			// EOF or the client isn't even sending proper JSON,
+			// just kill the connection
+			if err != io.EOF {
+				proto.metrics.errors.Inc(errorProtocol)
+			}
+			return err
+		}
+
+		// Execute the corresponding handler
+		resp := proto.handleRequest(ctx, &req, &hr)
+
+		if err = proto.writeResponse(ctx, resp, hr.file); err != nil {
+			// Something made us unable to write the response back
+			// to the client (could be a disconnection, ...).
+			return err
+		}
+	}
+}
+
+func (proto *Protocol) writeResponse(ctx *clientCtx, resp *api.Response, file *os.File) error {
+	ctx.writeLock.Lock()
+	defer ctx.writeLock.Unlock()
+
+	// First send an fd if the handler associated a file with the response
+	if file != nil {
+		err := api.WriteFd(ctx.conn.(*net.UnixConn), int(file.Fd()))
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Then send the response back to the client.
+	return api.WriteMessage(ctx.conn, resp)
+}
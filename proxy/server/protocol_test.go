@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package server
 
 import (
 	"encoding/binary"
@@ -20,22 +20,26 @@ import (
 	"errors"
 	"flag"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/01org/cc-oci-runtime/proxy/api"
 	"github.com/stretchr/testify/assert"
 )
 
 // A simple way to mock a net.Conn around syscall.socketpair()
 type mockServer struct {
 	t                      *testing.T
-	proto                  *protocol
+	proto                  *Protocol
 	serverConn, clientConn net.Conn
 }
 
-func newMockServer(t *testing.T, proto *protocol) *mockServer {
+func newMockServer(t *testing.T, proto *Protocol) *mockServer {
 	var err error
 
 	server := &mockServer{
@@ -64,7 +68,7 @@ func (server *mockServer) ServeWithUserData(userData interface{}) {
 
 }
 
-func setupMockServer(t *testing.T, proto *protocol) (client net.Conn, server *mockServer) {
+func setupMockServer(t *testing.T, proto *Protocol) (client net.Conn, server *mockServer) {
 	server = newMockServer(t, proto)
 	client = server.GetClientConn()
 	go server.Serve()
@@ -130,7 +134,7 @@ type myUserData struct {
 
 var testUserData myUserData
 
-func userDataHandler(data []byte, userData interface{}, response *handlerResponse) {
+func userDataHandler(data []byte, userData interface{}, response *HandlerResponse) {
 	p := userData.(*myUserData)
 	assert.Equal(p.t, p, &testUserData)
 
@@ -138,7 +142,7 @@ func userDataHandler(data []byte, userData interface{}, response *handlerRespons
 }
 
 func TestUserData(t *testing.T) {
-	proto := newProtocol()
+	proto := NewProtocol()
 	proto.Handle("foo", userDataHandler)
 
 	server := newMockServer(t, proto)
@@ -155,42 +159,51 @@ func TestUserData(t *testing.T) {
 }
 
 // Tests various behaviours of the protocol main loop and handler dispatching
-func simpleHandler(data []byte, userData interface{}, response *handlerResponse) {
+func simpleHandler(data []byte, userData interface{}, response *HandlerResponse) {
 }
 
 type Echo struct {
 	Arg string
 }
 
-func echoHandler(data []byte, userData interface{}, response *handlerResponse) {
+func echoHandler(data []byte, userData interface{}, response *HandlerResponse) {
 	echo := Echo{}
 	json.Unmarshal(data, &echo)
 
 	response.AddResult("result", echo.Arg)
 }
 
-func returnDataHandler(data []byte, userData interface{}, response *handlerResponse) {
+func returnDataHandler(data []byte, userData interface{}, response *HandlerResponse) {
 	response.AddResult("foo", "bar")
 }
 
-func returnErrorHandler(data []byte, userData interface{}, response *handlerResponse) {
+func returnErrorHandler(data []byte, userData interface{}, response *HandlerResponse) {
 	response.SetErrorMsg("This is an error")
 }
 
-func returnDataErrorHandler(data []byte, userData interface{}, response *handlerResponse) {
+func returnDataErrorHandler(data []byte, userData interface{}, response *HandlerResponse) {
 	response.AddResult("foo", "bar")
 	response.SetErrorMsg("This is an error")
 }
 
+func returnResultHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	response.AddResult("foo", "bar")
+	response.SetResult(&api.AllocateIoResult{IoBase: 1<<53 + 1})
+}
+
+func returnBadResultHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	response.SetResult(func() {})
+}
+
 func TestProtocol(t *testing.T) {
 	tests := []struct {
 		input, output string
 	}{
 		{`{"id": "simple"}`, `{"success":true}`},
 		{`{"id": "notfound"}`,
-			`{"success":false,"error":"no payload named 'notfound'"}`},
+			`{"success":false,"error":"no payload named 'notfound'","code":"unknownPayload"}`},
 		{`{"foo": "bar"}`,
-			`{"success":false,"error":"no 'id' field in request"}`},
+			`{"success":false,"error":"no 'id' field in request","code":"invalidRequest"}`},
 		// Tests return values from handlers
 		{`{"id":"returnData", "data": {"arg": "bar"}}`,
 			`{"success":true,"data":{"foo":"bar"}}`},
@@ -198,17 +211,24 @@ func TestProtocol(t *testing.T) {
 			`{"success":false,"error":"This is an error"}`},
 		{`{"id":"returnDataError", "data": {"arg": "bar"}}`,
 			`{"success":false,"error":"This is an error","data":{"foo":"bar"}}`},
+		// Typed results take precedence over AddResult
+		{`{"id":"returnResult"}`,
+			`{"success":true,"data":{"ioBase":9007199254740993}}`},
+		{`{"id":"returnBadResult"}`,
+			`{"success":false,"error":"couldn't encode the returnBadResult result: json: unsupported type: func()","code":"internalError"}`},
 		// Tests we can unmarshal payload data
 		{`{"id":"echo", "data": {"arg": "ping"}}`,
 			`{"success":true,"data":{"result":"ping"}}`},
 	}
 
-	proto := newProtocol()
+	proto := NewProtocol()
 	proto.Handle("simple", simpleHandler)
 	proto.Handle("returnData", returnDataHandler)
 	proto.Handle("returnError", returnErrorHandler)
 	proto.Handle("returnDataError", returnDataErrorHandler)
 	proto.Handle("echo", echoHandler)
+	proto.Handle("returnResult", returnResultHandler)
+	proto.Handle("returnBadResult", returnBadResultHandler)
 
 	client, _ := setupMockServer(t, proto)
 
@@ -226,7 +246,7 @@ func TestProtocol(t *testing.T) {
 
 // Make sure the server closes the connection when encountering an error
 func TestCloseOnError(t *testing.T) {
-	proto := newProtocol()
+	proto := NewProtocol()
 	proto.Handle("simple", simpleHandler)
 
 	client, _ := setupMockServer(t, proto)
@@ -242,6 +262,57 @@ func TestCloseOnError(t *testing.T) {
 	assert.Equal(t, err, io.EOF)
 }
 
+// Requests longer than the maximum message size close the connection before
+// their data is read
+func TestMaxMessageSize(t *testing.T) {
+	proto := NewProtocol()
+	proto.maxMessageSize = 32
+	proto.Handle("echo", echoHandler)
+
+	client, _ := setupMockServer(t, proto)
+
+	err := writeMessage(client, []byte(`{"id":"echo", "data": {"arg": "ping"}}`))
+	assert.Nil(t, err)
+
+	// The unread data makes the close a reset rather than an EOF
+	buf := make([]byte, 512)
+	n, err := client.Read(buf)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, n)
+
+	// Requests up to the limit are served
+	client, _ = setupMockServer(t, proto)
+
+	err = writeMessage(client, []byte(`{"id":"echo"}`))
+	assert.Nil(t, err)
+	buf, err = readMessage(client)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"success":true,"data":{"result":""}}`, string(buf))
+}
+
+// Clients not reading their notifications are disconnected
+func TestNotificationTimeout(t *testing.T) {
+	server := newMockServer(t, NewProtocol())
+	client := server.GetClientConn()
+	ctx := newClientCtx(server.serverConn, nil)
+
+	data := strings.Repeat("x", 4096)
+	start := time.Now()
+	var err error
+	for err == nil {
+		err = ctx.SendNotification("flood", data)
+	}
+	var netErr net.Error
+	assert.True(t, errors.As(err, &netErr) && netErr.Timeout())
+	assert.True(t, time.Since(start) < 10*notificationWriteTimeout)
+
+	// The connection is closed, the client reads what made it through
+	// then EOF
+	_, err = io.Copy(ioutil.Discard, client)
+	assert.Nil(t, err)
+	client.Close()
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 	os.Exit(m.Run())
@@ -0,0 +1,971 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+
+	"github.com/golang/glog"
+)
+
+// Main struct holding the proxy state
+type proxy struct {
+	// Protect concurrent accesses from separate client goroutines to this
+	// structure fields
+	sync.Mutex
+
+	// proxy socket
+	listener net.Listener
+
+	// admin API sockets (see admin.go)
+	adminListeners []net.Listener
+
+	// vms are hashed by their containerID
+	vms map[string]*vm
+
+	// VMs of pods, hashed by the ID of their containers (see pod.go)
+	containers map[string]*vm
+
+	// clients are hashed by their id
+	clients map[uint64]*client
+
+	// VM console capture configuration, protected by the mutex as it can
+	// be reloaded. So are the configuration values below.
+	console consoleConfig
+
+	// Traffic recording configuration
+	record recordConfig
+
+	// Quotas and rate limits
+	limits limitsConfig
+
+	// Who can use the proxy socket
+	auth authConfig
+
+	// Configuration file
+	config configState
+
+	// How long a lost VM stays registered before being forgotten
+	vmLostGracePeriod time.Duration
+
+	// How long hello waits for a VM to be ready by default, 0 for no limit
+	helloTimeout time.Duration
+
+	// How often the VM agents are pinged, 0 for never. healthCheckChanged
+	// is closed, and replaced, when it changes (see health.go).
+	healthCheckInterval time.Duration
+	healthCheckChanged  chan struct{}
+
+	// Agent backends hello can choose from, indexed by name
+	agents map[string]NewAgentFunc
+
+	// Forwards the I/O streams when not nil, see eventLoop
+	loop *eventLoop
+
+	// Where the log messages and the metrics go, shared with the protocol,
+	// the VMs and the event loop
+	log     *serverLog
+	metrics *metrics
+
+	wg sync.WaitGroup
+
+	// The VM monitoring goroutines, also part of wg
+	monitors sync.WaitGroup
+}
+
+// Represents a client, either a cc-oci-runtime or cc-shim process having
+// opened a socket to the proxy
+type client struct {
+	id    uint64
+	proxy *proxy
+
+	// Credentials of the process at the other end of the socket, nil if
+	// they couldn't be retrieved.
+	cred *syscall.Ucred
+
+	// vm is accessed from other goroutines than the one serving the client,
+	// eg. when notifying VM events, and is protected by vmLock.
+	vmLock sync.Mutex
+	vm     *vm
+	// ID given to hello or attach, a container of the pod for pods
+	containerID string
+	// Whether the client asked, on hello or attach, for the notifications
+	// about its VM: vmLost, vmReady and vmFailed
+	notifications bool
+
+	// Rate limiter of the client requests, nil when not rate limited
+	requests *tokenBucket
+
+	conn net.Conn
+	ctx  *clientCtx
+}
+
+func (c *client) attachedVM() *vm {
+	c.vmLock.Lock()
+	defer c.vmLock.Unlock()
+
+	return c.vm
+}
+
+// attachedContainer returns the ID the client has attached to its VM with,
+// empty if the client isn't attached.
+func (c *client) attachedContainer() string {
+	c.vmLock.Lock()
+	defer c.vmLock.Unlock()
+
+	return c.containerID
+}
+
+// wantsNotifications returns true if the client asked for the notifications
+// about the VM it's attached to.
+func (c *client) wantsNotifications() bool {
+	c.vmLock.Lock()
+	defer c.vmLock.Unlock()
+
+	return c.notifications
+}
+
+func (c *client) setVM(vm *vm, containerID string, notifications bool) {
+	c.vmLock.Lock()
+	c.vm = vm
+	c.containerID = containerID
+	c.notifications = notifications
+	c.vmLock.Unlock()
+}
+
+func (c *client) logFields() logFields {
+	fields := logFields{
+		fieldClientID: c.id,
+	}
+	if c.cred != nil {
+		fields[fieldClientPid] = c.cred.Pid
+	}
+	if vm := c.attachedVM(); vm != nil {
+		fields[fieldContainerID] = vm.containerID
+	}
+	return fields
+}
+
+func (c *client) glogPrefix() string {
+	return fmt.Sprintf("[client #%d] ", c.id)
+}
+
+// v is glog.V for the messages about this client. Clients attached to a VM
+// follow the log level of the VM.
+func (c *client) v(lvl glog.Level) bool {
+	if vm := c.attachedVM(); vm != nil {
+		return vm.v(lvl)
+	}
+	return bool(glog.V(lvl))
+}
+
+func (c *client) info(lvl glog.Level, msg string) {
+	if !c.v(lvl) {
+		return
+	}
+	c.proxy.log.output(2, lvl, c.glogPrefix(), c.logFields(), msg)
+}
+
+func (c *client) infof(lvl glog.Level, format string, a ...interface{}) {
+	if !c.v(lvl) {
+		return
+	}
+	c.proxy.log.output(2, lvl, c.glogPrefix(), c.logFields(), fmt.Sprintf(format, a...))
+}
+
+// logRequest logs the outcome of a payload handler, see requestLogger.
+func (c *client) logRequest(payload string, duration time.Duration, err error) {
+	if !c.v(1) {
+		return
+	}
+
+	fields := c.logFields()
+	fields[fieldPayload] = payload
+	fields[fieldDuration] = duration
+	msg := fmt.Sprintf("%s done in %v", payload, duration)
+	if err != nil {
+		fields[fieldError] = err
+		msg = fmt.Sprintf("%s failed in %v: %v", payload, duration, err)
+	}
+
+	c.proxy.log.output(2, 1, c.glogPrefix(), fields, msg)
+}
+
+// checkContainerID returns an error if id can't be used as a container ID.
+// IDs end up in file names, eg. the console logs, so they can't designate
+// other directories.
+func checkContainerID(id string) error {
+	if id == "" || strings.Contains(id, "/") || strings.Contains(id, "..") ||
+		strings.ContainsRune(id, 0) {
+		return newError(api.ErrorCodeInvalidRequest, "invalid containerID %q",
+			id).with("containerId", id)
+	}
+	return nil
+}
+
+// checkNewVM returns an error if a VM registered under ids can't be added
+// for client, because one of the ids is taken or because of the quotas. Must
+// be called with the proxy lock held.
+func (proxy *proxy) checkNewVM(client *client, ids ...string) error {
+	for _, id := range ids {
+		if proxy.lookupVM(id) != nil {
+			return alreadyRegisteredError(id)
+		}
+	}
+
+	return proxy.checkUserVMs(client)
+}
+
+// "hello"
+func helloHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	client := userData.(*client)
+	hello := api.Hello{}
+
+	if err := json.Unmarshal(data, &hello); err != nil {
+		response.SetError(invalidRequestError(err))
+		return
+	}
+
+	if hello.ContainerID == "" || hello.CtlSerial == "" || hello.IoSerial == "" {
+		response.SetError(newError(api.ErrorCodeInvalidRequest, "malformed hello command"))
+		return
+	}
+
+	ids := []string{hello.ContainerID}
+	if hello.PodID != "" {
+		ids = append(ids, hello.PodID)
+	}
+	for _, id := range ids {
+		if err := checkContainerID(id); err != nil {
+			response.SetError(err)
+			return
+		}
+	}
+
+	vmAgent, err := client.proxy.newAgent(hello.Agent, hello.CtlSerial, hello.IoSerial)
+	if err != nil {
+		response.SetError(invalidRequestError(err))
+		return
+	}
+	if hello.Console != "" {
+		if _, err := parseEndpoint(hello.Console); err != nil {
+			response.SetError(newError(api.ErrorCodeInvalidRequest,
+				"invalid console endpoint %v", err))
+			return
+		}
+	}
+
+	// The VM of a pod is registered under the pod ID, the container being
+	// the first one of the pod
+	vmID := hello.ContainerID
+	if hello.PodID != "" {
+		vmID = hello.PodID
+	}
+
+	proxy := client.proxy
+	proxy.Lock()
+	err = proxy.checkNewVM(client, vmID, hello.ContainerID)
+	consoleConfig := proxy.console
+	recordConfig := proxy.record
+	proxy.Unlock()
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+
+	client.infof(1, "hello(containerId=%s,podId=%s,ctlSerial=%s,ioSerial=%s,console=%s,record=%v,timeout=%d,async=%v,agent=%s,notifications=%v)",
+		hello.ContainerID, hello.PodID, hello.CtlSerial, hello.IoSerial, hello.Console,
+		hello.Record, hello.Timeout, hello.Async, hello.Agent, hello.Notifications)
+
+	vm := proxy.newVM(vmID, hello.CtlSerial, hello.IoSerial, vmAgent)
+	vm.owner = client.cred
+	vm.loop = proxy.loop
+
+	// The console and the recording are set up before the VM is
+	// registered, other clients can't see them change afterwards
+	fail := func(err error) {
+		vm.Close()
+		response.SetError(withCode(api.ErrorCodeInternal, err))
+	}
+
+	if hello.Console != "" {
+		if err := vm.setConsole(hello.Console, consoleConfig); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	if hello.Record || recordConfig.all {
+		if err := vm.startRecording(recordConfig); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	// Another hello may have registered the same IDs in the meantime
+	proxy.Lock()
+	if err := proxy.checkNewVM(client, vmID, hello.ContainerID); err != nil {
+		proxy.Unlock()
+		vm.Close()
+		response.SetError(err)
+		return
+	}
+	proxy.vms[vmID] = vm
+	if hello.ContainerID != vmID {
+		proxy.containers[hello.ContainerID] = vm
+	}
+	proxy.Unlock()
+
+	deadline := proxy.helloDeadline(hello.Timeout)
+
+	if hello.Async {
+		// Attach now so the client gets the outcome notification, asking
+		// for an asynchronous hello is asking for that notification
+		client.setVM(vm, hello.ContainerID, true)
+		proxy.wg.Add(1)
+		go func() {
+			proxy.startVMAsync(vm, deadline)
+			proxy.wg.Done()
+		}()
+		return
+	}
+
+	if err := proxy.startVM(vm, deadline); err != nil {
+		response.SetError(err)
+		return
+	}
+
+	client.setVM(vm, hello.ContainerID, hello.Notifications)
+}
+
+// clientsAttachedTo returns the clients attached to vm.
+func (proxy *proxy) clientsAttachedTo(vm *vm) []*client {
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	attached := make([]*client, 0)
+	for _, client := range proxy.clients {
+		if client.attachedVM() == vm {
+			attached = append(attached, client)
+		}
+	}
+	return attached
+}
+
+// vmLost notifies the clients attached to vm that asked for notifications it's
+// gone, terminates the I/O sessions and schedules the removal of vm from the
+// list of known VMs.
+func (proxy *proxy) vmLost(vm *vm) {
+	reason, _ := vm.LostReason()
+	vm.info(1, "ctl", "vm lost: "+reason)
+	proxy.metrics.errors.Inc(errorVMLost)
+
+	notification := api.VMLost{
+		ContainerID: vm.containerID,
+		Reason:      reason,
+	}
+
+	attached := proxy.clientsAttachedTo(vm)
+	for _, client := range attached {
+		if !client.wantsNotifications() {
+			continue
+		}
+		if err := client.ctx.SendNotification("vmLost", &notification); err != nil {
+			client.infof(1, "couldn't send vmLost notification: %v", err)
+		}
+	}
+
+	vm.Close()
+
+	proxy.Lock()
+	gracePeriod := proxy.vmLostGracePeriod
+	proxy.Unlock()
+
+	// Give some time to clients to see the VM is lost instead of it being
+	// unknown, then forget about it.
+	time.AfterFunc(gracePeriod, func() {
+		proxy.Lock()
+		proxy.unregisterVM(vm)
+		proxy.Unlock()
+	})
+}
+
+// checkVM returns an error if client isn't attached to a vm or if that vm has
+// been lost.
+func (client *client) checkVM() (*vm, error) {
+	vm := client.attachedVM()
+	if vm == nil {
+		return nil, errNotAttached
+	}
+
+	if reason, lost := vm.LostReason(); lost {
+		return nil, vmLostError(vm.containerID, reason)
+	}
+
+	if err := vm.checkReady(); err != nil {
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+// findVM returns the VM identified by containerID or, when containerID is
+// empty, the VM client is attached to. Lost VMs are returned as well.
+func (client *client) findVM(containerID string) (*vm, error) {
+	if containerID == "" {
+		vm := client.attachedVM()
+		if vm == nil {
+			return nil, errNotAttached
+		}
+		return vm, nil
+	}
+
+	proxy := client.proxy
+	proxy.Lock()
+	vm := proxy.lookupVM(containerID)
+	proxy.Unlock()
+
+	if vm == nil {
+		return nil, unknownContainerError(containerID)
+	}
+
+	return vm, nil
+}
+
+// "attach"
+func attachHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	client := userData.(*client)
+	proxy := client.proxy
+
+	attach := api.Attach{}
+	if err := json.Unmarshal(data, &attach); err != nil {
+		response.SetError(invalidRequestError(err))
+		return
+	}
+
+	proxy.Lock()
+	vm := proxy.lookupVM(attach.ContainerID)
+	proxy.Unlock()
+
+	if vm == nil {
+		response.SetError(unknownContainerError(attach.ContainerID))
+		return
+	}
+
+	if reason, lost := vm.LostReason(); lost {
+		response.SetError(vmLostError(attach.ContainerID, reason))
+		return
+	}
+
+	client.infof(1, "attach(containerId=%s,notifications=%v)", attach.ContainerID,
+		attach.Notifications)
+
+	client.setVM(vm, attach.ContainerID, attach.Notifications)
+}
+
+// "bye"
+func byeHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	// Bye only affects the proxy.vms map and so removes the VM from the
+	// client visible API.
+	// vm.Close(), which tears down the VM object, is done at the end of
+	// the VM life cycle, when  we detect the qemu process is effectively
+	// gone (see helloHandler)
+
+	client := userData.(*client)
+	proxy := client.proxy
+
+	bye := api.Bye{}
+	if err := json.Unmarshal(data, &bye); err != nil {
+		response.SetError(invalidRequestError(err))
+		return
+	}
+
+	proxy.Lock()
+	vm := proxy.lookupVM(bye.ContainerID)
+	proxy.Unlock()
+
+	if vm == nil {
+		response.SetError(unknownContainerError(bye.ContainerID))
+		return
+	}
+
+	client.info(1, "bye()")
+
+	proxy.Lock()
+	proxy.unregisterVM(vm)
+	proxy.Unlock()
+
+	client.setVM(nil, "", false)
+}
+
+// "allocateIO"
+func allocateIoHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	client := userData.(*client)
+
+	allocateIo := api.AllocateIo{}
+	if err := json.Unmarshal(data, &allocateIo); err != nil {
+		response.SetError(invalidRequestError(err))
+		return
+	}
+
+	if allocateIo.NStreams < 1 || allocateIo.NStreams > 2 {
+		response.SetError(newError(api.ErrorCodeInvalidRequest,
+			"asking for unexpected number of streams (%d)", allocateIo.NStreams))
+		return
+	}
+
+	vm, err := client.checkVM()
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+
+	containerID := allocateIo.ContainerID
+	if containerID == "" {
+		containerID = client.attachedContainer()
+	}
+
+	proxy := client.proxy
+	proxy.Lock()
+	limits := proxy.limits
+	member := proxy.lookupVM(containerID) == vm
+	proxy.Unlock()
+
+	if !member {
+		response.SetError(newError(api.ErrorCodeContainerNotInVM,
+			"%s: not a container of VM %s", containerID, vm.containerID).
+			with("containerId", containerID).with("vmId", vm.containerID))
+		return
+	}
+
+	client.infof(1, "allocateIo(nStreams=%d,containerId=%s)", allocateIo.NStreams, containerID)
+
+	// We'll send c0 to the client, keep c1
+	c0, c1, err := Socketpair()
+	if err != nil {
+		response.SetError(withCode(api.ErrorCodeInternal, err))
+		return
+	}
+
+	f0, err := c0.File()
+	if err != nil {
+		response.SetError(withCode(api.ErrorCodeInternal, err))
+		return
+	}
+
+	ioBase, err := vm.AllocateIo(allocateIo.NStreams, client.id, containerID, c1, limits)
+	if err != nil {
+		f0.Close()
+		c0.Close()
+		c1.Close()
+		response.SetError(withCode(api.ErrorCodeInternal, err))
+		return
+	}
+
+	client.infof(1, "-> %d streams allocated, ioBase=%d", allocateIo.NStreams, ioBase)
+
+	response.SetResult(&api.AllocateIoResult{IoBase: ioBase})
+	response.SetFile(f0)
+
+	// File() dups the underlying fd, so it's safe to close c0 here (will
+	// keep the c0 <-> c1 connection alive).
+	c0.Close()
+}
+
+// "hyper"
+func hyperHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	client := userData.(*client)
+	hyper := api.Hyper{}
+
+	if err := json.Unmarshal(data, &hyper); err != nil {
+		response.SetError(invalidRequestError(err))
+		return
+	}
+
+	vm, err := client.checkVM()
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+
+	client.infof(1, "hyper(cmd=%s, data=%s)", hyper.HyperName, hyper.Data)
+
+	start := time.Now()
+	err = vm.SendMessage(hyper.HyperName, hyper.Data)
+	command := hyperCommandLabel(hyper.HyperName)
+	metrics := client.proxy.metrics
+	metrics.hyperCommands.Inc(command)
+	metrics.hyperDuration.Observe(command, time.Since(start).Seconds())
+	if err != nil {
+		metrics.errors.Inc(errorHyperstart)
+		response.SetError(withCode(api.ErrorCodeAgentFailed, err))
+	}
+}
+
+// defaultVMLostGracePeriod is how long a lost VM stays registered when not
+// specified with -vm-lost-grace-period.
+const defaultVMLostGracePeriod = 30 * time.Second
+
+// "console"
+func consoleHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	client := userData.(*client)
+
+	console := api.Console{}
+	if err := json.Unmarshal(data, &console); err != nil {
+		response.SetError(invalidRequestError(err))
+		return
+	}
+
+	vm, err := client.findVM(console.ContainerID)
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+
+	capture := vm.Console()
+	if capture == nil {
+		response.SetError(noConsoleError(vm.containerID))
+		return
+	}
+
+	client.infof(1, "console(containerId=%s,lines=%d,follow=%v,unfollow=%v)",
+		vm.containerID, console.Lines, console.Follow, console.Unfollow)
+
+	if console.Unfollow {
+		capture.Unfollow(client.id)
+		return
+	}
+
+	response.SetResult(&api.ConsoleResult{Lines: capture.Last(console.Lines)})
+
+	if console.Follow {
+		capture.Follow(client)
+	}
+}
+
+// "tap"
+func tapHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	client := userData.(*client)
+
+	tap := api.Tap{}
+	if err := json.Unmarshal(data, &tap); err != nil {
+		response.SetError(invalidRequestError(err))
+		return
+	}
+
+	vm, err := client.findVM(tap.ContainerID)
+	if err != nil {
+		response.SetError(err)
+		return
+	}
+
+	client.infof(1, "tap(containerId=%s,data=%v,stop=%v)", vm.containerID,
+		tap.Data, tap.Stop)
+
+	if tap.Stop {
+		vm.taps.Remove(client.id)
+		return
+	}
+
+	vm.taps.Add(client, tap.Data)
+}
+
+// "consoleAttach"
+func consoleAttachHandler(data []byte, userData interface{}, response *HandlerResponse) {
+	client := userData.(*client)
+	proxy := client.proxy
+
+	attach := api.ConsoleAttach{}
+	if err := json.Unmarshal(data, &attach); err != nil {
+		response.SetError(invalidRequestError(err))
+		return
+	}
+
+	proxy.Lock()
+	vm := proxy.lookupVM(attach.ContainerID)
+	proxy.Unlock()
+
+	if vm == nil {
+		response.SetError(unknownContainerError(attach.ContainerID))
+		return
+	}
+
+	if reason, lost := vm.LostReason(); lost {
+		response.SetError(vmLostError(attach.ContainerID, reason))
+		return
+	}
+
+	if err := vm.checkReady(); err != nil {
+		response.SetError(err)
+		return
+	}
+
+	client.infof(1, "consoleAttach(containerId=%s)", attach.ContainerID)
+
+	// We'll send c0 to the client, keep c1
+	c0, c1, err := Socketpair()
+	if err != nil {
+		response.SetError(withCode(api.ErrorCodeInternal, err))
+		return
+	}
+
+	if err := vm.AttachConsole(c1); err != nil {
+		c0.Close()
+		c1.Close()
+		response.SetError(err)
+		return
+	}
+
+	f0, err := c0.File()
+	c0.Close()
+	if err != nil {
+		vm.detachConsole(c1)
+		response.SetError(withCode(api.ErrorCodeInternal, err))
+		return
+	}
+
+	response.SetFile(f0)
+}
+
+func newProxy() *proxy {
+	proxy := &proxy{
+		vms:                make(map[string]*vm),
+		containers:         make(map[string]*vm),
+		clients:            make(map[uint64]*client),
+		console:            defaultConsoleConfig,
+		vmLostGracePeriod:  defaultVMLostGracePeriod,
+		healthCheckChanged: make(chan struct{}),
+		agents:             make(map[string]NewAgentFunc),
+		config:             configState{options: DefaultConfig()},
+		log:                &serverLog{},
+		metrics:            newMetrics(),
+	}
+	for name, newFunc := range agents {
+		proxy.agents[name] = newFunc
+	}
+	return proxy
+}
+
+// DefaultSocketPath is populated at link time with the value of:
+//   ${locatestatedir}/run/cc-oci-runtime/proxy
+var DefaultSocketPath string
+
+// lookupGroup returns the gid of group, a group name or a numeric gid.
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// setSocketOwnership sets the permissions of the socket at path to mode and,
+// when group isn't empty, its group to group.
+func setSocketOwnership(path string, mode FileMode, group string) error {
+	if err := os.Chmod(path, os.FileMode(mode)|os.ModeSocket); err != nil {
+		return fmt.Errorf("couldn't set mode: %v", err)
+	}
+	if group == "" {
+		return nil
+	}
+
+	gid, err := lookupGroup(group)
+	if err != nil {
+		return fmt.Errorf("couldn't find group: %v", err)
+	}
+	if err = os.Chown(path, -1, gid); err != nil {
+		return fmt.Errorf("couldn't set group: %v", err)
+	}
+	return nil
+}
+
+// init configures proxy from options, the flags of fs being bound to them, and
+// the configuration file.
+func (proxy *proxy) init(fs *flag.FlagSet, options *Config) error {
+	var err error
+
+	// flags, possibly set from the configuration file
+	if err = proxy.loadConfig(fs, options); err != nil {
+		return fmt.Errorf("couldn't load configuration: %v", err)
+	}
+	proxy.console = consoleConfigFrom(options)
+	if proxy.record, err = recordConfigFrom(options); err != nil {
+		return err
+	}
+	if proxy.limits, err = limitsConfigFrom(options); err != nil {
+		return err
+	}
+	if proxy.auth, err = authConfigFrom(options); err != nil {
+		return err
+	}
+	if err := proxy.log.setup(options.LogFormat, options.LogJournald); err != nil {
+		return err
+	}
+	proxy.vmLostGracePeriod = options.VMLostGracePeriod
+	proxy.helloTimeout = options.HelloTimeout
+	if proxy.healthCheckInterval, err = healthCheckIntervalFrom(options); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// listen opens the proxy socket, either the one systemd activated us with or
+// the one given by options.
+func (proxy *proxy) listen(options *Config) (net.Listener, error) {
+	var l net.Listener
+	var err error
+
+	fds := listenFds()
+
+	if len(fds) > 1 {
+		return nil, fmt.Errorf("too many activated sockets (%d)", len(fds))
+	} else if len(fds) == 1 {
+		fd := fds[0]
+		l, err = net.FileListener(fd)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't listen on socket: %v", err)
+		}
+	} else {
+		// Invoking "go build" without any linker option will not
+		// populate DefaultSocketPath, so fallback to a reasonable
+		// path.
+		if DefaultSocketPath == "" {
+			DefaultSocketPath = "/var/run/cc-oci-runtime/proxy.sock"
+		}
+
+		socketPath := DefaultSocketPath
+		if len(options.SocketPath) != 0 {
+			socketPath = options.SocketPath
+		}
+
+		socketDir := filepath.Dir(socketPath)
+		if err = os.MkdirAll(socketDir, os.FileMode(options.SocketDirMode)); err != nil {
+			return nil, fmt.Errorf("couldn't create socket directory: %v", err)
+		}
+		if err = os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("couldn't remove exiting socket: %v", err)
+		}
+		l, err = net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create AF_UNIX socket: %v", err)
+		}
+		if err = setSocketOwnership(socketPath, options.SocketMode, options.SocketGroup); err != nil {
+			return nil, fmt.Errorf("socket: %v", err)
+		}
+
+		proxy.log.infof(1, "listening on %s", socketPath)
+	}
+
+	return l, nil
+}
+
+var nextClientID = uint64(1)
+
+func (proxy *proxy) serveNewClient(proto *Protocol, newConn net.Conn) {
+	newClient := &client{
+		id:    atomic.AddUint64(&nextClientID, 1) - 1,
+		proxy: proxy,
+		conn:  newConn,
+	}
+	newClient.ctx = newClientCtx(newConn, newClient)
+
+	if cred, err := getPeerCred(newConn); err == nil {
+		newClient.cred = cred
+	}
+
+	proxy.Lock()
+	if !proxy.auth.allows(newClient.cred) {
+		proxy.Unlock()
+		proxy.metrics.errors.Inc(errorUnauthorized)
+		newClient.info(1, "client not allowed by the authorization policy")
+		newConn.Close()
+		return
+	}
+	if proxy.limits.requestRate > 0 {
+		newClient.requests = newTokenBucket(proxy.limits.requestRate,
+			proxy.limits.requestBurst)
+	}
+	proxy.clients[newClient.id] = newClient
+	proxy.Unlock()
+
+	// Unfortunately it's hard to find out information on the peer
+	// at the other end of a unix socket. We use a per-client ID to
+	// identify connections.
+	newClient.info(1, "client connected")
+
+	if err := proto.serveCtx(newClient.ctx); err != nil && err != io.EOF {
+		newClient.infof(1, "error serving client: %v", err)
+	}
+
+	proxy.Lock()
+	delete(proxy.clients, newClient.id)
+	vms := make([]*vm, 0, len(proxy.vms))
+	for _, vm := range proxy.vms {
+		vms = append(vms, vm)
+	}
+	proxy.Unlock()
+
+	// Stop following VM consoles and tapping VM traffic
+	for _, vm := range vms {
+		if capture := vm.Console(); capture != nil {
+			capture.Unfollow(newClient.id)
+		}
+		vm.taps.Remove(newClient.id)
+	}
+
+	newConn.Close()
+	newClient.info(1, "connection closed")
+}
+
+// newProxyProtocol defines the client (runtime/shim) <-> proxy protocol.
+func newProxyProtocol() *Protocol {
+	proto := NewProtocol()
+	proto.Handle("hello", helloHandler)
+	proto.Handle("attach", attachHandler)
+	proto.Handle("bye", byeHandler)
+	proto.Handle("allocateIO", allocateIoHandler)
+	proto.Handle("hyper", hyperHandler)
+	proto.Handle("console", consoleHandler)
+	proto.Handle("consoleAttach", consoleAttachHandler)
+	proto.Handle("tap", tapHandler)
+	proto.Handle("listVMs", listVMsHandler)
+	proto.Handle("vmInfo", vmInfoHandler)
+	proto.Handle("listClients", listClientsHandler)
+	proto.Handle("setLogLevel", setLogLevelHandler)
+	proto.Handle("registerContainer", registerContainerHandler)
+	proto.Handle("unregisterContainer", unregisterContainerHandler)
+
+	return proto
+}
@@ -12,11 +12,13 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package server
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -29,6 +31,7 @@ import (
 	"time"
 
 	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/01org/cc-oci-runtime/proxy/fdleak"
 	"github.com/containers/virtcontainers/hyperstart/mock"
 
 	hyper "github.com/hyperhq/runv/hyperstart/api/json"
@@ -47,9 +50,12 @@ type testRig struct {
 	// process
 	proxyFork bool
 
+	// Forward the I/O streams with the event loop, in process only
+	eventLoop bool
+
 	// proxy, in process
 	proxy     *proxy
-	protocol  *protocol
+	protocol  *Protocol
 	proxyConn net.Conn // socket used by proxy to communicate with Client
 
 	// proxy, forked
@@ -60,15 +66,15 @@ type testRig struct {
 	Client *api.Client
 
 	// fd leak detection
-	detector          *FdLeakDetector
-	startFds, stopFds *FdSnapshot
+	detector          *fdleak.FdLeakDetector
+	startFds, stopFds *fdleak.FdSnapshot
 }
 
-func newTestRig(t *testing.T, proto *protocol) *testRig {
+func newTestRig(t *testing.T, proto *Protocol) *testRig {
 	return &testRig{
 		t:        t,
 		protocol: proto,
-		detector: NewFdLeadDetector(),
+		detector: fdleak.NewFdLeadDetector(),
 	}
 }
 
@@ -76,13 +82,17 @@ func (rig *testRig) SetFork(fork bool) {
 	rig.proxyFork = fork
 }
 
+func (rig *testRig) SetEventLoop(eventLoop bool) {
+	rig.eventLoop = eventLoop
+}
+
 func (rig *testRig) Start() {
 	var err error
 
 	rig.startFds, err = rig.detector.Snapshot()
 	assert.Nil(rig.t, err)
 
-	initLogging()
+	initTestLogging()
 	flag.Parse()
 
 	// Start hyperstart go routine
@@ -132,6 +142,11 @@ func (rig *testRig) Start() {
 		assert.Nil(rig.t, err)
 		// Start proxy main go routine
 		rig.proxy = newProxy()
+		rig.protocol.reportTo(rig.proxy)
+		if rig.eventLoop {
+			rig.proxy.loop, err = newEventLoop(rig.proxy.log, rig.proxy.metrics)
+			assert.Nil(rig.t, err)
+		}
 		rig.wg.Add(1)
 		go func() {
 			rig.proxy.serveNewClient(rig.protocol, rig.proxyConn)
@@ -143,6 +158,17 @@ func (rig *testRig) Start() {
 	rig.Client = api.NewClient(clientConn.(*net.UnixConn))
 }
 
+// initTestLogging is cc-proxy's initLogging: logs on stderr, verbosity from
+// CC_PROXY_LOG_LEVEL.
+func initTestLogging() {
+	flag.Set("logtostderr", "true")
+
+	level := os.Getenv("CC_PROXY_LOG_LEVEL")
+	if level != "" {
+		flag.Set("v", level)
+	}
+}
+
 // A fake test we use to lauch a full proxy process
 func proxyCommand(socketPath string) *exec.Cmd {
 	cs := []string{"-test.run=TestLaunchProxy"}
@@ -162,7 +188,10 @@ func TestLaunchProxy(t *testing.T) {
 	// used in proxy.go for the non socket-activated case
 	DefaultSocketPath = os.Getenv("CC_TEST_SOCKET_PATH")
 
-	proxyMain()
+	fs := flag.NewFlagSet("cc-proxy", flag.ContinueOnError)
+	srv, err := New(FromFlags(fs, DefaultConfig()))
+	assert.Nil(t, err)
+	srv.Serve(context.Background())
 }
 
 func (rig *testRig) Stop() {
@@ -190,6 +219,9 @@ func (rig *testRig) Stop() {
 
 	if rig.proxy != nil {
 		rig.proxy.wg.Wait()
+		if rig.proxy.loop != nil {
+			rig.proxy.loop.stop()
+		}
 	}
 
 	// We shouldn't have leaked a fd between the beginning of Start() and
@@ -204,7 +236,7 @@ func (rig *testRig) Stop() {
 const testContainerID = "0987654321"
 
 func TestHello(t *testing.T) {
-	proto := newProtocol()
+	proto := NewProtocol()
 	proto.Handle("hello", helloHandler)
 
 	rig := newTestRig(t, proto)
@@ -215,9 +247,22 @@ func TestHello(t *testing.T) {
 	_, err := rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath, nil)
 	assert.Nil(t, err)
 
+	// Container IDs can't designate other directories
+	for _, id := range []string{"../foo", "foo/bar", "foo..", "foo\x00"} {
+		_, err = rig.Client.Hello(id, ctlSocketPath, ioSocketPath, nil)
+		assert.True(t, errors.Is(err, api.ErrorCodeInvalidRequest), id)
+		_, err = rig.Client.Hello("foo", ctlSocketPath, ioSocketPath,
+			&api.HelloOptions{PodID: id})
+		assert.True(t, errors.Is(err, api.ErrorCodeInvalidRequest), id)
+	}
+
 	// A new Hello message with the same containerID should error out
 	_, err = rig.Client.Hello(testContainerID, "fooCtl", "fooIo", nil)
-	assert.NotNil(t, err)
+	assert.True(t, errors.Is(err, api.ErrorCodeContainerAlreadyRegistered))
+	var apiErr *api.Error
+	if assert.True(t, errors.As(err, &apiErr)) {
+		assert.Equal(t, testContainerID, apiErr.Details["containerId"])
+	}
 
 	// Hello should register a new vm object
 	proxy := rig.proxy
@@ -236,7 +281,7 @@ func TestHello(t *testing.T) {
 }
 
 func TestBye(t *testing.T) {
-	proto := newProtocol()
+	proto := NewProtocol()
 	proto.Handle("hello", helloHandler)
 	proto.Handle("bye", byeHandler)
 
@@ -250,7 +295,7 @@ func TestBye(t *testing.T) {
 
 	// Bye with a bad containerID
 	err = rig.Client.Bye("foo")
-	assert.NotNil(t, err)
+	assert.True(t, errors.Is(err, api.ErrorCodeUnknownContainer))
 
 	// Bye!
 	err = rig.Client.Bye(testContainerID)
@@ -275,7 +320,7 @@ func TestBye(t *testing.T) {
 }
 
 func TestAttach(t *testing.T) {
-	proto := newProtocol()
+	proto := NewProtocol()
 	proto.Handle("hello", helloHandler)
 	proto.Handle("attach", attachHandler)
 	proto.Handle("bye", byeHandler)
@@ -290,7 +335,7 @@ func TestAttach(t *testing.T) {
 
 	// Attaching to an unknown VM should return an error
 	_, err = rig.Client.Attach("foo", nil)
-	assert.NotNil(t, err)
+	assert.True(t, errors.Is(err, api.ErrorCodeUnknownContainer))
 
 	// Attaching to an existing VM should work. To test we are effectively
 	// attached, we issue a bye that would error out if not attached.
@@ -307,15 +352,19 @@ func TestAttach(t *testing.T) {
 }
 
 func TestHyperPing(t *testing.T) {
-	proto := newProtocol()
+	proto := NewProtocol()
 	proto.Handle("hello", helloHandler)
 	proto.Handle("hyper", hyperHandler)
 
 	rig := newTestRig(t, proto)
 	rig.Start()
 
+	// Hyper commands need a VM
+	err := rig.Client.Hyper("ping", nil)
+	assert.True(t, errors.Is(err, api.ErrorCodeNotAttached))
+
 	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
-	_, err := rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath, nil)
+	_, err = rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath, nil)
 	assert.Nil(t, err)
 
 	// Send ping and verify we have indeed received the message on the
@@ -335,7 +384,7 @@ func TestHyperPing(t *testing.T) {
 }
 
 func TestHyperStartpod(t *testing.T) {
-	proto := newProtocol()
+	proto := NewProtocol()
 	proto.Handle("hello", helloHandler)
 	proto.Handle("hyper", hyperHandler)
 
@@ -416,13 +465,29 @@ func readIo(t *testing.T, reader io.Reader) (seq uint64, data []byte) {
 	return
 }
 
+// forEachIoMode runs test with the I/O streams forwarded by goroutines, then
+// by the event loop.
+func forEachIoMode(t *testing.T, test func(t *testing.T, eventLoop bool)) {
+	t.Run("goroutines", func(t *testing.T) {
+		test(t, false)
+	})
+	t.Run("event-loop", func(t *testing.T) {
+		test(t, true)
+	})
+}
+
 func TestAllocateIo(t *testing.T) {
-	proto := newProtocol()
+	forEachIoMode(t, testAllocateIo)
+}
+
+func testAllocateIo(t *testing.T, eventLoop bool) {
+	proto := NewProtocol()
 	proto.Handle("hello", helloHandler)
 	proto.Handle("allocateIO", allocateIoHandler)
 
 	rig := newTestRig(t, proto)
 	//rig.SetFork(true)
+	rig.SetEventLoop(eventLoop)
 	rig.Start()
 
 	// Register new VM
@@ -430,6 +495,10 @@ func TestAllocateIo(t *testing.T) {
 	_, err := rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath, nil)
 	assert.Nil(t, err)
 
+	// Only stdout, and optionally stderr, can be allocated
+	_, _, err = rig.Client.AllocateIo(3)
+	assert.True(t, errors.Is(err, api.ErrorCodeInvalidRequest))
+
 	// Allocate 2 seq numbers and verify we can use the fd passed from
 	// allocate I/O to send and receive data.
 	ioBase, ioFile, err := rig.Client.AllocateIo(2)
@@ -489,3 +558,68 @@ func TestAllocateIo(t *testing.T) {
 
 	rig.Stop()
 }
+
+func TestVMLost(t *testing.T) {
+	forEachIoMode(t, testVMLost)
+}
+
+func testVMLost(t *testing.T, eventLoop bool) {
+	proto := NewProtocol()
+	proto.Handle("hello", helloHandler)
+	proto.Handle("allocateIO", allocateIoHandler)
+	proto.Handle("hyper", hyperHandler)
+
+	rig := newTestRig(t, proto)
+	rig.SetEventLoop(eventLoop)
+	rig.Start()
+
+	// Register new VM
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err := rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath,
+		&api.HelloOptions{Notifications: true})
+	assert.Nil(t, err)
+
+	ioBase, ioFile, err := rig.Client.AllocateIo(2)
+	assert.Nil(t, err)
+
+	// Make the VM go away
+	rig.Hyperstart.Stop()
+
+	// We should be notified the VM is lost
+	notification, err := rig.Client.WaitNotification()
+	assert.Nil(t, err)
+	assert.Equal(t, "vmLost", notification.ID)
+	vmLost := api.VMLost{}
+	err = json.Unmarshal(notification.Data, &vmLost)
+	assert.Nil(t, err)
+	assert.Equal(t, testContainerID, vmLost.ContainerID)
+	assert.Equal(t, api.VMLostIoEOF, vmLost.Reason)
+
+	// The I/O session is terminated: both streams are closed and an exit
+	// status is sent
+	for _, expected := range []uint64{ioBase, ioBase + 1} {
+		seq, data := readIo(t, ioFile)
+		assert.Equal(t, expected, seq)
+		assert.Equal(t, 0, len(data))
+	}
+	seq, data := readIo(t, ioFile)
+	assert.Equal(t, ioBase, seq)
+	assert.Equal(t, []byte{api.VMLostExitStatus}, data)
+	ioFile.Close()
+
+	// The VM is still registered, but unusable
+	proxy := rig.proxy
+	proxy.Lock()
+	vm := proxy.vms[testContainerID]
+	proxy.Unlock()
+	assert.NotNil(t, vm)
+
+	err = rig.Client.Hyper("ping", nil)
+	assert.True(t, errors.Is(err, api.ErrorCodeVMLost))
+	var apiErr *api.Error
+	if assert.True(t, errors.As(err, &apiErr)) {
+		assert.Equal(t, api.VMLostIoEOF, apiErr.Details["reason"])
+	}
+
+	rig.Stop()
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket is a rate limiter. The bucket holds up to burst tokens and is
+// refilled at rate tokens per second. Each operation takes tokens from the
+// bucket and is denied when there aren't enough tokens left.
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// Can be overridden by tests
+	now func() time.Time
+}
+
+// newTokenBucket creates a full token bucket. A rate <= 0 disables the rate
+// limiting.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// AllowN takes n tokens from the bucket, returning false if there isn't
+// enough of them.
+func (b *tokenBucket) AllowN(n int) bool {
+	if b == nil || b.rate <= 0 {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < float64(n) {
+		return false
+	}
+
+	b.tokens -= float64(n)
+	return true
+}
+
+// Allow is AllowN(1).
+func (b *tokenBucket) Allow() bool {
+	return b.AllowN(1)
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 5)
+	b.now = func() time.Time { return now }
+	b.last = now
+
+	// We start with a full bucket
+	for i := 0; i < 5; i++ {
+		assert.True(t, b.Allow())
+	}
+	assert.False(t, b.Allow())
+
+	// 10 tokens per second: 100ms gives us one more token
+	now = now.Add(100 * time.Millisecond)
+	assert.True(t, b.Allow())
+	assert.False(t, b.Allow())
+
+	// The bucket can't hold more than burst tokens
+	now = now.Add(10 * time.Second)
+	assert.False(t, b.AllowN(6))
+	assert.True(t, b.AllowN(5))
+}
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	b := newTokenBucket(0, 0)
+	for i := 0; i < 100; i++ {
+		assert.True(t, b.Allow())
+	}
+
+	var nilBucket *tokenBucket
+	assert.True(t, nilBucket.Allow())
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+// notReadyError is returned when a VM isn't ready, or didn't become ready in
+// time.
+type notReadyError struct {
+	msg string
+}
+
+func newNotReadyError(format string, a ...interface{}) *notReadyError {
+	return &notReadyError{
+		msg: fmt.Sprintf(format, a...),
+	}
+}
+
+func (e *notReadyError) Error() string {
+	return e.msg
+}
+
+// Code implements codedError.
+func (e *notReadyError) Code() api.ErrorCode {
+	return api.ErrorCodeVMNotReady
+}
+
+// helloDeadline returns the deadline for a VM to be ready, timeout being the
+// one given to hello, in milliseconds. A zero time means no deadline.
+func (proxy *proxy) helloDeadline(timeout uint32) time.Time {
+	d := time.Duration(timeout) * time.Millisecond
+	if d == 0 {
+		proxy.Lock()
+		d = proxy.helloTimeout
+		proxy.Unlock()
+	}
+	if d == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// startVM connects to vm, waiting until deadline for it to be ready, and
+// starts monitoring it. On failure, vm is unregistered and torn down.
+func (proxy *proxy) startVM(vm *vm, deadline time.Time) error {
+	start := time.Now()
+	err := vm.Connect(deadline)
+	if err != nil {
+		err = withCode(api.ErrorCodeAgentFailed, err)
+	} else {
+		// A bye may have raced with us
+		proxy.Lock()
+		registered := proxy.vms[vm.containerID] == vm
+		proxy.Unlock()
+		if !registered {
+			err = newError(api.ErrorCodeUnknownContainer, "%s: unregistered while starting",
+				vm.containerID).with("containerId", vm.containerID)
+		}
+	}
+	vm.setReady(err)
+
+	if err != nil {
+		if _, ok := err.(*notReadyError); ok {
+			proxy.metrics.errors.Inc(errorVMNotReady)
+		}
+		proxy.Lock()
+		proxy.unregisterVM(vm)
+		proxy.Unlock()
+		vm.Close()
+		return err
+	}
+	proxy.metrics.bootDuration.Observe("", time.Since(start).Seconds())
+
+	// We start one goroutine per-VM to monitor the qemu process, and
+	// another one to check the agent keeps answering
+	proxy.wg.Add(2)
+	proxy.monitors.Add(1)
+	go func() {
+		<-vm.OnVMLost()
+		proxy.vmLost(vm)
+		proxy.monitors.Done()
+		proxy.wg.Done()
+	}()
+	go func() {
+		proxy.checkHealth(vm)
+		proxy.wg.Done()
+	}()
+
+	return nil
+}
+
+// startVMAsync is startVM for asynchronous hellos: the clients attached to vm
+// are detached from it if it failed, and the ones that asked for notifications
+// are told the outcome.
+func (proxy *proxy) startVMAsync(vm *vm, deadline time.Time) {
+	err := proxy.startVM(vm, deadline)
+
+	attached := proxy.clientsAttachedTo(vm)
+	if err != nil {
+		vm.infof(1, "ctl", "vm failed to start: %v", err)
+		notification := api.VMFailed{
+			ContainerID: vm.containerID,
+			Error:       err.Error(),
+		}
+		var coded codedError
+		if errors.As(err, &coded) {
+			notification.Code = coded.Code()
+		}
+		for _, client := range attached {
+			notify := client.wantsNotifications()
+			client.setVM(nil, "", false)
+			if !notify {
+				continue
+			}
+			if err := client.ctx.SendNotification("vmFailed", &notification); err != nil {
+				client.infof(1, "couldn't send vmFailed notification: %v", err)
+			}
+		}
+		return
+	}
+
+	vm.info(1, "ctl", "vm ready")
+	notification := api.VMReady{
+		ContainerID: vm.containerID,
+	}
+	for _, client := range attached {
+		if !client.wantsNotifications() {
+			continue
+		}
+		if err := client.ctx.SendNotification("vmReady", &notification); err != nil {
+			client.infof(1, "couldn't send vmReady notification: %v", err)
+		}
+	}
+}
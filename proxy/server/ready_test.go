@@ -0,0 +1,149 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/containers/virtcontainers/hyperstart/mock"
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+	"github.com/stretchr/testify/assert"
+)
+
+func assertNotReady(t *testing.T, err error) {
+	apiErr, ok := err.(*api.Error)
+	if !assert.True(t, ok, "%v", err) {
+		return
+	}
+	assert.Equal(t, api.ErrorCodeVMNotReady, apiErr.Code)
+}
+
+// helloRig registers the test rig VM, which has to be connected to for
+// rig.Stop() to return.
+func helloRig(t *testing.T, rig *testRig) {
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err := rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath, nil)
+	assert.Nil(t, err)
+}
+
+func TestHelloWaitsForSockets(t *testing.T) {
+	rig := newTestRig(t, newProxyProtocol())
+	rig.Start()
+
+	// The VM sockets only show up after hello has been issued
+	h := mock.NewHyperstart(t)
+	ctlSocketPath, ioSocketPath := h.GetSocketPaths()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		h.Start()
+		h.SendMessage(int(hyper.INIT_READY), []byte{})
+	}()
+
+	_, err := rig.Client.Hello("late", ctlSocketPath, ioSocketPath,
+		&api.HelloOptions{Timeout: 5 * time.Second})
+	assert.Nil(t, err)
+
+	info, err := rig.Client.VMInfo("late", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "late", info.VM.ContainerID)
+
+	helloRig(t, rig)
+
+	h.Stop()
+	rig.Stop()
+}
+
+func TestHelloTimeout(t *testing.T) {
+	rig := newTestRig(t, newProxyProtocol())
+	rig.Start()
+
+	// Sockets never showing up
+	h := mock.NewHyperstart(t)
+	ctlSocketPath, ioSocketPath := h.GetSocketPaths()
+	_, err := rig.Client.Hello("missing", ctlSocketPath, ioSocketPath,
+		&api.HelloOptions{Timeout: 50 * time.Millisecond})
+	assertNotReady(t, err)
+
+	// hyperstart never sending READY
+	h.Start()
+	_, err = rig.Client.Hello("silent", ctlSocketPath, ioSocketPath,
+		&api.HelloOptions{Timeout: 100 * time.Millisecond})
+	assertNotReady(t, err)
+
+	// Neither VM is registered
+	vms, err := rig.Client.ListVMs()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(vms))
+
+	// The proxy default applies when hello doesn't give a timeout
+	rig.proxy.Lock()
+	rig.proxy.helloTimeout = 10 * time.Millisecond
+	rig.proxy.Unlock()
+	_, err = rig.Client.Hello("missing", "/nonexistent/ctl", "/nonexistent/io", nil)
+	assertNotReady(t, err)
+	rig.proxy.Lock()
+	rig.proxy.helloTimeout = 0
+	rig.proxy.Unlock()
+
+	helloRig(t, rig)
+
+	h.Stop()
+	rig.Stop()
+}
+
+func TestHelloAsync(t *testing.T) {
+	rig := newTestRig(t, newProxyProtocol())
+	rig.Start()
+
+	h := mock.NewHyperstart(t)
+	ctlSocketPath, ioSocketPath := h.GetSocketPaths()
+	_, err := rig.Client.Hello("async", ctlSocketPath, ioSocketPath,
+		&api.HelloOptions{Timeout: 5 * time.Second, Async: true})
+	assert.Nil(t, err)
+
+	// The VM is registered, but not usable yet
+	info, err := rig.Client.VMInfo("", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "async", info.VM.ContainerID)
+
+	err = rig.Client.Hyper("ping", nil)
+	assertNotReady(t, err)
+
+	h.Start()
+	h.SendMessage(int(hyper.INIT_READY), []byte{})
+
+	err = rig.Client.WaitVMReady("async")
+	assert.Nil(t, err)
+
+	// Failing, the client is detached from the VM
+	_, err = rig.Client.Hello("async-missing", "/nonexistent/ctl", "/nonexistent/io",
+		&api.HelloOptions{Timeout: 50 * time.Millisecond, Async: true})
+	assert.Nil(t, err)
+
+	err = rig.Client.WaitVMReady("async-missing")
+	assertNotReady(t, err)
+
+	_, err = rig.Client.VMInfo("", false)
+	assert.NotNil(t, err)
+	_, err = rig.Client.VMInfo("async-missing", false)
+	assert.NotNil(t, err)
+
+	helloRig(t, rig)
+
+	h.Stop()
+	rig.Stop()
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/record"
+)
+
+// Traffic recording configuration, see the record package.
+type recordConfig struct {
+	// Directory where recordings are written. Recording is disabled when
+	// empty.
+	dir string
+	// Record all VMs, not only the ones asking for it in hello
+	all bool
+}
+
+func recordConfigFrom(options *Config) (recordConfig, error) {
+	config := recordConfig{
+		dir: options.RecordDir,
+		all: options.RecordAll,
+	}
+
+	if config.all && config.dir == "" {
+		return config, errors.New("-record-all needs -record-dir")
+	}
+
+	return config, nil
+}
+
+var errRecordingDisabled = errors.New("recording is disabled, see -record-dir")
+
+// startRecording records the ctl and io traffic of vm in a new file of
+// config.dir.
+func (vm *vm) startRecording(config recordConfig) error {
+	if config.dir == "" {
+		return errRecordingDisabled
+	}
+
+	if err := os.MkdirAll(config.dir, 0750); err != nil {
+		return err
+	}
+
+	// hello has checked containerID with checkContainerID, make sure
+	// anyway the recording stays in config.dir
+	name := vm.containerID + "-" + time.Now().UTC().Format("20060102T150405.000000000") + ".ccrec"
+	path, err := fileUnder(config.dir, name)
+	if err != nil {
+		return err
+	}
+	w, err := record.Create(path)
+	if err != nil {
+		return err
+	}
+
+	vm.infof(1, "ctl", "recording traffic to %s", path)
+	vm.recorder = w
+	return nil
+}
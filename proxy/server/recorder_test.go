@@ -0,0 +1,124 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/01org/cc-oci-runtime/proxy/record"
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	proto := NewProtocol()
+	proto.Handle("hello", helloHandler)
+	proto.Handle("allocateIO", allocateIoHandler)
+	proto.Handle("hyper", hyperHandler)
+
+	rig := newTestRig(t, proto)
+	rig.Start()
+
+	rig.proxy.Lock()
+	rig.proxy.record.dir = dir
+	rig.proxy.record.all = false
+	rig.proxy.Unlock()
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err = rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath,
+		&api.HelloOptions{Record: true})
+	assert.Nil(t, err)
+
+	ioBase, ioFile, err := rig.Client.AllocateIo(1)
+	assert.Nil(t, err)
+
+	err = rig.Client.Hyper("ping", nil)
+	assert.Nil(t, err)
+
+	writeIo(t, ioFile, ioBase, []byte("stdin\n"))
+	buf := make([]byte, 32)
+	rig.Hyperstart.ReadIo(buf)
+
+	rig.Hyperstart.SendIoString(ioBase, "stdout\n")
+	_, data := readIo(t, ioFile)
+	assert.Equal(t, "stdout\n", string(data))
+
+	ioFile.Close()
+
+	// Check what has been recorded
+	files, err := filepath.Glob(filepath.Join(dir, testContainerID+"-*.ccrec"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+
+	r, err := record.Open(files[0])
+	assert.Nil(t, err)
+
+	expected := []record.Frame{
+		{Kind: record.KindCtl, Direction: record.FromVM, ID: hyper.INIT_READY},
+		{Kind: record.KindSession, Direction: record.ToVM, ID: ioBase, Data: []byte{1}},
+		{Kind: record.KindCtl, Direction: record.ToVM, ID: hyper.INIT_PING},
+		{Kind: record.KindCtl, Direction: record.FromVM, ID: hyper.INIT_ACK},
+		{Kind: record.KindIo, Direction: record.ToVM, ID: ioBase, Data: []byte("stdin\n")},
+		{Kind: record.KindIo, Direction: record.FromVM, ID: ioBase, Data: []byte("stdout\n")},
+	}
+	for _, e := range expected {
+		frame, err := r.Next()
+		assert.Nil(t, err)
+		if frame == nil {
+			break
+		}
+		frame.Time = 0
+		assert.Equal(t, e, *frame)
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+	r.Close()
+
+	rig.Stop()
+}
+
+func TestRecordDisabled(t *testing.T) {
+	// Asking for a recording when the proxy doesn't have a place to put
+	// it is an error.
+	vm := newProxy().newVM(testContainerID, "ctl", "io", nil)
+	err := vm.startRecording(recordConfig{})
+	assert.Equal(t, errRecordingDisabled, err)
+	assert.Nil(t, vm.recorder)
+}
+
+// Recordings can't be written outside of the recording directory
+func TestRecordPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cc-proxy-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	vm := newProxy().newVM("../foo", "ctl", "io", nil)
+	err = vm.startRecording(recordConfig{dir: filepath.Join(dir, "record")})
+	assert.NotNil(t, err)
+	assert.Nil(t, vm.recorder)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.ccrec"))
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+}
@@ -0,0 +1,346 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package server implements cc-proxy, the process multiplexing the
+// hyperstart channels of Clear Containers VMs between the runtime and the
+// shims. cc-proxy itself is a thin main() around this package and other
+// programs, eg. tests, can embed a proxy with:
+//
+//  srv, err := server.New(server.WithListener(l))
+//  if err != nil {
+//  	return err
+//  }
+//  go srv.Serve(ctx)
+//  ...
+//  srv.Shutdown(ctx)
+//
+// The cc-proxy command defines its command line options, bound to the fields
+// of a Config, and hands them to the FromFlags option, which also applies the
+// configuration file they name.
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+)
+
+// ErrServerClosed is returned by Serve after a call to Shutdown.
+var ErrServerClosed = errors.New("server: proxy closed")
+
+// Server is a proxy serving clients on a listener.
+type Server struct {
+	proxy *proxy
+	proto *Protocol
+
+	// admin API sockets, from the admin options of the Config
+	admin adminConfig
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// An Option configures a Server, see New.
+type Option func(*Server) error
+
+// New creates a Server configured by options, applied in order. A Server
+// needs a listener, given with either WithListener or FromFlags.
+func New(options ...Option) (*Server, error) {
+	s := &Server{
+		proxy:  newProxy(),
+		proto:  newProxyProtocol(),
+		closed: make(chan struct{}),
+	}
+	s.proto.reportTo(s.proxy)
+
+	var err error
+	for _, option := range options {
+		if err = option(s); err != nil {
+			break
+		}
+	}
+
+	if err == nil && s.proxy.listener == nil {
+		err = errors.New("server: no listener")
+	}
+
+	if err != nil {
+		if s.proxy.loop != nil {
+			s.proxy.loop.stop()
+		}
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// FromFlags configures the Server as config and the configuration file it
+// names say, including the proxy socket, socket activated or not. fs holds the
+// parsed command line options, bound to the fields of config: the
+// configuration file sets the flags of fs by name, those given on the command
+// line taking precedence, and a configuration reload sets them again. fs and
+// config must not be used by the caller once the Server is created. Options
+// given after FromFlags override what it sets.
+func FromFlags(fs *flag.FlagSet, config *Config) Option {
+	return func(s *Server) error {
+		if err := s.proxy.init(fs, config); err != nil {
+			return err
+		}
+
+		l, err := s.proxy.listen(config)
+		if err != nil {
+			return err
+		}
+		s.proxy.listener = l
+
+		s.admin = adminConfigFrom(config)
+
+		if err := WithMaxMessageSize(config.MaxMessageSize)(s); err != nil {
+			return err
+		}
+
+		if config.EventLoop {
+			return WithEventLoop()(s)
+		}
+
+		return nil
+	}
+}
+
+// WithListener makes the Server accept clients on l. The Server owns l and
+// closes it on Shutdown.
+func WithListener(l net.Listener) Option {
+	return func(s *Server) error {
+		s.proxy.listener = l
+		return nil
+	}
+}
+
+// WithLogger sends the log messages of the Server to logger instead of glog.
+// The glog verbosity (-v) still decides which messages are logged.
+func WithLogger(logger Logger) Option {
+	return func(s *Server) error {
+		s.proxy.log.sink = logger
+		return nil
+	}
+}
+
+// WithLimits sets the quotas and rate limits of the Server.
+func WithLimits(limits Limits) Option {
+	return func(s *Server) error {
+		config, err := limits.config()
+		if err != nil {
+			return err
+		}
+		s.proxy.limits = config
+		return nil
+	}
+}
+
+// WithHealthCheckInterval makes the Server ping the agent of each VM every
+// interval, declaring the VM lost with the api.VMLostHealthCheck reason when
+// the agent doesn't answer within interval. 0, the default, disables health
+// checks.
+func WithHealthCheckInterval(interval time.Duration) Option {
+	return func(s *Server) error {
+		if interval < 0 {
+			return errors.New("server: negative health check interval")
+		}
+		s.proxy.healthCheckInterval = interval
+		return nil
+	}
+}
+
+// WithAgent adds, or replaces, the agent backend clients select by giving name
+// to hello.
+func WithAgent(name string, newAgent NewAgentFunc) Option {
+	return func(s *Server) error {
+		if name == "" || newAgent == nil {
+			return errors.New("server: invalid agent")
+		}
+		s.proxy.agents[name] = newAgent
+		return nil
+	}
+}
+
+// WithMaxMessageSize sets the maximum size of the requests clients send, in
+// bytes, api.DefaultMaxMessageSize by default. Clients sending larger requests
+// are disconnected.
+func WithMaxMessageSize(size int) Option {
+	return func(s *Server) error {
+		if size <= 0 {
+			return errors.New("-max-message-size must be positive")
+		}
+		s.proto.maxMessageSize = size
+		return nil
+	}
+}
+
+// WithEventLoop makes the Server forward the I/O streams of the VMs and the
+// shims from a single epoll event loop, instead of a goroutine per VM and per
+// I/O session. The protocol spoken is the same. VMs whose agent doesn't expose
+// its io channel socket still get goroutines.
+func WithEventLoop() Option {
+	return func(s *Server) error {
+		if s.proxy.loop != nil {
+			return nil
+		}
+
+		loop, err := newEventLoop(s.proxy.log, s.proxy.metrics)
+		if err != nil {
+			return err
+		}
+		s.proxy.loop = loop
+		return nil
+	}
+}
+
+// Protocol returns the protocol spoken with clients, eg. to add handlers
+// before calling Serve.
+func (s *Server) Protocol() *Protocol {
+	return s.proto
+}
+
+// MetricsHandler returns the HTTP handler serving the Prometheus metrics.
+func (s *Server) MetricsHandler() http.Handler {
+	return s.proxy.metricsHandler()
+}
+
+// HandleSignals reloads the configuration file on SIGHUP and toggles the
+// debug log level on SIGUSR1, as cc-proxy does.
+func (s *Server) HandleSignals() {
+	s.proxy.handleReload()
+	s.proxy.handleDebugToggle()
+}
+
+// Serve accepts and serves clients until ctx is done, returning ctx.Err(), or
+// Shutdown is called, returning ErrServerClosed.
+func (s *Server) Serve(ctx context.Context) error {
+	proxy := s.proxy
+
+	if err := proxy.setupAdmin(s.proto, s.admin); err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			proxy.listener.Close()
+		case <-stop:
+		}
+	}()
+
+	proxy.log.infof(1, "proxy started")
+
+	for {
+		conn, err := proxy.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.closed:
+				return ErrServerClosed
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				proxy.log.infof(0, "couldn't accept connection: %v", err)
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
+			return err
+		}
+
+		proxy.wg.Add(1)
+		go func() {
+			proxy.serveNewClient(s.proto, conn)
+			proxy.wg.Done()
+		}()
+	}
+}
+
+// acceptRetryDelay is how long Serve waits before accepting connections again
+// after a temporary error, eg. running out of file descriptors.
+const acceptRetryDelay = 100 * time.Millisecond
+
+// Shutdown stops the Server: it stops accepting clients, declares the VMs lost
+// with the api.VMLostProxyShutdown reason, closes the client connections and
+// waits for everything to be torn down, or for ctx to be done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	proxy := s.proxy
+
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		proxy.listener.Close()
+	})
+
+	proxy.Lock()
+	for _, l := range proxy.adminListeners {
+		l.Close()
+	}
+	proxy.adminListeners = nil
+	vms := make([]*vm, 0, len(proxy.vms))
+	for _, vm := range proxy.vms {
+		vms = append(vms, vm)
+	}
+	proxy.Unlock()
+
+	// Give the attached clients a chance to be notified of the VMs being
+	// lost before disconnecting them
+	for _, vm := range vms {
+		vm.signalVMLost(api.VMLostProxyShutdown)
+	}
+	if err := waitCtx(ctx, &proxy.monitors); err != nil {
+		return err
+	}
+
+	proxy.Lock()
+	for _, client := range proxy.clients {
+		client.conn.Close()
+	}
+	proxy.Unlock()
+
+	if err := waitCtx(ctx, &proxy.wg); err != nil {
+		return err
+	}
+
+	if proxy.loop != nil {
+		proxy.loop.stop()
+	}
+	return nil
+}
+
+// waitCtx waits for wg, or for ctx to be done.
+func waitCtx(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/01org/cc-oci-runtime/proxy/fdleak"
+	"github.com/containers/virtcontainers/hyperstart/mock"
+	"github.com/stretchr/testify/assert"
+)
+
+// testLogger records the messages logged through WithLogger.
+type testLogger struct {
+	sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) Log(level int, fields map[string]interface{}, msg string) {
+	l.Lock()
+	l.msgs = append(l.msgs, msg)
+	l.Unlock()
+}
+
+func listenTestServer(t *testing.T) (net.Listener, string) {
+	path := mock.GetTmpPath("test-server.%s.sock")
+	l, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	return l, path
+}
+
+func dialTestServer(t *testing.T, path string) *api.Client {
+	conn, err := net.Dial("unix", path)
+	assert.Nil(t, err)
+	return api.NewClient(conn.(*net.UnixConn))
+}
+
+func TestNewNeedsListener(t *testing.T) {
+	_, err := New()
+	assert.NotNil(t, err)
+
+	_, err = New(WithListener(nil))
+	assert.NotNil(t, err)
+}
+
+func TestServerOptions(t *testing.T) {
+	l, path := listenTestServer(t)
+	defer os.Remove(path)
+	defer l.Close()
+
+	_, err := New(WithListener(l), WithLimits(Limits{UserVMs: -1}))
+	assert.NotNil(t, err)
+
+	_, err = New(WithListener(l), WithAgent("", newHyperstartAgent))
+	assert.NotNil(t, err)
+
+	srv, err := New(WithListener(l), WithLimits(Limits{UserVMs: 2}))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, srv.proxy.limits.userVMs)
+	assert.NotNil(t, srv.Protocol())
+	assert.NotNil(t, srv.MetricsHandler())
+}
+
+func TestServerLogger(t *testing.T) {
+	l, path := listenTestServer(t)
+	defer os.Remove(path)
+	defer l.Close()
+
+	// Each Server has its own logger
+	logger, other := &testLogger{}, &testLogger{}
+	srv, err := New(WithListener(l), WithLogger(logger))
+	assert.Nil(t, err)
+	_, err = New(WithListener(l), WithLogger(other))
+	assert.Nil(t, err)
+
+	srv.proxy.log.infof(0, "hello %s", "logger")
+
+	// I/O data dumps go to the logger as well
+	vm := srv.proxy.newVM(testContainerID, "ctl", "io", nil)
+	vm.setLogLevel(2)
+	vm.dump(2, 1, []byte("data"))
+
+	logger.Lock()
+	assert.Equal(t, []string{"hello logger", "io data"}, logger.msgs)
+	logger.Unlock()
+	other.Lock()
+	assert.Empty(t, other.msgs)
+	other.Unlock()
+}
+
+func TestServerShutdown(t *testing.T) {
+	detector := fdleak.NewFdLeadDetector()
+	startFds, err := detector.Snapshot()
+	assert.Nil(t, err)
+
+	a := newMemoryAgent()
+	close(a.ready)
+
+	l, path := listenTestServer(t)
+	defer os.Remove(path)
+	srv, err := New(WithListener(l),
+		WithAgent("test", func(ctlSerial, ioSerial string) (Agent, error) {
+			return a, nil
+		}))
+	assert.Nil(t, err)
+
+	served := make(chan error)
+	go func() {
+		served <- srv.Serve(context.Background())
+	}()
+
+	client := dialTestServer(t, path)
+	_, err = client.Hello(testContainerID, "ctl", "io",
+		&api.HelloOptions{Agent: "test", Notifications: true})
+	assert.Nil(t, err)
+
+	other := dialTestServer(t, path)
+	_, err = other.Attach(testContainerID, nil)
+	assert.Nil(t, err)
+
+	// Attached clients are told their VM is lost before being disconnected,
+	// when they've asked for notifications
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		assert.Nil(t, srv.Shutdown(ctx))
+	}()
+
+	notification, err := client.WaitNotification()
+	assert.Nil(t, err)
+	assert.Equal(t, "vmLost", notification.ID)
+	vmLost := api.VMLost{}
+	err = json.Unmarshal(notification.Data, &vmLost)
+	assert.Nil(t, err)
+	assert.Equal(t, api.VMLostProxyShutdown, vmLost.Reason)
+
+	_, err = other.WaitNotification()
+	assert.NotNil(t, err)
+
+	assert.Equal(t, ErrServerClosed, <-served)
+	client.Close()
+	other.Close()
+	assert.Nil(t, srv.Shutdown(ctx))
+
+	stopFds, err := detector.Snapshot()
+	assert.Nil(t, err)
+	assert.True(t, detector.Compare(os.Stdout, startFds, stopFds))
+}
+
+func TestServeContext(t *testing.T) {
+	l, path := listenTestServer(t)
+	defer os.Remove(path)
+	srv, err := New(WithListener(l))
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- srv.Serve(ctx)
+	}()
+
+	client := dialTestServer(t, path)
+	err = client.Bye("foo")
+	assert.NotNil(t, err)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-served)
+
+	client.Close()
+	assert.Nil(t, srv.Shutdown(context.Background()))
+}
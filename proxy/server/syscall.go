@@ -0,0 +1,153 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Socketpair wraps the eponymous syscall but gives go friendly objects instead
+// of the raw file descriptors.
+func Socketpair() (*net.UnixConn, *net.UnixConn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// First end
+	f0 := os.NewFile(uintptr(fds[0]), "")
+	// os.NewFile() dups the fd and we're responsible for closing it
+	defer f0.Close()
+	c0, err := net.FileConn(f0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Second end
+	f1 := os.NewFile(uintptr(fds[1]), "")
+	defer f1.Close()
+	c1, err := net.FileConn(f1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c0.(*net.UnixConn), c1.(*net.UnixConn), nil
+}
+
+// getPeerCred returns the credentials of the process at the other end of the
+// AF_UNIX socket conn.
+func getPeerCred(conn net.Conn) (*syscall.Ucred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not an AF_UNIX socket")
+	}
+
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd),
+			syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cred, credErr
+}
+
+// AF_VSOCK and VMADDR_CID_HOST aren't defined by the syscall package.
+const (
+	afVsock       = 40
+	vmaddrCIDHost = 2
+)
+
+// rawSockaddrVM is struct sockaddr_vm from <linux/vm_sockets.h>.
+type rawSockaddrVM struct {
+	family    uint16
+	reserved1 uint16
+	port      uint32
+	cid       uint32
+	zero      [4]uint8
+}
+
+// vsockAddr is the net.Addr of a vsock connection.
+type vsockAddr struct {
+	cid, port uint32
+}
+
+func (a *vsockAddr) Network() string {
+	return "vsock"
+}
+
+func (a *vsockAddr) String() string {
+	return fmt.Sprintf("%d:%d", a.cid, a.port)
+}
+
+// vsockConn is a net.Conn on top of an AF_VSOCK socket, which the net package
+// doesn't know about. Deadlines are supported by the non-blocking *os.File.
+type vsockConn struct {
+	*os.File
+	remote vsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return &vsockAddr{cid: vmaddrCIDHost}
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return &c.remote
+}
+
+// dialVsock connects to port on the VM identified by cid.
+func dialVsock(cid, port uint32) (net.Conn, error) {
+	fd, err := syscall.Socket(afVsock, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	sa := rawSockaddrVM{
+		family: afVsock,
+		port:   port,
+		cid:    cid,
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_CONNECT, uintptr(fd),
+		uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("connect", errno)
+	}
+
+	// os.NewFile() makes non-blocking fds pollable, giving us deadlines
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+
+	conn := &vsockConn{
+		File:   os.NewFile(uintptr(fd), fmt.Sprintf("vsock:%d:%d", cid, port)),
+		remote: vsockAddr{cid, port},
+	}
+	return conn, nil
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/01org/cc-oci-runtime/proxy/record"
+)
+
+// Tap frames are delivered from a dedicated goroutine so a slow client cannot
+// stall the data path. Frames are dropped when the client falls too far
+// behind.
+const tapQueueLength = 1024
+
+type tap struct {
+	client *client
+	// Include the frame data in the notifications, protected by the
+	// tapSet lock
+	data   bool
+	frames chan api.TapFrame
+	// Number of frames dropped since the last one queued, protected by
+	// the tapSet lock
+	dropped uint64
+	wg      sync.WaitGroup
+}
+
+func (t *tap) run() {
+	for frame := range t.frames {
+		t.client.ctx.SendNotification("tapFrame", &frame)
+	}
+
+	t.wg.Done()
+}
+
+// tapSet is the set of clients tapping the traffic of a VM. The zero value is
+// an empty set.
+type tapSet struct {
+	sync.Mutex
+
+	// Number of taps. It's read without taking the lock so the data path
+	// only pays for an atomic load when nobody is tapping.
+	n int32
+
+	taps map[uint64]*tap
+}
+
+func (s *tapSet) active() bool {
+	return atomic.LoadInt32(&s.n) > 0
+}
+
+// Add starts sending the traffic to client.
+func (s *tapSet) Add(client *client, data bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.taps == nil {
+		s.taps = make(map[uint64]*tap)
+	}
+
+	if t := s.taps[client.id]; t != nil {
+		t.data = data
+		return
+	}
+
+	t := &tap{
+		client: client,
+		data:   data,
+		frames: make(chan api.TapFrame, tapQueueLength),
+	}
+	t.wg.Add(1)
+	go t.run()
+	s.taps[client.id] = t
+	atomic.AddInt32(&s.n, 1)
+}
+
+// Remove stops sending the traffic to the client identified by clientID.
+func (s *tapSet) Remove(clientID uint64) {
+	s.Lock()
+	t := s.taps[clientID]
+	if t != nil {
+		delete(s.taps, clientID)
+		atomic.AddInt32(&s.n, -1)
+	}
+	s.Unlock()
+
+	if t == nil {
+		return
+	}
+
+	close(t.frames)
+	t.wg.Wait()
+}
+
+// Close removes all the taps.
+func (s *tapSet) Close() {
+	s.Lock()
+	taps := s.taps
+	s.taps = nil
+	atomic.StoreInt32(&s.n, 0)
+	s.Unlock()
+
+	for _, t := range taps {
+		close(t.frames)
+		t.wg.Wait()
+	}
+}
+
+var tapChannels = map[record.Kind]string{
+	record.KindCtl:     api.TapChannelCtl,
+	record.KindIo:      api.TapChannelIo,
+	record.KindSession: api.TapChannelSession,
+}
+
+// send queues a frame to all the taps.
+func (s *tapSet) send(containerID string, kind record.Kind, dir record.Direction,
+	id uint64, data []byte) {
+	frame := api.TapFrame{
+		ContainerID: containerID,
+		Time:        time.Now().UTC().Format(time.RFC3339Nano),
+		Channel:     tapChannels[kind],
+		Direction:   api.TapToVM,
+		Length:      len(data),
+	}
+	if dir == record.FromVM {
+		frame.Direction = api.TapFromVM
+	}
+	switch kind {
+	case record.KindCtl:
+		frame.Cmd = record.CmdName(uint32(id))
+	case record.KindSession:
+		frame.Seq = id
+		frame.Length = int(data[0])
+		data = nil
+	default:
+		frame.Seq = id
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// The caller is free to reuse data once we return
+	var dataCopy []byte
+
+	for _, t := range s.taps {
+		f := frame
+		if t.data && len(data) > 0 {
+			if dataCopy == nil {
+				dataCopy = append([]byte(nil), data...)
+			}
+			f.Data = dataCopy
+		}
+
+		f.Dropped = t.dropped
+		select {
+		case t.frames <- f:
+			t.dropped = 0
+		default:
+			t.dropped++
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/01org/cc-oci-runtime/proxy/record"
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+	"github.com/stretchr/testify/assert"
+)
+
+func waitTapFrame(t *testing.T, client *api.Client) api.TapFrame {
+	notification, err := client.WaitNotification()
+	assert.Nil(t, err)
+	assert.Equal(t, "tapFrame", notification.ID)
+
+	frame := api.TapFrame{}
+	err = json.Unmarshal(notification.Data, &frame)
+	assert.Nil(t, err)
+	assert.Equal(t, testContainerID, frame.ContainerID)
+	assert.NotEqual(t, "", frame.Time)
+	frame.Time = ""
+	frame.ContainerID = ""
+
+	return frame
+}
+
+func TestTap(t *testing.T) {
+	proto := NewProtocol()
+	proto.Handle("hello", helloHandler)
+	proto.Handle("allocateIO", allocateIoHandler)
+	proto.Handle("hyper", hyperHandler)
+	proto.Handle("tap", tapHandler)
+
+	rig := newTestRig(t, proto)
+	rig.Start()
+
+	// Not attached to a VM
+	err := rig.Client.Tap(nil)
+	assert.NotNil(t, err)
+
+	ctlSocketPath, ioSocketPath := rig.Hyperstart.GetSocketPaths()
+	_, err = rig.Client.Hello(testContainerID, ctlSocketPath, ioSocketPath, nil)
+	assert.Nil(t, err)
+
+	err = rig.Client.Tap(&api.TapOptions{Data: true})
+	assert.Nil(t, err)
+
+	err = rig.Client.Hyper("ping", nil)
+	assert.Nil(t, err)
+
+	ioBase, ioFile, err := rig.Client.AllocateIo(1)
+	assert.Nil(t, err)
+
+	writeIo(t, ioFile, ioBase, []byte("stdin\n"))
+	buf := make([]byte, 32)
+	rig.Hyperstart.ReadIo(buf)
+
+	expected := []api.TapFrame{
+		{Channel: api.TapChannelCtl, Direction: api.TapToVM, Cmd: "ping"},
+		{Channel: api.TapChannelCtl, Direction: api.TapFromVM, Cmd: "ack"},
+		{Channel: api.TapChannelSession, Direction: api.TapToVM, Seq: ioBase, Length: 1},
+		{Channel: api.TapChannelIo, Direction: api.TapToVM, Seq: ioBase, Length: 6,
+			Data: []byte("stdin\n")},
+	}
+	for _, e := range expected {
+		assert.Equal(t, e, waitTapFrame(t, rig.Client))
+	}
+
+	err = rig.Client.TapStop(testContainerID)
+	assert.Nil(t, err)
+
+	rig.proxy.Lock()
+	vm := rig.proxy.vms[testContainerID]
+	rig.proxy.Unlock()
+	assert.False(t, vm.taps.active())
+
+	ioFile.Close()
+
+	rig.Stop()
+}
+
+func TestTapDropped(t *testing.T) {
+	s := tapSet{}
+	slow := &tap{
+		frames: make(chan api.TapFrame, 1),
+	}
+	s.taps = map[uint64]*tap{1: slow}
+	s.n = 1
+
+	// The queue holds a single frame, the next 2 are dropped
+	for i := 0; i < 3; i++ {
+		s.send(testContainerID, record.KindCtl, record.ToVM, hyper.INIT_PING, nil)
+	}
+	frame := <-slow.frames
+	assert.Equal(t, uint64(0), frame.Dropped)
+
+	s.send(testContainerID, record.KindIo, record.FromVM, 1, []byte("foo"))
+	frame = <-slow.frames
+	assert.Equal(t, uint64(2), frame.Dropped)
+	assert.Equal(t, 3, frame.Length)
+	// Data isn't part of the frame unless asked for
+	assert.Nil(t, frame.Data)
+}
@@ -0,0 +1,935 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/01org/cc-oci-runtime/proxy/api"
+	"github.com/01org/cc-oci-runtime/proxy/record"
+	"github.com/golang/glog"
+	hyper "github.com/hyperhq/runv/hyperstart/api/json"
+)
+
+// Represents a single qemu/hyperstart instance on the system
+type vm struct {
+	sync.Mutex
+
+	// Log and metrics of the proxy the VM belongs to
+	log     *serverLog
+	metrics *metrics
+
+	containerID string
+
+	// Endpoints of hyperstart's ctl and io channels, see parseEndpoint
+	ctlSerial, ioSerial string
+
+	// Credentials of the client that registered the VM, nil if they
+	// couldn't be retrieved.
+	owner *syscall.Ucred
+
+	// Verbosity of the messages about this VM, noLogLevel to follow the
+	// global log level. Accessed atomically.
+	logLevel int32
+
+	// The agent running inside the VM
+	agent Agent
+	// Held while a command is sent to the agent, see ping
+	cmdLock sync.Mutex
+
+	// Socket to the VM console
+	console struct {
+		socketPath string
+		conn       net.Conn
+		capture    *consoleCapture
+
+		// Interactive session on the console, see AttachConsole.
+		// Protected by vm's mutex.
+		attached net.Conn
+
+		// Incomplete line, waiting for more console output
+		partial []byte
+	}
+
+	// Used to allocate globally unique IO sequence numbers
+	nextIoBase uint64
+
+	// ios are hashed by their sequence numbers. If 2 sequence numbers are
+	// allocated for one process (stdin/stdout and stderr) both sequence
+	// numbers appear in this map.
+	ioSessions map[uint64]*ioSession
+
+	// Used to wait for all VM-global goroutines to finish on Close()
+	wg sync.WaitGroup
+
+	// When not nil, the I/O streams are forwarded by loop, ioConn being
+	// the agent io channel once connected. See forwardIo.
+	loop   *eventLoop
+	ioConn *loopConn
+
+	ioStats ioStats
+
+	// When non nil, the ctl and io traffic is recorded
+	recorder *record.Writer
+	// Clients receiving a live copy of the ctl and io traffic
+	taps tapSet
+
+	// Closed once Connect is done, readyErr being its outcome. See
+	// checkReady.
+	ready    chan struct{}
+	readyErr error
+
+	// Channel to signal qemu has terminated.
+	vmLost chan interface{}
+	// The first reason for which the VM has been declared lost, one of
+	// the api.VMLost* constants. Protected by vm's mutex.
+	lostReason string
+	lostOnce   sync.Once
+}
+
+// How long we wait for a client to read the data still to be sent on an I/O
+// session when the VM goes away.
+const sessionDrainTimeout = 1 * time.Second
+
+// A set of I/O streams between a client and a process running inside the VM
+type ioSession struct {
+	nStreams int
+	ioBase   uint64
+
+	// id  of the client owning that ioSession
+	clientID uint64
+
+	// container the ioSession belongs to
+	containerID string
+
+	// socket connected to the fd sent over to the client
+	client net.Conn
+
+	// writes the I/O frames to client
+	writer *ioWriter
+
+	// client, when the session is served by the event loop. writer is
+	// then nil until the session is taken off the loop, see detach.
+	loopConn *loopConn
+
+	// Used to wait for per-ioSession goroutines. Currently there's only
+	// one such goroutine, the one reading stdin data from client socket.
+	wg sync.WaitGroup
+}
+
+// newVM creates a VM of proxy, logging its messages and counting its metrics
+// as proxy does.
+func (proxy *proxy) newVM(id, ctlSerial, ioSerial string, agent Agent) *vm {
+	return &vm{
+		log:         proxy.log,
+		metrics:     proxy.metrics,
+		containerID: id,
+		ctlSerial:   ctlSerial,
+		ioSerial:    ioSerial,
+		agent:       agent,
+		logLevel:    noLogLevel,
+		nextIoBase:  1,
+		ioSessions:  make(map[uint64]*ioSession),
+		ready:       make(chan struct{}),
+		vmLost:      make(chan interface{}),
+	}
+}
+
+// setConsole() will make the proxy capture the console output. The output
+// is also logged at verbosity level 3.
+func (vm *vm) setConsole(path string, config consoleConfig) error {
+	capture, err := newConsoleCapture(vm.containerID, config, vm.metrics)
+	if err != nil {
+		return err
+	}
+
+	vm.console.socketPath = path
+	vm.console.capture = capture
+	return nil
+}
+
+// Console returns the console capture of vm, nil if the VM has no console.
+func (vm *vm) Console() *consoleCapture {
+	return vm.console.capture
+}
+
+func (vm *vm) shortName() string {
+	length := 8
+	if len(vm.containerID) < 8 {
+		length = len(vm.containerID)
+	}
+	return vm.containerID[0:length]
+}
+
+func (vm *vm) logFields(channel string) logFields {
+	return logFields{
+		fieldContainerID: vm.containerID,
+		fieldChannel:     channel,
+	}
+}
+
+func (vm *vm) glogPrefix(channel string) string {
+	return fmt.Sprintf("[vm %s %s] ", vm.shortName(), channel)
+}
+
+// noLogLevel is the value of vm.logLevel when the VM follows the global log
+// level.
+const noLogLevel = -1
+
+// setLogLevel sets the verbosity of the messages about this VM, overriding the
+// global log level. noLogLevel restores the global log level.
+func (vm *vm) setLogLevel(level int) {
+	atomic.StoreInt32(&vm.logLevel, int32(level))
+}
+
+// v is glog.V for the messages about this VM.
+func (vm *vm) v(lvl glog.Level) bool {
+	if level := atomic.LoadInt32(&vm.logLevel); level != noLogLevel {
+		return glog.Level(level) >= lvl
+	}
+	return bool(glog.V(lvl))
+}
+
+func (vm *vm) info(lvl glog.Level, channel string, msg string) {
+	if !vm.v(lvl) {
+		return
+	}
+	vm.log.output(2, lvl, vm.glogPrefix(channel), vm.logFields(channel), msg)
+}
+
+func (vm *vm) infof(lvl glog.Level, channel string, format string, a ...interface{}) {
+	if !vm.v(lvl) {
+		return
+	}
+	vm.log.output(2, lvl, vm.glogPrefix(channel), vm.logFields(channel),
+		fmt.Sprintf(format, a...))
+}
+
+// ioInfof is infof for messages related to the I/O stream seq.
+func (vm *vm) ioInfof(lvl glog.Level, seq uint64, format string, a ...interface{}) {
+	if !vm.v(lvl) {
+		return
+	}
+	fields := vm.logFields("io")
+	fields[fieldSeq] = seq
+	vm.log.output(2, lvl, vm.glogPrefix("io"), fields, fmt.Sprintf(format, a...))
+}
+
+func (vm *vm) dump(lvl glog.Level, seq uint64, data []byte) {
+	if !vm.v(lvl) {
+		return
+	}
+	if vm.log.native() {
+		vm.log.output(2, lvl, "", nil, "\n"+hex.Dump(data))
+		return
+	}
+	fields := vm.logFields("io")
+	fields[fieldSeq] = seq
+	fields["data"] = hex.EncodeToString(data)
+	vm.log.output(2, lvl, "", fields, "io data")
+}
+
+// tracing returns true when the traffic with hyperstart is recorded or
+// tapped.
+func (vm *vm) tracing() bool {
+	return vm.recorder != nil || vm.taps.active()
+}
+
+// trace hands a frame exchanged with hyperstart to the recorder and the taps.
+// It's cheap when the VM isn't traced.
+func (vm *vm) trace(kind record.Kind, dir record.Direction, id uint64, data []byte) {
+	if vm.recorder != nil {
+		vm.recorder.WriteFrame(kind, dir, id, data)
+	}
+	if vm.taps.active() {
+		vm.taps.send(vm.containerID, kind, dir, id, data)
+	}
+}
+
+// numSessions returns the number of I/O sessions currently allocated.
+func (vm *vm) numSessions() int {
+	vm.Lock()
+	defer vm.Unlock()
+
+	n := 0
+	for seq, session := range vm.ioSessions {
+		if seq == session.ioBase {
+			n++
+		}
+	}
+	return n
+}
+
+// sessions returns the I/O sessions currently allocated, sorted by ioBase.
+func (vm *vm) sessions() []api.SessionState {
+	vm.Lock()
+	defer vm.Unlock()
+
+	sessions := make([]api.SessionState, 0, len(vm.ioSessions))
+	for seq, session := range vm.ioSessions {
+		if seq != session.ioBase {
+			continue
+		}
+		sessions = append(sessions, api.SessionState{
+			IoBase:      session.ioBase,
+			NStreams:    session.nStreams,
+			ClientID:    session.clientID,
+			ContainerID: session.containerID,
+		})
+	}
+	sort.Sort(byIoBase(sessions))
+
+	return sessions
+}
+
+type byIoBase []api.SessionState
+
+func (a byIoBase) Len() int           { return len(a) }
+func (a byIoBase) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byIoBase) Less(i, j int) bool { return a[i].IoBase < a[j].IoBase }
+
+func (vm *vm) findSession(seq uint64) *ioSession {
+	vm.Lock()
+	defer vm.Unlock()
+
+	return vm.ioSessions[seq]
+}
+
+// This function runs in a goroutine, reading data from the io channel and
+// dispatching it to the right client (the one with matching seq number)
+// There's only one instance of this goroutine per-VM
+func (vm *vm) ioHyperToClients() {
+	// Frames are buffered and only written to the clients once there's
+	// nothing more to read from the agent, coalescing the frames of a
+	// burst. Agents without a read buffer don't tell, frames are then
+	// written right away.
+	buffer, _ := vm.agent.(streamBuffer)
+	var pending []*ioSession
+
+	for {
+		seq, data, err := vm.agent.ReadStream()
+		if err != nil {
+			vm.ioChannelLost(err)
+			break
+		}
+
+		session := vm.frameFromHyper(seq, data)
+		if session == nil {
+			continue
+		}
+
+		err = session.writer.writeFrame(seq, data)
+		if err == nil {
+			pending = addSession(pending, session)
+			if buffer == nil || !buffer.StreamBuffered() {
+				err = vm.flushSessions(pending)
+				pending = pending[:0]
+			}
+		}
+		if err != nil {
+			vm.metrics.errors.Inc(errorIo)
+			vm.infof(0, "io", "error writing I/O data to client: %v", err)
+			break
+		}
+	}
+
+	vm.flushSessions(pending)
+	vm.wg.Done()
+}
+
+// ioChannelLost declares the VM lost after the io channel returned err.
+func (vm *vm) ioChannelLost(err error) {
+	// VM process is gone
+	if err == io.EOF {
+		vm.signalVMLost(api.VMLostIoEOF)
+	} else {
+		vm.signalVMLost(api.VMLostIoError)
+	}
+}
+
+// frameFromHyper accounts for a frame read from the io channel and returns
+// the session it's for, nil if there's none.
+func (vm *vm) frameFromHyper(seq uint64, data []byte) *ioSession {
+	vm.trace(record.KindIo, record.FromVM, seq, data)
+	vm.ioStats.fromVM(len(data))
+
+	session := vm.findSession(seq)
+	if session == nil {
+		vm.metrics.errors.Inc(errorIo)
+		vm.ioInfof(0, seq, "couldn't find client with seq number %d", seq)
+		return nil
+	}
+
+	vm.ioInfof(1, seq, "<- writing to client #%d", session.clientID)
+	vm.dump(2, seq, data)
+
+	return session
+}
+
+// loopHyperToClients is ioHyperToClients for the event loop, called with the
+// frames read from the io channel.
+func (vm *vm) loopHyperToClients(seq uint64, data []byte) error {
+	if session := vm.frameFromHyper(seq, data); session != nil {
+		vm.loop.writeFrame(session.loopConn, vm.ioConn, seq, data)
+	}
+	return nil
+}
+
+// loopHyperClosed is called once the event loop stops reading the io channel.
+func (vm *vm) loopHyperClosed(err error) {
+	vm.ioChannelLost(err)
+	vm.wg.Done()
+}
+
+// addSession adds session to sessions, if not already there.
+func addSession(sessions []*ioSession, session *ioSession) []*ioSession {
+	for _, s := range sessions {
+		if s == session {
+			return sessions
+		}
+	}
+	return append(sessions, session)
+}
+
+// flushSessions writes the I/O frames buffered for sessions. The sessions
+// closed since their frames were buffered aren't an error.
+func (vm *vm) flushSessions(sessions []*ioSession) error {
+	for _, session := range sessions {
+		err := session.writer.flush()
+		if err != nil && vm.findSession(session.ioBase) == session {
+			return err
+		}
+	}
+	return nil
+}
+
+// captureConsole splits the console output into lines for the console
+// capture and the logs.
+func (vm *vm) captureConsole(data []byte) {
+	vm.console.partial = append(vm.console.partial, data...)
+
+	for {
+		i := bytes.IndexByte(vm.console.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := strings.TrimRight(string(vm.console.partial[:i]), "\r")
+		vm.console.partial = vm.console.partial[i+1:]
+
+		for _, l := range vm.console.capture.Add(line) {
+			vm.info(3, "hyperstart", l)
+		}
+	}
+
+	// Don't let a guest make us buffer an infinite line
+	if max := vm.console.capture.config.maxLineLength; max > 0 && len(vm.console.partial) > max {
+		vm.captureConsole([]byte{'\n'})
+	}
+}
+
+// consoleToAttached forwards console output to the interactive session, if
+// any.
+func (vm *vm) consoleToAttached(data []byte) {
+	vm.Lock()
+	attached := vm.console.attached
+	vm.Unlock()
+
+	if attached == nil {
+		return
+	}
+
+	// An attached client not reading the console output shouldn't stall
+	// the capture for too long.
+	attached.SetWriteDeadline(time.Now().Add(sessionDrainTimeout))
+	if _, err := attached.Write(data); err != nil {
+		vm.infof(1, "console", "detaching console session: %v", err)
+		vm.detachConsole(attached)
+	}
+}
+
+// Capture the VM console, also streaming it to the logs and to the attached
+// interactive session.
+func (vm *vm) consoleToLog() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := vm.console.conn.Read(buf)
+		if n > 0 {
+			vm.consoleToAttached(buf[:n])
+			vm.captureConsole(buf[:n])
+		}
+		if err != nil {
+			// The console socket is closed when qemu exits
+			vm.signalVMLost(api.VMLostQemuExit)
+			break
+		}
+	}
+
+	vm.wg.Done()
+}
+
+// attachedToConsole runs in a goroutine, writing the input of an interactive
+// console session to the VM console.
+func (vm *vm) attachedToConsole(attached net.Conn) {
+	io.Copy(vm.console.conn, attached)
+	vm.detachConsole(attached)
+	vm.wg.Done()
+}
+
+// AttachConsole starts an interactive session on the VM console through the
+// c socket. The console output keeps being captured. Only one interactive
+// session is allowed at a time.
+func (vm *vm) AttachConsole(c net.Conn) error {
+	if vm.console.conn == nil {
+		return noConsoleError(vm.containerID)
+	}
+
+	vm.Lock()
+	if vm.console.attached != nil {
+		vm.Unlock()
+		return newError(api.ErrorCodeConsoleAlreadyAttached, "%s: console already attached",
+			vm.containerID).with("containerId", vm.containerID)
+	}
+	vm.console.attached = c
+	vm.wg.Add(1)
+	vm.Unlock()
+
+	go vm.attachedToConsole(c)
+
+	return nil
+}
+
+func (vm *vm) detachConsole(c net.Conn) {
+	vm.Lock()
+	if vm.console.attached == c {
+		vm.console.attached = nil
+	}
+	vm.Unlock()
+
+	c.Close()
+}
+
+// Connect connects to the VM console and agent and waits for the agent to be
+// ready, giving up at deadline. A zero deadline means waiting forever for the
+// agent, the VM channels having to be there already.
+func (vm *vm) Connect(deadline time.Time) error {
+	if vm.console.socketPath != "" {
+		console, err := parseEndpoint(vm.console.socketPath)
+		if err != nil {
+			return err
+		}
+		vm.console.conn, err = console.dialUntil(deadline)
+		if err != nil {
+			return err
+		}
+
+		vm.wg.Add(1)
+		go vm.consoleToLog()
+	}
+
+	if err := vm.agent.Connect(deadline); err != nil {
+		return err
+	}
+
+	if err := vm.agent.WaitReady(deadline); err != nil {
+		if timeout, ok := err.(interface {
+			Timeout() bool
+		}); ok && timeout.Timeout() {
+			err = newNotReadyError("%s: timed out waiting for the agent to be ready",
+				vm.containerID)
+		}
+		return err
+	}
+	vm.trace(record.KindCtl, record.FromVM, hyper.INIT_READY, nil)
+
+	return vm.forwardIo()
+}
+
+// forwardIo starts forwarding the I/O streams between the agent and the
+// clients, from the event loop when there's one and the agent lets it read
+// the io channel.
+func (vm *vm) forwardIo() error {
+	agent, ok := vm.agent.(streamConn)
+	if vm.loop == nil || !ok {
+		vm.wg.Add(1)
+		go vm.ioHyperToClients()
+		return nil
+	}
+
+	ioConn, err := vm.loop.newLoopConn(agent.StreamConn(), "hyperstart")
+	if err != nil {
+		return err
+	}
+
+	vm.Lock()
+	vm.ioConn = ioConn
+	vm.Unlock()
+
+	vm.wg.Add(1)
+	vm.loop.add(ioConn, vm.loopHyperToClients, vm.loopHyperClosed)
+
+	return nil
+}
+
+// setReady records the outcome of Connect, see checkReady.
+func (vm *vm) setReady(err error) {
+	vm.readyErr = err
+	close(vm.ready)
+}
+
+// checkReady returns an error if vm isn't ready to be used, either because
+// it's still starting or because it failed to.
+func (vm *vm) checkReady() error {
+	select {
+	case <-vm.ready:
+		return vm.readyErr
+	default:
+		return newNotReadyError("%s: vm not ready", vm.containerID)
+	}
+}
+
+func (vm *vm) SendMessage(cmd string, data []byte) error {
+	if vm.tracing() {
+		if code, ok := record.CmdCode(cmd); ok {
+			vm.trace(record.KindCtl, record.ToVM, uint64(code), data)
+		}
+	}
+
+	vm.cmdLock.Lock()
+	resp, err := vm.agent.SendCommand(cmd, data)
+	vm.cmdLock.Unlock()
+
+	// Errors from the underlying connection are a sign the VM is gone.
+	if _, ok := err.(*ChannelError); ok {
+		vm.signalVMLost(api.VMLostCtlError)
+	} else if err != nil {
+		vm.trace(record.KindCtl, record.FromVM, hyper.INIT_ERROR, nil)
+	} else {
+		vm.trace(record.KindCtl, record.FromVM, hyper.INIT_ACK, resp)
+	}
+
+	return err
+}
+
+// This function runs in a goroutine, reading data from the client socket and
+// writing data to the hyperstart I/O chanel.
+// There's one instance of this goroutine per client having done an allocateIO.
+func (vm *vm) ioClientToHyper(session *ioSession) {
+	reader := newIoReader(session.client)
+
+	for {
+		seq, data, err := reader.readFrame()
+		if err != nil {
+			// client process is gone
+			break
+		}
+
+		if err := vm.frameToHyper(session, seq, data); err != nil {
+			break
+		}
+
+		err = vm.agent.WriteStream(seq, data)
+		if err != nil {
+			vm.metrics.errors.Inc(errorIo)
+			vm.ioInfof(0, seq, "error writing I/O data to hyperstart: %v", err)
+			break
+		}
+
+		vm.ioStats.toVM(len(data))
+	}
+
+	reader.release()
+	session.wg.Done()
+}
+
+// frameToHyper checks a frame read from the session client is for the
+// process stdin, closing the client if not, and accounts for it.
+func (vm *vm) frameToHyper(session *ioSession, seq uint64, data []byte) error {
+	if seq != session.ioBase {
+		err := fmt.Errorf("stdin seq %d not matching ioBase %d", seq, session.ioBase)
+		vm.metrics.errors.Inc(errorIo)
+		vm.ioInfof(0, seq, "closing client #%d: %v", session.clientID, err)
+		session.client.Close()
+		return err
+	}
+
+	vm.ioInfof(1, seq, "-> writing to hyper from #%d", session.clientID)
+	vm.dump(2, seq, data)
+	vm.trace(record.KindIo, record.ToVM, seq, data)
+
+	return nil
+}
+
+// loopClientToHyper is ioClientToHyper for the event loop, called with the
+// frames read from the session client.
+func (vm *vm) loopClientToHyper(session *ioSession, seq uint64, data []byte) error {
+	if err := vm.frameToHyper(session, seq, data); err != nil {
+		return err
+	}
+
+	vm.loop.writeFrame(vm.ioConn, session.loopConn, seq, data)
+	vm.ioStats.toVM(len(data))
+
+	return nil
+}
+
+// countSessions returns the number of I/O sessions in the VM and how many of
+// them are owned by the client clientID. Must be called with the vm lock held.
+func (vm *vm) countSessions(clientID uint64) (total, owned int) {
+	for seq, session := range vm.ioSessions {
+		if seq != session.ioBase {
+			continue
+		}
+		total++
+		if session.clientID == clientID {
+			owned++
+		}
+	}
+	return
+}
+
+// AllocateIo creates an I/O session of n streams for the client clientID and
+// the container containerID, c being our end of the socket handed to the
+// client. It fails if the session would exceed one of the I/O session quotas
+// of limits.
+func (vm *vm) AllocateIo(n int, clientID uint64, containerID string, c net.Conn,
+	limits limitsConfig) (uint64, error) {
+	vm.Lock()
+	total, owned := vm.countSessions(clientID)
+	if limits.vmIoSessions > 0 && total >= limits.vmIoSessions {
+		vm.Unlock()
+		return 0, newLimitError(vm.metrics, api.ErrorCodeTooManyVMIoSessions,
+			"%s: too many I/O sessions (max %d)", vm.containerID, limits.vmIoSessions)
+	}
+	if limits.clientIoSessions > 0 && owned >= limits.clientIoSessions {
+		vm.Unlock()
+		return 0, newLimitError(vm.metrics, api.ErrorCodeTooManyClientIoSessions,
+			"client #%d: too many I/O sessions (max %d)", clientID, limits.clientIoSessions)
+	}
+
+	session := &ioSession{
+		nStreams:    n,
+		clientID:    clientID,
+		containerID: containerID,
+		client:      c,
+	}
+	if vm.ioConn != nil {
+		lc, err := vm.loop.newLoopConn(c, "client")
+		if err != nil {
+			vm.Unlock()
+			return 0, err
+		}
+		session.loopConn = lc
+	} else {
+		session.writer = newIoWriter(c)
+	}
+
+	// Allocate ioBase
+	ioBase := vm.nextIoBase
+	vm.nextIoBase += uint64(n)
+	session.ioBase = ioBase
+
+	for i := 0; i < n; i++ {
+		vm.ioSessions[ioBase+uint64(i)] = session
+	}
+	vm.Unlock()
+
+	vm.trace(record.KindSession, record.ToVM, ioBase, []byte{byte(n)})
+
+	// Starts stdin forwarding between client and hyper
+	if session.loopConn != nil {
+		vm.loop.add(session.loopConn, func(seq uint64, data []byte) error {
+			return vm.loopClientToHyper(session, seq, data)
+		}, nil)
+	} else {
+		session.wg.Add(1)
+		go vm.ioClientToHyper(session)
+	}
+
+	return ioBase, nil
+}
+
+// detach takes the session off the event loop, if it's served by one,
+// writing what's still queued for the client.
+func (session *ioSession) detach() {
+	lc := session.loopConn
+	if lc == nil {
+		return
+	}
+
+	if pending := lc.loop.remove(lc); len(pending) > 0 {
+		session.client.SetWriteDeadline(time.Now().Add(sessionDrainTimeout))
+		session.client.Write(pending)
+	}
+}
+
+func (session *ioSession) Close() {
+	session.detach()
+	session.client.Close()
+	session.wg.Wait()
+}
+
+// terminate signals the end of all the session streams to the client and
+// reports api.VMLostExitStatus as the process exit status before closing the
+// session.
+func (session *ioSession) terminate() {
+	session.detach()
+	if session.writer == nil {
+		session.writer = newIoWriter(session.client)
+	}
+
+	session.client.SetWriteDeadline(time.Now().Add(sessionDrainTimeout))
+
+	for i := 0; i < session.nStreams; i++ {
+		if err := session.writer.writeFrame(session.ioBase+uint64(i), nil); err != nil {
+			break
+		}
+	}
+
+	session.writer.writeFrameNow(session.ioBase, []byte{api.VMLostExitStatus})
+
+	session.Close()
+}
+
+func (vm *vm) CloseIo(seq uint64) {
+	vm.Lock()
+	session := vm.ioSessions[seq]
+	if session == nil {
+		vm.Unlock()
+		return
+	}
+	for i := 0; i < session.nStreams; i++ {
+		delete(vm.ioSessions, seq+uint64(i))
+	}
+	vm.Unlock()
+
+	session.Close()
+}
+
+// closeContainerIo closes the I/O sessions of the container containerID.
+func (vm *vm) closeContainerIo(containerID string) {
+	var sessions []*ioSession
+
+	vm.Lock()
+	for seq, session := range vm.ioSessions {
+		if session.containerID != containerID {
+			continue
+		}
+		delete(vm.ioSessions, seq)
+		if seq == session.ioBase {
+			sessions = append(sessions, session)
+		}
+	}
+	vm.Unlock()
+
+	for _, session := range sessions {
+		session.Close()
+	}
+}
+
+func (vm *vm) Close() {
+	// The event loop stops reading the io channel before it's closed
+	vm.Lock()
+	ioConn := vm.ioConn
+	vm.Unlock()
+	if ioConn != nil {
+		vm.loop.remove(ioConn)
+	}
+
+	vm.agent.Close()
+	if vm.console.conn != nil {
+		vm.console.conn.Close()
+	}
+	vm.Lock()
+	if vm.console.attached != nil {
+		vm.console.attached.Close()
+	}
+	vm.Unlock()
+
+	// A client not reading its I/O data could block ioHyperToClients
+	// forever, bound the time we're willing to wait for pending data to be
+	// written.
+	vm.Lock()
+	for _, session := range vm.ioSessions {
+		session.client.SetWriteDeadline(time.Now().Add(sessionDrainTimeout))
+	}
+	vm.Unlock()
+
+	// Wait for VM global goroutines. Once done, nothing else is writing to
+	// the sessions' sockets.
+	vm.wg.Wait()
+
+	if vm.console.capture != nil {
+		vm.console.capture.Close()
+	}
+
+	_, lost := vm.LostReason()
+
+	// Wait for per-client goroutines. Terminating a session can take up to
+	// sessionDrainTimeout, don't hold the lock meanwhile.
+	var sessions []*ioSession
+	vm.Lock()
+	for seq, session := range vm.ioSessions {
+		delete(vm.ioSessions, seq)
+		if seq == session.ioBase {
+			sessions = append(sessions, session)
+		}
+	}
+	vm.Unlock()
+
+	for _, session := range sessions {
+		if lost {
+			session.terminate()
+		} else {
+			session.Close()
+		}
+	}
+	vm.recorder.Close()
+	vm.taps.Close()
+}
+
+// OnVmLost returns a channel can be waited on to signal the end of the qemu
+// process.
+func (vm *vm) OnVMLost() <-chan interface{} {
+	return vm.vmLost
+}
+
+// LostReason returns why the VM has been declared lost, if it has.
+func (vm *vm) LostReason() (string, bool) {
+	vm.Lock()
+	defer vm.Unlock()
+
+	return vm.lostReason, vm.lostReason != ""
+}
+
+func (vm *vm) signalVMLost(reason string) {
+	vm.lostOnce.Do(func() {
+		vm.Lock()
+		vm.lostReason = reason
+		vm.Unlock()
+
+		close(vm.vmLost)
+	})
+}